@@ -0,0 +1,498 @@
+//go:build linux
+// +build linux
+
+package adapters
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/afpacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+	"golang.org/x/net/bpf"
+	"golang.org/x/sys/unix"
+
+	"github.com/hyeoncheon/goul"
+)
+
+// constants...
+const (
+	defaultAfpacketAdapterID = "afp"
+	defaultAfpacketTimeout   = 100 * time.Millisecond
+
+	ErrAfpacketInvalidRing   = "invalid ring options"
+	ErrAfpacketInvalidFanout = "invalid fanout options"
+)
+
+// FanoutTypes is a map of the names and the types of fanout for options.
+var FanoutTypes = map[string]afpacket.FanoutType{
+	"hash":     afpacket.FanoutHash,
+	"lb":       afpacket.FanoutLoadBalance,
+	"cpu":      afpacket.FanoutCPU,
+	"rollover": afpacket.FanoutRollover,
+	"random":   afpacket.FanoutRandom,
+	"qm":       afpacket.FanoutQueueMapping,
+}
+
+// AfpacketAdapter is an adapter for the network device interfacing with
+// memory mapped AF_PACKET rings of TPACKET_V3 on Linux. It is an alternative
+// of the DeviceAdapter for high traffic. It does not use libpcap while
+// capturing, and the filter is compiled once and attached to the socket
+// as a kernel BPF filter.
+//
+// The size of the ring is configured by the size and the number of the
+// blocks. With fanout, the packets are distributed to several sockets in
+// the fanout group, and each of them is read by its own goroutine.
+//
+// The ring does not tell the packet type of each packet, so when the
+// direction is `inout`, the packets of each direction are captured by their
+// own sockets and annotated with the direction of the socket. In that case,
+// the sockets of outgoing packets join the fanout group next to the given
+// one.
+//
+// Please note that the order of packets from different workers is not
+// guaranteed.
+type AfpacketAdapter struct {
+	goul.Adapter
+	ID          string
+	err         error
+	device      string
+	snaplen     int
+	promiscuous bool
+	timeout     time.Duration
+	filter      string
+	exclude     string
+	direction   string
+
+	blockSize   int
+	numBlocks   int
+	workers     int
+	fanoutType  afpacket.FanoutType
+	fanoutGroup uint16
+
+	mutex      sync.Mutex // guards the sockets and the filters
+	handles    []*afpacket.TPacket
+	directions []string // direction of the packets on each socket
+	promisc    int      // socket for promiscuous membership
+}
+
+// Read implements interface Adapter
+func (a *AfpacketAdapter) Read(ctrl chan goul.Item, message goul.Message) (out chan goul.Item, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			fmt.Fprintf(os.Stderr, "AfpacketAdapter#Read recovered from panic!\n")
+			fmt.Fprintf(os.Stderr, "Probably an inheritance problem of pipeline instance.\n")
+			fmt.Fprintf(os.Stderr, "panic: %v\n", r)
+			err = errors.New("panic")
+		}
+	}()
+
+	if a.err = a.activate(); a.err != nil {
+		a.SetError(a.err)
+		goul.Error(a.GetLogger(), a.ID, "%v: %v", ErrCouldNotActivate, a.err)
+		return nil, errors.New(ErrCouldNotActivate)
+	}
+	a.logFilter(a.EffectiveFilter())
+	return goul.Launch(a.reader, ctrl, message)
+}
+
+// Write implements interface Adapter
+func (a *AfpacketAdapter) Write(in chan goul.Item, message goul.Message) (done chan goul.Item, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			fmt.Fprintf(os.Stderr, "AfpacketAdapter#Write recovered from panic!\n")
+			fmt.Fprintf(os.Stderr, "Probably an inheritance problem of pipeline instance.\n")
+			fmt.Fprintf(os.Stderr, "panic: %v\n", r)
+			err = errors.New("panic")
+		}
+	}()
+
+	a.workers = 1 // a socket is enough for injection
+	if a.err = a.activate(); a.err != nil {
+		a.SetError(a.err)
+		goul.Error(a.GetLogger(), a.ID, "%v: %v", ErrCouldNotActivate, a.err)
+		return nil, errors.New(ErrCouldNotActivate)
+	}
+	return goul.Launch(a.writer, in, message)
+}
+
+// reader runs capturing workers for each socket and waits for them.
+func (a *AfpacketAdapter) reader(in, out chan goul.Item, message goul.Message) {
+	defer close(out)
+	defer goul.Log(a.GetLogger(), a.ID, "exit")
+
+	goul.Log(a.GetLogger(), a.ID, "capturing in looping... (%v workers)", len(a.handles))
+	wg := sync.WaitGroup{}
+	for i, handle := range a.handles {
+		wg.Add(1)
+		go func(id int, handle *afpacket.TPacket, direction string) {
+			defer wg.Done()
+			count := a.capture(handle, direction, in, out)
+			goul.Log(a.GetLogger(), a.ID, "worker %v captured %v packets", id, count)
+		}(i, handle, a.directions[i])
+	}
+	wg.Wait()
+}
+
+// capture reads packets from the socket until the control channel is
+// closed. The packets are annotated with the direction of the socket if
+// it is given. It returns the number of captured packets.
+func (a *AfpacketAdapter) capture(handle *afpacket.TPacket, direction string, in, out chan goul.Item) int {
+	count := 0
+	for {
+		select {
+		case item, ok := <-in:
+			if !ok {
+				goul.Log(a.GetLogger(), a.ID, "channel closed")
+				return count
+			}
+			if item.String() == goul.ItemTypeFilter {
+				if err := a.SetFilter(string(item.Data())); err != nil {
+					goul.Error(a.GetLogger(), a.ID, "couldn't change filter to <%s>: %v", item.Data(), err)
+				}
+			}
+		default:
+		}
+
+		data, ci, err := handle.ReadPacketData()
+		if err == afpacket.ErrTimeout || err == afpacket.ErrPoll {
+			continue
+		} else if err != nil {
+			a.SetError(err)
+			goul.Error(a.GetLogger(), a.ID, "couldn't read packet: %v", err)
+			return count
+		}
+		if len(data) > a.snaplen {
+			data = data[:a.snaplen]
+			ci.CaptureLength = a.snaplen
+		}
+		packet := gopacket.NewPacket(data, layers.LayerTypeEthernet, gopacket.NoCopy)
+		md := packet.Metadata()
+		md.CaptureInfo = ci
+		if direction != "" {
+			goul.Annotate(packet, goul.AnnotationDirection, direction)
+		}
+		out <- packet
+		count++
+	}
+}
+
+// writer write out the packets from input channel
+func (a *AfpacketAdapter) writer(in, out chan goul.Item, message goul.Message) {
+	defer close(out)
+	defer goul.Log(a.GetLogger(), a.ID, "exit")
+
+	goul.Log(a.GetLogger(), a.ID, "writer in looping...")
+	for item := range in {
+		if p, ok := item.(gopacket.Packet); ok {
+			a.handles[0].WritePacketData(p.Data())
+		}
+	}
+	goul.Log(a.GetLogger(), a.ID, "channel closed")
+	out <- goul.Messages["closed"]
+}
+
+// NewAfpacket returns new AF_PACKET adapter for the device.
+func NewAfpacket(dev string) (*AfpacketAdapter, error) {
+	a := &AfpacketAdapter{
+		ID:          defaultAfpacketAdapterID,
+		device:      dev,
+		snaplen:     defaultSnapLen,
+		promiscuous: defaultPromiscuous,
+		timeout:     defaultAfpacketTimeout,
+		filter:      defaultFilter,
+		blockSize:   afpacket.DefaultBlockSize,
+		numBlocks:   afpacket.DefaultNumBlocks,
+		workers:     1,
+		fanoutType:  afpacket.FanoutHash,
+		promisc:     -1,
+		Adapter:     &goul.BaseAdapter{},
+	}
+	if _, err := net.InterfaceByName(dev); err != nil {
+		a.err = err
+	}
+	return a, a.err
+}
+
+// Close clean up resources on afpacket adapter.
+func (a *AfpacketAdapter) Close() error {
+	goul.Log(a.GetLogger(), a.ID, "cleanup...")
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	for _, handle := range a.handles {
+		handle.Close()
+	}
+	a.handles = nil
+	a.directions = nil
+	if a.promisc >= 0 {
+		unix.Close(a.promisc)
+		a.promisc = -1
+	}
+	return nil
+}
+
+// SetOptions sets capture options. The timeout is in seconds as the
+// DeviceAdapter but zero means the default timeout, 100ms.
+func (a *AfpacketAdapter) SetOptions(promisc bool, snaplength int, timeout time.Duration) error {
+	if snaplength < 1 || snaplength > maxSnapLen {
+		a.err = errors.New(ErrInvalidSnapLen)
+		return a.err
+	}
+	if timeout < 0 {
+		a.err = errors.New(ErrInvalidTimeout)
+		return a.err
+	}
+	goul.Log(a.GetLogger(), a.ID, "set timeout/snaplen/promisc: %v/%v/%v", timeout, snaplength, promisc)
+	a.promiscuous = promisc
+	a.snaplen = snaplength
+	a.timeout = timeout * time.Second
+	if a.timeout == 0 {
+		a.timeout = defaultAfpacketTimeout
+	}
+	return nil
+}
+
+// SetFilter sets filter string which is applied while capturing.
+// Empty filter means no filter. If the sockets are already created, the
+// new filter is compiled first and attached to them, so the filter can be
+// changed without restart. An invalid filter is rejected and the current
+// filter is kept.
+func (a *AfpacketAdapter) SetFilter(filter string) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if err := a.updateFilter(combineFilter(filter, a.exclude)); err != nil {
+		return err
+	}
+	a.filter = filter
+	return nil
+}
+
+// SetExclude sets the filter expression of the traffic to be excluded from
+// the capture. The effective filter is `(filter) and not (exclude)`. If
+// the sockets are already created, the new filter is attached to them.
+func (a *AfpacketAdapter) SetExclude(exclude string) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if err := a.updateFilter(combineFilter(a.filter, exclude)); err != nil {
+		return err
+	}
+	a.exclude = exclude
+	return nil
+}
+
+// updateFilter compiles the effective filter and attaches it to the
+// sockets if they are created. It should be called with the mutex locked.
+func (a *AfpacketAdapter) updateFilter(expr string) error {
+	if a.handles == nil {
+		return nil
+	}
+	filters := map[string][]bpf.RawInstruction{}
+	for _, direction := range a.socketDirections() {
+		filter, err := a.compileFilter(expr, direction)
+		if err != nil {
+			return err
+		}
+		if filter == nil { // accept all
+			filter, _ = bpf.Assemble([]bpf.Instruction{bpf.RetConstant{Val: uint32(a.snaplen)}})
+		}
+		filters[direction] = filter
+	}
+	for i, handle := range a.handles {
+		if err := handle.SetBPF(filters[a.directions[i]]); err != nil {
+			return err
+		}
+	}
+	a.logFilter(expr)
+	return nil
+}
+
+// EffectiveFilter returns the filter combined with the exclusion, which
+// is actually applied while capturing.
+func (a *AfpacketAdapter) EffectiveFilter() string {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return combineFilter(a.filter, a.exclude)
+}
+
+func (a *AfpacketAdapter) logFilter(filter string) {
+	if logger := a.GetLogger(); logger != nil {
+		logger.Infof("[%v] effective filter of %v: <%v>", a.ID, a.device, filter)
+	}
+}
+
+// SetDirection sets capture direction, one of `in`, `out` and `inout`.
+// If it is set, the actual direction is annotated on each captured packet.
+func (a *AfpacketAdapter) SetDirection(direction string) error {
+	if _, ok := pcapDirections[direction]; !ok {
+		a.err = errors.New(ErrInvalidDirection)
+		return a.err
+	}
+	a.direction = direction
+	return nil
+}
+
+// SetRing sets the size in bytes and the number of the blocks of the ring.
+// The block size must be a multiple of the page size.
+func (a *AfpacketAdapter) SetRing(blockSize, numBlocks int) error {
+	if blockSize <= 0 || blockSize%os.Getpagesize() != 0 || numBlocks <= 0 {
+		a.err = errors.New(ErrAfpacketInvalidRing)
+		return a.err
+	}
+	a.blockSize = blockSize
+	a.numBlocks = numBlocks
+	return nil
+}
+
+// SetFanout sets the number of workers and the fanout type. If workers is
+// larger than 1, the sockets of the workers join the fanout group. If the
+// group is zero, it is derived from the process ID.
+func (a *AfpacketAdapter) SetFanout(workers int, fanoutType string, group uint16) error {
+	t, ok := FanoutTypes[fanoutType]
+	if workers < 1 || !ok {
+		a.err = errors.New(ErrAfpacketInvalidFanout)
+		return a.err
+	}
+	if group == 0 {
+		group = uint16(os.Getpid())
+	}
+	a.workers = workers
+	a.fanoutType = t
+	a.fanoutGroup = group
+	return nil
+}
+
+func (a *AfpacketAdapter) activate() error {
+	if a.handles != nil {
+		return nil
+	}
+
+	frameSize := afpacket.DefaultFrameSize
+	for frameSize < a.snaplen {
+		frameSize *= 2
+	}
+	if a.blockSize%frameSize != 0 {
+		return errors.New(ErrAfpacketInvalidRing)
+	}
+
+	for d, direction := range a.socketDirections() {
+		filter, err := a.compileFilter(a.EffectiveFilter(), direction)
+		if err != nil {
+			a.Close()
+			return err
+		}
+		for i := 0; i < a.workers; i++ {
+			handle, err := afpacket.NewTPacket(
+				afpacket.OptInterface(a.device),
+				afpacket.OptTPacketVersion(afpacket.TPacketVersion3),
+				afpacket.OptFrameSize(frameSize),
+				afpacket.OptBlockSize(a.blockSize),
+				afpacket.OptNumBlocks(a.numBlocks),
+				afpacket.OptPollTimeout(a.timeout),
+			)
+			if err != nil {
+				a.Close()
+				return err
+			}
+			a.handles = append(a.handles, handle)
+			a.directions = append(a.directions, direction)
+			if filter != nil {
+				if err := handle.SetBPF(filter); err != nil {
+					a.Close()
+					return err
+				}
+			}
+			if a.workers > 1 {
+				if err := handle.SetFanout(a.fanoutType, a.fanoutGroup+uint16(d)); err != nil {
+					a.Close()
+					return err
+				}
+			}
+		}
+	}
+	if a.promiscuous {
+		if err := a.setPromisc(); err != nil {
+			a.Close()
+			return err
+		}
+	}
+	goul.Log(a.GetLogger(), a.ID, "%v sockets initiated on %v (block %v x %v)",
+		len(a.handles), a.device, a.blockSize, a.numBlocks)
+	return nil
+}
+
+// socketDirections returns the directions of the packets to be captured
+// by separated sockets. It has both directions for `inout` since the
+// direction of each packet can be known only by the filter of the socket.
+func (a *AfpacketAdapter) socketDirections() []string {
+	if a.direction == goul.DirectionInOut {
+		return []string{goul.DirectionIn, goul.DirectionOut}
+	}
+	return []string{a.direction}
+}
+
+// compileFilter compiles the filter expression into BPF instructions. If
+// the direction is in or out, the instructions checking the packet type
+// are prepended. It returns nil if there is nothing to filter.
+func (a *AfpacketAdapter) compileFilter(expr, direction string) ([]bpf.RawInstruction, error) {
+	var prefix []bpf.Instruction
+	if direction == goul.DirectionIn || direction == goul.DirectionOut {
+		var accept, drop uint8 = 1, 0 // jump offsets to the filter or drop
+		if direction == goul.DirectionIn {
+			accept, drop = 0, 1
+		}
+		prefix = []bpf.Instruction{
+			bpf.LoadExtension{Num: bpf.ExtType},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: unix.PACKET_OUTGOING, SkipTrue: accept, SkipFalse: drop},
+			bpf.RetConstant{Val: 0},
+		}
+	}
+	if expr == "" {
+		if prefix == nil {
+			return nil, nil
+		}
+		return bpf.Assemble(append(prefix, bpf.RetConstant{Val: uint32(a.snaplen)}))
+	}
+
+	filter, err := bpf.Assemble(prefix)
+	if err != nil {
+		return nil, err
+	}
+	goul.Log(a.GetLogger(), a.ID, "compiling filter <%v>...", expr)
+	instructions, err := pcap.CompileBPFFilter(layers.LinkTypeEthernet, a.snaplen, expr)
+	if err != nil {
+		return nil, err
+	}
+	for _, ins := range instructions {
+		filter = append(filter, bpf.RawInstruction{Op: ins.Code, Jt: ins.Jt, Jf: ins.Jf, K: ins.K})
+	}
+	return filter, nil
+}
+
+// setPromisc puts the device in promiscuous mode while the adapter is
+// alive, by the membership of an extra socket. The kernel restores the
+// mode when the socket is closed.
+func (a *AfpacketAdapter) setPromisc() error {
+	intf, err := net.InterfaceByName(a.device)
+	if err != nil {
+		return err
+	}
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_RAW, 0)
+	if err != nil {
+		return err
+	}
+	mreq := &unix.PacketMreq{Ifindex: int32(intf.Index), Type: unix.PACKET_MR_PROMISC}
+	if err := unix.SetsockoptPacketMreq(fd, unix.SOL_PACKET, unix.PACKET_ADD_MEMBERSHIP, mreq); err != nil {
+		unix.Close(fd)
+		return err
+	}
+	a.promisc = fd
+	return nil
+}
@@ -0,0 +1,58 @@
+//go:build !linux
+// +build !linux
+
+package adapters
+
+import (
+	"errors"
+	"time"
+
+	"github.com/hyeoncheon/goul"
+)
+
+// constants...
+const (
+	ErrAfpacketNotSupported = "afpacket is supported on linux only"
+)
+
+// AfpacketAdapter is a placeholder of the AF_PACKET adapter on the
+// platforms other than Linux. It cannot be created.
+type AfpacketAdapter struct {
+	goul.Adapter
+	ID string
+}
+
+// NewAfpacket returns an error since AF_PACKET is not supported.
+func NewAfpacket(dev string) (*AfpacketAdapter, error) {
+	return nil, errors.New(ErrAfpacketNotSupported)
+}
+
+// SetOptions is a placeholder.
+func (a *AfpacketAdapter) SetOptions(promisc bool, snaplength int, timeout time.Duration) error {
+	return errors.New(ErrAfpacketNotSupported)
+}
+
+// SetFilter is a placeholder.
+func (a *AfpacketAdapter) SetFilter(filter string) error {
+	return errors.New(ErrAfpacketNotSupported)
+}
+
+// SetExclude is a placeholder.
+func (a *AfpacketAdapter) SetExclude(exclude string) error {
+	return errors.New(ErrAfpacketNotSupported)
+}
+
+// SetDirection is a placeholder.
+func (a *AfpacketAdapter) SetDirection(direction string) error {
+	return errors.New(ErrAfpacketNotSupported)
+}
+
+// SetRing is a placeholder.
+func (a *AfpacketAdapter) SetRing(blockSize, numBlocks int) error {
+	return errors.New(ErrAfpacketNotSupported)
+}
+
+// SetFanout is a placeholder.
+func (a *AfpacketAdapter) SetFanout(workers int, fanoutType string, group uint16) error {
+	return errors.New(ErrAfpacketNotSupported)
+}
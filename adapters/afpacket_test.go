@@ -0,0 +1,209 @@
+//go:build linux
+// +build linux
+
+package adapters_test
+
+import (
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/stretchr/testify/require"
+
+	"github.com/hyeoncheon/goul"
+	"github.com/hyeoncheon/goul/adapters"
+	. "github.com/hyeoncheon/goul/testing"
+)
+
+func Test_Afpacket_10_Capture(t *testing.T) {
+	r := require.New(t)
+
+	reader, err := adapters.NewAfpacket("lo")
+	r.NoError(err)
+	r.NoError(reader.SetOptions(false, 1600, 0))
+	r.NoError(reader.SetFilter(""))
+	r.NoError(reader.SetRing(os.Getpagesize()*32, 4))
+	r.NoError(reader.SetFanout(2, "hash", 0))
+	r.NoError(reader.SetDirection(goul.DirectionIn))
+
+	router := &goul.BaseRouter{}
+	router.SetLogger(goul.NewLogger("debug"))
+	router.SetReader(reader)
+	router.SetWriter(&GeneratorAdapter{ID: "  --AW", Adapter: &goul.BaseAdapter{}})
+	control, out, err := router.Run()
+	if err != nil {
+		t.Skipf("couldn't open AF_PACKET socket: %v", reader.GetError())
+	}
+
+	conn, err := net.Dial("udp", "127.0.0.1:6301")
+	r.NoError(err)
+	defer conn.Close()
+	go func() {
+		for i := 0; i < 10; i++ {
+			conn.Write([]byte("AfpacketData"))
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+
+	found := false
+	timeout := time.After(3 * time.Second)
+	for !found {
+		select {
+		case item := <-out:
+			packet := item.(gopacket.Packet)
+			r.False(packet.Metadata().Timestamp.IsZero())
+			r.Equal(goul.DirectionIn, goul.AnnotationsOf(item)[goul.AnnotationDirection])
+			if app := packet.ApplicationLayer(); app != nil {
+				found = string(app.Payload()) == "AfpacketData"
+			}
+		case <-timeout:
+			r.Fail("no packet captured")
+		}
+	}
+
+	close(control)
+	for range out {
+	}
+	r.NoError(reader.Close())
+}
+
+func Test_Afpacket_11_RuntimeFilter(t *testing.T) {
+	r := require.New(t)
+
+	reader, err := adapters.NewAfpacket("lo")
+	r.NoError(err)
+	r.NoError(reader.SetFilter(""))
+	r.NoError(reader.SetRing(os.Getpagesize()*32, 4))
+	r.NoError(reader.SetDirection(goul.DirectionIn))
+
+	router := &goul.BaseRouter{}
+	router.SetLogger(goul.NewLogger("debug"))
+	router.SetReader(reader)
+	router.SetWriter(&GeneratorAdapter{ID: "  --AW", Adapter: &goul.BaseAdapter{}})
+	control, out, err := router.Run()
+	if err != nil {
+		t.Skipf("couldn't open AF_PACKET socket: %v", reader.GetError())
+	}
+	defer func() {
+		close(control)
+		for range out {
+		}
+		reader.Close()
+	}()
+
+	// invalid filter is rejected and the current one is kept.
+	r.Error(reader.SetFilter("udp and ("))
+	control <- &goul.ItemGeneric{Meta: goul.ItemTypeFilter, DATA: []byte("udp and (")}
+	r.Equal("", reader.EffectiveFilter())
+
+	if err := reader.SetFilter("udp port 6303"); err != nil {
+		t.Skipf("couldn't compile filter: %v", err)
+	}
+	r.Equal("udp port 6303", reader.EffectiveFilter())
+
+	filtered, err := net.Dial("udp", "127.0.0.1:6302")
+	r.NoError(err)
+	defer filtered.Close()
+	passed, err := net.Dial("udp", "127.0.0.1:6303")
+	r.NoError(err)
+	defer passed.Close()
+	go func() {
+		for i := 0; i < 10; i++ {
+			filtered.Write([]byte("Filtered"))
+			passed.Write([]byte("Passed"))
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+
+	found := false
+	timeout := time.After(3 * time.Second)
+	for !found {
+		select {
+		case item := <-out:
+			if app := item.(gopacket.Packet).ApplicationLayer(); app != nil {
+				r.NotEqual("Filtered", string(app.Payload()))
+				found = string(app.Payload()) == "Passed"
+			}
+		case <-timeout:
+			r.Fail("no packet captured")
+		}
+	}
+}
+
+func Test_Afpacket_12_InOut(t *testing.T) {
+	r := require.New(t)
+
+	reader, err := adapters.NewAfpacket("lo")
+	r.NoError(err)
+	r.NoError(reader.SetFilter(""))
+	r.NoError(reader.SetRing(os.Getpagesize()*32, 4))
+	r.NoError(reader.SetFanout(2, "hash", 0))
+	r.NoError(reader.SetDirection(goul.DirectionInOut))
+
+	router := &goul.BaseRouter{}
+	router.SetLogger(goul.NewLogger("debug"))
+	router.SetReader(reader)
+	router.SetWriter(&GeneratorAdapter{ID: "  --AW", Adapter: &goul.BaseAdapter{}})
+	control, out, err := router.Run()
+	if err != nil {
+		t.Skipf("couldn't open AF_PACKET socket: %v", reader.GetError())
+	}
+
+	conn, err := net.Dial("udp", "127.0.0.1:6302")
+	r.NoError(err)
+	defer conn.Close()
+	go func() {
+		for i := 0; i < 10; i++ {
+			conn.Write([]byte("AfpacketInOut"))
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+
+	// a packet on loopback is seen as outgoing and then as incoming.
+	directions := map[string]bool{}
+	timeout := time.After(3 * time.Second)
+	for len(directions) < 2 {
+		select {
+		case item := <-out:
+			packet := item.(gopacket.Packet)
+			if app := packet.ApplicationLayer(); app != nil && string(app.Payload()) == "AfpacketInOut" {
+				directions[goul.AnnotationsOf(item)[goul.AnnotationDirection]] = true
+			}
+		case <-timeout:
+			r.Fail("no packet captured in both directions")
+		}
+	}
+	r.True(directions[goul.DirectionIn])
+	r.True(directions[goul.DirectionOut])
+
+	close(control)
+	for range out {
+	}
+	r.NoError(reader.Close())
+}
+
+func Test_Afpacket_20_Exceptions(t *testing.T) {
+	r := require.New(t)
+
+	_, err := adapters.NewAfpacket("bond9") // does not exist
+	r.Error(err)
+
+	a, err := adapters.NewAfpacket("lo")
+	r.NoError(err)
+	r.EqualError(a.SetRing(1000, 4), adapters.ErrAfpacketInvalidRing)
+	r.EqualError(a.SetRing(os.Getpagesize(), 0), adapters.ErrAfpacketInvalidRing)
+	r.EqualError(a.SetFanout(0, "hash", 0), adapters.ErrAfpacketInvalidFanout)
+	r.EqualError(a.SetFanout(2, "unknown", 0), adapters.ErrAfpacketInvalidFanout)
+	r.EqualError(a.SetDirection("both"), adapters.ErrInvalidDirection)
+
+	// block size is smaller than the frame size for the snaplen.
+	r.NoError(a.SetFilter(""))
+	r.NoError(a.SetOptions(false, 9000, 1))
+	r.NoError(a.SetRing(os.Getpagesize(), 4))
+	_, err = a.Read(make(chan goul.Item), nil)
+	r.EqualError(err, adapters.ErrCouldNotActivate)
+	r.EqualError(a.GetError(), adapters.ErrAfpacketInvalidRing)
+	r.NoError(a.Close())
+}
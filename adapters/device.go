@@ -3,7 +3,12 @@ package adapters
 import (
 	"errors"
 	"fmt"
+	"net"
 	"os"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/google/gopacket"
@@ -19,11 +24,48 @@ const (
 	defaultPromiscuous     = false
 	defaultTimeout         = 1
 	defaultFilter          = "ip"
+	defaultStatsInterval   = 1 * time.Minute
+	defaultRetryInterval   = 1 * time.Second
+	maxInjectFailures      = 10
+	maxSnapLen             = 262144
 
 	ErrDeviceAdapterNotInitialized = "device adapter not initialized"
 	ErrCouldNotActivate            = "could not activate capture interface"
+	ErrInvalidDirection            = "invalid capture direction"
+	ErrInvalidStatsInterval        = "invalid statistics interval"
+	ErrInvalidSnapLen              = "invalid snaplen, it should be 1 to 262144"
+	ErrInvalidTimeout              = "invalid timeout, it should not be negative"
+	ErrInvalidBufferSize           = "invalid buffer size, it should be positive"
+	ErrInvalidTimestampSource      = "unknown timestamp type"
+	ErrUnsupportedTimestampSource  = "timestamp type is not supported by the device"
+	ErrNanosecondNotSupported      = "nanosecond timestamp is not supported by the device"
+	ErrDeviceNotAvailable          = "device is not available"
+	ErrInvalidRetryInterval        = "invalid retry interval"
+
+	DeviceEventDown = "down"
+	DeviceEventUp   = "up"
+
+	InjectErrorNoBuffer    = "ENOBUFS"
+	InjectErrorNetworkDown = "ENETDOWN"
+	InjectErrorTooLong     = "EMSGSIZE"
+	InjectErrorOther       = "other"
 )
 
+// injectErrnos are the errors of injection counted by their own classes.
+// Other errors are counted as InjectErrorOther.
+var injectErrnos = map[syscall.Errno]string{
+	syscall.ENOBUFS:  InjectErrorNoBuffer,
+	syscall.ENETDOWN: InjectErrorNetworkDown,
+	syscall.EMSGSIZE: InjectErrorTooLong,
+}
+
+// pcapDirections is a map of the capture directions and pcap directions.
+var pcapDirections = map[string]pcap.Direction{
+	goul.DirectionIn:    pcap.DirectionIn,
+	goul.DirectionOut:   pcap.DirectionOut,
+	goul.DirectionInOut: pcap.DirectionInOut,
+}
+
 // DeviceAdapter is an adapter for the network device interfacing.
 // This is the most important adapter of Goul. It is used as a reader
 // adapter for the sender and a writer adapter for the receiver.
@@ -41,10 +83,26 @@ type DeviceAdapter struct {
 	promiscuous bool
 	timeout     time.Duration
 	filter      string
+	exclude     string
+	direction   string
+	bufferSize  int
+	immediate   bool
+	tstampType  string
+	nanosecond  bool
+	netns       string
+
+	statsInterval time.Duration
+	mutex         sync.Mutex // guards the handle, the filters and stats
+	stats         DeviceStats
+	closedStats   pcap.Stats
+	retryInterval time.Duration
+	eventHandler  func(event DeviceEvent)
+	filterUpdate  chan string
 
 	isTest         bool
 	handle         *pcap.Handle
 	inactiveHandle *pcap.InactiveHandle
+	ifindex        int // index of the interface when the handle is opened
 }
 
 // Read implements interface Adapter
@@ -65,12 +123,22 @@ func (a *DeviceAdapter) Read(ctrl chan goul.Item, message goul.Message) (out cha
 		return nil, errors.New(ErrCouldNotActivate)
 	}
 
-	goul.Log(a.GetLogger(), a.ID, "setting filter <%v>...", a.filter)
-	if a.err = a.handle.SetBPFFilter(a.filter); a.err != nil {
+	filter := a.EffectiveFilter()
+	goul.Log(a.GetLogger(), a.ID, "setting filter <%v>...", filter)
+	if a.err = a.handle.SetBPFFilter(filter); a.err != nil {
 		a.SetError(a.err)
 		goul.Error(a.GetLogger(), a.ID, "%v: %v", ErrCouldNotActivate, a.err)
 		return nil, errors.New(ErrCouldNotActivate)
 	}
+	if a.direction != "" {
+		goul.Log(a.GetLogger(), a.ID, "setting direction <%v>...", a.direction)
+		if a.err = a.handle.SetDirection(pcapDirections[a.direction]); a.err != nil {
+			a.SetError(a.err)
+			goul.Error(a.GetLogger(), a.ID, "%v: %v", ErrCouldNotActivate, a.err)
+			return nil, errors.New(ErrCouldNotActivate)
+		}
+	}
+	a.logFilter(filter)
 	return goul.Launch(a.reader, ctrl, message)
 }
 
@@ -103,6 +171,9 @@ func (a *DeviceAdapter) Write(in chan goul.Item, message goul.Message) (done cha
 }
 
 // reader read packets from device and push it into output channel.
+// If the capture fails, for example the interface goes down or is
+// removed, it reports the outage and tries to reopen the device every
+// retry interval while keeping the pipeline running.
 func (a *DeviceAdapter) reader(in, out chan goul.Item, message goul.Message) {
 	defer close(out)
 	defer goul.Log(a.GetLogger(), a.ID, "exit")
@@ -111,36 +182,216 @@ func (a *DeviceAdapter) reader(in, out chan goul.Item, message goul.Message) {
 	//? changing the execution order as reversed?
 	time.Sleep(500 * time.Millisecond)
 
-	packets := gopacket.NewPacketSource(a.handle, a.handle.LinkType()).Packets()
+	ticker := a.newStatsTicker()
+	defer ticker.Stop()
+	stop := make(chan struct{})
+	defer close(stop)
+
+	var retry <-chan time.Time
+	var down time.Time
+	comment := ""
+	packets, errs := a.capture(a.handle, stop)
 	goul.Log(a.GetLogger(), a.ID, "capturing in looping...")
 	for {
 		select {
-		case _, ok := <-in:
+		case item, ok := <-in:
 			if !ok {
 				goul.Log(a.GetLogger(), a.ID, "channel closed")
+				a.logStats()
 				return
 			}
+			if item.String() == goul.ItemTypeFilter {
+				if err := a.SetFilter(string(item.Data())); err != nil {
+					goul.Error(a.GetLogger(), a.ID, "couldn't change filter to <%s>: %v", item.Data(), err)
+				}
+			}
 		case packet := <-packets:
+			if a.direction == goul.DirectionIn || a.direction == goul.DirectionOut {
+				goul.Annotate(packet, goul.AnnotationDirection, a.direction)
+			}
+			if comment != "" {
+				goul.Annotate(packet, goul.AnnotationComment, comment)
+				comment = ""
+			}
 			out <- packet
-		default: // for non-blocking looping
-			time.Sleep(10 * time.Millisecond)
+			a.mutex.Lock()
+			a.stats.Captured++
+			a.mutex.Unlock()
+		case err := <-errs:
+			down = time.Now()
+			a.outage(err)
+			packets, errs = nil, nil
+			retry = time.After(a.retryInterval)
+		case <-retry:
+			if err := a.reopen(true); err != nil {
+				goul.Log(a.GetLogger(), a.ID, "couldn't reopen %v: %v", a.device, err)
+				retry = time.After(a.retryInterval)
+				break
+			}
+			retry = nil
+			comment = fmt.Sprintf("capture on %v was interrupted for %v", a.device, a.recovered(down))
+			packets, errs = a.capture(a.handle, stop)
+		case <-ticker.C:
+			a.logStats()
 		}
 	}
 }
 
-// writer write out the packets from input channel
+// capture reads the packets from the handle in a goroutine and sends them
+// to the returned packet channel until stop is closed. If reading fails,
+// the error is sent to the returned error channel and the capture ends.
+// Filter updates are applied between reads, on the same goroutine.
+func (a *DeviceAdapter) capture(handle *pcap.Handle, stop chan struct{}) (chan gopacket.Packet, chan error) {
+	packets := make(chan gopacket.Packet)
+	errs := make(chan error, 1)
+	source := gopacket.NewPacketSource(handle, handle.LinkType())
+	go func() {
+		for {
+			select {
+			case filter := <-a.filterUpdate:
+				if err := handle.SetBPFFilter(filter); err != nil {
+					goul.Error(a.GetLogger(), a.ID, "couldn't update filter <%v>: %v", filter, err)
+				} else {
+					a.logFilter(filter)
+				}
+			default:
+			}
+			packet, err := source.NextPacket()
+			if err == pcap.NextErrorTimeoutExpired || err == syscall.EAGAIN {
+				select {
+				case <-stop:
+					return
+				default:
+					continue
+				}
+			}
+			if err != nil {
+				errs <- err
+				return
+			}
+			select {
+			case packets <- packet:
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return packets, errs
+}
+
+// writer write out the packets from input channel. If the injection fails
+// since the interface is down or removed, it reports the outage and tries
+// to reopen the device every retry interval. The packets are dropped and
+// counted as failures while the device is not available. The handle is
+// also reopened if the interface was re-created with the same name, or
+// after maxInjectFailures consecutive failures other than the full buffer
+// or the size, since the handle may be stale. The interface is checked
+// only on such failures and at most once per retry interval, since it is
+// costly with the network namespace.
 func (a *DeviceAdapter) writer(in, out chan goul.Item, message goul.Message) {
 	defer close(out)
 	defer goul.Log(a.GetLogger(), a.ID, "exit")
 
+	ticker := a.newStatsTicker()
+	defer ticker.Stop()
+
+	var retry <-chan time.Time
+	var down, checked time.Time
+	failures := 0
 	goul.Log(a.GetLogger(), a.ID, "writer in looping...")
-	for item := range in {
-		if p, ok := item.(gopacket.Packet); ok {
-			a.handle.WritePacketData(p.Data())
+	for {
+		select {
+		case item, ok := <-in:
+			if !ok {
+				goul.Log(a.GetLogger(), a.ID, "channel closed")
+				a.logStats()
+				out <- &goul.ItemGeneric{Meta: "message", DATA: []byte("channel closed. done")}
+				return
+			}
+			p, ok := item.(gopacket.Packet)
+			if !ok {
+				continue
+			}
+			if retry != nil {
+				a.countInjection(errors.New(ErrDeviceNotAvailable))
+				continue
+			}
+			err := a.inject(p.Data())
+			if err == nil {
+				failures = 0
+				break
+			}
+			if class := InjectErrorClass(err); class == InjectErrorNoBuffer || class == InjectErrorTooLong {
+				break
+			}
+			failures++
+			stale := false
+			if time.Since(checked) >= a.retryInterval {
+				checked = time.Now()
+				stale = a.isStale()
+			}
+			if failures >= maxInjectFailures || stale {
+				failures = 0
+				down = time.Now()
+				a.outage(err)
+				retry = time.After(a.retryInterval)
+			}
+		case <-retry:
+			if err := a.reopen(false); err != nil {
+				goul.Log(a.GetLogger(), a.ID, "couldn't reopen %v: %v", a.device, err)
+				retry = time.After(a.retryInterval)
+				break
+			}
+			retry = nil
+			a.recovered(down)
+		case <-ticker.C:
+			a.logStats()
 		}
 	}
-	goul.Log(a.GetLogger(), a.ID, "channel closed")
-	out <- &goul.ItemGeneric{Meta: "message", DATA: []byte("channel closed. done")}
+}
+
+// inject writes the packet data to the device and counts the result.
+func (a *DeviceAdapter) inject(data []byte) error {
+	err := a.handle.WritePacketData(data)
+	a.countInjection(err)
+	return err
+}
+
+// countInjection counts the result of an injection. Failures are counted
+// by the class of the error.
+func (a *DeviceAdapter) countInjection(err error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if err == nil {
+		a.stats.Injected++
+		return
+	}
+	a.stats.InjectFailed++
+	if a.stats.InjectErrors == nil {
+		a.stats.InjectErrors = map[string]uint64{}
+	}
+	class := InjectErrorClass(err)
+	if a.stats.InjectErrors[class] == 0 { // log once for each class
+		goul.Error(a.GetLogger(), a.ID, "injection failed: %v", err)
+	}
+	a.stats.InjectErrors[class]++
+}
+
+// InjectErrorClass returns the class of the injection error, one of the
+// fixed classes so the statistics do not grow with the messages. libpcap
+// returns the errors as messages, so they are also compared with the
+// messages of the errnos.
+func InjectErrorClass(err error) string {
+	if err.Error() == ErrDeviceNotAvailable {
+		return InjectErrorNetworkDown
+	}
+	message := strings.ToLower(err.Error())
+	for errno, class := range injectErrnos {
+		if errors.Is(err, errno) || strings.HasSuffix(message, errno.Error()) {
+			return class
+		}
+	}
+	return InjectErrorOther
 }
 
 // writer write out the packets from input channel
@@ -160,6 +411,16 @@ func (a *DeviceAdapter) dummy(in, out chan goul.Item, message goul.Message) {
 
 // NewDevice returns new device adapter.
 func NewDevice(dev string, isTest bool) (*DeviceAdapter, error) {
+	return NewDeviceInNetns(dev, "", isTest)
+}
+
+// NewDeviceInNetns returns new device adapter for the device in the network
+// namespace, for the devices of containers or pods. The namespace is a path
+// such as `/proc/<pid>/ns/net` or a name of `ip netns`. The handle is
+// opened inside the namespace on a locked OS thread, while the other
+// adapters keep using the namespace of the process. Empty namespace means
+// the namespace of the process.
+func NewDeviceInNetns(dev, netns string, isTest bool) (*DeviceAdapter, error) {
 	a := &DeviceAdapter{
 		ID:          defaultDeviceAdapterID,
 		device:      dev,
@@ -169,9 +430,19 @@ func NewDevice(dev string, isTest bool) (*DeviceAdapter, error) {
 		filter:      defaultFilter,
 		Adapter:     &goul.BaseAdapter{},
 		isTest:      isTest,
+
+		statsInterval: defaultStatsInterval,
+		retryInterval: defaultRetryInterval,
+		filterUpdate:  make(chan string, 1),
+	}
+	if a.netns, a.err = netnsPath(netns); a.err != nil {
+		return a, a.err
 	}
 	if !isTest {
-		a.inactiveHandle, a.err = pcap.NewInactiveHandle(a.device)
+		a.err = inNetns(a.netns, func() (err error) {
+			a.inactiveHandle, err = pcap.NewInactiveHandle(a.device)
+			return err
+		})
 	}
 	return a, a.err
 }
@@ -188,17 +459,26 @@ func (a *DeviceAdapter) Close() (err error) {
 	}()
 
 	goul.Log(a.GetLogger(), a.ID, "cleanup...")
-	if a.handle != nil {
-		a.handle.Close()
-	}
+	a.mutex.Lock()
+	a.closeHandle()
+	a.mutex.Unlock()
 	if a.inactiveHandle != nil {
 		a.inactiveHandle.CleanUp()
 	}
 	return nil
 }
 
-// SetOptions sets capture options to inactive handler.
+// SetOptions sets capture options to inactive handler. The timeout is
+// given in seconds.
 func (a *DeviceAdapter) SetOptions(promisc bool, snaplength int, timeout time.Duration) (err error) {
+	if snaplength < 1 || snaplength > maxSnapLen {
+		a.err = errors.New(ErrInvalidSnapLen)
+		return a.err
+	}
+	if timeout < 0 {
+		a.err = errors.New(ErrInvalidTimeout)
+		return a.err
+	}
 	if a.inactiveHandle == nil {
 		a.err = errors.New(ErrDeviceAdapterNotInitialized)
 		return a.err
@@ -218,23 +498,482 @@ func (a *DeviceAdapter) SetOptions(promisc bool, snaplength int, timeout time.Du
 	return a.err
 }
 
-// SetFilter sets filter string which is applied while capturing.
+// SetBufferSize sets the size of the kernel buffer in bytes. If the buffer
+// is too small for the traffic, the kernel drops the packets.
+func (a *DeviceAdapter) SetBufferSize(size int) error {
+	if size < 1 {
+		a.err = errors.New(ErrInvalidBufferSize)
+		return a.err
+	}
+	if a.inactiveHandle == nil {
+		a.err = errors.New(ErrDeviceAdapterNotInitialized)
+		return a.err
+	}
+
+	goul.Log(a.GetLogger(), a.ID, "set buffer size: %v", size)
+	if a.err = a.inactiveHandle.SetBufferSize(size); a.err != nil {
+		goul.Error(a.GetLogger(), a.ID, "set buffer size error: %v", a.err)
+		return a.err
+	}
+	a.bufferSize = size
+	return nil
+}
+
+// SetImmediateMode sets immediate mode. In immediate mode, the packets are
+// delivered as soon as they arrive without buffering till the timeout.
+func (a *DeviceAdapter) SetImmediateMode(immediate bool) error {
+	if a.inactiveHandle == nil {
+		a.err = errors.New(ErrDeviceAdapterNotInitialized)
+		return a.err
+	}
+
+	goul.Log(a.GetLogger(), a.ID, "set immediate mode: %v", immediate)
+	if a.err = a.inactiveHandle.SetImmediateMode(immediate); a.err != nil {
+		goul.Error(a.GetLogger(), a.ID, "set immediate mode error: %v", a.err)
+		return a.err
+	}
+	a.immediate = immediate
+	return nil
+}
+
+// SetTimestampSource sets the timestamp type by the name used by libpcap,
+// such as `host`, `adapter` or `adapter_unsynced`. The type should be one
+// of the types supported by the device.
+func (a *DeviceAdapter) SetTimestampSource(name string) error {
+	source, err := pcap.TimestampSourceFromString(name)
+	if err != nil {
+		a.err = errors.New(ErrInvalidTimestampSource)
+		return a.err
+	}
+	if a.inactiveHandle == nil {
+		a.err = errors.New(ErrDeviceAdapterNotInitialized)
+		return a.err
+	}
+
+	supported := []string{}
+	found := false
+	for _, s := range a.inactiveHandle.SupportedTimestamps() {
+		supported = append(supported, s.String())
+		found = found || s == source
+	}
+	if len(supported) == 0 { // the device supports the default only.
+		supported = append(supported, "host")
+		found = source.String() == "host"
+	}
+	if !found {
+		a.err = errors.New(ErrUnsupportedTimestampSource)
+		goul.Error(a.GetLogger(), a.ID, "%v: %v (supported: %v)", ErrUnsupportedTimestampSource,
+			name, strings.Join(supported, ", "))
+		return a.err
+	}
+
+	goul.Log(a.GetLogger(), a.ID, "set timestamp type: %v", source)
+	if a.err = a.inactiveHandle.SetTimestampSource(source); a.err != nil {
+		goul.Error(a.GetLogger(), a.ID, "set timestamp type error: %v", a.err)
+		return a.err
+	}
+	a.tstampType = source.String()
+	return nil
+}
+
+// SetNanosecond makes nanosecond timestamp precision mandatory. The
+// nanosecond precision is always requested if the device supports it, but
+// with this option, the activation fails if it is not supported.
+func (a *DeviceAdapter) SetNanosecond(nanosecond bool) error {
+	a.nanosecond = nanosecond
+	return nil
+}
+
+// SetFilter sets filter string which is applied while capturing. If the
+// device is capturing, the new filter is validated by compiling it and
+// swapped on the live handle by the capturing goroutine, so the filter can
+// be changed without restart. An invalid filter is rejected and the
+// current filter is kept.
 func (a *DeviceAdapter) SetFilter(filter string) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if err := a.updateFilter(combineFilter(filter, a.exclude)); err != nil {
+		return err
+	}
 	a.filter = filter
 	return nil
 }
 
+// SetExclude sets the filter expression of the traffic to be excluded from
+// the capture, such as the connection of Goul itself. The effective filter
+// is `(filter) and not (exclude)`. If the device is capturing, the filter
+// of the handle is updated as SetFilter.
+func (a *DeviceAdapter) SetExclude(exclude string) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if err := a.updateFilter(combineFilter(a.filter, exclude)); err != nil {
+		return err
+	}
+	a.exclude = exclude
+	return nil
+}
+
+// updateFilter validates the effective filter and passes it to the
+// capturing goroutine if the handle is active. It should be called with
+// the mutex locked.
+func (a *DeviceAdapter) updateFilter(filter string) error {
+	if a.handle == nil {
+		return nil
+	}
+	if _, err := pcap.CompileBPFFilter(a.handle.LinkType(), a.snaplen, filter); err != nil {
+		return err
+	}
+	select { // replace the pending update if exists
+	case <-a.filterUpdate:
+	default:
+	}
+	a.filterUpdate <- filter
+	return nil
+}
+
+// EffectiveFilter returns the filter combined with the exclusion, which
+// is actually applied while capturing.
+func (a *DeviceAdapter) EffectiveFilter() string {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return combineFilter(a.filter, a.exclude)
+}
+
+func (a *DeviceAdapter) logFilter(filter string) {
+	if logger := a.GetLogger(); logger != nil {
+		logger.Infof("[%v] effective filter of %v: <%v>", a.ID, a.device, filter)
+	}
+}
+
+// SetDirection sets capture direction, one of `in`, `out` and `inout`.
+// If it is `in` or `out`, the direction is annotated on each captured
+// packet. libpcap does not tell the direction of each packet, so packets
+// captured with `inout` are not annotated.
+func (a *DeviceAdapter) SetDirection(direction string) error {
+	if _, ok := pcapDirections[direction]; !ok {
+		a.err = errors.New(ErrInvalidDirection)
+		return a.err
+	}
+	a.direction = direction
+	return nil
+}
+
+// SetStatsInterval sets the interval of statistics logging. Zero disables
+// periodic logging but the statistics are still logged at the end.
+func (a *DeviceAdapter) SetStatsInterval(interval time.Duration) error {
+	if interval < 0 {
+		a.err = errors.New(ErrInvalidStatsInterval)
+		return a.err
+	}
+	a.statsInterval = interval
+	return nil
+}
+
+// Stats returns a snapshot of the capture and injection statistics. The
+// capture statistics from libpcap are the last known values if the handle
+// is already closed.
+func (a *DeviceAdapter) Stats() DeviceStats {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	a.updateCaptureStats()
+	stats := a.stats
+	stats.InjectErrors = map[string]uint64{}
+	for k, v := range a.stats.InjectErrors {
+		stats.InjectErrors[k] = v
+	}
+	return stats
+}
+
+// updateCaptureStats reads the statistics of the handle. It should be
+// called with mutex.
+func (a *DeviceAdapter) updateCaptureStats() {
+	if a.handle == nil {
+		return
+	}
+	if ps, err := a.handle.Stats(); err == nil {
+		a.stats.Received = a.closedStats.PacketsReceived + ps.PacketsReceived
+		a.stats.Dropped = a.closedStats.PacketsDropped + ps.PacketsDropped
+		a.stats.IfDropped = a.closedStats.PacketsIfDropped + ps.PacketsIfDropped
+	}
+}
+
+// closeHandle closes the handle and keeps its capture statistics so they
+// can be accumulated over reopened handles. It should be called with
+// mutex.
+func (a *DeviceAdapter) closeHandle() {
+	if a.handle == nil {
+		return
+	}
+	a.updateCaptureStats()
+	a.closedStats = pcap.Stats{
+		PacketsReceived:  a.stats.Received,
+		PacketsDropped:   a.stats.Dropped,
+		PacketsIfDropped: a.stats.IfDropped,
+	}
+	a.handle.Close()
+	a.handle = nil
+}
+
+func (a *DeviceAdapter) logStats() {
+	if logger := a.GetLogger(); logger != nil {
+		logger.Infof("[%v] statistics: %v", a.ID, a.Stats())
+	}
+}
+
+// newStatsTicker returns a ticker for periodic statistics logging. If the
+// interval is not set, the ticker is stopped and never ticks.
+func (a *DeviceAdapter) newStatsTicker() *time.Ticker {
+	if a.statsInterval > 0 {
+		return time.NewTicker(a.statsInterval)
+	}
+	ticker := time.NewTicker(time.Hour)
+	ticker.Stop()
+	return ticker
+}
+
+// SetRetryInterval sets the interval to retry opening the device while it
+// is not available.
+func (a *DeviceAdapter) SetRetryInterval(interval time.Duration) error {
+	if interval <= 0 {
+		a.err = errors.New(ErrInvalidRetryInterval)
+		return a.err
+	}
+	a.retryInterval = interval
+	return nil
+}
+
+// SetEventHandler sets the handler of the device events. The handler is
+// called on the goroutine of the reader or writer so it should not block.
+func (a *DeviceAdapter) SetEventHandler(handler func(event DeviceEvent)) error {
+	a.eventHandler = handler
+	return nil
+}
+
+// outage closes the failed handle and reports the outage.
+func (a *DeviceAdapter) outage(err error) {
+	goul.Error(a.GetLogger(), a.ID, "device %v is not available: %v", a.device, err)
+	a.mutex.Lock()
+	a.closeHandle()
+	a.stats.Outages++
+	a.mutex.Unlock()
+	a.emit(DeviceEvent{Type: DeviceEventDown, Device: a.device, Time: time.Now(), Error: err})
+}
+
+// recovered reports the recovery of the device which was down since down,
+// and returns the duration of the outage.
+func (a *DeviceAdapter) recovered(down time.Time) time.Duration {
+	outage := time.Since(down).Round(time.Millisecond)
+	if logger := a.GetLogger(); logger != nil {
+		logger.Infof("[%v] device %v is recovered after %v", a.ID, a.device, outage)
+	}
+	a.emit(DeviceEvent{Type: DeviceEventUp, Device: a.device, Time: time.Now(), Outage: outage})
+	return outage
+}
+
+func (a *DeviceAdapter) emit(event DeviceEvent) {
+	if a.eventHandler != nil {
+		a.eventHandler(event)
+	}
+}
+
+// isUp returns true if the interface exists and is up.
+func (a *DeviceAdapter) isUp() bool {
+	up := false
+	inNetns(a.netns, func() error {
+		intf, err := net.InterfaceByName(a.device)
+		up = err == nil && intf.Flags&net.FlagUp != 0
+		return nil
+	})
+	return up
+}
+
+// isStale returns true if the interface is not available or it is not
+// the interface of the handle anymore, since it was re-created with the
+// same name and got a new index.
+func (a *DeviceAdapter) isStale() bool {
+	stale := true
+	inNetns(a.netns, func() error {
+		intf, err := net.InterfaceByName(a.device)
+		stale = err != nil || intf.Flags&net.FlagUp == 0 || intf.Index != a.ifindex
+		return nil
+	})
+	return stale
+}
+
+// interfaceIndex returns the index of the interface, or zero if it is
+// not found. It should be called in the namespace of the device.
+func (a *DeviceAdapter) interfaceIndex() int {
+	intf, err := net.InterfaceByName(a.device)
+	if err != nil {
+		return 0
+	}
+	return intf.Index
+}
+
+// reopen opens the device again with the same options. For capturing,
+// the filter and the direction are also set again.
+func (a *DeviceAdapter) reopen(capture bool) error {
+	if !a.isUp() {
+		return errors.New(ErrDeviceNotAvailable)
+	}
+	var handle *pcap.Handle
+	var ifindex int
+	err := inNetns(a.netns, func() error {
+		ifindex = a.interfaceIndex()
+		inactive, err := pcap.NewInactiveHandle(a.device)
+		if err != nil {
+			return err
+		}
+		defer inactive.CleanUp()
+
+		if err := a.configure(inactive); err != nil {
+			return err
+		}
+		handle, err = inactive.Activate()
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if a.nanosecond && !isNanosecond(handle) {
+		handle.Close()
+		return errors.New(ErrNanosecondNotSupported)
+	}
+	if capture {
+		filter := a.EffectiveFilter()
+		if err := handle.SetBPFFilter(filter); err != nil {
+			handle.Close()
+			return err
+		}
+		if a.direction != "" {
+			if err := handle.SetDirection(pcapDirections[a.direction]); err != nil {
+				handle.Close()
+				return err
+			}
+		}
+		a.logFilter(filter)
+	}
+
+	a.mutex.Lock()
+	a.handle = handle
+	a.ifindex = ifindex
+	a.mutex.Unlock()
+	goul.Log(a.GetLogger(), a.ID, "device %v reopened", a.device)
+	return nil
+}
+
+// configure sets the options of the adapter to the inactive handle.
+func (a *DeviceAdapter) configure(inactive *pcap.InactiveHandle) error {
+	if err := inactive.SetTimeout(a.timeout * time.Second); err != nil {
+		return err
+	}
+	if err := inactive.SetSnapLen(a.snaplen); err != nil {
+		return err
+	}
+	if err := inactive.SetPromisc(a.promiscuous); err != nil {
+		return err
+	}
+	if a.bufferSize > 0 {
+		if err := inactive.SetBufferSize(a.bufferSize); err != nil {
+			return err
+		}
+	}
+	if a.immediate {
+		if err := inactive.SetImmediateMode(true); err != nil {
+			return err
+		}
+	}
+	if a.tstampType != "" {
+		source, err := pcap.TimestampSourceFromString(a.tstampType)
+		if err != nil {
+			return err
+		}
+		if err := inactive.SetTimestampSource(source); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (a *DeviceAdapter) activate() error {
 	if a.inactiveHandle == nil {
 		a.err = errors.New(ErrDeviceAdapterNotInitialized)
 		return a.err
 	}
 	if a.handle == nil && a.inactiveHandle != nil {
-		a.handle, a.err = a.inactiveHandle.Activate()
+		a.err = inNetns(a.netns, func() (err error) {
+			a.ifindex = a.interfaceIndex()
+			a.handle, err = a.inactiveHandle.Activate()
+			return err
+		})
 		if a.err != nil {
 			return a.err
 		}
+		if a.nanosecond && !isNanosecond(a.handle) {
+			a.handle.Close()
+			a.handle = nil
+			a.err = errors.New(ErrNanosecondNotSupported)
+			return a.err
+		}
 	}
 	goul.Log(a.GetLogger(), a.ID, "handle initiated: %v", a.handle)
 	return nil
 }
+
+// isNanosecond returns true if the timestamps of the handle are captured
+// in nanosecond precision. Note that Handle.Resolution() of gopacket
+// v1.1.19 returns the resolution in reverse, microsecond resolution for
+// nanosecond precision, since it is based on the scaling factor.
+func isNanosecond(handle *pcap.Handle) bool {
+	return handle.Resolution() == gopacket.TimestampResolutionMicrosecond
+}
+
+//** statistics -----------------------------------------------------
+
+// DeviceStats is a statistics of the device adapter. Received, Dropped and
+// IfDropped are the capture statistics from libpcap, which are packets
+// received by the filter, dropped by the kernel since the buffer was full
+// and dropped by the interface or its driver. The others are counted by
+// the adapter. InjectErrors keeps the number of injection failures for
+// each class of the error, such as `ENOBUFS` or `other`, and Outages is
+// the number of times the device went down or was removed.
+type DeviceStats struct {
+	Received  int
+	Dropped   int
+	IfDropped int
+
+	Captured     uint64
+	Injected     uint64
+	InjectFailed uint64
+	InjectErrors map[string]uint64
+	Outages      uint64
+}
+
+// String returns a one line summary of the statistics.
+func (s DeviceStats) String() string {
+	str := fmt.Sprintf("received %v, dropped %v, if-dropped %v, captured %v, injected %v, failed %v, outages %v",
+		s.Received, s.Dropped, s.IfDropped, s.Captured, s.Injected, s.InjectFailed, s.Outages)
+	if len(s.InjectErrors) == 0 {
+		return str
+	}
+	errs := []string{}
+	for k, v := range s.InjectErrors {
+		errs = append(errs, fmt.Sprintf("%v: %v", k, v))
+	}
+	sort.Strings(errs)
+	return str + " (" + strings.Join(errs, ", ") + ")"
+}
+
+// DeviceEvent is an event of the device reported by the adapter. For the
+// event `down`, Error is the cause of the outage. For the event `up`,
+// Outage is the duration of the outage.
+type DeviceEvent struct {
+	Type   string
+	Device string
+	Time   time.Time
+	Error  error
+	Outage time.Duration
+}
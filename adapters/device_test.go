@@ -1,7 +1,11 @@
 package adapters_test
 
 import (
+	"errors"
+	"fmt"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 
@@ -84,6 +88,10 @@ func Test_DeviceAdapter_2_AdapterSpecific(t *testing.T) {
 	r.NoError(err)
 	err = adapter.SetOptions(false, 1500, 1)
 	r.NoError(err)
+	err = adapter.SetDirection(goul.DirectionIn)
+	r.NoError(err)
+	err = adapter.SetDirection("both")
+	r.EqualError(err, adapters.ErrInvalidDirection)
 
 	in := make(chan goul.Item)
 	_, err = adapter.Write(in, nil)
@@ -120,3 +128,131 @@ func Test_DeviceAdapter_3_Uninitialized(t *testing.T) {
 	r.Error(err)
 	r.EqualError(adapter.GetError(), adapters.ErrDeviceAdapterNotInitialized)
 }
+
+func Test_DeviceAdapter_4_Stats(t *testing.T) {
+	r := require.New(t)
+
+	adapter, err := adapters.NewDevice("lo", true)
+	r.NoError(err)
+	r.NoError(adapter.SetStatsInterval(10 * time.Millisecond))
+	r.EqualError(adapter.SetStatsInterval(-1), adapters.ErrInvalidStatsInterval)
+
+	stats := adapter.Stats()
+	r.Zero(stats.Received)
+	r.Zero(stats.Injected)
+	r.Empty(stats.InjectErrors)
+	r.Equal("received 0, dropped 0, if-dropped 0, captured 0, injected 0, failed 0, outages 0", stats.String())
+
+	stats = adapters.DeviceStats{
+		Outages:      1,
+		Received:     10,
+		Injected:     7,
+		InjectFailed: 3,
+		InjectErrors: map[string]uint64{adapters.InjectErrorNetworkDown: 2, adapters.InjectErrorTooLong: 1},
+	}
+	r.Equal("received 10, dropped 0, if-dropped 0, captured 0, injected 7, failed 3, outages 1"+
+		" (EMSGSIZE: 1, ENETDOWN: 2)", stats.String())
+
+	for err, class := range map[error]string{
+		errors.New("send: No buffer space available"): adapters.InjectErrorNoBuffer,
+		errors.New("send: Network is down"):           adapters.InjectErrorNetworkDown,
+		fmt.Errorf("write: %w", syscall.EMSGSIZE):     adapters.InjectErrorTooLong,
+		errors.New(adapters.ErrDeviceNotAvailable):    adapters.InjectErrorNetworkDown,
+		errors.New("send: Unexpected error 4242"):     adapters.InjectErrorOther,
+	} {
+		r.Equal(class, adapters.InjectErrorClass(err), err.Error())
+	}
+	r.NoError(adapter.Close())
+}
+
+func Test_DeviceAdapter_5_Tuning(t *testing.T) {
+	r := require.New(t)
+
+	adapter, err := adapters.NewDevice("lo", false)
+	r.NoError(err)
+	defer adapter.Close()
+
+	r.EqualError(adapter.SetOptions(false, 0, 1), adapters.ErrInvalidSnapLen)
+	r.EqualError(adapter.SetOptions(false, 300000, 1), adapters.ErrInvalidSnapLen)
+	r.EqualError(adapter.SetOptions(false, 1500, -1), adapters.ErrInvalidTimeout)
+	r.NoError(adapter.SetOptions(true, 65535, 0))
+
+	r.EqualError(adapter.SetBufferSize(0), adapters.ErrInvalidBufferSize)
+	r.NoError(adapter.SetBufferSize(4 * 1024 * 1024))
+	r.NoError(adapter.SetImmediateMode(true))
+	r.EqualError(adapter.SetTimestampSource("sundial"), adapters.ErrInvalidTimestampSource)
+	r.NoError(adapter.SetNanosecond(true))
+
+	// not initialized
+	adapter = &adapters.DeviceAdapter{Adapter: &goul.BaseAdapter{}}
+	r.EqualError(adapter.SetBufferSize(1024), adapters.ErrDeviceAdapterNotInitialized)
+	r.EqualError(adapter.SetImmediateMode(true), adapters.ErrDeviceAdapterNotInitialized)
+}
+
+func Test_DeviceAdapter_6_Recovery(t *testing.T) {
+	r := require.New(t)
+
+	adapter, err := adapters.NewDevice("lo", false)
+	r.NoError(err)
+	defer adapter.Close()
+
+	r.NoError(adapter.SetRetryInterval(100 * time.Millisecond))
+	r.EqualError(adapter.SetRetryInterval(0), adapters.ErrInvalidRetryInterval)
+
+	events := []adapters.DeviceEvent{}
+	r.NoError(adapter.SetEventHandler(func(event adapters.DeviceEvent) {
+		events = append(events, event)
+	}))
+	r.Empty(events)
+}
+
+func Test_DeviceAdapter_7_Exclude(t *testing.T) {
+	r := require.New(t)
+
+	adapter, err := adapters.NewDevice("lo", false)
+	r.NoError(err)
+	defer adapter.Close()
+
+	r.Equal("ip", adapter.EffectiveFilter())
+	r.NoError(adapter.SetExclude("port 6001"))
+	r.Equal("(ip) and not (port 6001)", adapter.EffectiveFilter())
+	r.NoError(adapter.SetFilter(""))
+	r.Equal("not (port 6001)", adapter.EffectiveFilter())
+	r.NoError(adapter.SetExclude(""))
+	r.Equal("", adapter.EffectiveFilter())
+}
+
+func Test_DeviceAdapter_8_RuntimeFilter(t *testing.T) {
+	r := require.New(t)
+
+	adapter, err := adapters.NewDevice("lo", false)
+	r.NoError(err)
+	defer adapter.Close()
+
+	// the filter is not validated before activation.
+	r.NoError(adapter.SetFilter("udp and ("))
+	r.Equal("udp and (", adapter.EffectiveFilter())
+	r.NoError(adapter.SetFilter("udp"))
+
+	ctrl := make(chan goul.Item)
+	out, err := adapter.Read(ctrl, nil)
+	if err != nil {
+		t.Skipf("couldn't capture on lo: %v", adapter.GetError())
+	}
+	defer func() {
+		close(ctrl)
+		for range out {
+		}
+	}()
+
+	r.Error(adapter.SetFilter("udp and ("))
+	r.Equal("udp", adapter.EffectiveFilter())
+	r.NoError(adapter.SetFilter("tcp"))
+	r.Equal("tcp", adapter.EffectiveFilter())
+
+	ctrl <- &goul.ItemGeneric{Meta: goul.ItemTypeFilter, DATA: []byte("udp and (")}
+	ctrl <- &goul.ItemGeneric{Meta: goul.ItemTypeFilter, DATA: []byte("icmp")}
+	r.Eventually(func() bool {
+		return adapter.EffectiveFilter() == "icmp"
+	}, time.Second, 10*time.Millisecond)
+}
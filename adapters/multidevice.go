@@ -0,0 +1,324 @@
+package adapters
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/hyeoncheon/goul"
+)
+
+// constants...
+const (
+	defaultMultiDeviceAdapterID = "multi"
+	defaultDemuxAdapterID       = "demux"
+
+	ErrMultiDeviceNoReader  = "no reader for multi device"
+	ErrMultiDeviceDuplicate = "duplicated interface name"
+	ErrDemuxNoWriter        = "no default writer for demux"
+)
+
+// MultiDeviceAdapter is a reader adapter that captures from several
+// devices in one process. Each device is captured by its own reader, with
+// its own filter, and the packets are merged into one stream and tagged
+// with the name of the interface as the annotation `interface`.
+//
+// On the receiver side, DemuxAdapter or PcapNgFileAdapter can separate
+// the stream by the interface again.
+type MultiDeviceAdapter struct {
+	goul.Adapter
+	ID      string
+	err     error
+	names   []string
+	readers map[string]goul.Adapter
+	ctrls   []chan goul.Item
+	outs    []chan goul.Item
+}
+
+// Read implements interface Adapter
+func (a *MultiDeviceAdapter) Read(ctrl chan goul.Item, message goul.Message) (chan goul.Item, error) {
+	if len(a.names) == 0 {
+		a.err = errors.New(ErrMultiDeviceNoReader)
+		return nil, a.err
+	}
+
+	a.outs = []chan goul.Item{}
+	for _, name := range a.names {
+		reader := a.readers[name]
+		reader.SetLogger(a.GetLogger())
+		ch := make(chan goul.Item)
+		out, err := reader.Read(ch, message)
+		if err != nil {
+			a.err = err
+			a.SetError(err)
+			goul.Error(a.GetLogger(), a.ID, "couldn't start reader for %v: %v", name, err)
+			close(ch)
+			a.closeCtrls()
+			return nil, err
+		}
+		a.ctrls = append(a.ctrls, ch)
+		a.outs = append(a.outs, out)
+	}
+	return goul.Launch(a.merger, ctrl, message)
+}
+
+// merger merges outputs of the readers into output channel with the tag.
+func (a *MultiDeviceAdapter) merger(in, out chan goul.Item, message goul.Message) {
+	defer close(out)
+	defer goul.Log(a.GetLogger(), a.ID, "exit")
+
+	goul.Log(a.GetLogger(), a.ID, "merger in looping... (%v devices)", len(a.outs))
+	wg := sync.WaitGroup{}
+	for i, ch := range a.outs {
+		wg.Add(1)
+		go func(name string, ch chan goul.Item) {
+			defer wg.Done()
+			count := 0
+			for item := range ch {
+				goul.Annotate(item, goul.AnnotationInterface, name)
+				out <- item
+				count++
+			}
+			goul.Log(a.GetLogger(), a.ID, "%v packets from %v", count, name)
+		}(a.names[i], ch)
+	}
+
+	go func() {
+		for item := range in {
+			if item.String() == goul.ItemTypeFilter {
+				if err := a.SetFilter(string(item.Data())); err != nil {
+					goul.Error(a.GetLogger(), a.ID, "couldn't change filter to <%s>: %v", item.Data(), err)
+				}
+			}
+		}
+		goul.Log(a.GetLogger(), a.ID, "channel closed")
+		a.closeCtrls()
+	}()
+	wg.Wait()
+}
+
+// NewMultiDevice returns new multi device adapter without devices.
+func NewMultiDevice() (*MultiDeviceAdapter, error) {
+	a := &MultiDeviceAdapter{
+		Adapter: &goul.BaseAdapter{},
+		ID:      defaultMultiDeviceAdapterID,
+		readers: map[string]goul.Adapter{},
+	}
+	return a, nil
+}
+
+// AddDevice opens the device with given filter and adds it to the adapter.
+// If the filter is empty, the default filter of DeviceAdapter is used.
+func (a *MultiDeviceAdapter) AddDevice(dev, filter string, isTest bool) (*DeviceAdapter, error) {
+	return a.AddDeviceInNetns(dev, "", filter, isTest)
+}
+
+// AddDeviceInNetns opens the device in the network namespace with given
+// filter and adds it to the adapter. See NewDeviceInNetns for the details.
+func (a *MultiDeviceAdapter) AddDeviceInNetns(dev, netns, filter string, isTest bool) (*DeviceAdapter, error) {
+	reader, err := NewDeviceInNetns(dev, netns, isTest)
+	if err != nil {
+		return nil, err
+	}
+	reader.ID = defaultDeviceAdapterID + ":" + dev
+	if filter != "" {
+		reader.SetFilter(filter)
+	}
+	if err := a.Add(dev, reader); err != nil {
+		reader.Close()
+		return nil, err
+	}
+	return reader, nil
+}
+
+// Add adds the reader adapter with the name of the interface.
+func (a *MultiDeviceAdapter) Add(name string, reader goul.Adapter) error {
+	if _, ok := a.readers[name]; ok {
+		a.err = errors.New(ErrMultiDeviceDuplicate)
+		return a.err
+	}
+	a.names = append(a.names, name)
+	a.readers[name] = reader
+	return nil
+}
+
+// SetFilter sets the filter of all readers which support it, replacing
+// the filters of each device. See DeviceAdapter.SetFilter for the details.
+func (a *MultiDeviceAdapter) SetFilter(filter string) error {
+	for _, name := range a.names {
+		reader, ok := a.readers[name].(interface{ SetFilter(string) error })
+		if !ok {
+			continue
+		}
+		if err := reader.SetFilter(filter); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetExclude sets the exclusion filter of all readers which support it.
+// See DeviceAdapter.SetExclude for the details.
+func (a *MultiDeviceAdapter) SetExclude(exclude string) error {
+	for _, name := range a.names {
+		reader, ok := a.readers[name].(interface{ SetExclude(string) error })
+		if !ok {
+			continue
+		}
+		if err := reader.SetExclude(exclude); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Readers returns the reader adapters of the devices by its name.
+func (a *MultiDeviceAdapter) Readers() map[string]goul.Adapter {
+	readers := map[string]goul.Adapter{}
+	for name, reader := range a.readers {
+		readers[name] = reader
+	}
+	return readers
+}
+
+// Close implements Adapter: it closes all readers.
+func (a *MultiDeviceAdapter) Close() error {
+	goul.Log(a.GetLogger(), a.ID, "cleanup...")
+	var err error
+	for _, name := range a.names {
+		if cerr := a.readers[name].Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+func (a *MultiDeviceAdapter) closeCtrls() {
+	for _, ch := range a.ctrls {
+		close(ch)
+	}
+	a.ctrls = nil
+}
+
+//** demultiplexer --------------------------------------------------
+
+// DemuxAdapter is a writer adapter that dispatches the items to writers
+// by the interface annotation of the items. The items without the
+// annotation or with unknown interface are written by the default writer.
+type DemuxAdapter struct {
+	goul.Adapter
+	ID       string
+	err      error
+	fallback goul.Adapter
+	names    []string
+	writers  map[string]goul.Adapter
+
+	ins   map[goul.Adapter]chan goul.Item
+	dones []chan goul.Item
+}
+
+// Write implements interface Adapter
+func (a *DemuxAdapter) Write(in chan goul.Item, message goul.Message) (chan goul.Item, error) {
+	if a.fallback == nil {
+		a.err = errors.New(ErrDemuxNoWriter)
+		return nil, a.err
+	}
+
+	a.ins = map[goul.Adapter]chan goul.Item{}
+	a.dones = []chan goul.Item{}
+	for _, writer := range append([]goul.Adapter{a.fallback}, a.writerList()...) {
+		if _, ok := a.ins[writer]; ok { // shared writer
+			continue
+		}
+		writer.SetLogger(a.GetLogger())
+		ch := make(chan goul.Item, goul.ChannelSize)
+		done, err := writer.Write(ch, message)
+		if err != nil {
+			a.err = err
+			a.SetError(err)
+			goul.Error(a.GetLogger(), a.ID, "couldn't start writer: %v", err)
+			close(ch)
+			a.closeIns()
+			return nil, err
+		}
+		a.ins[writer] = ch
+		a.dones = append(a.dones, done)
+	}
+	return goul.Launch(a.dispatcher, in, message)
+}
+
+// dispatcher dispatches the items to the writers and waits for them.
+func (a *DemuxAdapter) dispatcher(in, out chan goul.Item, message goul.Message) {
+	defer close(out)
+	defer goul.Log(a.GetLogger(), a.ID, "exit")
+
+	goul.Log(a.GetLogger(), a.ID, "dispatcher in looping... (%v writers)", len(a.dones))
+	for item := range in {
+		writer, ok := a.writers[goul.AnnotationsOf(item)[goul.AnnotationInterface]]
+		if !ok {
+			writer = a.fallback
+		}
+		a.ins[writer] <- item
+	}
+	goul.Log(a.GetLogger(), a.ID, "channel closed")
+	a.closeIns()
+	for _, done := range a.dones {
+		for range done {
+		}
+	}
+	out <- goul.Messages["closed"]
+}
+
+// NewDemux returns new demux adapter with the default writer.
+func NewDemux(fallback goul.Adapter) (*DemuxAdapter, error) {
+	a := &DemuxAdapter{
+		Adapter:  &goul.BaseAdapter{},
+		ID:       defaultDemuxAdapterID,
+		fallback: fallback,
+		writers:  map[string]goul.Adapter{},
+	}
+	return a, nil
+}
+
+// Add adds the writer for the interface name. A writer can be added for
+// several interfaces.
+func (a *DemuxAdapter) Add(name string, writer goul.Adapter) error {
+	if _, ok := a.writers[name]; ok {
+		a.err = errors.New(ErrMultiDeviceDuplicate)
+		return a.err
+	}
+	a.names = append(a.names, name)
+	a.writers[name] = writer
+	return nil
+}
+
+// Close implements Adapter: it closes all writers once.
+func (a *DemuxAdapter) Close() error {
+	goul.Log(a.GetLogger(), a.ID, "cleanup...")
+	closed := map[goul.Adapter]bool{}
+	var err error
+	for _, writer := range append([]goul.Adapter{a.fallback}, a.writerList()...) {
+		if writer == nil || closed[writer] {
+			continue
+		}
+		closed[writer] = true
+		if cerr := writer.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+func (a *DemuxAdapter) closeIns() {
+	for _, ch := range a.ins {
+		close(ch)
+	}
+	a.ins = nil
+}
+
+func (a *DemuxAdapter) writerList() []goul.Adapter {
+	writers := []goul.Adapter{}
+	for _, name := range a.names {
+		writers = append(writers, a.writers[name])
+	}
+	return writers
+}
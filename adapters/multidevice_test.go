@@ -0,0 +1,158 @@
+package adapters_test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/stretchr/testify/require"
+
+	"github.com/hyeoncheon/goul"
+	"github.com/hyeoncheon/goul/adapters"
+	. "github.com/hyeoncheon/goul/testing"
+)
+
+func Test_MultiDevice_10_Merge(t *testing.T) {
+	r := require.New(t)
+	dir := t.TempDir()
+
+	multi, err := adapters.NewMultiDevice()
+	r.NoError(err)
+	for _, name := range []string{"wan", "lan"} {
+		path := filepath.Join(dir, name+".pcap")
+		writeTestFile(r, path, false, 3, time.Millisecond)
+		reader, _ := adapters.NewPcapFile(path)
+		r.NoError(multi.Add(name, reader))
+	}
+	r.EqualError(multi.Add("lan", &goul.BaseAdapter{}), adapters.ErrMultiDeviceDuplicate)
+	r.Equal(2, len(multi.Readers()))
+
+	router := &goul.BaseRouter{}
+	router.SetLogger(goul.NewLogger("debug"))
+	router.SetReader(multi)
+	router.SetWriter(&GeneratorAdapter{ID: "  --MW", Adapter: &goul.BaseAdapter{}})
+	control, out, err := router.Run()
+	r.NoError(err)
+
+	counts := map[string]int{}
+	for item := range out { // closed when all files are done
+		counts[goul.AnnotationsOf(item)[goul.AnnotationInterface]]++
+	}
+	r.Equal(map[string]int{"wan": 3, "lan": 3}, counts)
+	close(control)
+	r.NoError(multi.Close())
+}
+
+func Test_MultiDevice_20_Exceptions(t *testing.T) {
+	r := require.New(t)
+
+	multi, _ := adapters.NewMultiDevice()
+	_, err := multi.Read(make(chan goul.Item), nil)
+	r.EqualError(err, adapters.ErrMultiDeviceNoReader)
+
+	_, err = multi.AddDevice("lo", "port 80", true)
+	r.NoError(err)
+	_, err = multi.AddDevice("lo", "", true)
+	r.EqualError(err, adapters.ErrMultiDeviceDuplicate)
+
+	reader, _ := adapters.NewPcapFile("/not/exist.pcap")
+	r.NoError(multi.Add("file", reader))
+	_, err = multi.Read(make(chan goul.Item), nil)
+	r.Error(err)
+	r.NoError(multi.Close())
+
+	demux, _ := adapters.NewDemux(nil)
+	_, err = demux.Write(make(chan goul.Item), nil)
+	r.EqualError(err, adapters.ErrDemuxNoWriter)
+}
+
+func Test_Demux_10_Dispatch(t *testing.T) {
+	r := require.New(t)
+
+	buffers := []*bytes.Buffer{{}, {}}
+	fallback, _ := adapters.NewPcapStream(nil, buffers[0])
+	wan, _ := adapters.NewPcapStream(nil, buffers[1])
+	demux, err := adapters.NewDemux(fallback)
+	r.NoError(err)
+	r.NoError(demux.Add("wan", wan))
+	r.NoError(demux.Add("dmz", wan)) // shared writer
+	r.EqualError(demux.Add("wan", fallback), adapters.ErrMultiDeviceDuplicate)
+
+	in := make(chan goul.Item)
+	done, err := demux.Write(in, nil)
+	r.NoError(err)
+	for _, name := range []string{"wan", "lan", "", "dmz", "wan"} {
+		packet, _ := GeneratePacket("DD")
+		if name != "" {
+			goul.Annotate(packet, goul.AnnotationInterface, name)
+		}
+		in <- packet
+	}
+	close(in)
+	r.Equal("message", (<-done).String())
+	r.NoError(demux.Close())
+
+	counts := []int{}
+	for _, buffer := range buffers {
+		pr, err := pcapgo.NewReader(buffer)
+		r.NoError(err)
+		count := 0
+		for {
+			if _, _, err := pr.ReadPacketData(); err != nil {
+				break
+			}
+			count++
+		}
+		counts = append(counts, count)
+	}
+	r.Equal([]int{2, 3}, counts)
+}
+
+func Test_Demux_20_PcapNgInterfaces(t *testing.T) {
+	r := require.New(t)
+	path := filepath.Join(t.TempDir(), "multi.pcapng")
+
+	writer, _ := adapters.NewPcapNgFile(path)
+	in := make(chan goul.Item)
+	done, err := writer.Write(in, nil)
+	r.NoError(err)
+
+	session := &adapters.Session{Hostname: "fw", Device: "wan,lan", LinkType: layers.LinkTypeEthernet, SnapLen: 1600}
+	for _, name := range []string{"wan", "lan", "wan", ""} {
+		packet, _ := GeneratePacket("DD")
+		md := packet.Metadata()
+		md.AncillaryData = append(md.AncillaryData, session)
+		if name != "" {
+			goul.Annotate(packet, goul.AnnotationInterface, name)
+		}
+		in <- packet
+	}
+	close(in)
+	<-done
+	r.NoError(writer.Close())
+
+	f, err := os.Open(path)
+	r.NoError(err)
+	defer f.Close()
+	ng, err := pcapgo.NewNgReader(f, pcapgo.DefaultNgReaderOptions)
+	r.NoError(err)
+	indexes := []int{}
+	for {
+		_, ci, err := ng.ReadPacketData()
+		if err != nil {
+			break
+		}
+		indexes = append(indexes, ci.InterfaceIndex)
+	}
+	r.Equal([]int{1, 2, 1, 3}, indexes)
+	names := []string{}
+	for i := 1; i < ng.NInterfaces(); i++ {
+		intf, _ := ng.Interface(i)
+		names = append(names, intf.Name)
+	}
+	r.Equal([]string{"fw:wan", "fw:lan", "fw:wan,lan"}, names)
+}
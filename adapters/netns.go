@@ -0,0 +1,96 @@
+//go:build linux
+// +build linux
+
+package adapters
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// constants...
+const (
+	netnsRunDir = "/var/run/netns"
+
+	ErrInvalidNetns = "invalid network namespace"
+)
+
+// netnsPath returns the path of the network namespace. The name without
+// a slash is a name of `ip netns` and it is found in /var/run/netns. The
+// path should be a namespace file of nsfs, such as `/proc/<pid>/ns/net`.
+// Other files, even on procfs, are rejected.
+func netnsPath(netns string) (string, error) {
+	if netns == "" {
+		return "", nil
+	}
+	if !strings.Contains(netns, "/") {
+		netns = filepath.Join(netnsRunDir, netns)
+	}
+	ns, err := os.Open(netns)
+	if err != nil {
+		return "", err
+	}
+	defer ns.Close()
+
+	var stat unix.Statfs_t
+	if err := unix.Fstatfs(int(ns.Fd()), &stat); err != nil {
+		return "", err
+	}
+	if stat.Type != unix.NSFS_MAGIC {
+		return "", errors.New(ErrInvalidNetns)
+	}
+	return netns, nil
+}
+
+// inNetns runs fn in the network namespace of the path. Since the
+// namespace is an attribute of the thread, fn runs on a dedicated goroutine
+// locked on its OS thread, and the caller waits for it. Sockets opened in
+// fn stay in the namespace, so they can be used from any goroutine.
+func inNetns(path string, fn func() error) error {
+	if path == "" {
+		return fn()
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		runtime.LockOSThread()
+		done <- runInNetns(path, fn)
+	}()
+	return <-done
+}
+
+// runInNetns switches the locked thread of the goroutine into the network
+// namespace and runs fn. The thread is unlocked only if it goes back to
+// the original namespace. Otherwise it is left locked and thrown away when
+// the goroutine exits, so no other goroutine runs in the namespace.
+func runInNetns(path string, fn func() error) error {
+	origin, err := os.Open(fmt.Sprintf("/proc/self/task/%d/ns/net", unix.Gettid()))
+	if err != nil {
+		runtime.UnlockOSThread()
+		return err
+	}
+	defer origin.Close()
+	target, err := os.Open(path)
+	if err != nil {
+		runtime.UnlockOSThread()
+		return err
+	}
+	defer target.Close()
+
+	if err := unix.Setns(int(target.Fd()), unix.CLONE_NEWNET); err != nil {
+		runtime.UnlockOSThread()
+		return err
+	}
+	defer func() {
+		if unix.Setns(int(origin.Fd()), unix.CLONE_NEWNET) == nil {
+			runtime.UnlockOSThread()
+		}
+	}()
+	return fn()
+}
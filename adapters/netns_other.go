@@ -0,0 +1,24 @@
+//go:build !linux
+// +build !linux
+
+package adapters
+
+import "errors"
+
+// constants...
+const (
+	ErrNetnsNotSupported = "network namespace is supported on linux only"
+)
+
+// netnsPath returns an error since network namespace is not supported.
+func netnsPath(netns string) (string, error) {
+	if netns == "" {
+		return "", nil
+	}
+	return "", errors.New(ErrNetnsNotSupported)
+}
+
+// inNetns just runs fn since there is no network namespace.
+func inNetns(path string, fn func() error) error {
+	return fn()
+}
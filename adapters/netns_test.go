@@ -0,0 +1,98 @@
+//go:build linux
+// +build linux
+
+package adapters_test
+
+import (
+	"net"
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/stretchr/testify/require"
+
+	"github.com/hyeoncheon/goul"
+	"github.com/hyeoncheon/goul/adapters"
+)
+
+// setupNetns creates a network namespace with a veth pair, goulveth0 on the
+// host and goulveth1 in the namespace. It returns the cleanup function.
+func setupNetns(t *testing.T, name string) func() {
+	cleanup := func() {
+		exec.Command("ip", "netns", "del", name).Run()
+		exec.Command("ip", "link", "del", "goulveth0").Run()
+	}
+	commands := [][]string{
+		{"ip", "netns", "add", name},
+		{"ip", "link", "add", "goulveth0", "type", "veth", "peer", "name", "goulveth1"},
+		{"ip", "link", "set", "goulveth1", "netns", name},
+		{"ip", "addr", "add", "10.254.1.1/30", "dev", "goulveth0"},
+		{"ip", "link", "set", "goulveth0", "up"},
+		{"ip", "netns", "exec", name, "ip", "addr", "add", "10.254.1.2/30", "dev", "goulveth1"},
+		{"ip", "netns", "exec", name, "ip", "link", "set", "goulveth1", "up"},
+	}
+	for _, command := range commands {
+		if out, err := exec.Command(command[0], command[1:]...).CombinedOutput(); err != nil {
+			cleanup()
+			t.Skipf("couldn't setup network namespace: %v: %s", err, out)
+		}
+	}
+	return cleanup
+}
+
+func Test_DeviceAdapter_9_Netns(t *testing.T) {
+	r := require.New(t)
+
+	_, err := adapters.NewDeviceInNetns("lo", "/proc/self/ns/net", false)
+	r.NoError(err)
+	_, err = adapters.NewDeviceInNetns("lo", "/etc/hostname", false)
+	r.EqualError(err, adapters.ErrInvalidNetns)
+	_, err = adapters.NewDeviceInNetns("lo", "/proc/self/status", false)
+	r.EqualError(err, adapters.ErrInvalidNetns) // procfs but not a namespace
+	_, err = adapters.NewDeviceInNetns("lo", "goulnone", false)
+	r.Error(err)
+
+	defer setupNetns(t, "goultest")()
+
+	_, err = net.InterfaceByName("goulveth1")
+	r.Error(err) // not in the host namespace
+	adapter, err := adapters.NewDeviceInNetns("goulveth1", "goultest", false)
+	r.NoError(err)
+	defer adapter.Close()
+	r.NoError(adapter.SetFilter("udp"))
+
+	ctrl := make(chan goul.Item)
+	out, err := adapter.Read(ctrl, nil)
+	if err != nil {
+		t.Skipf("couldn't capture in the namespace: %v", adapter.GetError())
+	}
+	defer func() {
+		close(ctrl)
+		for range out {
+		}
+	}()
+
+	conn, err := net.Dial("udp", "10.254.1.2:6304")
+	r.NoError(err)
+	defer conn.Close()
+	go func() {
+		for i := 0; i < 20; i++ {
+			conn.Write([]byte("NetnsData"))
+			time.Sleep(50 * time.Millisecond)
+		}
+	}()
+
+	found := false
+	timeout := time.After(3 * time.Second)
+	for !found {
+		select {
+		case item := <-out:
+			if app := item.(gopacket.Packet).ApplicationLayer(); app != nil {
+				found = string(app.Payload()) == "NetnsData"
+			}
+		case <-timeout:
+			r.Fail("no packet captured in the namespace")
+		}
+	}
+}
@@ -3,9 +3,15 @@ package adapters
 import (
 	"bufio"
 	"encoding/binary"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
 	"net"
+	"os"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/gopacket"
@@ -20,8 +26,81 @@ const (
 	ErrNetworkReaderNotSupported = "reader not supported for client"
 	ErrNetworkReadHeader         = "could not read header from network"
 	ErrNetworkReadChunk          = "could not read chunk from network"
+	ErrNetworkReadFrame          = "could not read control frame from network"
 )
 
+// control frames. A control frame starts with zero size header followed
+// by 1 byte kind, 2 bytes length and the payload of the length. Since the
+// size of a data frame cannot be zero, the receiver can distinguish them.
+//
+// The hello frame is sent by the receiver as soon as it accepts the
+// connection. The legacy receiver sends nothing, so the capturer which
+// does not get the hello within handshakeTimeout falls back to the legacy
+// framing, which has data frames only. Otherwise, the session frame is
+// sent once at the beginning of the connection, and the meta frame is sent
+// before a data frame only if the data has annotations, was truncated, or
+// the receiver asked for the original timestamps.
+//
+// After the hello, the receiver sends only control frames to the capturer,
+// each of them carries a control item such as a new capture filter.
+const (
+	frameSession   = 1
+	frameMeta      = 2
+	frameHello     = 3
+	frameControl   = 4
+	frameMetaFixed = 12 // timestamp(8), length(4)
+
+	protocolVersion  = 1
+	handshakeTimeout = 1 * time.Second
+	controlTimeout   = 1 * time.Second
+)
+
+// hello is the payload of the hello frame.
+type hello struct {
+	Version    int  `json:"version"`
+	Timestamps bool `json:"timestamps"`
+}
+
+// control is the payload of the control frame.
+type control struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+// Session is an information of the capturer connected to the receiver.
+// The receiver attaches it to each packet from the connection so writers
+// can distinguish the source of the packet.
+type Session struct {
+	ID       int             `json:"-"`
+	Remote   string          `json:"-"`
+	Hostname string          `json:"hostname"`
+	Device   string          `json:"device"`
+	LinkType layers.LinkType `json:"link_type"`
+	SnapLen  int             `json:"snaplen"`
+	closed   int32
+}
+
+// Closed returns true if the connection of the session is closed. Writers
+// can release the resources of the session after it.
+func (s *Session) Closed() bool {
+	return atomic.LoadInt32(&s.closed) == 1
+}
+
+// SessionOf returns the session of the packet item received from network
+// adapter. It returns nil if the item has no session.
+func SessionOf(item goul.Item) *Session {
+	p, ok := item.(gopacket.Packet)
+	if !ok || p.Metadata() == nil {
+		return nil
+	}
+	for _, data := range p.Metadata().AncillaryData {
+		if session, ok := data.(*Session); ok {
+			return session
+		}
+	}
+	return nil
+}
+
 // NetworkAdapter is normal mode networking adapter.
 type NetworkAdapter struct {
 	goul.Adapter
@@ -30,6 +109,15 @@ type NetworkAdapter struct {
 	address  string
 	isServer bool
 	listener *net.TCPListener
+	source   Session
+	sessions int
+
+	timestamps bool
+	conns      map[int]net.Conn
+	mutex      sync.Mutex
+
+	connectHandler func(local, remote net.Addr)
+	controlHandler func(item goul.Item)
 }
 
 // Read implements interface Adapter
@@ -57,6 +145,9 @@ func (a *NetworkAdapter) Write(in chan goul.Item, message goul.Message) (chan go
 			a.err = err
 			return nil, a.err
 		}
+		if a.connectHandler != nil {
+			a.connectHandler(conn.LocalAddr(), conn.RemoteAddr())
+		}
 		go a.writer(in, done, conn)
 	} else {
 		return nil, errors.New(ErrNetworkWriterNotSupported)
@@ -65,11 +156,24 @@ func (a *NetworkAdapter) Write(in chan goul.Item, message goul.Message) (chan go
 }
 
 // complex, non-blocking loop over the input channel.
-func (a *NetworkAdapter) reader(ctrl, out chan goul.Item, conn *net.TCPConn) {
+func (a *NetworkAdapter) reader(ctrl, out chan goul.Item, conn *net.TCPConn, session *Session) {
 	defer goul.Log(a.GetLogger(), a.ID+"-rcv", "exit")
 	defer conn.Close()
 
 	goul.Log(a.GetLogger(), a.ID+"-rcv", "reader in looping...")
+	payload, _ := json.Marshal(&hello{Version: protocolVersion, Timestamps: a.timestamps})
+	a.mutex.Lock()
+	if err := writeFrame(conn, frameHello, payload); err != nil {
+		goul.Log(a.GetLogger(), a.ID+"-rcv", "oops! couldn't write hello: %v", err)
+	}
+	a.conns[session.ID] = conn
+	a.mutex.Unlock()
+	defer func() {
+		a.mutex.Lock()
+		delete(a.conns, session.ID)
+		a.mutex.Unlock()
+		atomic.StoreInt32(&session.closed, 1)
+	}()
 	buffer := bufio.NewReader(conn)
 	conn.SetReadDeadline(time.Now().Add(1 * time.Second))
 
@@ -83,6 +187,7 @@ func (a *NetworkAdapter) reader(ctrl, out chan goul.Item, conn *net.TCPConn) {
 	var data []byte
 	var cnt int
 	var packet gopacket.Packet
+	var meta []byte
 	for {
 		for i = 0; i < 2; {
 			header[i], err = buffer.ReadByte()
@@ -100,6 +205,25 @@ func (a *NetworkAdapter) reader(ctrl, out chan goul.Item, conn *net.TCPConn) {
 			}
 		}
 		size = binary.BigEndian.Uint16(header[:])
+		if size == 0 {
+			kind, payload, err := readFrame(buffer, conn)
+			if err != nil {
+				a.SetError(errors.New(ErrNetworkReadFrame))
+				goul.Log(a.GetLogger(), a.ID+"-rcv", "oops! couldn't read frame: %v", err)
+				return
+			}
+			switch kind {
+			case frameSession:
+				if err = json.Unmarshal(payload, session); err != nil {
+					goul.Log(a.GetLogger(), a.ID+"-rcv", "invalid session frame: %v", err)
+					continue
+				}
+				goul.Log(a.GetLogger(), a.ID+"-rcv", "session %v: %v/%v from %v", session.ID, session.Hostname, session.Device, session.Remote)
+			case frameMeta:
+				meta = payload
+			}
+			continue
+		}
 
 		data = []byte{}
 		remind = int(size)
@@ -137,8 +261,10 @@ func (a *NetworkAdapter) reader(ctrl, out chan goul.Item, conn *net.TCPConn) {
 		// am I need autodetection? or just let pipeline do it?
 		// TODO: This code does not work properly. gzip also treated as packet.
 		// TODO: Please add mime type in header or just remove all pipes.
-		packet = gopacket.NewPacket(data, layers.LayerTypeEthernet, gopacket.Default)
+		packet = gopacket.NewPacket(data, session.LinkType, gopacket.Default)
 		if packet != nil {
+			a.setMeta(packet, session, meta)
+			meta = nil
 			out <- packet
 		} else {
 			out <- &goul.ItemGeneric{Meta: goul.ItemTypeUnknown, DATA: data}
@@ -156,8 +282,30 @@ func (a *NetworkAdapter) writer(in, done chan goul.Item, conn net.Conn) {
 	header := make([]byte, 2)
 	buffer := bufio.NewWriter(conn)
 
+	peer := handshake(conn)
+	if peer.Version > 0 {
+		go a.controller(conn)
+	}
+	if peer.Version == 0 {
+		goul.Log(a.GetLogger(), a.ID+"-snd", "legacy receiver, sending data frames only")
+	} else if payload, err := json.Marshal(&a.source); err != nil {
+		goul.Log(a.GetLogger(), a.ID+"-snd", "oops! couldn't encode session: %v", err)
+	} else if err = writeFrame(conn, frameSession, payload); err != nil {
+		goul.Log(a.GetLogger(), a.ID+"-snd", "oops! couldn't write session: %v", err)
+		a.SetError(errors.New("ErrNetAdapterWriteError"))
+		return
+	}
+
 	goul.Log(a.GetLogger(), a.ID+"-snd", "writer in looping...")
 	for item := range in {
+		if peer.Version > 0 && (peer.Timestamps || needMeta(item)) {
+			if err := writeFrame(buffer, frameMeta, encodeMeta(item)); err != nil {
+				goul.Log(a.GetLogger(), a.ID+"-snd", "oops! couldn't write meta: %v", err)
+				a.SetError(errors.New("ErrNetAdapterWriteError"))
+				return
+			}
+		}
+
 		data := item.Data()
 		size := len(data)
 		binary.BigEndian.PutUint16(header, uint16(size))
@@ -184,15 +332,78 @@ func (a *NetworkAdapter) writer(in, done chan goul.Item, conn net.Conn) {
 
 // NewNetwork ...
 func NewNetwork(addr string, port int) (*NetworkAdapter, error) {
+	hostname, _ := os.Hostname()
 	a := &NetworkAdapter{
 		Adapter:  &goul.BaseAdapter{},
 		ID:       "net",
 		address:  addr + ":" + strconv.Itoa(port),
 		isServer: addr == "",
+		source: Session{
+			Hostname: hostname,
+			LinkType: layers.LinkTypeEthernet,
+			SnapLen:  defaultSnapLen,
+		},
+		conns: map[int]net.Conn{},
 	}
 	return a, nil
 }
 
+// SetSource sets the information of the capturing source which is sent
+// to the receiver at the beginning of the session.
+func (a *NetworkAdapter) SetSource(device string, linkType layers.LinkType, snaplen int) error {
+	a.source.Device = device
+	a.source.LinkType = linkType
+	a.source.SnapLen = snaplen
+	return nil
+}
+
+// SetTimestamps sets whether the receiver asks the capturers to send the
+// original timestamps of the packets. It costs a meta frame per packet,
+// so it should be set only if the writer keeps the timestamps, such as a
+// pcap file writer. Otherwise the packets are stamped on arrival.
+func (a *NetworkAdapter) SetTimestamps(timestamps bool) error {
+	a.timestamps = timestamps
+	return nil
+}
+
+// SetConnectHandler sets the handler which is called with the addresses of
+// the connection whenever the client connects to the receiver. It can be
+// used to exclude the connection from the capture.
+func (a *NetworkAdapter) SetConnectHandler(handler func(local, remote net.Addr)) error {
+	a.connectHandler = handler
+	return nil
+}
+
+// SetControlHandler sets the handler which is called with the control item
+// whenever the client gets a control frame from the receiver.
+func (a *NetworkAdapter) SetControlHandler(handler func(item goul.Item)) error {
+	a.controlHandler = handler
+	return nil
+}
+
+// SendControl sends the control item to all capturers connected to the
+// receiver, such as a filter item to narrow down the traffic. It returns
+// the number of sessions the item was sent to. The legacy capturers just
+// ignore it since they never read from the connection.
+func (a *NetworkAdapter) SendControl(item goul.Item) int {
+	payload, err := json.Marshal(&control{Type: item.String(), Value: string(item.Data())})
+	if err != nil {
+		return 0
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	count := 0
+	for id, conn := range a.conns {
+		conn.SetWriteDeadline(time.Now().Add(controlTimeout))
+		if err := writeFrame(conn, frameControl, payload); err != nil {
+			goul.Log(a.GetLogger(), a.ID, "couldn't send %v to session %v: %v", item.String(), id, err)
+			continue
+		}
+		count++
+	}
+	return count
+}
+
 // Close implements Adapter:
 func (a *NetworkAdapter) Close() error {
 	goul.Log(a.GetLogger(), a.ID, "cleanup...")
@@ -226,7 +437,13 @@ func (a *NetworkAdapter) listen(in, out chan goul.Item) {
 			conn, err := a.listener.AcceptTCP()
 			if err == nil {
 				goul.Log(a.GetLogger(), a.ID+"-listener", "connected from %v", conn.RemoteAddr())
-				go a.reader(in, out, conn)
+				a.sessions++
+				session := &Session{
+					ID:       a.sessions,
+					Remote:   conn.RemoteAddr().String(),
+					LinkType: layers.LinkTypeEthernet,
+				}
+				go a.reader(in, out, conn, session)
 			} else {
 				if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
 					continue
@@ -238,3 +455,154 @@ func (a *NetworkAdapter) listen(in, out chan goul.Item) {
 		}
 	}
 }
+
+// setMeta sets capture information, session and annotations to the packet
+// based on the meta frame received before the packet.
+func (a *NetworkAdapter) setMeta(packet gopacket.Packet, session *Session, meta []byte) {
+	md := packet.Metadata()
+	md.CaptureLength = len(packet.Data())
+	md.Length = len(packet.Data())
+	md.AncillaryData = append(md.AncillaryData, session)
+	if len(meta) < frameMetaFixed {
+		md.Timestamp = time.Now()
+		return
+	}
+
+	md.Timestamp = time.Unix(0, int64(binary.BigEndian.Uint64(meta[0:8])))
+	if length := int(binary.BigEndian.Uint32(meta[8:12])); length > md.Length {
+		md.Length = length
+	}
+
+	if len(meta) > frameMetaFixed {
+		annotations := goul.Annotations{}
+		if err := json.Unmarshal(meta[frameMetaFixed:], &annotations); err != nil {
+			goul.Log(a.GetLogger(), a.ID+"-rcv", "invalid annotations: %v", err)
+			return
+		}
+		for key, value := range annotations {
+			goul.Annotate(packet, key, value)
+		}
+	}
+}
+
+// needMeta returns true if the item has information which cannot be sent
+// without the meta frame, annotations or the original length.
+func needMeta(item goul.Item) bool {
+	if len(goul.AnnotationsOf(item)) > 0 {
+		return true
+	}
+	ci, _ := captureInfo(item, 0)
+	return ci.Length != len(item.Data())
+}
+
+// encodeMeta returns the payload of the meta frame for the item.
+func encodeMeta(item goul.Item) []byte {
+	ci, _ := captureInfo(item, 0)
+	meta := make([]byte, frameMetaFixed)
+	binary.BigEndian.PutUint64(meta[0:8], uint64(ci.Timestamp.UnixNano()))
+	binary.BigEndian.PutUint32(meta[8:12], uint32(ci.Length))
+	if annotations := goul.AnnotationsOf(item); len(annotations) > 0 {
+		if data, err := json.Marshal(annotations); err == nil {
+			meta = append(meta, data...)
+		}
+	}
+	return meta
+}
+
+// writeFrame writes a control frame into the writer at once.
+func writeFrame(w io.Writer, kind byte, payload []byte) error {
+	if len(payload) > 0xFFFF {
+		return fmt.Errorf("frame too large: %v", len(payload))
+	}
+	frame := make([]byte, 5, 5+len(payload))
+	frame[2] = kind
+	binary.BigEndian.PutUint16(frame[3:5], uint16(len(payload)))
+	_, err := w.Write(append(frame, payload...))
+	return err
+}
+
+// controller reads the control frames from the receiver and passes their
+// items to the control handler. It exits when the connection is closed.
+func (a *NetworkAdapter) controller(conn net.Conn) {
+	defer goul.Log(a.GetLogger(), a.ID+"-ctl", "exit")
+
+	buffer := bufio.NewReader(conn)
+	header := make([]byte, 5)
+	for {
+		if _, err := io.ReadFull(buffer, header); err != nil {
+			return
+		}
+		payload := make([]byte, binary.BigEndian.Uint16(header[3:5]))
+		if _, err := io.ReadFull(buffer, payload); err != nil {
+			return
+		}
+		if header[0] != 0 || header[1] != 0 || header[2] != frameControl {
+			goul.Log(a.GetLogger(), a.ID+"-ctl", "unexpected frame %v from receiver", header[2])
+			continue
+		}
+		c := control{}
+		if err := json.Unmarshal(payload, &c); err != nil {
+			goul.Log(a.GetLogger(), a.ID+"-ctl", "invalid control frame: %v", err)
+			continue
+		}
+		goul.Log(a.GetLogger(), a.ID+"-ctl", "control %v <%v> from receiver", c.Type, c.Value)
+		if a.controlHandler != nil {
+			a.controlHandler(&goul.ItemGeneric{Meta: c.Type, DATA: []byte(c.Value)})
+		}
+	}
+}
+
+// handshake waits for the hello frame of the receiver. The legacy receiver
+// never sends it, so zero value is returned on timeout and the caller
+// should fall back to the legacy framing.
+func handshake(conn net.Conn) hello {
+	peer := hello{}
+	conn.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return hello{}
+	}
+	if header[0] != 0 || header[1] != 0 || header[2] != frameHello {
+		return hello{}
+	}
+	payload := make([]byte, binary.BigEndian.Uint16(header[3:5]))
+	if _, err := io.ReadFull(conn, payload); err != nil {
+		return hello{}
+	}
+	if err := json.Unmarshal(payload, &peer); err != nil {
+		return hello{}
+	}
+	return peer
+}
+
+// readFrame reads a control frame after zero size header.
+func readFrame(buffer *bufio.Reader, conn *net.TCPConn) (byte, []byte, error) {
+	header := make([]byte, 3)
+	if err := readFull(buffer, conn, header); err != nil {
+		return 0, nil, err
+	}
+	payload := make([]byte, binary.BigEndian.Uint16(header[1:3]))
+	if err := readFull(buffer, conn, payload); err != nil {
+		return 0, nil, err
+	}
+	return header[0], payload, nil
+}
+
+// readFull reads exactly len(data) bytes. It extends read deadline of the
+// connection on timeout as the reader does.
+func readFull(buffer *bufio.Reader, conn *net.TCPConn, data []byte) error {
+	for i := 0; i < len(data); {
+		cnt, err := buffer.Read(data[i:])
+		i += cnt
+		if err != nil {
+			if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+				conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+				continue
+			}
+			return err
+		}
+	}
+	return nil
+}
@@ -1,6 +1,9 @@
 package adapters_test
 
 import (
+	"encoding/binary"
+	"io"
+	"net"
 	"sync"
 	"testing"
 	"time"
@@ -158,6 +161,203 @@ func Test_Network_23_Respawn(t *testing.T) {
 	<-d
 }
 
+func Test_Network_30_Metadata(t *testing.T) {
+	r := require.New(t)
+
+	reader, err := adapters.NewNetwork("", 6007)
+	r.NoError(err)
+	server := &goul.BaseRouter{}
+	server.SetReader(reader)
+	server.SetWriter(&GeneratorAdapter{ID: "  --SW", Adapter: &goul.BaseAdapter{}})
+	control, out, err := server.Run()
+	r.NoError(err)
+	defer reader.Close()
+
+	conn, err := net.Dial("tcp", "localhost:6007")
+	r.NoError(err)
+	defer conn.Close()
+
+	frame := func(kind byte, payload []byte) []byte {
+		header := []byte{0, 0, kind, 0, 0}
+		binary.BigEndian.PutUint16(header[3:], uint16(len(payload)))
+		return append(header, payload...)
+	}
+	meta := func(ts time.Time, annotations string) []byte {
+		payload := make([]byte, 12)
+		binary.BigEndian.PutUint64(payload[0:8], uint64(ts.UnixNano()))
+		binary.BigEndian.PutUint32(payload[8:12], 1000)
+		return frame(2, append(payload, annotations...))
+	}
+	data := func(packet gopacket.Packet) []byte {
+		header := []byte{0, 0}
+		binary.BigEndian.PutUint16(header, uint16(len(packet.Data())))
+		return append(header, packet.Data()...)
+	}
+
+	ts := time.Unix(1600000000, 123456789)
+	packet, _ := GeneratePacket("MD1")
+	_, err = conn.Write(frame(1, []byte(`{"hostname":"box","device":"eth7","link_type":1,"snaplen":1500}`)))
+	r.NoError(err)
+	_, err = conn.Write(append(meta(ts, `{"comment":"first"}`), data(packet)...))
+	r.NoError(err)
+	_, err = conn.Write(append(meta(ts, ""), data(packet)...))
+	r.NoError(err)
+
+	item := <-out
+	r.NoError(CheckPacket(item, "MD1"))
+	md := item.(gopacket.Packet).Metadata()
+	r.True(ts.Equal(md.Timestamp))
+	r.Equal(1000, md.Length)
+	r.Equal("first", goul.AnnotationsOf(item)[goul.AnnotationComment])
+	session := adapters.SessionOf(item)
+	r.NotNil(session)
+	r.Equal("box", session.Hostname)
+	r.Equal("eth7", session.Device)
+	r.Equal(1500, session.SnapLen)
+
+	item = <-out
+	r.Empty(goul.AnnotationsOf(item))
+	r.Equal(session, adapters.SessionOf(item))
+
+	close(control)
+	<-out
+}
+
+func Test_Network_40_ConnectHandler(t *testing.T) {
+	r := require.New(t)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:6008")
+	r.NoError(err)
+	defer listener.Close()
+
+	writer, err := adapters.NewNetwork("127.0.0.1", 6008)
+	r.NoError(err)
+	var local, remote net.Addr
+	r.NoError(writer.SetConnectHandler(func(l, r net.Addr) {
+		local, remote = l, r
+	}))
+	in := make(chan goul.Item)
+	done, err := writer.Write(in, nil)
+	r.NoError(err)
+	conn, err := listener.Accept()
+	r.NoError(err)
+	defer conn.Close()
+
+	r.Equal(conn.RemoteAddr().String(), local.String())
+	r.Equal("127.0.0.1:6008", remote.String())
+
+	// the listener is a legacy receiver which sends no hello.
+	packet, _ := GeneratePacket("LG1")
+	r.True(goul.Annotate(packet, goul.AnnotationComment, "dropped"))
+	in <- packet
+	data := make([]byte, 2+len(packet.Data()))
+	_, err = io.ReadFull(conn, data)
+	r.NoError(err)
+	r.Equal(uint16(len(packet.Data())), binary.BigEndian.Uint16(data))
+	r.Equal(packet.Data(), data[2:])
+	close(in)
+	<-done
+}
+
+func Test_Network_41_Handshake(t *testing.T) {
+	r := require.New(t)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:6009")
+	r.NoError(err)
+	defer listener.Close()
+
+	writer, err := adapters.NewNetwork("127.0.0.1", 6009)
+	r.NoError(err)
+	in := make(chan goul.Item)
+	done, err := writer.Write(in, nil)
+	r.NoError(err)
+	conn, err := listener.Accept()
+	r.NoError(err)
+	defer conn.Close()
+	_, err = conn.Write([]byte{0, 0, 3, 0, 13, '{', '"', 'v', 'e', 'r', 's', 'i', 'o', 'n', '"', ':', '1', '}'})
+	r.NoError(err)
+
+	readFrame := func() (byte, []byte) {
+		header := make([]byte, 2)
+		_, err := io.ReadFull(conn, header)
+		r.NoError(err)
+		kind := byte(0)
+		if size := binary.BigEndian.Uint16(header); size > 0 {
+			data := make([]byte, size)
+			_, err = io.ReadFull(conn, data)
+			r.NoError(err)
+			return kind, data
+		}
+		header = make([]byte, 3)
+		_, err = io.ReadFull(conn, header)
+		r.NoError(err)
+		payload := make([]byte, binary.BigEndian.Uint16(header[1:]))
+		_, err = io.ReadFull(conn, payload)
+		r.NoError(err)
+		return header[0], payload
+	}
+
+	kind, _ := readFrame()
+	r.Equal(byte(1), kind) // session
+
+	// plain packets are sent without meta frame.
+	packet, _ := GeneratePacket("HS1")
+	in <- packet
+	kind, data := readFrame()
+	r.Equal(byte(0), kind)
+	r.Equal(packet.Data(), data)
+
+	packet, _ = GeneratePacket("HS2")
+	r.True(goul.Annotate(packet, goul.AnnotationComment, "annotated"))
+	in <- packet
+	kind, meta := readFrame()
+	r.Equal(byte(2), kind)
+	r.Contains(string(meta[12:]), "annotated")
+	kind, data = readFrame()
+	r.Equal(byte(0), kind)
+	r.Equal(packet.Data(), data)
+	close(in)
+	<-done
+}
+
+func Test_Network_50_Control(t *testing.T) {
+	r := require.New(t)
+
+	reader, err := adapters.NewNetwork("", 6010)
+	r.NoError(err)
+	server := &goul.BaseRouter{}
+	server.SetReader(reader)
+	server.SetWriter(&GeneratorAdapter{ID: "  --SW", Adapter: &goul.BaseAdapter{}})
+	control0, out, err := server.Run()
+	r.NoError(err)
+	defer reader.Close()
+	r.Equal(0, reader.SendControl(&goul.ItemGeneric{Meta: goul.ItemTypeFilter}))
+
+	writer, err := adapters.NewNetwork("localhost", 6010)
+	r.NoError(err)
+	items := make(chan goul.Item, 1)
+	r.NoError(writer.SetControlHandler(func(item goul.Item) {
+		items <- item
+	}))
+	in := make(chan goul.Item)
+	done, err := writer.Write(in, nil)
+	r.NoError(err)
+
+	// the session is registered when the first packet arrives.
+	packet, _ := GeneratePacket("CT1")
+	in <- packet
+	<-out
+	r.Equal(1, reader.SendControl(&goul.ItemGeneric{Meta: goul.ItemTypeFilter, DATA: []byte("tcp port 443")}))
+	item := <-items
+	r.Equal(goul.ItemTypeFilter, item.String())
+	r.Equal("tcp port 443", string(item.Data()))
+
+	close(in)
+	<-done
+	close(control0)
+	<-out
+}
+
 //** utilities
 
 func debugServer(r *require.Assertions) (control, out chan goul.Item) {
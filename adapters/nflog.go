@@ -0,0 +1,394 @@
+//go:build linux
+// +build linux
+
+package adapters
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"golang.org/x/sys/unix"
+
+	"github.com/hyeoncheon/goul"
+)
+
+// constants...
+const (
+	defaultNflogAdapterID = "nflog"
+	nflogReadTimeout      = 100 * time.Millisecond
+	nflogReceiveBuffer    = 2 * 1024 * 1024
+
+	ErrNflogInvalidGroup = "invalid nflog group, it should be 0 to 65535"
+)
+
+// constants of nfnetlink_log, from linux/netfilter/nfnetlink_log.h
+const (
+	nfulnlMsgPacket = 0
+	nfulnlMsgConfig = 1
+
+	nfulaPacketHdr    = 1
+	nfulaMark         = 2
+	nfulaTimestamp    = 3
+	nfulaIfindexIn    = 4
+	nfulaIfindexOut   = 5
+	nfulaPayload      = 9
+	nfulaPrefix       = 10
+	nfulaHwType       = 15
+	nfulaHwHeader     = 16
+	nfulaCfgCmd       = 1
+	nfulaCfgMode      = 2
+	nfulnlCfgCmdBind  = 1
+	nfulnlCopyPacket  = 2
+	arphrdEther       = 1
+	sizeofNfgenmsg    = 4
+	ethernetHeaderLen = 14
+)
+
+// nativeEndian is the byte order of netlink headers, the host byte order.
+var nativeEndian binary.ByteOrder = binary.LittleEndian
+
+func init() {
+	one := uint16(1)
+	if *(*byte)(unsafe.Pointer(&one)) == 0 {
+		nativeEndian = binary.BigEndian
+	}
+}
+
+// NflogAdapter is a reader adapter that subscribes to an NFLOG group of
+// netfilter over netlink on Linux. With this, iptables or nftables rules
+// can select exactly what to mirror, for example the traffic matching
+// conntrack marks, with a rule like:
+//
+//	iptables -A FORWARD -m connmark --mark 7 -j NFLOG --nflog-group 5
+//
+// Each logged packet is passed as an ethernet packet so the rest of the
+// pipeline and the transport are not changed. If the hardware header is
+// not logged, for example for outgoing packets, an ethernet header with
+// zero addresses is made up. The prefix, the mark and the in/out devices
+// of the log are annotated on the packet.
+type NflogAdapter struct {
+	goul.Adapter
+	ID      string
+	err     error
+	group   uint16
+	snaplen int
+	fd      int
+	devices map[uint32]string
+
+	received uint64
+	overruns uint64
+}
+
+// Read implements interface Adapter
+func (a *NflogAdapter) Read(ctrl chan goul.Item, message goul.Message) (out chan goul.Item, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			fmt.Fprintf(os.Stderr, "NflogAdapter#Read recovered from panic!\n")
+			fmt.Fprintf(os.Stderr, "Probably an inheritance problem of pipeline instance.\n")
+			fmt.Fprintf(os.Stderr, "panic: %v\n", r)
+			err = errors.New("panic")
+		}
+	}()
+
+	if a.err = a.open(); a.err != nil {
+		a.SetError(a.err)
+		goul.Error(a.GetLogger(), a.ID, "%v: %v", ErrCouldNotActivate, a.err)
+		return nil, errors.New(ErrCouldNotActivate)
+	}
+	return goul.Launch(a.reader, ctrl, message)
+}
+
+// reader receives the logged packets until the control channel is closed.
+func (a *NflogAdapter) reader(in, out chan goul.Item, message goul.Message) {
+	defer close(out)
+	defer goul.Log(a.GetLogger(), a.ID, "exit")
+
+	goul.Log(a.GetLogger(), a.ID, "receiving nflog group %v in looping...", a.group)
+	buffer := make([]byte, 65536+a.snaplen)
+	for {
+		select {
+		case _, ok := <-in:
+			if !ok {
+				goul.Log(a.GetLogger(), a.ID, "channel closed")
+				a.logStats()
+				return
+			}
+		default:
+		}
+
+		n, _, err := unix.Recvfrom(a.fd, buffer, 0)
+		if err == unix.EAGAIN || err == unix.EINTR {
+			continue
+		} else if err == unix.ENOBUFS { // the socket buffer was overrun
+			if atomic.AddUint64(&a.overruns, 1) == 1 {
+				goul.Error(a.GetLogger(), a.ID, "packets lost by overrun, the receiver is too slow")
+			}
+			continue
+		} else if err != nil {
+			a.SetError(err)
+			goul.Error(a.GetLogger(), a.ID, "couldn't receive: %v", err)
+			a.logStats()
+			return
+		}
+
+		messages, err := syscall.ParseNetlinkMessage(buffer[:n])
+		if err != nil {
+			goul.Error(a.GetLogger(), a.ID, "couldn't parse netlink message: %v", err)
+			continue
+		}
+		for _, m := range messages {
+			if m.Header.Type != unix.NFNL_SUBSYS_ULOG<<8|nfulnlMsgPacket {
+				continue
+			}
+			if packet := a.packet(m.Data); packet != nil {
+				atomic.AddUint64(&a.received, 1)
+				out <- packet
+			}
+		}
+	}
+}
+
+// packet returns the packet of the log message, with the annotations.
+func (a *NflogAdapter) packet(data []byte) gopacket.Packet {
+	if len(data) < sizeofNfgenmsg {
+		return nil
+	}
+	attrs := nflogAttributes(data[sizeofNfgenmsg:])
+	payload, ok := attrs[nfulaPayload]
+	if !ok || len(payload) == 0 {
+		return nil
+	}
+
+	var frame []byte
+	if header := attrs[nfulaHwHeader]; len(header) == ethernetHeaderLen &&
+		len(attrs[nfulaHwType]) == 2 && binary.BigEndian.Uint16(attrs[nfulaHwType]) == arphrdEther {
+		frame = append(frame, header...)
+	} else {
+		frame = make([]byte, ethernetHeaderLen)
+		etherType := layers.EthernetTypeIPv4
+		if hdr := attrs[nfulaPacketHdr]; len(hdr) >= 2 && binary.BigEndian.Uint16(hdr) != 0 {
+			etherType = layers.EthernetType(binary.BigEndian.Uint16(hdr))
+		} else if payload[0]>>4 == 6 {
+			etherType = layers.EthernetTypeIPv6
+		}
+		binary.BigEndian.PutUint16(frame[12:], uint16(etherType))
+	}
+	frame = append(frame, payload...)
+
+	timestamp := time.Now()
+	if ts := attrs[nfulaTimestamp]; len(ts) == 16 {
+		sec := int64(binary.BigEndian.Uint64(ts[0:8]))
+		usec := int64(binary.BigEndian.Uint64(ts[8:16]))
+		timestamp = time.Unix(sec, usec*1000)
+	}
+
+	packet := gopacket.NewPacket(frame, layers.LayerTypeEthernet, gopacket.Default)
+	md := packet.Metadata()
+	md.Timestamp = timestamp
+	md.CaptureLength = len(frame)
+	md.Length = len(frame)
+
+	if prefix := attrs[nfulaPrefix]; len(prefix) > 0 {
+		if prefix[len(prefix)-1] == 0 {
+			prefix = prefix[:len(prefix)-1]
+		}
+		goul.Annotate(packet, goul.AnnotationPrefix, string(prefix))
+	}
+	if mark := attrs[nfulaMark]; len(mark) == 4 {
+		goul.Annotate(packet, goul.AnnotationMark, strconv.FormatUint(uint64(binary.BigEndian.Uint32(mark)), 10))
+	}
+	in, out := a.deviceName(attrs[nfulaIfindexIn]), a.deviceName(attrs[nfulaIfindexOut])
+	if in != "" {
+		goul.Annotate(packet, goul.AnnotationInDevice, in)
+	}
+	if out != "" {
+		goul.Annotate(packet, goul.AnnotationOutDevice, out)
+	}
+	switch {
+	case in != "" && out == "":
+		goul.Annotate(packet, goul.AnnotationDirection, goul.DirectionIn)
+	case in == "" && out != "":
+		goul.Annotate(packet, goul.AnnotationDirection, goul.DirectionOut)
+	}
+	return packet
+}
+
+// deviceName returns the name of the device of the index attribute.
+func (a *NflogAdapter) deviceName(attr []byte) string {
+	if len(attr) != 4 {
+		return ""
+	}
+	index := binary.BigEndian.Uint32(attr)
+	if name, ok := a.devices[index]; ok {
+		return name
+	}
+	name := strconv.FormatUint(uint64(index), 10)
+	if intf, err := net.InterfaceByIndex(int(index)); err == nil {
+		name = intf.Name
+	}
+	a.devices[index] = name
+	return name
+}
+
+// nflogAttributes returns the netlink attributes by the type.
+func nflogAttributes(data []byte) map[uint16][]byte {
+	attrs := map[uint16][]byte{}
+	for len(data) >= unix.SizeofNlAttr {
+		length := int(nativeEndian.Uint16(data[0:2]))
+		if length < unix.SizeofNlAttr || length > len(data) {
+			break
+		}
+		attrType := nativeEndian.Uint16(data[2:4]) &^ (unix.NLA_F_NESTED | unix.NLA_F_NET_BYTEORDER)
+		attrs[attrType] = data[unix.SizeofNlAttr:length]
+		aligned := (length + unix.NLA_ALIGNTO - 1) &^ (unix.NLA_ALIGNTO - 1)
+		if aligned > len(data) {
+			break
+		}
+		data = data[aligned:]
+	}
+	return attrs
+}
+
+// NewNflog returns new NFLOG adapter for the group.
+func NewNflog(group int) (*NflogAdapter, error) {
+	a := &NflogAdapter{
+		Adapter: &goul.BaseAdapter{},
+		ID:      defaultNflogAdapterID,
+		snaplen: defaultSnapLen,
+		fd:      -1,
+		devices: map[uint32]string{},
+	}
+	if group < 0 || group > 65535 {
+		a.err = errors.New(ErrNflogInvalidGroup)
+	}
+	a.group = uint16(group)
+	return a, a.err
+}
+
+// SetSnapLen sets the number of bytes of each packet to be copied.
+func (a *NflogAdapter) SetSnapLen(snaplen int) error {
+	if snaplen < 1 || snaplen > maxSnapLen {
+		a.err = errors.New(ErrInvalidSnapLen)
+		return a.err
+	}
+	a.snaplen = snaplen
+	return nil
+}
+
+// Stats returns the number of received packets and the number of overruns
+// of the socket buffer. Each overrun means one or more lost packets.
+func (a *NflogAdapter) Stats() (received, overruns uint64) {
+	return atomic.LoadUint64(&a.received), atomic.LoadUint64(&a.overruns)
+}
+
+func (a *NflogAdapter) logStats() {
+	if logger := a.GetLogger(); logger != nil {
+		received, overruns := a.Stats()
+		logger.Infof("[%v] nflog group %v: %v packets received, %v overruns", a.ID, a.group, received, overruns)
+	}
+}
+
+// Close clean up resources on nflog adapter.
+func (a *NflogAdapter) Close() error {
+	goul.Log(a.GetLogger(), a.ID, "cleanup...")
+	if a.fd >= 0 {
+		unix.Close(a.fd)
+		a.fd = -1
+	}
+	return nil
+}
+
+// open opens the netlink socket and binds it to the group in packet
+// copy mode.
+func (a *NflogAdapter) open() error {
+	if a.fd >= 0 {
+		return nil
+	}
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_NETFILTER)
+	if err != nil {
+		return err
+	}
+	if err := unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		unix.Close(fd)
+		return err
+	}
+	unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_RCVBUF, nflogReceiveBuffer)
+
+	mode := make([]byte, 6) // copy range(4) and copy mode(1) with a pad
+	binary.BigEndian.PutUint32(mode, uint32(a.snaplen))
+	mode[4] = nfulnlCopyPacket
+	for i, attr := range []struct {
+		attrType uint16
+		data     []byte
+	}{
+		{nfulaCfgCmd, []byte{nfulnlCfgCmdBind}},
+		{nfulaCfgMode, mode},
+	} {
+		if err := a.configure(fd, uint32(i+1), attr.attrType, attr.data); err != nil {
+			unix.Close(fd)
+			return err
+		}
+	}
+
+	timeout := unix.NsecToTimeval(nflogReadTimeout.Nanoseconds())
+	if err := unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &timeout); err != nil {
+		unix.Close(fd)
+		return err
+	}
+	a.fd = fd
+	goul.Log(a.GetLogger(), a.ID, "bound to nflog group %v", a.group)
+	return nil
+}
+
+// configure sends a config message with the attribute and waits for the
+// acknowledgement.
+func (a *NflogAdapter) configure(fd int, seq uint32, attrType uint16, data []byte) error {
+	attrLen := unix.SizeofNlAttr + len(data)
+	aligned := (attrLen + unix.NLA_ALIGNTO - 1) &^ (unix.NLA_ALIGNTO - 1)
+	length := unix.SizeofNlMsghdr + sizeofNfgenmsg + aligned
+	msg := make([]byte, length)
+	nativeEndian.PutUint32(msg[0:4], uint32(length))
+	nativeEndian.PutUint16(msg[4:6], unix.NFNL_SUBSYS_ULOG<<8|nfulnlMsgConfig)
+	nativeEndian.PutUint16(msg[6:8], unix.NLM_F_REQUEST|unix.NLM_F_ACK)
+	nativeEndian.PutUint32(msg[8:12], seq)
+	nfgen := msg[unix.SizeofNlMsghdr:]
+	nfgen[0] = unix.AF_UNSPEC
+	nfgen[1] = unix.NFNETLINK_V0
+	binary.BigEndian.PutUint16(nfgen[2:4], a.group)
+	attr := nfgen[sizeofNfgenmsg:]
+	nativeEndian.PutUint16(attr[0:2], uint16(attrLen))
+	nativeEndian.PutUint16(attr[2:4], attrType)
+	copy(attr[unix.SizeofNlAttr:], data)
+
+	if err := unix.Sendto(fd, msg, 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return err
+	}
+	buffer := make([]byte, os.Getpagesize())
+	n, _, err := unix.Recvfrom(fd, buffer, 0)
+	if err != nil {
+		return err
+	}
+	messages, err := syscall.ParseNetlinkMessage(buffer[:n])
+	if err != nil {
+		return err
+	}
+	for _, m := range messages {
+		if m.Header.Type == unix.NLMSG_ERROR && m.Header.Seq == seq && len(m.Data) >= 4 {
+			if errno := int32(nativeEndian.Uint32(m.Data[0:4])); errno != 0 {
+				return syscall.Errno(-errno)
+			}
+			return nil
+		}
+	}
+	return nil
+}
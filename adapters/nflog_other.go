@@ -0,0 +1,33 @@
+//go:build !linux
+// +build !linux
+
+package adapters
+
+import (
+	"errors"
+
+	"github.com/hyeoncheon/goul"
+)
+
+// constants...
+const (
+	ErrNflogNotSupported = "nflog is supported on linux only"
+	ErrNflogInvalidGroup = "invalid nflog group, it should be 0 to 65535"
+)
+
+// NflogAdapter is a placeholder of the NFLOG adapter on the platforms other
+// than Linux. It cannot be created.
+type NflogAdapter struct {
+	goul.Adapter
+	ID string
+}
+
+// NewNflog returns an error since NFLOG is not supported.
+func NewNflog(group int) (*NflogAdapter, error) {
+	return nil, errors.New(ErrNflogNotSupported)
+}
+
+// SetSnapLen is a placeholder.
+func (a *NflogAdapter) SetSnapLen(snaplen int) error {
+	return errors.New(ErrNflogNotSupported)
+}
@@ -0,0 +1,83 @@
+//go:build linux
+// +build linux
+
+package adapters_test
+
+import (
+	"net"
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/stretchr/testify/require"
+
+	"github.com/hyeoncheon/goul"
+	"github.com/hyeoncheon/goul/adapters"
+)
+
+func Test_Nflog_10_Read(t *testing.T) {
+	r := require.New(t)
+
+	reader, err := adapters.NewNflog(1905)
+	r.NoError(err)
+	r.NoError(reader.SetSnapLen(1600))
+	reader.SetLogger(goul.NewLogger("debug"))
+
+	ctrl := make(chan goul.Item)
+	out, err := reader.Read(ctrl, nil)
+	if err != nil {
+		t.Skipf("couldn't bind nflog group: %v", reader.GetError())
+	}
+	defer func() {
+		close(ctrl)
+		for range out {
+		}
+		r.NoError(reader.Close())
+	}()
+
+	rule := []string{"OUTPUT", "-o", "lo", "-p", "udp", "--dport", "6305",
+		"-m", "mark", "--mark", "7", "-j", "NFLOG", "--nflog-group", "1905", "--nflog-prefix", "goultest"}
+	if out, err := exec.Command("iptables", append([]string{"-I"}, rule...)...).CombinedOutput(); err != nil {
+		t.Skipf("couldn't add nflog rule: %v: %s", err, out)
+	}
+	defer exec.Command("iptables", append([]string{"-D"}, rule...)...).Run()
+	mark := []string{"OUTPUT", "-o", "lo", "-p", "udp", "--dport", "6305", "-j", "MARK", "--set-mark", "7"}
+	r.NoError(exec.Command("iptables", append([]string{"-I"}, mark...)...).Run())
+	defer exec.Command("iptables", append([]string{"-D"}, mark...)...).Run()
+
+	conn, err := net.Dial("udp", "127.0.0.1:6305")
+	r.NoError(err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("NflogData"))
+	r.NoError(err)
+
+	select {
+	case item := <-out:
+		packet := item.(gopacket.Packet)
+		r.Equal("NflogData", string(packet.ApplicationLayer().Payload()))
+		annotations := goul.AnnotationsOf(item)
+		r.Equal("goultest", annotations[goul.AnnotationPrefix])
+		r.Equal("7", annotations[goul.AnnotationMark])
+		r.Equal("lo", annotations[goul.AnnotationOutDevice])
+		r.Equal(goul.DirectionOut, annotations[goul.AnnotationDirection])
+	case <-time.After(3 * time.Second):
+		r.Fail("no packet logged")
+	}
+	received, _ := reader.Stats()
+	r.Equal(uint64(1), received)
+}
+
+func Test_Nflog_20_Exceptions(t *testing.T) {
+	r := require.New(t)
+
+	_, err := adapters.NewNflog(-1)
+	r.EqualError(err, adapters.ErrNflogInvalidGroup)
+	_, err = adapters.NewNflog(65536)
+	r.EqualError(err, adapters.ErrNflogInvalidGroup)
+
+	reader, err := adapters.NewNflog(0)
+	r.NoError(err)
+	r.EqualError(reader.SetSnapLen(0), adapters.ErrInvalidSnapLen)
+	r.NoError(reader.Close())
+}
@@ -0,0 +1,406 @@
+package adapters
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+
+	"github.com/hyeoncheon/goul"
+)
+
+// constants...
+const (
+	defaultPcapFileAdapterID = "file"
+	pcapFileHeaderSize       = 24
+	pcapRecordHeaderSize     = 16
+
+	ErrPcapFileInvalidSnapLen  = "invalid snaplen for pcap file"
+	ErrPcapFileInvalidRotation = "invalid rotation options"
+	ErrPcapFileInvalidSpeed    = "invalid replay speed"
+)
+
+// pcapngMagic is the block type of pcapng section header block.
+var pcapngMagic = []byte{0x0A, 0x0D, 0x0D, 0x0A}
+
+// PcapFileAdapter is an adapter for pcap files. As a writer, it writes
+// items to pcap files with given link type and snaplen, and rotates the
+// files by size, time interval or packet count like `tcpdump -C -G -W`.
+//
+// The path of the file is a strftime style pattern such as
+// `/var/goul/goul-%Y%m%d-%H%M%S.pcap` and it is evaluated for each file.
+// If the name of the next file is the same as the current one, a serial
+// number will be added to the name, e.g. `goul-20200101-000000-1.pcap`.
+//
+// As a reader, it reads a pcap or pcapng file of the path and feeds the
+// packets into the pipeline as fast as possible, at original timing of
+// the packets, or at original timing with speed multiplier. It can loop
+// the file until the control channel is closed. When the file is done,
+// it closes the output channel so the pipeline will be finished.
+type PcapFileAdapter struct {
+	goul.Adapter
+	ID       string
+	err      error
+	path     string
+	linkType layers.LinkType
+	snaplen  int
+
+	rotateSize     int64
+	rotateInterval time.Duration
+	rotateCount    int
+	maxFiles       int
+
+	speed float64
+	loop  bool
+
+	file     *os.File
+	buffer   *bufio.Writer
+	pcap     *pcapgo.Writer
+	opened   time.Time
+	written  int64
+	packets  int
+	files    []string
+	lastName string
+	serial   int
+}
+
+// Read implements interface Adapter
+func (a *PcapFileAdapter) Read(ctrl chan goul.Item, message goul.Message) (chan goul.Item, error) {
+	f, err := os.Open(a.path)
+	if err != nil {
+		a.err = err
+		a.SetError(a.err)
+		goul.Error(a.GetLogger(), a.ID, "couldn't open pcap file: %v", a.err)
+		return nil, a.err
+	}
+	f.Close()
+	return goul.Launch(a.reader, ctrl, message)
+}
+
+// Write implements interface Adapter
+func (a *PcapFileAdapter) Write(in chan goul.Item, message goul.Message) (chan goul.Item, error) {
+	if a.err = a.rotate(); a.err != nil {
+		a.SetError(a.err)
+		goul.Error(a.GetLogger(), a.ID, "couldn't open pcap file: %v", a.err)
+		return nil, a.err
+	}
+	return goul.Launch(a.writer, in, message)
+}
+
+// reader reads packets from the file and push it into output channel.
+func (a *PcapFileAdapter) reader(in, out chan goul.Item, message goul.Message) {
+	defer close(out)
+	defer goul.Log(a.GetLogger(), a.ID, "exit")
+
+	goul.Log(a.GetLogger(), a.ID, "reader in looping... (speed %v, loop %v)", a.speed, a.loop)
+	for {
+		count, err := a.replay(in, out)
+		if err != nil {
+			a.SetError(err)
+			goul.Error(a.GetLogger(), a.ID, "couldn't replay pcap file: %v", err)
+			return
+		}
+		goul.Log(a.GetLogger(), a.ID, "%v packets replayed", count)
+		if !a.loop || count == 0 {
+			return
+		}
+		select {
+		case _, ok := <-in:
+			if !ok {
+				goul.Log(a.GetLogger(), a.ID, "channel closed")
+				return
+			}
+		default:
+		}
+	}
+}
+
+// replay reads the file once and push the packets into output channel.
+// It returns the number of replayed packets. If the control channel is
+// closed while replaying, it stops and returns without error.
+func (a *PcapFileAdapter) replay(in, out chan goul.Item) (int, error) {
+	f, err := os.Open(a.path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	source, err := newPacketSource(f)
+	if err != nil {
+		return 0, err
+	}
+
+	var first time.Time
+	var started time.Time
+	count := 0
+	for {
+		packet, err := source.NextPacket()
+		if err == io.EOF {
+			return count, nil
+		} else if err != nil {
+			return count, err
+		}
+
+		ts := packet.Metadata().Timestamp
+		if count == 0 {
+			first = ts
+			started = time.Now()
+		}
+		var wait <-chan time.Time
+		if a.speed > 0 {
+			offset := time.Duration(float64(ts.Sub(first)) / a.speed)
+			wait = time.After(time.Until(started.Add(offset)))
+		} else {
+			ch := make(chan time.Time)
+			close(ch)
+			wait = ch
+		}
+		select {
+		case _, ok := <-in:
+			if !ok {
+				goul.Log(a.GetLogger(), a.ID, "channel closed")
+				return count, nil
+			}
+		case <-wait:
+		}
+		out <- packet
+		count++
+	}
+}
+
+// writer writes the items from input channel into the pcap files.
+func (a *PcapFileAdapter) writer(in, out chan goul.Item, message goul.Message) {
+	defer close(out)
+	defer goul.Log(a.GetLogger(), a.ID, "exit")
+
+	goul.Log(a.GetLogger(), a.ID, "writer in looping...")
+	for item := range in {
+		if a.needRotation() {
+			if err := a.rotate(); err != nil {
+				a.SetError(err)
+				goul.Error(a.GetLogger(), a.ID, "couldn't rotate pcap file: %v", err)
+				a.closeFile()
+				return
+			}
+		}
+
+		ci, data := captureInfo(item, a.snaplen)
+		if err := a.pcap.WritePacket(ci, data); err != nil {
+			a.SetError(err)
+			goul.Error(a.GetLogger(), a.ID, "couldn't write packet: %v", err)
+			a.closeFile()
+			return
+		}
+		a.written += int64(pcapRecordHeaderSize + len(data))
+		a.packets++
+	}
+	goul.Log(a.GetLogger(), a.ID, "channel closed")
+	if err := a.closeFile(); err != nil {
+		a.SetError(err)
+		goul.Error(a.GetLogger(), a.ID, "couldn't close pcap file: %v", err)
+	}
+	out <- goul.Messages["closed"]
+}
+
+// NewPcapFile returns new pcap file adapter with the path pattern.
+func NewPcapFile(path string) (*PcapFileAdapter, error) {
+	a := &PcapFileAdapter{
+		Adapter:  &goul.BaseAdapter{},
+		ID:       defaultPcapFileAdapterID,
+		path:     path,
+		linkType: layers.LinkTypeEthernet,
+		snaplen:  defaultPcapSnapLen,
+	}
+	return a, nil
+}
+
+// Close implements Adapter:
+func (a *PcapFileAdapter) Close() error {
+	goul.Log(a.GetLogger(), a.ID, "cleanup...")
+	return a.closeFile()
+}
+
+// SetLinkType sets link type and snaplen of the pcap file header.
+func (a *PcapFileAdapter) SetLinkType(linkType layers.LinkType, snaplen int) error {
+	if snaplen <= 0 {
+		a.err = errors.New(ErrPcapFileInvalidSnapLen)
+		return a.err
+	}
+	a.linkType = linkType
+	a.snaplen = snaplen
+	return nil
+}
+
+// FileLinkType returns the link type and snaplen of the file to read, so
+// the packets can be described correctly to the receiver.
+func (a *PcapFileAdapter) FileLinkType() (layers.LinkType, int, error) {
+	f, err := os.Open(a.path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	_, linkType, snaplen, err := openPcap(f)
+	return linkType, snaplen, err
+}
+
+// SetRotation sets rotation options. The file will be rotated when its
+// size reaches size bytes, when it has been open for interval, or when
+// it contains count packets. Zero value disables each condition.
+// If maxFiles is not zero, only the latest maxFiles files are kept and
+// older files are removed.
+func (a *PcapFileAdapter) SetRotation(size int64, interval time.Duration, count, maxFiles int) error {
+	if size < 0 || interval < 0 || count < 0 || maxFiles < 0 {
+		a.err = errors.New(ErrPcapFileInvalidRotation)
+		return a.err
+	}
+	a.rotateSize = size
+	a.rotateInterval = interval
+	a.rotateCount = count
+	a.maxFiles = maxFiles
+	return nil
+}
+
+// SetReplay sets replay options for the reader. If speed is zero, the
+// packets are replayed as fast as possible. Otherwise, the packets are
+// replayed at their original timing divided by speed, so 1 means original
+// timing and 2 means twice as fast. If loop is true, the file is replayed
+// again and again until the control channel is closed.
+func (a *PcapFileAdapter) SetReplay(speed float64, loop bool) error {
+	if speed < 0 {
+		a.err = errors.New(ErrPcapFileInvalidSpeed)
+		return a.err
+	}
+	a.speed = speed
+	a.loop = loop
+	return nil
+}
+
+// Files returns the names of the files written by the adapter and still
+// kept on the storage.
+func (a *PcapFileAdapter) Files() []string {
+	return append([]string{}, a.files...)
+}
+
+func (a *PcapFileAdapter) needRotation() bool {
+	switch {
+	case a.rotateSize > 0 && a.written >= a.rotateSize:
+		return true
+	case a.rotateInterval > 0 && time.Since(a.opened) >= a.rotateInterval:
+		return true
+	case a.rotateCount > 0 && a.packets >= a.rotateCount:
+		return true
+	}
+	return false
+}
+
+// rotate closes current file and opens the next file.
+func (a *PcapFileAdapter) rotate() error {
+	if err := a.closeFile(); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	name := a.nextName(now)
+	if dir := filepath.Dir(name); dir != "" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+	file, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	goul.Log(a.GetLogger(), a.ID, "writing packets to %v...", name)
+
+	a.file = file
+	a.buffer = bufio.NewWriter(file)
+	a.pcap = pcapgo.NewWriter(a.buffer)
+	if err := a.pcap.WriteFileHeader(uint32(a.snaplen), a.linkType); err != nil {
+		return err
+	}
+	a.opened = now
+	a.written = pcapFileHeaderSize
+	a.packets = 0
+
+	a.files = append(a.files, name)
+	for a.maxFiles > 0 && len(a.files) > a.maxFiles {
+		goul.Log(a.GetLogger(), a.ID, "removing old file %v...", a.files[0])
+		if err := os.Remove(a.files[0]); err != nil && !os.IsNotExist(err) {
+			goul.Error(a.GetLogger(), a.ID, "couldn't remove old file: %v", err)
+		}
+		a.files = a.files[1:]
+	}
+	return nil
+}
+
+// nextName returns the name of the next file based on the path pattern.
+func (a *PcapFileAdapter) nextName(t time.Time) string {
+	name := strftime(a.path, t)
+	if name != a.lastName {
+		a.lastName = name
+		a.serial = 0
+		return name
+	}
+	a.serial++
+	ext := filepath.Ext(name)
+	return name[:len(name)-len(ext)] + "-" + strconv.Itoa(a.serial) + ext
+}
+
+func (a *PcapFileAdapter) closeFile() error {
+	if a.file == nil {
+		return nil
+	}
+	err := a.buffer.Flush()
+	if cerr := a.file.Close(); err == nil {
+		err = cerr
+	}
+	a.file = nil
+	a.buffer = nil
+	a.pcap = nil
+	return err
+}
+
+// newPacketSource returns packet source of pcap or pcapng file.
+func newPacketSource(r io.Reader) (*gopacket.PacketSource, error) {
+	reader, linkType, _, err := openPcap(r)
+	if err != nil {
+		return nil, err
+	}
+	return gopacket.NewPacketSource(reader, linkType), nil
+}
+
+// openPcap returns packet data source of pcap or pcapng file with the
+// link type and snaplen of the file. For pcapng, they are of the first
+// interface.
+func openPcap(r io.Reader) (gopacket.PacketDataSource, layers.LinkType, int, error) {
+	buffer := bufio.NewReader(r)
+	magic, err := buffer.Peek(len(pcapngMagic))
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	if bytes.Equal(magic, pcapngMagic) {
+		ng, err := pcapgo.NewNgReader(buffer, pcapgo.DefaultNgReaderOptions)
+		if err != nil {
+			return nil, 0, 0, err
+		}
+		intf, err := ng.Interface(0)
+		if err != nil {
+			return nil, 0, 0, err
+		}
+		return ng, ng.LinkType(), int(intf.SnapLength), nil
+	}
+	pr, err := pcapgo.NewReader(buffer)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	return pr, pr.LinkType(), int(pr.Snaplen()), nil
+}
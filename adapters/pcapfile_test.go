@@ -0,0 +1,236 @@
+package adapters_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/stretchr/testify/require"
+
+	"github.com/hyeoncheon/goul"
+	"github.com/hyeoncheon/goul/adapters"
+	. "github.com/hyeoncheon/goul/testing"
+)
+
+func Test_PcapFile_10_RotateByCount(t *testing.T) {
+	r := require.New(t)
+	dir := t.TempDir()
+
+	writer, err := adapters.NewPcapFile(filepath.Join(dir, "%Y", "test-%Y%m%d.pcap"))
+	r.NoError(err)
+	r.NoError(writer.SetLinkType(layers.LinkTypeEthernet, 1500))
+	r.NoError(writer.SetRotation(0, 0, 2, 2))
+
+	in := make(chan goul.Item)
+	done, err := writer.Write(in, nil)
+	r.NoError(err)
+	for i := 0; i < 5; i++ {
+		packet, _ := GeneratePacket("FD1")
+		in <- packet
+	}
+	close(in)
+	message := <-done
+	r.Equal("message", message.String())
+	r.NoError(writer.Close())
+
+	// 5 packets with 2 packets per file, 2 files are kept: 3rd and 4th
+	files := writer.Files()
+	r.Equal(2, len(files))
+	year := time.Now().Format("2006")
+	r.Contains(files[0], filepath.Join(dir, year, "test-"+year))
+	r.Equal(".pcap", filepath.Ext(files[0]))
+	r.Contains(files[1], "-2.pcap")
+	matches, _ := filepath.Glob(filepath.Join(dir, year, "*.pcap"))
+	r.Equal(2, len(matches))
+
+	f, err := os.Open(files[0])
+	r.NoError(err)
+	defer f.Close()
+	pr, err := pcapgo.NewReader(f)
+	r.NoError(err)
+	r.Equal(uint32(1500), pr.Snaplen())
+	count := 0
+	for {
+		data, _, err := pr.ReadPacketData()
+		if err != nil {
+			break
+		}
+		r.NotEmpty(data)
+		count++
+	}
+	r.Equal(2, count)
+}
+
+func Test_PcapFile_20_RotateBySize(t *testing.T) {
+	r := require.New(t)
+	dir := t.TempDir()
+
+	writer, err := adapters.NewPcapFile(filepath.Join(dir, "size.pcap"))
+	r.NoError(err)
+	r.NoError(writer.SetRotation(100, time.Hour, 0, 0))
+
+	in := make(chan goul.Item)
+	done, err := writer.Write(in, nil)
+	r.NoError(err)
+	for i := 0; i < 3; i++ {
+		in <- &goul.ItemGeneric{Meta: goul.ItemTypeRawPacket, DATA: make([]byte, 60)}
+	}
+	close(in)
+	<-done
+
+	// header(24) + 16 + 60 exceeds 100 bytes, so each file has a packet.
+	r.Equal([]string{
+		filepath.Join(dir, "size.pcap"),
+		filepath.Join(dir, "size-1.pcap"),
+		filepath.Join(dir, "size-2.pcap"),
+	}, writer.Files())
+	r.NoError(writer.Close())
+}
+
+func Test_PcapFile_30_Exceptions(t *testing.T) {
+	r := require.New(t)
+
+	writer, err := adapters.NewPcapFile(filepath.Join(t.TempDir(), "test.pcap"))
+	r.NoError(err)
+	r.EqualError(writer.SetLinkType(layers.LinkTypeEthernet, 0), adapters.ErrPcapFileInvalidSnapLen)
+	r.EqualError(writer.SetRotation(-1, 0, 0, 0), adapters.ErrPcapFileInvalidRotation)
+
+	_, err = writer.Read(make(chan goul.Item), nil)
+	r.Error(err) // file does not exist yet
+
+	writer, err = adapters.NewPcapFile("/dev/null/test.pcap")
+	r.NoError(err)
+	_, err = writer.Write(make(chan goul.Item), nil)
+	r.Error(err)
+	r.NoError(writer.Close())
+}
+
+func Test_PcapFile_40_Replay(t *testing.T) {
+	r := require.New(t)
+	path := filepath.Join(t.TempDir(), "replay.pcap")
+	writeTestFile(r, path, false, 3, 100*time.Millisecond)
+
+	reader, err := adapters.NewPcapFile(path)
+	r.NoError(err)
+	r.EqualError(reader.SetReplay(-1, false), adapters.ErrPcapFileInvalidSpeed)
+	linkType, snaplen, err := reader.FileLinkType()
+	r.NoError(err)
+	r.Equal(layers.LinkTypeEthernet, linkType)
+	r.Equal(65536, snaplen)
+
+	// as fast as possible
+	r.NoError(reader.SetReplay(0, false))
+	ctrl := make(chan goul.Item)
+	out, err := reader.Read(ctrl, nil)
+	r.NoError(err)
+	started := time.Now()
+	count := 0
+	for item := range out {
+		r.NoError(CheckPacket(item, "RD1"))
+		count++
+	}
+	r.Equal(3, count)
+	r.Less(int64(time.Since(started)), int64(100*time.Millisecond))
+
+	// original timing, 200ms for 3 packets
+	r.NoError(reader.SetReplay(1, false))
+	out, err = reader.Read(ctrl, nil)
+	r.NoError(err)
+	first := time.Time{}
+	for range out {
+		if first.IsZero() {
+			first = time.Now()
+		}
+	}
+	r.GreaterOrEqual(int64(time.Since(first)), int64(200*time.Millisecond))
+
+	// twice as fast, 100ms for 3 packets
+	r.NoError(reader.SetReplay(2, false))
+	out, err = reader.Read(ctrl, nil)
+	r.NoError(err)
+	started = time.Now()
+	for range out {
+	}
+	elapsed := time.Since(started)
+	r.GreaterOrEqual(int64(elapsed), int64(100*time.Millisecond))
+	r.Less(int64(elapsed), int64(200*time.Millisecond))
+}
+
+func Test_PcapFile_50_ReplayLoopPcapNg(t *testing.T) {
+	r := require.New(t)
+	path := filepath.Join(t.TempDir(), "replay.pcapng")
+	writeTestFile(r, path, true, 2, time.Millisecond)
+
+	reader, err := adapters.NewPcapFile(path)
+	r.NoError(err)
+	r.NoError(reader.SetReplay(0, true))
+	ctrl := make(chan goul.Item)
+	out, err := reader.Read(ctrl, nil)
+	r.NoError(err)
+	for i := 0; i < 5; i++ {
+		r.NoError(CheckPacket(<-out, "RD1"))
+	}
+	close(ctrl)
+	for range out {
+	}
+	r.NoError(reader.Close())
+
+	reader, err = adapters.NewPcapFile(filepath.Join(t.TempDir(), "none.pcap"))
+	r.NoError(err)
+	_, err = reader.Read(ctrl, nil)
+	r.Error(err)
+	_, _, err = reader.FileLinkType()
+	r.Error(err)
+}
+
+func Test_PcapFile_60_LinkType(t *testing.T) {
+	r := require.New(t)
+	path := filepath.Join(t.TempDir(), "raw.pcap")
+
+	f, err := os.Create(path)
+	r.NoError(err)
+	r.NoError(pcapgo.NewWriter(f).WriteFileHeader(1500, layers.LinkTypeRaw))
+	r.NoError(f.Close())
+
+	reader, err := adapters.NewPcapFile(path)
+	r.NoError(err)
+	linkType, snaplen, err := reader.FileLinkType()
+	r.NoError(err)
+	r.Equal(layers.LinkTypeRaw, linkType)
+	r.Equal(1500, snaplen)
+}
+
+//** utilities
+
+func writeTestFile(r *require.Assertions, path string, ng bool, count int, interval time.Duration) {
+	f, err := os.Create(path)
+	r.NoError(err)
+	defer f.Close()
+
+	var write func(ci gopacket.CaptureInfo, data []byte) error
+	if ng {
+		w, err := pcapgo.NewNgWriter(f, layers.LinkTypeEthernet)
+		r.NoError(err)
+		defer w.Flush()
+		write = w.WritePacket
+	} else {
+		w := pcapgo.NewWriter(f)
+		r.NoError(w.WriteFileHeader(65536, layers.LinkTypeEthernet))
+		write = w.WritePacket
+	}
+
+	ts := time.Unix(1600000000, 0)
+	for i := 0; i < count; i++ {
+		packet, _ := GeneratePacket("RD1")
+		ci := gopacket.CaptureInfo{
+			Timestamp:     ts.Add(time.Duration(i) * interval),
+			CaptureLength: len(packet.Data()),
+			Length:        len(packet.Data()),
+		}
+		r.NoError(write(ci, packet.Data()))
+	}
+}
@@ -0,0 +1,289 @@
+package adapters
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"sort"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+
+	"github.com/hyeoncheon/goul"
+)
+
+// constants...
+const (
+	defaultPcapNgFileAdapterID = "pcapng"
+
+	pcapngBlockTypeEnhancedPacket = 6
+	pcapngOptionComment           = 1
+	pcapngOptionFlags             = 2
+	pcapngFlagInbound             = 1
+	pcapngFlagOutbound            = 2
+)
+
+// PcapNgFileAdapter is a writer adapter that writes items into a single
+// pcapng file. It is designed for the receiver that aggregates several
+// capturers: it adds an Interface Description Block for each session of
+// the network adapter with source hostname, device name, link type and
+// snaplen, and each packet is written with interface ID of its session
+// and its original timestamp. If the client captures several devices, an
+// interface is added for each device of the session, by the interface
+// annotation of the packets.
+//
+// Annotations of the packet, such as the comment of the flight recorder
+// or the process of the packet, are written as comments of the packet,
+// except the direction which is written as inbound or outbound flag of
+// the packet. Items without session are written with the first
+// interface, named `goul`.
+type PcapNgFileAdapter struct {
+	goul.Adapter
+	ID         string
+	err        error
+	path       string
+	file       *os.File
+	ng         *pcapgo.NgWriter
+	interfaces map[pcapngInterfaceKey]int
+}
+
+// pcapngInterfaceKey is a key of the interfaces, session and device name.
+type pcapngInterfaceKey struct {
+	session *Session
+	device  string
+}
+
+// Write implements interface Adapter
+func (a *PcapNgFileAdapter) Write(in chan goul.Item, message goul.Message) (chan goul.Item, error) {
+	if a.err = a.open(); a.err != nil {
+		a.SetError(a.err)
+		goul.Error(a.GetLogger(), a.ID, "couldn't open pcapng file: %v", a.err)
+		return nil, a.err
+	}
+	return goul.Launch(a.writer, in, message)
+}
+
+// writer writes the items from input channel into the pcapng file.
+func (a *PcapNgFileAdapter) writer(in, out chan goul.Item, message goul.Message) {
+	defer close(out)
+	defer goul.Log(a.GetLogger(), a.ID, "exit")
+
+	goul.Log(a.GetLogger(), a.ID, "writer in looping...")
+	for item := range in {
+		if err := a.writePacket(item); err != nil {
+			a.SetError(err)
+			goul.Error(a.GetLogger(), a.ID, "couldn't write packet: %v", err)
+			a.closeFile()
+			return
+		}
+	}
+	goul.Log(a.GetLogger(), a.ID, "channel closed")
+	if err := a.closeFile(); err != nil {
+		a.SetError(err)
+		goul.Error(a.GetLogger(), a.ID, "couldn't close pcapng file: %v", err)
+	}
+	out <- goul.Messages["closed"]
+}
+
+// NewPcapNgFile returns new pcapng file adapter.
+func NewPcapNgFile(path string) (*PcapNgFileAdapter, error) {
+	a := &PcapNgFileAdapter{
+		Adapter: &goul.BaseAdapter{},
+		ID:      defaultPcapNgFileAdapterID,
+		path:    path,
+	}
+	return a, nil
+}
+
+// Close implements Adapter:
+func (a *PcapNgFileAdapter) Close() error {
+	goul.Log(a.GetLogger(), a.ID, "cleanup...")
+	return a.closeFile()
+}
+
+func (a *PcapNgFileAdapter) open() error {
+	file, err := os.Create(a.path)
+	if err != nil {
+		return err
+	}
+	intf := pcapgo.NgInterface{
+		Name:        "goul",
+		Description: "items without session",
+		OS:          runtime.GOOS,
+		LinkType:    layers.LinkTypeEthernet,
+		SnapLength:  defaultPcapSnapLen,
+	}
+	options := pcapgo.NgWriterOptions{
+		SectionInfo: pcapgo.NgSectionInfo{
+			Hardware:    runtime.GOARCH,
+			OS:          runtime.GOOS,
+			Application: "goul",
+		},
+	}
+	a.ng, err = pcapgo.NewNgWriterInterface(file, intf, options)
+	if err != nil {
+		file.Close()
+		return err
+	}
+	a.file = file
+	a.interfaces = map[pcapngInterfaceKey]int{}
+	goul.Log(a.GetLogger(), a.ID, "writing packets to %v...", a.path)
+	return nil
+}
+
+// interfaceOf returns interface ID for the session and the device of the
+// item. It adds new interface description block if it is new one. If the
+// device is empty, the device of the session is used.
+func (a *PcapNgFileAdapter) interfaceOf(session *Session, device string) (int, error) {
+	if session == nil {
+		return 0, nil
+	}
+	key := pcapngInterfaceKey{session: session, device: device}
+	if id, ok := a.interfaces[key]; ok {
+		return id, nil
+	}
+	if device == "" {
+		device = session.Device
+	}
+	id, err := a.ng.AddInterface(pcapgo.NgInterface{
+		Name:        session.Hostname + ":" + device,
+		Description: device,
+		Comment:     fmt.Sprintf("goul session %v from %v (%v)", session.ID, session.Hostname, session.Remote),
+		LinkType:    session.LinkType,
+		SnapLength:  uint32(session.SnapLen),
+	})
+	if err != nil {
+		return 0, err
+	}
+	goul.Log(a.GetLogger(), a.ID, "interface %v for %v of session %v (%v)", id, device, session.ID, session.Remote)
+	a.interfaces[key] = id
+	return id, nil
+}
+
+func (a *PcapNgFileAdapter) writePacket(item goul.Item) error {
+	session := SessionOf(item)
+	id, err := a.interfaceOf(session, goul.AnnotationsOf(item)[goul.AnnotationInterface])
+	if err != nil {
+		return err
+	}
+	snaplen := 0
+	if session != nil {
+		snaplen = session.SnapLen
+	}
+	ci, data := captureInfo(item, snaplen)
+	ci.InterfaceIndex = id
+
+	comments := commentsOf(item)
+	flags := flagsOf(item)
+	if len(comments) == 0 && flags == 0 {
+		return a.ng.WritePacket(ci, data)
+	}
+	// NgWriter does not support packet options. write the block directly
+	// after flushing the buffered blocks.
+	if err := a.ng.Flush(); err != nil {
+		return err
+	}
+	return writeEnhancedPacket(a.file, ci, data, comments, flags)
+}
+
+func (a *PcapNgFileAdapter) closeFile() error {
+	if a.file == nil {
+		return nil
+	}
+	err := a.ng.Flush()
+	if cerr := a.file.Close(); err == nil {
+		err = cerr
+	}
+	a.file = nil
+	a.ng = nil
+	return err
+}
+
+// commentsOf returns the annotations of the item as comments.
+func commentsOf(item goul.Item) []string {
+	annotations := goul.AnnotationsOf(item)
+	comments := []string{}
+	for key, value := range annotations {
+		if key == goul.AnnotationDirection || key == goul.AnnotationInterface {
+			continue
+		} else if key == goul.AnnotationComment {
+			comments = append(comments, value)
+		} else {
+			comments = append(comments, key+"="+value)
+		}
+	}
+	sort.Strings(comments)
+	return comments
+}
+
+// flagsOf returns the direction of the item as packet flags. It returns 0
+// if the direction is unknown.
+func flagsOf(item goul.Item) uint32 {
+	switch goul.AnnotationsOf(item)[goul.AnnotationDirection] {
+	case goul.DirectionIn:
+		return pcapngFlagInbound
+	case goul.DirectionOut:
+		return pcapngFlagOutbound
+	}
+	return 0
+}
+
+// writeEnhancedPacket writes an enhanced packet block with comments and
+// flags in little endian as pcapgo.NgWriter does. The timestamp resolution
+// of the interfaces is fixed to nanoseconds by the NgWriter.
+func writeEnhancedPacket(w io.Writer, ci gopacket.CaptureInfo, data []byte, comments []string, flags uint32) error {
+	pad := func(n int) int { return (4 - n&3) & 3 }
+
+	length := 28 + len(data) + pad(len(data)) + 4
+	for _, comment := range comments {
+		length += 4 + len(comment) + pad(len(comment))
+	}
+	if flags != 0 {
+		length += 8
+	}
+	length += 4 // end of options
+
+	block := make([]byte, 0, length)
+	le := binary.LittleEndian
+	ts := uint64(ci.Timestamp.UnixNano())
+	block = appendUint32(block, le, pcapngBlockTypeEnhancedPacket)
+	block = appendUint32(block, le, uint32(length))
+	block = appendUint32(block, le, uint32(ci.InterfaceIndex))
+	block = appendUint32(block, le, uint32(ts>>32))
+	block = appendUint32(block, le, uint32(ts))
+	block = appendUint32(block, le, uint32(ci.CaptureLength))
+	block = appendUint32(block, le, uint32(ci.Length))
+	block = append(block, data...)
+	block = append(block, make([]byte, pad(len(data)))...)
+	for _, comment := range comments {
+		block = appendUint16(block, le, pcapngOptionComment)
+		block = appendUint16(block, le, uint16(len(comment)))
+		block = append(block, comment...)
+		block = append(block, make([]byte, pad(len(comment)))...)
+	}
+	if flags != 0 {
+		block = appendUint16(block, le, pcapngOptionFlags)
+		block = appendUint16(block, le, 4)
+		block = appendUint32(block, le, flags)
+	}
+	block = appendUint32(block, le, 0) // end of options
+	block = appendUint32(block, le, uint32(length))
+
+	_, err := w.Write(block)
+	return err
+}
+
+func appendUint16(b []byte, order binary.ByteOrder, v uint16) []byte {
+	buf := make([]byte, 2)
+	order.PutUint16(buf, v)
+	return append(b, buf...)
+}
+
+func appendUint32(b []byte, order binary.ByteOrder, v uint32) []byte {
+	buf := make([]byte, 4)
+	order.PutUint32(buf, v)
+	return append(b, buf...)
+}
@@ -0,0 +1,140 @@
+package adapters_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/stretchr/testify/require"
+
+	"github.com/hyeoncheon/goul"
+	"github.com/hyeoncheon/goul/adapters"
+	. "github.com/hyeoncheon/goul/testing"
+)
+
+func Test_PcapNg_10_InterfacePerSession(t *testing.T) {
+	r := require.New(t)
+	path := filepath.Join(t.TempDir(), "test.pcapng")
+
+	reader, err := adapters.NewNetwork("", 6206)
+	r.NoError(err)
+	r.NoError(reader.SetTimestamps(true))
+	writer, err := adapters.NewPcapNgFile(path)
+	r.NoError(err)
+	server := &goul.BaseRouter{}
+	server.SetLogger(goul.NewLogger("debug"))
+	server.SetReader(reader)
+	server.SetWriter(writer)
+	control0, done0, err := server.Run()
+	r.NoError(err)
+
+	control1, done1 := sourceClient(r, 6206, "C1", "eth1")
+	control2, done2 := sourceClient(r, 6206, "C2", "eth2")
+	time.Sleep(1000 * time.Millisecond)
+	for i := 0; i < 2; i++ {
+		control1 <- &goul.ItemGeneric{Meta: "packet", DATA: []byte("ND1")}
+		time.Sleep(100 * time.Millisecond)
+		control2 <- &goul.ItemGeneric{Meta: "packet", DATA: []byte("ND2")}
+		time.Sleep(100 * time.Millisecond)
+	}
+	close(control1)
+	<-done1
+	close(control2)
+	<-done2
+	time.Sleep(1000 * time.Millisecond)
+	close(control0)
+	message := <-done0
+	r.Equal("message", message.String())
+	reader.Close()
+
+	f, err := os.Open(path)
+	r.NoError(err)
+	defer f.Close()
+	ng, err := pcapgo.NewNgReader(f, pcapgo.DefaultNgReaderOptions)
+	r.NoError(err)
+
+	indexes := []int{}
+	for {
+		_, ci, err := ng.ReadPacketData()
+		if err != nil {
+			break
+		}
+		r.False(ci.Timestamp.IsZero())
+		indexes = append(indexes, ci.InterfaceIndex)
+	}
+	r.Equal([]int{1, 2, 1, 2}, indexes)
+	r.Equal(3, ng.NInterfaces())
+	intf, err := ng.Interface(1)
+	r.NoError(err)
+	r.Contains(intf.Name, ":eth1")
+	r.Equal(layers.LinkTypeEthernet, intf.LinkType)
+	r.Equal(uint32(1500), intf.SnapLength)
+}
+
+func Test_PcapNg_20_Comments(t *testing.T) {
+	r := require.New(t)
+	path := filepath.Join(t.TempDir(), "test.pcapng")
+
+	writer, err := adapters.NewPcapNgFile(path)
+	r.NoError(err)
+	in := make(chan goul.Item)
+	done, err := writer.Write(in, nil)
+	r.NoError(err)
+
+	packet, _ := GeneratePacket("ND3")
+	r.True(goul.Annotate(packet, goul.AnnotationComment, "hello pcapng"))
+	r.True(goul.Annotate(packet, goul.AnnotationPID, "3"))
+	in <- packet
+	packet, _ = GeneratePacket("ND4")
+	r.True(goul.Annotate(packet, goul.AnnotationDirection, goul.DirectionOut))
+	in <- packet
+	close(in)
+	<-done
+	r.NoError(writer.Close())
+
+	raw, err := ioutil.ReadFile(path)
+	r.NoError(err)
+	r.True(bytes.Contains(raw, []byte("hello pcapng")))
+	r.True(bytes.Contains(raw, []byte(goul.AnnotationPID+"=3")))
+	r.False(bytes.Contains(raw, []byte(goul.AnnotationDirection+"=")))
+	r.True(bytes.Contains(raw, []byte{2, 0, 4, 0, 2, 0, 0, 0})) // outbound flag
+
+	f, err := os.Open(path)
+	r.NoError(err)
+	defer f.Close()
+	ng, err := pcapgo.NewNgReader(f, pcapgo.DefaultNgReaderOptions)
+	r.NoError(err)
+	for _, payload := range []string{"ND3", "ND4"} {
+		data, ci, err := ng.ReadPacketData()
+		r.NoError(err)
+		r.Equal(0, ci.InterfaceIndex)
+		r.Contains(string(data), payload)
+	}
+
+	writer, err = adapters.NewPcapNgFile("/dev/null/test.pcapng")
+	r.NoError(err)
+	_, err = writer.Write(make(chan goul.Item), nil)
+	r.Error(err)
+}
+
+//** utilities
+
+func sourceClient(r *require.Assertions, port int, name, device string) (control, out chan goul.Item) {
+	writer, err := adapters.NewNetwork("localhost", port)
+	r.NoError(err)
+	writer.ID = name + "->  "
+	r.NoError(writer.SetSource(device, layers.LinkTypeEthernet, 1500))
+	client := &goul.BaseRouter{}
+	client.SetLogger(goul.NewLogger("debug"))
+	client.SetReader(&GeneratorAdapter{ID: name + "    ", Adapter: &goul.BaseAdapter{}})
+	client.SetWriter(writer)
+	control, done, err := client.Run()
+	r.NoError(err)
+
+	return control, done
+}
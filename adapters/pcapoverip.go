@@ -0,0 +1,322 @@
+package adapters
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+
+	"github.com/hyeoncheon/goul"
+)
+
+// constants...
+const (
+	defaultPcapOverIPAdapterID = "pcap-ip"
+
+	ErrPcapOverIPInvalidSnapLen  = "invalid snaplen for pcap stream"
+	ErrPcapOverIPInvalidLinkType = "unexpected link type of pcap stream"
+)
+
+// PcapOverIPAdapter is an adapter for PCAP-over-IP streaming. PCAP-over-IP
+// is a plain pcap file stream, a global header followed by records, over
+// TCP connection and it is supported by NetworkMiner, Arkime and others.
+//
+// As a writer, it streams items to the connected peer(s). If the adapter
+// was created without address, it listens on the port and streams the
+// same records to all connected clients. Otherwise, it connects to the
+// given address and streams records to it.
+// As a reader, it reads a pcap stream and push packets into the pipeline.
+// It also listens on the port if the address is empty, otherwise it
+// connects to the given address and reads the stream from it. The streams
+// of other link type than the one set by SetLinkType are rejected since
+// the link type is announced to the receiver before any stream is read.
+type PcapOverIPAdapter struct {
+	goul.Adapter
+	ID       string
+	err      error
+	address  string
+	isServer bool
+	linkType layers.LinkType
+	snaplen  int
+	listener *net.TCPListener
+
+	mu      sync.Mutex
+	streams map[net.Conn]*pcapStream
+}
+
+// pcapStream is a pcap writer for a connection.
+type pcapStream struct {
+	buffer *bufio.Writer
+	writer *pcapgo.Writer
+}
+
+// Read implements interface Adapter
+func (a *PcapOverIPAdapter) Read(ctrl chan goul.Item, message goul.Message) (chan goul.Item, error) {
+	out := make(chan goul.Item, goul.ChannelSize)
+	if a.isServer {
+		if a.err = a.listen(); a.err != nil {
+			return nil, a.err
+		}
+		go a.acceptReaders(ctrl, out)
+		return out, nil
+	}
+
+	conn, err := a.connect()
+	if err != nil {
+		a.err = err
+		return nil, a.err
+	}
+	go func() {
+		defer close(out)
+		a.reader(ctrl, out, conn)
+	}()
+	return out, nil
+}
+
+// Write implements interface Adapter
+func (a *PcapOverIPAdapter) Write(in chan goul.Item, message goul.Message) (chan goul.Item, error) {
+	a.streams = map[net.Conn]*pcapStream{}
+	if a.isServer {
+		if a.err = a.listen(); a.err != nil {
+			return nil, a.err
+		}
+		go a.acceptWriters()
+	} else {
+		conn, err := a.connect()
+		if err != nil {
+			a.err = err
+			return nil, a.err
+		}
+		if err = a.addStream(conn); err != nil {
+			a.err = err
+			return nil, a.err
+		}
+	}
+	return goul.Launch(a.writer, in, message)
+}
+
+// reader reads pcap stream from the connection and push packets into
+// output channel.
+func (a *PcapOverIPAdapter) reader(ctrl, out chan goul.Item, conn net.Conn) {
+	defer goul.Log(a.GetLogger(), a.ID+"-rcv", "exit")
+	defer conn.Close()
+
+	r, err := pcapgo.NewReader(conn)
+	if err != nil {
+		a.SetError(err)
+		goul.Log(a.GetLogger(), a.ID+"-rcv", "oops! couldn't read header: %v", err)
+		return
+	}
+	if r.LinkType() != a.linkType {
+		a.SetError(errors.New(ErrPcapOverIPInvalidLinkType))
+		goul.Log(a.GetLogger(), a.ID+"-rcv", "oops! link type %v is not %v", r.LinkType(), a.linkType)
+		return
+	}
+	goul.Log(a.GetLogger(), a.ID+"-rcv", "reader in looping... (link type %v)", r.LinkType())
+
+	packets := gopacket.NewPacketSource(r, r.LinkType()).Packets()
+	for {
+		select {
+		case _, ok := <-ctrl:
+			if !ok {
+				goul.Log(a.GetLogger(), a.ID+"-rcv", "channel closed")
+				return
+			}
+		case packet, ok := <-packets:
+			if !ok {
+				goul.Log(a.GetLogger(), a.ID+"-rcv", "stream closed")
+				return
+			}
+			out <- packet
+		}
+	}
+}
+
+// writer writes the items from input channel to all connected streams.
+func (a *PcapOverIPAdapter) writer(in, out chan goul.Item, message goul.Message) {
+	defer close(out)
+	defer goul.Log(a.GetLogger(), a.ID+"-snd", "exit")
+	defer a.closeStreams()
+
+	goul.Log(a.GetLogger(), a.ID+"-snd", "writer in looping...")
+	for item := range in {
+		ci, data := captureInfo(item, a.snaplen)
+
+		a.mu.Lock()
+		for conn, s := range a.streams {
+			err := s.writer.WritePacket(ci, data)
+			if err == nil {
+				err = s.buffer.Flush()
+			}
+			if err != nil {
+				goul.Log(a.GetLogger(), a.ID+"-snd", "oops! couldn't write to %v: %v", conn.RemoteAddr(), err)
+				a.SetError(err)
+				conn.Close()
+				delete(a.streams, conn)
+			}
+		}
+		remains := len(a.streams)
+		a.mu.Unlock()
+
+		if !a.isServer && remains == 0 {
+			goul.Log(a.GetLogger(), a.ID+"-snd", "connection lost")
+			return
+		}
+	}
+	goul.Log(a.GetLogger(), a.ID+"-snd", "channel closed")
+	out <- goul.Messages["closed"]
+}
+
+// NewPcapOverIP returns new PCAP-over-IP adapter. If addr is empty, the
+// adapter listens on the port, otherwise it connects to the addr:port.
+func NewPcapOverIP(addr string, port int) (*PcapOverIPAdapter, error) {
+	a := &PcapOverIPAdapter{
+		Adapter:  &goul.BaseAdapter{},
+		ID:       defaultPcapOverIPAdapterID,
+		address:  addr + ":" + strconv.Itoa(port),
+		isServer: addr == "",
+		linkType: layers.LinkTypeEthernet,
+		snaplen:  defaultPcapSnapLen,
+	}
+	return a, nil
+}
+
+// Close implements Adapter:
+func (a *PcapOverIPAdapter) Close() error {
+	goul.Log(a.GetLogger(), a.ID, "cleanup...")
+	if a.listener != nil {
+		a.listener.Close()
+	}
+	a.closeStreams()
+	return nil
+}
+
+// SetLinkType sets link type and snaplen of the pcap global header which
+// is written at the beginning of each stream.
+func (a *PcapOverIPAdapter) SetLinkType(linkType layers.LinkType, snaplen int) error {
+	if snaplen <= 0 {
+		a.err = errors.New(ErrPcapOverIPInvalidSnapLen)
+		return a.err
+	}
+	a.linkType = linkType
+	a.snaplen = snaplen
+	return nil
+}
+
+func (a *PcapOverIPAdapter) connect() (net.Conn, error) {
+	goul.Log(a.GetLogger(), a.ID, "preparing client connection...")
+	return net.Dial("tcp", a.address)
+}
+
+func (a *PcapOverIPAdapter) listen() error {
+	laddr, err := net.ResolveTCPAddr("tcp", a.address)
+	if err != nil {
+		return err
+	}
+	a.listener, err = net.ListenTCP("tcp", laddr)
+	return err
+}
+
+// accept waits for a connection until the listener is closed or ctrl
+// channel is closed. ctrl can be nil for writer.
+func (a *PcapOverIPAdapter) accept(ctrl chan goul.Item) (*net.TCPConn, bool) {
+	for {
+		select {
+		case _, ok := <-ctrl:
+			if !ok {
+				goul.Log(a.GetLogger(), a.ID+"-listener", "channel closed")
+				return nil, false
+			}
+		default:
+		}
+		a.listener.SetDeadline(time.Now().Add(1 * time.Second))
+		conn, err := a.listener.AcceptTCP()
+		if err == nil {
+			goul.Log(a.GetLogger(), a.ID+"-listener", "connected from %v", conn.RemoteAddr())
+			return conn, true
+		}
+		if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+			continue
+		}
+		goul.Log(a.GetLogger(), a.ID+"-listener", "couldn't accept: %v", err)
+		return nil, false
+	}
+}
+
+// acceptReaders runs reader for each connection.
+func (a *PcapOverIPAdapter) acceptReaders(ctrl, out chan goul.Item) {
+	defer close(out)
+	defer goul.Log(a.GetLogger(), a.ID+"-listener", "exit")
+	defer a.listener.Close()
+
+	wg := sync.WaitGroup{}
+	defer wg.Wait()
+
+	goul.Log(a.GetLogger(), a.ID+"-listener", "preparing listener...")
+	for {
+		conn, ok := a.accept(ctrl)
+		if !ok {
+			return
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			a.reader(ctrl, out, conn)
+		}()
+	}
+}
+
+// acceptWriters registers each connection as a stream of the writer.
+func (a *PcapOverIPAdapter) acceptWriters() {
+	defer goul.Log(a.GetLogger(), a.ID+"-listener", "exit")
+
+	goul.Log(a.GetLogger(), a.ID+"-listener", "preparing listener...")
+	for {
+		conn, ok := a.accept(nil)
+		if !ok {
+			return
+		}
+		if err := a.addStream(conn); err != nil {
+			goul.Log(a.GetLogger(), a.ID+"-listener", "couldn't start stream: %v", err)
+			conn.Close()
+		}
+	}
+}
+
+// addStream writes pcap global header to the connection and registers it.
+func (a *PcapOverIPAdapter) addStream(conn net.Conn) error {
+	buffer := bufio.NewWriter(conn)
+	writer := pcapgo.NewWriter(buffer)
+	if err := writer.WriteFileHeader(uint32(a.snaplen), a.linkType); err != nil {
+		return err
+	}
+	if err := buffer.Flush(); err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.streams == nil {
+		return net.ErrClosed
+	}
+	a.streams[conn] = &pcapStream{buffer: buffer, writer: writer}
+	return nil
+}
+
+func (a *PcapOverIPAdapter) closeStreams() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for conn := range a.streams {
+		conn.Close()
+	}
+	a.streams = nil
+	if a.listener != nil {
+		a.listener.Close()
+	}
+}
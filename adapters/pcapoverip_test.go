@@ -0,0 +1,158 @@
+package adapters_test
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/stretchr/testify/require"
+
+	"github.com/hyeoncheon/goul"
+	"github.com/hyeoncheon/goul/adapters"
+	. "github.com/hyeoncheon/goul/testing"
+)
+
+func Test_PcapOverIP_10_ListeningWriter(t *testing.T) {
+	r := require.New(t)
+
+	writer, err := adapters.NewPcapOverIP("", 6106)
+	r.NoError(err)
+	writer.ID = "P1->  "
+	source := &goul.BaseRouter{}
+	source.SetLogger(goul.NewLogger("debug"))
+	source.SetReader(&GeneratorAdapter{ID: "P1    ", Adapter: &goul.BaseAdapter{}})
+	source.SetWriter(writer)
+	control1, done1, err := source.Run()
+	r.NoError(err)
+
+	reader, err := adapters.NewPcapOverIP("localhost", 6106)
+	r.NoError(err)
+	reader.ID = "  ->PR"
+	sink := &goul.BaseRouter{}
+	sink.SetLogger(goul.NewLogger("debug"))
+	sink.SetReader(reader)
+	sink.SetWriter(&GeneratorAdapter{ID: "  --PW", Adapter: &goul.BaseAdapter{}})
+	control2, out, err := sink.Run()
+	r.NoError(err)
+
+	time.Sleep(500 * time.Millisecond)
+	for i := 0; i < 3; i++ {
+		control1 <- &goul.ItemGeneric{Meta: "packet", DATA: []byte("PD1")}
+		item := <-out
+		r.NoError(CheckPacket(item, "PD1"))
+		r.False(item.(gopacket.Packet).Metadata().Timestamp.IsZero())
+	}
+
+	close(control2)
+	<-out
+	close(control1)
+	message := <-done1
+	r.Equal("message", message.String())
+	reader.Close()
+	writer.Close()
+}
+
+func Test_PcapOverIP_20_ConnectingWriter(t *testing.T) {
+	r := require.New(t)
+
+	reader, err := adapters.NewPcapOverIP("", 6107)
+	r.NoError(err)
+	sink := &goul.BaseRouter{}
+	sink.SetReader(reader)
+	sink.SetWriter(&GeneratorAdapter{ID: "  --PW", Adapter: &goul.BaseAdapter{}})
+	control2, out, err := sink.Run()
+	r.NoError(err)
+
+	writer, err := adapters.NewPcapOverIP("localhost", 6107)
+	r.NoError(err)
+	source := &goul.BaseRouter{}
+	source.SetReader(&GeneratorAdapter{ID: "P2    ", Adapter: &goul.BaseAdapter{}})
+	source.SetWriter(writer)
+	control1, done1, err := source.Run()
+	r.NoError(err)
+
+	control1 <- &goul.ItemGeneric{Meta: "rawpacket", DATA: []byte("PD2")}
+	r.NoError(CheckPacket(<-out, "PD2"))
+
+	close(control1)
+	<-done1
+	close(control2)
+	<-out
+	reader.Close()
+	writer.Close()
+}
+
+func Test_PcapOverIP_30_StreamFormat(t *testing.T) {
+	r := require.New(t)
+
+	writer, err := adapters.NewPcapOverIP("", 6108)
+	r.NoError(err)
+	r.EqualError(writer.SetLinkType(layers.LinkTypeEthernet, 0), adapters.ErrPcapOverIPInvalidSnapLen)
+	r.NoError(writer.SetLinkType(layers.LinkTypeEthernet, 1500))
+
+	in := make(chan goul.Item)
+	done, err := writer.Write(in, nil)
+	r.NoError(err)
+
+	conn, err := net.Dial("tcp", "localhost:6108")
+	r.NoError(err)
+	defer conn.Close()
+	pr, err := pcapgo.NewReader(conn)
+	r.NoError(err)
+	r.Equal(layers.LinkTypeEthernet, pr.LinkType())
+	r.Equal(uint32(1500), pr.Snaplen())
+
+	packet, _ := GeneratePacket("PD3")
+	in <- packet
+	data, ci, err := pr.ReadPacketData()
+	r.NoError(err)
+	r.Equal(packet.Data(), data)
+	r.Equal(len(data), ci.Length)
+
+	close(in)
+	<-done
+	r.NoError(writer.Close())
+}
+
+func Test_PcapOverIP_40_Exceptions(t *testing.T) {
+	r := require.New(t)
+
+	reader, err := adapters.NewPcapOverIP("localhost", 6109)
+	r.NoError(err)
+	_, err = reader.Read(make(chan goul.Item), nil)
+	r.Error(err)
+	r.Contains(err.Error(), "connection refused")
+
+	writer, err := adapters.NewPcapOverIP("localhost", 6109)
+	r.NoError(err)
+	_, err = writer.Write(make(chan goul.Item), nil)
+	r.Error(err)
+	r.Contains(err.Error(), "connection refused")
+}
+
+func Test_PcapOverIP_41_LinkType(t *testing.T) {
+	r := require.New(t)
+
+	listener, err := net.Listen("tcp", "localhost:6110")
+	r.NoError(err)
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		pcapgo.NewWriter(conn).WriteFileHeader(65536, layers.LinkTypeLinuxSLL)
+	}()
+
+	reader, err := adapters.NewPcapOverIP("localhost", 6110)
+	r.NoError(err)
+	out, err := reader.Read(make(chan goul.Item), nil)
+	r.NoError(err)
+	_, ok := <-out
+	r.False(ok)
+	r.EqualError(reader.GetError(), adapters.ErrPcapOverIPInvalidLinkType)
+}
@@ -0,0 +1,209 @@
+package adapters
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+
+	"github.com/hyeoncheon/goul"
+)
+
+// constants...
+const (
+	defaultPcapStreamAdapterID = "stream"
+
+	ErrPcapStreamNoReader       = "no reader for pcap stream"
+	ErrPcapStreamNoWriter       = "no writer for pcap stream"
+	ErrPcapStreamInvalidSnapLen = "invalid snaplen for pcap stream"
+)
+
+// PcapStreamAdapter is an adapter for pcap streams on plain reader and
+// writer such as stdin and stdout. With this, goul can be composed with
+// unix tools like `tcpdump -w - | goul ...` or `goul ... | wireshark -k -i -`.
+//
+// As a reader, it reads a pcap or pcapng stream and push packets into the
+// pipeline. When the stream reaches EOF, it closes the output channel so
+// the pipeline will be finished. The link type of the stream can be read
+// before it with StreamLinkType. As a writer, it writes a pcap global
+// header followed by records and flushes each record. If the stream was
+// broken, for example the consumer of stdout was exited, it stops and
+// closes the done channel.
+type PcapStreamAdapter struct {
+	goul.Adapter
+	ID       string
+	err      error
+	r        io.Reader
+	w        io.Writer
+	isStdio  bool
+	linkType layers.LinkType
+	snaplen  int
+
+	source       gopacket.PacketDataSource
+	sourceType   layers.LinkType
+	sourceLength int
+}
+
+// Read implements interface Adapter
+func (a *PcapStreamAdapter) Read(ctrl chan goul.Item, message goul.Message) (chan goul.Item, error) {
+	if a.r == nil {
+		a.err = errors.New(ErrPcapStreamNoReader)
+		return nil, a.err
+	}
+	return goul.Launch(a.reader, ctrl, message)
+}
+
+// Write implements interface Adapter
+func (a *PcapStreamAdapter) Write(in chan goul.Item, message goul.Message) (chan goul.Item, error) {
+	if a.w == nil {
+		a.err = errors.New(ErrPcapStreamNoWriter)
+		return nil, a.err
+	}
+	if a.isStdio {
+		// without this, writing to the closed stdout kills the program
+		// with SIGPIPE instead of returning EPIPE error.
+		signal.Ignore(syscall.SIGPIPE)
+	}
+	return goul.Launch(a.writer, in, message)
+}
+
+// reader reads packets from the stream and push it into output channel.
+func (a *PcapStreamAdapter) reader(in, out chan goul.Item, message goul.Message) {
+	defer close(out)
+	defer goul.Log(a.GetLogger(), a.ID, "exit")
+
+	linkType, _, err := a.StreamLinkType()
+	if err != nil {
+		a.SetError(err)
+		goul.Error(a.GetLogger(), a.ID, "couldn't read pcap stream: %v", err)
+		return
+	}
+
+	goul.Log(a.GetLogger(), a.ID, "reader in looping... (link type %v)", linkType)
+	packets := gopacket.NewPacketSource(a.source, linkType).Packets()
+	count := 0
+	for {
+		select {
+		case _, ok := <-in:
+			if !ok {
+				goul.Log(a.GetLogger(), a.ID, "channel closed")
+				return
+			}
+		case packet, ok := <-packets:
+			if !ok {
+				goul.Log(a.GetLogger(), a.ID, "end of stream. %v packets", count)
+				return
+			}
+			out <- packet
+			count++
+		}
+	}
+}
+
+// writer writes the items from input channel into the stream.
+func (a *PcapStreamAdapter) writer(in, out chan goul.Item, message goul.Message) {
+	defer close(out)
+	defer goul.Log(a.GetLogger(), a.ID, "exit")
+
+	buffer := bufio.NewWriter(a.w)
+	writer := pcapgo.NewWriter(buffer)
+	err := writer.WriteFileHeader(uint32(a.snaplen), a.linkType)
+	if err == nil {
+		err = buffer.Flush()
+	}
+	if err != nil {
+		a.SetError(err)
+		goul.Error(a.GetLogger(), a.ID, "couldn't write pcap header: %v", err)
+		return
+	}
+
+	goul.Log(a.GetLogger(), a.ID, "writer in looping...")
+	for item := range in {
+		ci, data := captureInfo(item, a.snaplen)
+		err = writer.WritePacket(ci, data)
+		if err == nil {
+			err = buffer.Flush()
+		}
+		if err != nil {
+			a.SetError(err)
+			goul.Log(a.GetLogger(), a.ID, "stream closed: %v", err)
+			return
+		}
+	}
+	goul.Log(a.GetLogger(), a.ID, "channel closed")
+	out <- goul.Messages["closed"]
+}
+
+// NewPcapStream returns new pcap stream adapter for the reader and the
+// writer. Either of them can be nil if it is not used.
+func NewPcapStream(r io.Reader, w io.Writer) (*PcapStreamAdapter, error) {
+	a := &PcapStreamAdapter{
+		Adapter:  &goul.BaseAdapter{},
+		ID:       defaultPcapStreamAdapterID,
+		r:        r,
+		w:        w,
+		linkType: layers.LinkTypeEthernet,
+		snaplen:  defaultPcapSnapLen,
+	}
+	return a, nil
+}
+
+// NewStdio returns new pcap stream adapter for stdin and stdout.
+func NewStdio() (*PcapStreamAdapter, error) {
+	a, err := NewPcapStream(os.Stdin, os.Stdout)
+	a.isStdio = true
+	return a, err
+}
+
+// Close implements Adapter: It closes the reader and the writer if they
+// are closable, except stdin and stdout.
+func (a *PcapStreamAdapter) Close() error {
+	goul.Log(a.GetLogger(), a.ID, "cleanup...")
+	if a.isStdio {
+		return nil
+	}
+	var err error
+	if c, ok := a.r.(io.Closer); ok {
+		err = c.Close()
+	}
+	if c, ok := a.w.(io.Closer); ok {
+		if cerr := c.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// StreamLinkType returns the link type and snaplen of the stream to read,
+// so the packets can be described correctly to the receiver. It reads the
+// header of the stream only once, and the reader continues after it.
+func (a *PcapStreamAdapter) StreamLinkType() (layers.LinkType, int, error) {
+	if a.r == nil {
+		return 0, 0, errors.New(ErrPcapStreamNoReader)
+	}
+	if a.source == nil {
+		source, linkType, snaplen, err := openPcap(a.r)
+		if err != nil {
+			return 0, 0, err
+		}
+		a.source, a.sourceType, a.sourceLength = source, linkType, snaplen
+	}
+	return a.sourceType, a.sourceLength, nil
+}
+
+// SetLinkType sets link type and snaplen of the pcap global header.
+func (a *PcapStreamAdapter) SetLinkType(linkType layers.LinkType, snaplen int) error {
+	if snaplen <= 0 {
+		a.err = errors.New(ErrPcapStreamInvalidSnapLen)
+		return a.err
+	}
+	a.linkType = linkType
+	a.snaplen = snaplen
+	return nil
+}
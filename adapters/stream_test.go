@@ -0,0 +1,122 @@
+package adapters_test
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/stretchr/testify/require"
+
+	"github.com/hyeoncheon/goul"
+	"github.com/hyeoncheon/goul/adapters"
+	. "github.com/hyeoncheon/goul/testing"
+)
+
+func Test_PcapStream_10_Pipe(t *testing.T) {
+	r := require.New(t)
+
+	pr, pw := io.Pipe()
+
+	writer, err := adapters.NewPcapStream(nil, pw)
+	r.NoError(err)
+	r.NoError(writer.SetLinkType(layers.LinkTypeEthernet, 1600))
+	source := &goul.BaseRouter{}
+	source.SetLogger(goul.NewLogger("debug"))
+	source.SetReader(&GeneratorAdapter{ID: "S1    ", Adapter: &goul.BaseAdapter{}})
+	source.SetWriter(writer)
+	control1, done1, err := source.Run()
+	r.NoError(err)
+
+	reader, err := adapters.NewPcapStream(pr, nil)
+	r.NoError(err)
+	sink := &goul.BaseRouter{}
+	sink.SetLogger(goul.NewLogger("debug"))
+	sink.SetReader(reader)
+	sink.SetWriter(&GeneratorAdapter{ID: "  --SW", Adapter: &goul.BaseAdapter{}})
+	control2, out, err := sink.Run()
+	r.NoError(err)
+
+	for i := 0; i < 3; i++ {
+		control1 <- &goul.ItemGeneric{Meta: "packet", DATA: []byte("SD1")}
+		r.NoError(CheckPacket(<-out, "SD1"))
+	}
+
+	// EOF of the stream finishes the reader pipeline.
+	close(control1)
+	r.Equal("message", (<-done1).String())
+	r.NoError(writer.Close())
+	_, ok := <-out
+	r.False(ok)
+	close(control2)
+	r.NoError(reader.GetError())
+}
+
+func Test_PcapStream_20_BrokenPipe(t *testing.T) {
+	r := require.New(t)
+
+	pr, pw := io.Pipe()
+	pr.Close() // the consumer has gone.
+
+	writer, _ := adapters.NewPcapStream(nil, pw)
+	source := &goul.BaseRouter{}
+	source.SetReader(&GeneratorAdapter{ID: "S2    ", Adapter: &goul.BaseAdapter{}})
+	source.SetWriter(writer)
+	control, done, err := source.Run()
+	r.NoError(err)
+
+	_, ok := <-done
+	r.False(ok)
+	r.Equal(io.ErrClosedPipe, writer.GetError())
+	close(control)
+}
+
+func Test_PcapStream_21_LinkType(t *testing.T) {
+	r := require.New(t)
+
+	// a stream of linux cooked capture such as `tcpdump -i any -w -`.
+	stream := &bytes.Buffer{}
+	w := pcapgo.NewWriter(stream)
+	r.NoError(w.WriteFileHeader(262144, layers.LinkTypeLinuxSLL))
+	data := append([]byte{0, 0, 0, 1, 0, 6, 2, 0, 0, 0, 0, 1, 0, 0, 8, 0}, []byte("SD2")...)
+	ci := gopacket.CaptureInfo{Timestamp: time.Now(), CaptureLength: len(data), Length: len(data)}
+	r.NoError(w.WritePacket(ci, data))
+
+	reader, err := adapters.NewPcapStream(stream, nil)
+	r.NoError(err)
+	linkType, snaplen, err := reader.StreamLinkType()
+	r.NoError(err)
+	r.Equal(layers.LinkTypeLinuxSLL, linkType)
+	r.Equal(262144, snaplen)
+
+	// the reader continues after the header.
+	out, err := reader.Read(make(chan goul.Item), nil)
+	r.NoError(err)
+	packet := (<-out).(gopacket.Packet)
+	r.NotNil(packet.Layer(layers.LayerTypeLinuxSLL))
+	r.Equal(data, packet.Data())
+	_, ok := <-out
+	r.False(ok)
+	r.NoError(reader.GetError())
+}
+
+func Test_PcapStream_30_Exceptions(t *testing.T) {
+	r := require.New(t)
+
+	a, _ := adapters.NewPcapStream(nil, nil)
+	_, err := a.Read(make(chan goul.Item), nil)
+	r.EqualError(err, adapters.ErrPcapStreamNoReader)
+	_, err = a.Write(make(chan goul.Item), nil)
+	r.EqualError(err, adapters.ErrPcapStreamNoWriter)
+	r.EqualError(a.SetLinkType(layers.LinkTypeEthernet, 0), adapters.ErrPcapStreamInvalidSnapLen)
+	_, _, err = a.StreamLinkType()
+	r.EqualError(err, adapters.ErrPcapStreamNoReader)
+	r.NoError(a.Close())
+
+	stdio, err := adapters.NewStdio()
+	r.NoError(err)
+	r.NoError(stdio.Close())
+}
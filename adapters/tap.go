@@ -0,0 +1,256 @@
+//go:build linux
+// +build linux
+
+package adapters
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+	"unsafe"
+
+	"github.com/google/gopacket"
+	"golang.org/x/sys/unix"
+
+	"github.com/hyeoncheon/goul"
+)
+
+// constants...
+const (
+	defaultTapAdapterID = "tap"
+	defaultTapName      = "goul0"
+	tapSweepInterval    = 1 * time.Second
+
+	ErrTapInvalidName = "invalid tap device name"
+)
+
+// TapAdapter is a writer adapter that creates and owns Linux TAP devices
+// and writes the packets into them. With this, local analyzers such as
+// tcpdump, Zeek or Suricata can listen on the TAP device of the receiver
+// without any physical switch or extra NIC.
+//
+// By default, all packets are written into one TAP device. If per session
+// mode is set, a TAP device is created for each session of the network
+// adapter, named with the session ID like `goul0-1`. The device of a
+// session is removed shortly after the session is closed, and the others
+// are removed when the adapter is closed.
+type TapAdapter struct {
+	goul.Adapter
+	ID         string
+	err        error
+	name       string
+	perSession bool
+
+	main  *tapDevice
+	taps  map[*Session]*tapDevice
+	count int
+}
+
+// tapDevice is a created TAP device.
+type tapDevice struct {
+	name string
+	file *os.File
+}
+
+// Write implements interface Adapter
+func (a *TapAdapter) Write(in chan goul.Item, message goul.Message) (chan goul.Item, error) {
+	if a.main == nil {
+		if a.main, a.err = a.create(a.name); a.err != nil {
+			a.SetError(a.err)
+			goul.Error(a.GetLogger(), a.ID, "couldn't create tap device: %v", a.err)
+			return nil, a.err
+		}
+	}
+	return goul.Launch(a.writer, in, message)
+}
+
+// writer writes the packets from input channel into the tap devices.
+func (a *TapAdapter) writer(in, out chan goul.Item, message goul.Message) {
+	defer close(out)
+	defer goul.Log(a.GetLogger(), a.ID, "exit")
+
+	goul.Log(a.GetLogger(), a.ID, "writer in looping...")
+	ticker := time.NewTicker(tapSweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case item, ok := <-in:
+			if !ok {
+				goul.Log(a.GetLogger(), a.ID, "channel closed")
+				goul.Log(a.GetLogger(), a.ID, "%v packets written", a.count)
+				out <- goul.Messages["closed"]
+				return
+			}
+			p, ok := item.(gopacket.Packet)
+			if !ok {
+				continue
+			}
+			tap := a.tapOf(SessionOf(item))
+			if _, err := tap.file.Write(p.Data()); err != nil {
+				goul.Error(a.GetLogger(), a.ID, "couldn't write to %v: %v", tap.name, err)
+				continue
+			}
+			a.count++
+		case <-ticker.C:
+			a.sweep()
+		}
+	}
+}
+
+// sweep removes the tap devices of the closed sessions.
+func (a *TapAdapter) sweep() {
+	for session, tap := range a.taps {
+		if !session.Closed() {
+			continue
+		}
+		if tap != a.main {
+			if err := tap.file.Close(); err != nil {
+				goul.Error(a.GetLogger(), a.ID, "couldn't remove tap device %v: %v", tap.name, err)
+			} else {
+				goul.Log(a.GetLogger(), a.ID, "tap device %v removed", tap.name)
+			}
+		}
+		delete(a.taps, session)
+	}
+}
+
+// NewTap returns new tap adapter. The device is created when the writer
+// is started. If the name is empty, `goul0` is used.
+func NewTap(name string) (*TapAdapter, error) {
+	if name == "" {
+		name = defaultTapName
+	}
+	a := &TapAdapter{
+		Adapter: &goul.BaseAdapter{},
+		ID:      defaultTapAdapterID,
+		name:    name,
+		taps:    map[*Session]*tapDevice{},
+	}
+	if len(name) >= unix.IFNAMSIZ {
+		a.err = errors.New(ErrTapInvalidName)
+	}
+	return a, a.err
+}
+
+// SetPerSession sets per session mode which creates a tap device for
+// each session.
+func (a *TapAdapter) SetPerSession(perSession bool) error {
+	a.perSession = perSession
+	return nil
+}
+
+// Names returns the names of the created tap devices.
+func (a *TapAdapter) Names() []string {
+	names := []string{}
+	if a.main != nil {
+		names = append(names, a.main.name)
+	}
+	for _, tap := range a.taps {
+		if tap != a.main {
+			names = append(names, tap.name)
+		}
+	}
+	return names
+}
+
+// Close implements Adapter: it removes all tap devices.
+func (a *TapAdapter) Close() error {
+	goul.Log(a.GetLogger(), a.ID, "cleanup...")
+	var err error
+	for session, tap := range a.taps {
+		if tap != a.main {
+			if cerr := tap.file.Close(); err == nil {
+				err = cerr
+			}
+		}
+		delete(a.taps, session)
+	}
+	if a.main != nil {
+		if cerr := a.main.file.Close(); err == nil {
+			err = cerr
+		}
+		a.main = nil
+	}
+	return err
+}
+
+// tapOf returns the tap device for the session. If it is failed to create
+// the tap device for the session, the main device is used. The packets of
+// a closed session without the device, which are left in the pipeline,
+// are also written into the main device.
+func (a *TapAdapter) tapOf(session *Session) *tapDevice {
+	if !a.perSession || session == nil {
+		return a.main
+	}
+	if tap, ok := a.taps[session]; ok {
+		return tap
+	}
+	if session.Closed() {
+		return a.main
+	}
+	name := fmt.Sprintf("%v-%v", a.name, session.ID)
+	tap, err := a.create(name)
+	if err != nil {
+		goul.Error(a.GetLogger(), a.ID, "couldn't create tap device %v: %v", name, err)
+		tap = a.main
+	}
+	a.taps[session] = tap
+	return tap
+}
+
+// ifreq is the part of struct ifreq for the name and the flags.
+type ifreq struct {
+	name  [unix.IFNAMSIZ]byte
+	flags uint16
+	_     [22]byte
+}
+
+// create creates a tap device with the name and brings it up. The device
+// is not persistent so it is removed when the file is closed.
+func (a *TapAdapter) create(name string) (*tapDevice, error) {
+	if name == "" || len(name) >= unix.IFNAMSIZ {
+		return nil, errors.New(ErrTapInvalidName)
+	}
+	fd, err := unix.Open("/dev/net/tun", unix.O_RDWR|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, err
+	}
+	req := ifreq{flags: unix.IFF_TAP | unix.IFF_NO_PI}
+	copy(req.name[:], name)
+	if err := ioctl(fd, unix.TUNSETIFF, &req); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	if err := setUp(name); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	goul.Log(a.GetLogger(), a.ID, "tap device %v created", name)
+	return &tapDevice{name: name, file: os.NewFile(uintptr(fd), name)}, nil
+}
+
+// setUp brings the device up.
+func setUp(name string) error {
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+
+	req := ifreq{}
+	copy(req.name[:], name)
+	if err := ioctl(fd, unix.SIOCGIFFLAGS, &req); err != nil {
+		return err
+	}
+	req.flags |= unix.IFF_UP
+	return ioctl(fd, unix.SIOCSIFFLAGS, &req)
+}
+
+func ioctl(fd int, request uintptr, req *ifreq) error {
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), request, uintptr(unsafe.Pointer(req)))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
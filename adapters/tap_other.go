@@ -0,0 +1,32 @@
+//go:build !linux
+// +build !linux
+
+package adapters
+
+import (
+	"errors"
+
+	"github.com/hyeoncheon/goul"
+)
+
+// constants...
+const (
+	ErrTapNotSupported = "tap device is supported on linux only"
+)
+
+// TapAdapter is a placeholder of the TAP adapter on the platforms other
+// than Linux. It cannot be created.
+type TapAdapter struct {
+	goul.Adapter
+	ID string
+}
+
+// NewTap returns an error since TAP device is not supported.
+func NewTap(name string) (*TapAdapter, error) {
+	return nil, errors.New(ErrTapNotSupported)
+}
+
+// SetPerSession is a placeholder.
+func (a *TapAdapter) SetPerSession(perSession bool) error {
+	return errors.New(ErrTapNotSupported)
+}
@@ -0,0 +1,140 @@
+//go:build linux
+// +build linux
+
+package adapters_test
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/hyeoncheon/goul"
+	"github.com/hyeoncheon/goul/adapters"
+	. "github.com/hyeoncheon/goul/testing"
+)
+
+func Test_Tap_10_Write(t *testing.T) {
+	r := require.New(t)
+
+	writer, err := adapters.NewTap("goultest0")
+	r.NoError(err)
+	r.NoError(writer.SetPerSession(true))
+	in := make(chan goul.Item)
+	done, err := writer.Write(in, nil)
+	if err != nil {
+		t.Skipf("couldn't create tap device: %v", err)
+	}
+	intf, err := net.InterfaceByName("goultest0")
+	r.NoError(err)
+	r.NotZero(intf.Flags & net.FlagUp)
+
+	// capture on the tap device to check the written packets.
+	reader, err := adapters.NewAfpacket("goultest0")
+	r.NoError(err)
+	r.NoError(reader.SetFilter(""))
+	ctrl := make(chan goul.Item)
+	out, err := reader.Read(ctrl, nil)
+	r.NoError(err)
+	time.Sleep(100 * time.Millisecond)
+
+	packet, _ := GeneratePacket("TapData")
+	in <- packet
+	found := false
+	timeout := time.After(3 * time.Second)
+	for !found { // skip packets from the kernel such as IPv6 RS
+		select {
+		case item := <-out:
+			found = CheckPacket(item, "TapData") == nil
+		case <-timeout:
+			t.Fatal("packet not captured on tap device")
+		}
+	}
+
+	session := &adapters.Session{ID: 7}
+	packet, _ = GeneratePacket("TapSession")
+	md := packet.Metadata()
+	md.AncillaryData = append(md.AncillaryData, session)
+	in <- packet
+
+	close(in)
+	r.Equal("message", (<-done).String())
+	_, err = net.InterfaceByName("goultest0-7")
+	r.NoError(err)
+	r.ElementsMatch([]string{"goultest0", "goultest0-7"}, writer.Names())
+	close(ctrl)
+	for range out {
+	}
+	r.NoError(reader.Close())
+	r.NoError(writer.Close())
+
+	_, err = net.InterfaceByName("goultest0")
+	r.Error(err) // removed
+	_, err = net.InterfaceByName("goultest0-7")
+	r.Error(err)
+}
+
+func Test_Tap_11_SessionClosed(t *testing.T) {
+	r := require.New(t)
+
+	writer, err := adapters.NewTap("goultest1")
+	r.NoError(err)
+	r.NoError(writer.SetPerSession(true))
+	reader, err := adapters.NewNetwork("", 6011)
+	r.NoError(err)
+	defer reader.Close()
+	server := &goul.BaseRouter{}
+	server.SetLogger(goul.NewLogger("debug"))
+	server.SetReader(reader)
+	server.SetWriter(writer)
+	control, done, err := server.Run()
+	if err != nil {
+		t.Skipf("couldn't create tap device: %v", writer.GetError())
+	}
+
+	client, err := adapters.NewNetwork("localhost", 6011)
+	r.NoError(err)
+	in := make(chan goul.Item)
+	sent, err := client.Write(in, nil)
+	r.NoError(err)
+	packet, _ := GeneratePacket("TapSession")
+	in <- packet
+
+	// the device of the session is removed after the session is closed.
+	r.Eventually(func() bool { return len(sessionTaps("goultest1-")) == 1 }, 3*time.Second, 100*time.Millisecond)
+	close(in)
+	<-sent
+	r.Eventually(func() bool { return len(sessionTaps("goultest1-")) == 0 }, 3*time.Second, 100*time.Millisecond)
+	_, err = net.InterfaceByName("goultest1")
+	r.NoError(err)
+
+	close(control)
+	<-done
+	r.NoError(writer.Close())
+}
+
+// sessionTaps returns the names of the interfaces with the prefix.
+func sessionTaps(prefix string) []string {
+	names := []string{}
+	intfs, _ := net.Interfaces()
+	for _, intf := range intfs {
+		if strings.HasPrefix(intf.Name, prefix) {
+			names = append(names, intf.Name)
+		}
+	}
+	return names
+}
+
+func Test_Tap_20_Exceptions(t *testing.T) {
+	r := require.New(t)
+
+	_, err := adapters.NewTap("very-long-tap-name")
+	r.EqualError(err, adapters.ErrTapInvalidName)
+
+	writer, err := adapters.NewTap("")
+	r.NoError(err)
+	r.Equal([]string{}, writer.Names())
+	r.NoError(writer.Close())
+}
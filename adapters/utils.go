@@ -0,0 +1,106 @@
+package adapters
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/gopacket"
+
+	"github.com/hyeoncheon/goul"
+)
+
+// constants...
+const (
+	defaultPcapSnapLen = 65536
+)
+
+// captureInfo returns capture information and data of the item so it can
+// be written into pcap family of files or streams. If the item is not a
+// packet or the packet has no valid capture information, it fills the
+// capture information with current time and length of the data.
+// The data will be truncated if it is longer than snaplen.
+func captureInfo(item goul.Item, snaplen int) (gopacket.CaptureInfo, []byte) {
+	data := item.Data()
+	var ci gopacket.CaptureInfo
+	if p, ok := item.(gopacket.Packet); ok && p.Metadata() != nil {
+		ci = p.Metadata().CaptureInfo
+	}
+	if ci.Timestamp.IsZero() {
+		ci.Timestamp = time.Now()
+	}
+	if ci.CaptureLength != len(data) || ci.Length < len(data) {
+		ci.CaptureLength = len(data)
+		ci.Length = len(data)
+	}
+	if snaplen > 0 && len(data) > snaplen {
+		data = data[:snaplen]
+		ci.CaptureLength = snaplen
+	}
+	return ci, data
+}
+
+// combineFilter returns the filter expression which matches the filter but
+// not the exclusion. The empty one is omitted.
+func combineFilter(filter, exclude string) string {
+	switch {
+	case exclude == "":
+		return filter
+	case filter == "":
+		return "not (" + exclude + ")"
+	}
+	return "(" + filter + ") and not (" + exclude + ")"
+}
+
+// strftime formats the time with strftime(3) style conversion
+// specifications such as `%Y%m%d-%H%M%S`. Unsupported specifications are
+// left as is.
+func strftime(format string, t time.Time) string {
+	var b strings.Builder
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' || i == len(format)-1 {
+			b.WriteByte(format[i])
+			continue
+		}
+		i++
+		switch format[i] {
+		case 'Y':
+			b.WriteString(t.Format("2006"))
+		case 'y':
+			b.WriteString(t.Format("06"))
+		case 'm':
+			b.WriteString(t.Format("01"))
+		case 'd':
+			b.WriteString(t.Format("02"))
+		case 'H':
+			b.WriteString(t.Format("15"))
+		case 'M':
+			b.WriteString(t.Format("04"))
+		case 'S':
+			b.WriteString(t.Format("05"))
+		case 'j':
+			b.WriteString(fmt.Sprintf("%03d", t.YearDay()))
+		case 'b':
+			b.WriteString(t.Format("Jan"))
+		case 'a':
+			b.WriteString(t.Format("Mon"))
+		case 'Z':
+			b.WriteString(t.Format("MST"))
+		case 'z':
+			b.WriteString(t.Format("-0700"))
+		case 's':
+			b.WriteString(strconv.FormatInt(t.Unix(), 10))
+		case 'F':
+			b.WriteString(t.Format("2006-01-02"))
+		case 'T':
+			b.WriteString(t.Format("15:04:05"))
+		case '%':
+			b.WriteByte('%')
+		default:
+			b.WriteByte('%')
+			b.WriteByte(format[i])
+		}
+	}
+	return b.String()
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"os"
 	"strings"
+	"time"
 
 	getopt "github.com/pborman/getopt/v2"
 
@@ -25,7 +26,81 @@ type Options struct {
 	addr     string
 	port     int
 	device   string
+	netns    string
 	filter   string
+
+	filterFile    string
+	controlFile   string
+	direction     string
+	devFilters    []string
+	excludePorts  []string
+	statsInterval time.Duration
+	retryInterval time.Duration
+
+	snaplen    int
+	promisc    bool
+	timeout    int
+	bufferSize int
+	immediate  bool
+	tstampType string
+	tstampNano bool
+
+	readStream     string
+	writeStream    string
+	readPcapOverIP string
+	pcapOverIP     string
+	readFile       string
+	nflog          string
+	replaySpeed    float64
+	loop           bool
+	writeDir       string
+	writePcapNg    string
+	rotateSize     int
+	rotateInterval time.Duration
+	rotateCount    int
+	maxFiles       int
+	tap            string
+	tapPerSession  bool
+
+	setDstMAC      string
+	setSrcMAC      string
+	pushVLAN       int
+	vlanPerSession bool
+	popVLAN        bool
+	setTTL         int
+	fixChecksums   bool
+
+	afpacket   bool
+	blockSize  int
+	blocks     int
+	fanout     int
+	fanoutType string
+
+	process    bool
+	processLog string
+
+	dedupWindow     time.Duration
+	dedupIgnoreIPID bool
+	protocolStats   bool
+	sample          int
+	sampleMode      string
+	postFilter      string
+	postFilterDrop  bool
+
+	truncate        int
+	truncateHeaders bool
+	truncatePayload int
+	fixTruncated    bool
+
+	anonymizeKey   string
+	deanonymizeKey string
+	scrubMAC       bool
+
+	recordWindow  time.Duration
+	recordSize    int
+	recordAfter   time.Duration
+	recordFile    string
+	recordTrigger string
 }
 
 func main() {
@@ -51,6 +126,11 @@ func getOptions() *Options {
 		addr:     "",
 		port:     PORT,
 		device:   "eth0",
+
+		snaplen:    defaultSnapLen,
+		promisc:    true,
+		timeout:    defaultTimeout,
+		fanoutType: "hash",
 	}
 	getopt.SetParameters("filters ...")
 	getopt.FlagLong(&help, "help", 'h', "help")
@@ -60,7 +140,71 @@ func getOptions() *Options {
 	getopt.FlagLong(&opts.isServer, "server", 's', "run as receiver")
 	getopt.FlagLong(&opts.addr, "addr", 'a', "address to connect (for client)")
 	getopt.FlagLong(&opts.port, "port", 'p', "tcp port number (default is 6001)")
-	getopt.FlagLong(&opts.device, "dev", 'd', "network interface to read/write")
+	getopt.FlagLong(&opts.device, "dev", 'd', "network interface(s) to read/write, separated by comma")
+	getopt.FlagLong(&opts.netns, "netns", 0, "network namespace of the device(s), a path or a name of ip netns")
+	getopt.FlagLong(&opts.filterFile, "filter-file", 0, "file of the filter expression, reloaded on SIGHUP (for client)")
+	getopt.FlagLong(&opts.controlFile, "control-file", 0, "file of control commands, applied on SIGHUP or sent to the clients (for server)")
+	getopt.FlagLong(&opts.devFilters, "dev-filter", 0, "filter for a device as dev=filter (for client)")
+	getopt.FlagLong(&opts.excludePorts, "exclude-port", 0, "relay or management ports to exclude from capture, separated by comma (for client)")
+	getopt.FlagLong(&opts.direction, "direction", 0, "capture direction: in, out or inout (for client)")
+	getopt.FlagLong(&opts.snaplen, "snaplen", 0, "snapshot length in bytes")
+	getopt.FlagLong(&opts.promisc, "promisc", 0, "promiscuous mode, --promisc=false to disable")
+	getopt.FlagLong(&opts.timeout, "timeout", 0, "read timeout in seconds")
+	getopt.FlagLong(&opts.bufferSize, "buffer-size", 0, "kernel capture buffer size in kilobytes (for client)")
+	getopt.FlagLong(&opts.immediate, "immediate", 0, "deliver packets immediately without buffering (for client)")
+	getopt.FlagLong(&opts.tstampType, "tstamp-type", 0, "timestamp type such as host, adapter or adapter_unsynced (for client)")
+	getopt.FlagLong(&opts.tstampNano, "tstamp-nano", 0, "require nanosecond timestamp precision (for client)")
+	getopt.FlagLong(&opts.statsInterval, "stats-interval", 0, "interval of capture and injection statistics logging (default is 1m)")
+	getopt.FlagLong(&opts.retryInterval, "retry-interval", 0, "interval to retry opening the device while it is down (default is 1s)")
+	getopt.FlagLong(&opts.afpacket, "afpacket", 0, "capture with AF_PACKET ring instead of libpcap (for client)")
+	getopt.FlagLong(&opts.blockSize, "block-size", 0, "block size of AF_PACKET ring in kilobytes (default is 512)")
+	getopt.FlagLong(&opts.blocks, "blocks", 0, "number of blocks of AF_PACKET ring (default is 128)")
+	getopt.FlagLong(&opts.fanout, "fanout", 0, "number of AF_PACKET capturing workers in fanout group")
+	getopt.FlagLong(&opts.fanoutType, "fanout-type", 0, "fanout type: hash, lb, cpu, rollover, random or qm")
+	getopt.FlagLong(&opts.readStream, "read", 0, "pcap stream to read instead of capture, - for stdin (for client)")
+	getopt.FlagLong(&opts.writeStream, "write", 0, "pcap stream to write instead of injection, - for stdout (for server)")
+	getopt.FlagLong(&opts.readPcapOverIP, "read-pcap-over-ip", 0, "pcap-over-ip stream to read instead of capture, :port to listen or host:port to connect (for client)")
+	getopt.FlagLong(&opts.pcapOverIP, "pcap-over-ip", 0, "pcap-over-ip stream to serve instead of injection, :port to listen or host:port to connect (for server)")
+	getopt.FlagLong(&opts.readFile, "read-file", 0, "pcap or pcapng file to replay instead of capture (for client)")
+	getopt.FlagLong(&opts.nflog, "nflog", 0, "nflog group to read instead of capture (for client)")
+	getopt.FlagLong(&opts.replaySpeed, "replay-speed", 0, "replay speed multiplier (0 is as fast as possible)")
+	getopt.FlagLong(&opts.loop, "loop", 0, "replay the file in loop")
+	getopt.FlagLong(&opts.writeDir, "write-dir", 0, "directory to write pcap files instead of injection or sending")
+	getopt.FlagLong(&opts.writePcapNg, "write-pcapng", 0, "pcapng file to write packets of all sessions (for server)")
+	getopt.FlagLong(&opts.rotateSize, "rotate-size", 0, "rotate pcap file when it reaches given megabytes")
+	getopt.FlagLong(&opts.rotateInterval, "rotate-interval", 0, "rotate pcap file with given interval (e.g. 1h)")
+	getopt.FlagLong(&opts.rotateCount, "rotate-count", 0, "rotate pcap file when it contains given packets")
+	getopt.FlagLong(&opts.maxFiles, "max-files", 0, "number of pcap files to keep (0 is unlimited)")
+	getopt.FlagLong(&opts.tap, "tap", 0, "tap device to create and inject into instead of the device (for server)")
+	getopt.FlagLong(&opts.tapPerSession, "tap-per-session", 0, "create a tap device for each session (for server)")
+	getopt.FlagLong(&opts.setDstMAC, "set-dst-mac", 0, "rewrite destination MAC address before injection (for server)")
+	getopt.FlagLong(&opts.setSrcMAC, "set-src-mac", 0, "rewrite source MAC address before injection (for server)")
+	getopt.FlagLong(&opts.pushVLAN, "push-vlan", 0, "push 802.1Q tag of given VLAN before injection (for server)")
+	getopt.FlagLong(&opts.vlanPerSession, "vlan-per-session", 0, "push VLAN of push-vlan plus session ID for each session (for server)")
+	getopt.FlagLong(&opts.popVLAN, "pop-vlan", 0, "pop outer 802.1Q tag before injection (for server)")
+	getopt.FlagLong(&opts.setTTL, "set-ttl", 0, "rewrite IP TTL or hop limit before injection (for server)")
+	getopt.FlagLong(&opts.fixChecksums, "fix-checksums", 0, "recompute checksums of rewritten or anonymized packets")
+	getopt.FlagLong(&opts.process, "process", 0, "annotate packets with their local processes (for client)")
+	getopt.FlagLong(&opts.processLog, "process-log", 0, "file to log flows with their processes as JSON lines (for client)")
+	getopt.FlagLong(&opts.dedupWindow, "dedup-window", 0, "drop duplicated packets seen within given duration (default is 50ms)")
+	getopt.FlagLong(&opts.dedupIgnoreIPID, "dedup-ignore-ipid", 0, "ignore IPv4 ID when comparing packets for dedup (enables dedup)")
+	getopt.FlagLong(&opts.sample, "sample", 0, "send 1 in given number of packets or flows (for client)")
+	getopt.FlagLong(&opts.sampleMode, "sample-mode", 0, "sampling mode: count, random or flow (default is count)")
+	getopt.FlagLong(&opts.postFilter, "post-filter", 0, "keep packets matching given expression over decoded fields (e.g. tls.sni ~ \"*.example.com\")")
+	getopt.FlagLong(&opts.postFilterDrop, "post-filter-drop", 0, "drop packets matching post-filter instead of keeping them")
+	getopt.FlagLong(&opts.protocolStats, "protocol-stats", 0, "count packets by protocols and ports, logged on exit and for each stats-interval")
+	getopt.FlagLong(&opts.truncate, "truncate", 0, "truncate packets to given length before sending (for client)")
+	getopt.FlagLong(&opts.truncateHeaders, "truncate-headers", 0, "truncate packets after L4 header before sending (for client)")
+	getopt.FlagLong(&opts.truncatePayload, "truncate-payload", 0, "keep given bytes of payload after L4 header (implies truncate-headers)")
+	getopt.FlagLong(&opts.fixTruncated, "fix-truncated", 0, "fix lengths and checksums of truncated packets before injection (for server)")
+	getopt.FlagLong(&opts.anonymizeKey, "anonymize-key", 0, "key file to anonymize IP addresses with Crypto-PAn before sending (for client)")
+	getopt.FlagLong(&opts.deanonymizeKey, "deanonymize-key", 0, "key file to restore anonymized IP addresses (for server)")
+	getopt.FlagLong(&opts.scrubMAC, "scrub-mac", 0, "replace MAC addresses while anonymizing (for client)")
+	getopt.FlagLong(&opts.recordWindow, "record-window", 0, "keep packets of given duration and send them on trigger (for client)")
+	getopt.FlagLong(&opts.recordSize, "record-size", 0, "keep packets up to given megabytes and send them on trigger (for client)")
+	getopt.FlagLong(&opts.recordAfter, "record-after", 0, "keep sending packets for given duration after trigger")
+	getopt.FlagLong(&opts.recordFile, "record-file", 0, "file to map as the recording buffer instead of memory")
+	getopt.FlagLong(&opts.recordTrigger, "record-trigger", 0, "filter expression of packets that trigger the recorder")
 	getopt.FlagLong(&version, "version", 'v', "show version of goul")
 
 	getopt.Parse()
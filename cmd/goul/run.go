@@ -1,72 +1,449 @@
 package main
 
 import (
+	"encoding/hex"
 	"errors"
+	"fmt"
+	"net"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"syscall"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
 
 	"github.com/hyeoncheon/goul"
 	"github.com/hyeoncheon/goul/adapters"
+	"github.com/hyeoncheon/goul/pipes"
 )
 
 // constants
 const (
 	ErrCouldNotCreateDeviceReader = "couldn't create new device reader"
 	ErrCouldNotCreateDeviceWriter = "couldn't create new device writer"
+	ErrCouldNotCreateFileWriter   = "couldn't create new pcap file writer"
+	ErrCouldNotCreateFileReader   = "couldn't create new pcap file reader"
+	ErrCouldNotCreateStream       = "couldn't create new pcap stream"
+	ErrCouldNotCreatePcapOverIP   = "couldn't create new pcap-over-ip adapter"
+	ErrCouldNotCreateTapWriter    = "couldn't create new tap device writer"
+	ErrCouldNotCreateNflogReader  = "couldn't create new nflog reader"
+	ErrCouldNotCreateRecorder     = "couldn't create new flight recorder"
+	ErrCouldNotCreateRewriter     = "couldn't create new rewriter"
+	ErrCouldNotCreateProcessLog   = "couldn't create process log"
+	ErrCouldNotReadAnonymizerKey  = "couldn't read anonymizer key"
+	ErrCouldNotCreateSampler      = "couldn't create new sampler"
+	ErrCouldNotCreateFilter       = "couldn't create new post filter"
+	ErrInvalidDeviceFilter        = "invalid device filter, it should be dev=filter"
+	ErrInvalidExcludePort         = "invalid port to exclude"
+	ErrCouldNotReadFilterFile     = "couldn't read filter file"
+	ErrCouldNotReadControlFile    = "couldn't read control file"
+	ErrInvalidControlCommand      = "invalid control command"
 	ErrCouldNotStartTheRouter     = "couldn't start the router"
 )
 
 func run(opts *Options, sigs ...chan os.Signal) error {
 	var err error
+	var recorder *pipes.FlightRecorder
+	var sampler *pipes.Sampler
+	var capturer excluder // reader which can change the filter at runtime
+	var receiver *adapters.NetworkAdapter
 	var router goul.Router = &goul.Pipeline{Router: &goul.BaseRouter{}}
+	ctl := &controls{}
 
 	logger := logger(opts)
 	router.SetLogger(logger)
 
+	if opts.controlFile != "" {
+		if _, err := readControl(opts.controlFile); err != nil {
+			logger.Error(ErrCouldNotReadControlFile, ": ", err)
+			return errors.New(ErrCouldNotReadControlFile)
+		}
+	}
+
 	if opts.isServer {
 		logger.Debugf("initialize network connection %v:%v...", opts.addr, opts.port)
 		reader, _ := adapters.NewNetwork(opts.addr, opts.port)
 		defer reader.Close()
+		// only the file writers need the original timestamps.
+		reader.SetTimestamps(opts.writeDir != "" || opts.writeStream != "" || opts.writePcapNg != "" ||
+			opts.pcapOverIP != "")
+		receiver = reader
 
-		logger.Debugf("initialize device pump on %v...", opts.device)
-		writer, err := adapters.NewDevice(opts.device, opts.isTest)
-		if err != nil {
-			logger.Error(ErrCouldNotCreateDeviceWriter, ": ", err)
-			return errors.New(ErrCouldNotCreateDeviceWriter)
-		}
-		defer reader.Close()
+		router.SetReader(reader)
+		if opts.writeDir != "" {
+			logger.Debugf("initialize pcap file writer on %v...", opts.writeDir)
+			writer, err := newFileWriter(opts)
+			if err != nil {
+				logger.Error(ErrCouldNotCreateFileWriter, ": ", err)
+				return errors.New(ErrCouldNotCreateFileWriter)
+			}
+			defer writer.Close()
 
-		writer.SetOptions(true, 1600, 1)
+			router.SetWriter(writer)
+		} else if opts.writeStream != "" {
+			logger.Debugf("initialize pcap stream writer on %v...", opts.writeStream)
+			writer, err := newStream(opts.writeStream, true)
+			if err != nil {
+				logger.Error(ErrCouldNotCreateStream, ": ", err)
+				return errors.New(ErrCouldNotCreateStream)
+			}
+			defer writer.Close()
 
-		router.SetReader(reader)
-		router.SetWriter(writer)
+			router.SetWriter(writer)
+		} else if opts.pcapOverIP != "" {
+			logger.Debugf("initialize pcap-over-ip writer on %v...", opts.pcapOverIP)
+			writer, err := newPcapOverIP(opts.pcapOverIP)
+			if err != nil {
+				logger.Error(ErrCouldNotCreatePcapOverIP, ": ", err)
+				return errors.New(ErrCouldNotCreatePcapOverIP)
+			}
+			defer writer.Close()
+
+			router.SetWriter(writer)
+		} else if opts.writePcapNg != "" {
+			logger.Debugf("initialize pcapng file writer on %v...", opts.writePcapNg)
+			writer, _ := adapters.NewPcapNgFile(opts.writePcapNg)
+			defer writer.Close()
+
+			router.SetWriter(writer)
+		} else if opts.tap != "" {
+			logger.Debugf("initialize tap device writer on %v...", opts.tap)
+			writer, err := adapters.NewTap(opts.tap)
+			if err == nil {
+				err = writer.SetPerSession(opts.tapPerSession)
+			}
+			if err != nil {
+				logger.Error(ErrCouldNotCreateTapWriter, ": ", err)
+				return errors.New(ErrCouldNotCreateTapWriter)
+			}
+			defer writer.Close()
+
+			router.SetWriter(writer)
+		} else if strings.ContainsAny(opts.device, ",=") {
+			logger.Debugf("initialize device pumps on %v...", opts.device)
+			writer, err := newDemuxWriter(opts)
+			if err != nil {
+				logger.Error(ErrCouldNotCreateDeviceWriter, ": ", err)
+				return errors.New(ErrCouldNotCreateDeviceWriter)
+			}
+			defer writer.Close()
+
+			router.SetWriter(writer)
+		} else {
+			logger.Debugf("initialize device pump on %v...", opts.device)
+			writer, err := adapters.NewDeviceInNetns(opts.device, opts.netns, opts.isTest)
+			if err != nil {
+				logger.Error(ErrCouldNotCreateDeviceWriter, ": ", err)
+				return errors.New(ErrCouldNotCreateDeviceWriter)
+			}
+			defer writer.Close()
+
+			if err := setDeviceOptions(writer, opts, false); err != nil {
+				logger.Error(ErrCouldNotCreateDeviceWriter, ": ", err)
+				return errors.New(ErrCouldNotCreateDeviceWriter)
+			}
+
+			router.SetWriter(writer)
+		}
+		if opts.deanonymizeKey != "" {
+			anonymizer, err := newAnonymizer(opts.deanonymizeKey, opts, goul.ModeReverter)
+			if err != nil {
+				logger.Error(ErrCouldNotReadAnonymizerKey, ": ", err)
+				return errors.New(ErrCouldNotReadAnonymizerKey)
+			}
+			router.AddPipe(anonymizer)
+		}
+		if opts.postFilter != "" {
+			filter, err := newFilter(opts)
+			if err != nil {
+				logger.Error(ErrCouldNotCreateFilter, ": ", err)
+				return errors.New(ErrCouldNotCreateFilter)
+			}
+			logger.Infof("post filter is enabled: %v", opts.postFilter)
+			router.AddPipe(filter)
+		}
+		if dedup := newDeduplicator(opts); dedup != nil {
+			logger.Infof("deduplication is enabled")
+			router.AddPipe(dedup)
+		}
+		if opts.protocolStats {
+			router.AddPipe(newProtocolStats(opts))
+		}
+		if opts.fixTruncated {
+			router.AddPipe(&pipes.Truncator{Pipe: &goul.BasePipe{Mode: goul.ModeConverter}, FixUp: true})
+		}
+		rewriter, err := newRewriter(opts)
+		if err != nil {
+			logger.Error(ErrCouldNotCreateRewriter, ": ", err)
+			return errors.New(ErrCouldNotCreateRewriter)
+		}
+		if rewriter != nil {
+			router.AddPipe(rewriter)
+		}
 		//router.AddPipe(&pipes.CompressZLib{Pipe: &goul.BasePipe{Mode: goul.ModeReverter}})
 		//router.AddPipe(&pipes.DebugPipe{Pipe: &goul.BasePipe{Mode: goul.ModeConverter}})
 	} else {
-		logger.Debugf("initialize device dump on %v...", opts.device)
-		reader, err := adapters.NewDevice(opts.device, opts.isTest)
-		if err != nil {
-			logger.Error(ErrCouldNotCreateDeviceReader, ": ", err)
-			return errors.New(ErrCouldNotCreateDeviceReader)
+		source := opts.device
+		linkType, snapLen := layers.LinkTypeEthernet, snaplen(opts)
+		if opts.filterFile != "" {
+			opts.filter, err = readFilter(opts.filterFile)
+			if err != nil {
+				logger.Error(ErrCouldNotReadFilterFile, ": ", err)
+				return errors.New(ErrCouldNotReadFilterFile)
+			}
 		}
-		defer reader.Close()
+		if opts.readStream != "" {
+			logger.Debugf("initialize pcap stream reader on %v...", opts.readStream)
+			reader, err := newStream(opts.readStream, false)
+			if err != nil {
+				logger.Error(ErrCouldNotCreateStream, ": ", err)
+				return errors.New(ErrCouldNotCreateStream)
+			}
+			defer reader.Close()
+
+			if opts.filter != "" {
+				logger.Warnf("filter is not supported for pcap stream: <%v>", opts.filter)
+			}
+			source = "stdin"
+			if opts.readStream != "-" {
+				source = filepath.Base(opts.readStream)
+			}
+			linkType, snapLen, err = reader.StreamLinkType()
+			if err != nil {
+				logger.Error(ErrCouldNotCreateStream, ": ", err)
+				return errors.New(ErrCouldNotCreateStream)
+			}
+			if snapLen <= 0 {
+				snapLen = snaplen(opts)
+			}
+
+			router.SetReader(reader)
+		} else if opts.readPcapOverIP != "" {
+			logger.Debugf("initialize pcap-over-ip reader on %v...", opts.readPcapOverIP)
+			reader, err := newPcapOverIP(opts.readPcapOverIP)
+			if err != nil {
+				logger.Error(ErrCouldNotCreatePcapOverIP, ": ", err)
+				return errors.New(ErrCouldNotCreatePcapOverIP)
+			}
+			defer reader.Close()
+
+			if opts.filter != "" {
+				logger.Warnf("filter is not supported for pcap-over-ip: <%v>", opts.filter)
+			}
+			source = "pcap-over-ip:" + opts.readPcapOverIP
+
+			router.SetReader(reader)
+		} else if opts.readFile != "" {
+			logger.Debugf("initialize pcap file reader on %v...", opts.readFile)
+			reader, _ := adapters.NewPcapFile(opts.readFile)
+			defer reader.Close()
+
+			if err := reader.SetReplay(opts.replaySpeed, opts.loop); err != nil {
+				logger.Error(ErrCouldNotCreateFileReader, ": ", err)
+				return errors.New(ErrCouldNotCreateFileReader)
+			}
+			if opts.filter != "" {
+				logger.Warnf("filter is not supported for pcap file: <%v>", opts.filter)
+			}
+			source = filepath.Base(opts.readFile)
+			linkType, snapLen, err = reader.FileLinkType()
+			if err != nil {
+				logger.Error(ErrCouldNotCreateFileReader, ": ", err)
+				return errors.New(ErrCouldNotCreateFileReader)
+			}
+			if snapLen <= 0 {
+				snapLen = snaplen(opts)
+			}
+
+			router.SetReader(reader)
+		} else if opts.nflog != "" {
+			logger.Debugf("initialize nflog reader on group %v...", opts.nflog)
+			reader, err := newNflogReader(opts)
+			if err != nil {
+				logger.Error(ErrCouldNotCreateNflogReader, ": ", err)
+				return errors.New(ErrCouldNotCreateNflogReader)
+			}
+			defer reader.Close()
 
-		if opts.filter != "" {
-			logger.Infof("user defined filter: <%v>", opts.filter)
-			reader.SetFilter(opts.filter)
+			if opts.filter != "" {
+				logger.Warnf("filter is not supported for nflog, use the rules: <%v>", opts.filter)
+			}
+			source = "nflog:" + opts.nflog
+
+			router.SetReader(reader)
+		} else if opts.afpacket {
+			logger.Debugf("initialize afpacket capture on %v...", opts.device)
+			if opts.netns != "" {
+				logger.Warnf("network namespace is not supported for afpacket: <%v>", opts.netns)
+			}
+			reader, err := newAfpacketReader(opts)
+			if err != nil {
+				logger.Error(ErrCouldNotCreateDeviceReader, ": ", err)
+				return errors.New(ErrCouldNotCreateDeviceReader)
+			}
+			defer reader.Close()
+
+			capturer = reader
+			router.SetReader(reader)
+		} else if strings.Contains(opts.device, ",") {
+			logger.Debugf("initialize device dumps on %v...", opts.device)
+			reader, err := newMultiDeviceReader(opts)
+			if err != nil {
+				logger.Error(ErrCouldNotCreateDeviceReader, ": ", err)
+				return errors.New(ErrCouldNotCreateDeviceReader)
+			}
+			defer reader.Close()
+
+			capturer = reader
+			router.SetReader(reader)
+		} else {
+			logger.Debugf("initialize device dump on %v...", opts.device)
+			reader, err := adapters.NewDeviceInNetns(opts.device, opts.netns, opts.isTest)
+			if err != nil {
+				logger.Error(ErrCouldNotCreateDeviceReader, ": ", err)
+				return errors.New(ErrCouldNotCreateDeviceReader)
+			}
+			defer reader.Close()
+
+			if opts.filter != "" {
+				logger.Infof("user defined filter: <%v>", opts.filter)
+				reader.SetFilter(opts.filter)
+			}
+			if opts.direction != "" {
+				if err := reader.SetDirection(opts.direction); err != nil {
+					logger.Error(ErrCouldNotCreateDeviceReader, ": ", err)
+					return errors.New(ErrCouldNotCreateDeviceReader)
+				}
+			}
+			if err := setDeviceOptions(reader, opts, true); err != nil {
+				logger.Error(ErrCouldNotCreateDeviceReader, ": ", err)
+				return errors.New(ErrCouldNotCreateDeviceReader)
+			}
+
+			capturer = reader
+			router.SetReader(reader)
 		}
-		reader.SetOptions(true, 1600, 1)
 
-		logger.Debugf("initialize network connection %v:%v...", opts.addr, opts.port)
-		writer, _ := adapters.NewNetwork(opts.addr, opts.port)
-		defer writer.Close()
+		ports, err := excludedPorts(opts)
+		if err != nil {
+			logger.Error(ErrInvalidExcludePort, ": ", err)
+			return errors.New(ErrInvalidExcludePort)
+		}
+		if capturer != nil && len(ports) > 0 {
+			if err := capturer.SetExclude(exclusion(nil, nil, ports)); err != nil {
+				logger.Warnf("couldn't exclude ports %v: %v", ports, err)
+			}
+		}
 
-		router.SetReader(reader)
-		router.SetWriter(writer)
+		if opts.writeDir != "" {
+			logger.Debugf("initialize pcap file writer on %v...", opts.writeDir)
+			writer, err := newFileWriter(opts)
+			if err != nil {
+				logger.Error(ErrCouldNotCreateFileWriter, ": ", err)
+				return errors.New(ErrCouldNotCreateFileWriter)
+			}
+			defer writer.Close()
+			if err := writer.SetLinkType(linkType, snapLen); err != nil {
+				logger.Error(ErrCouldNotCreateFileWriter, ": ", err)
+				return errors.New(ErrCouldNotCreateFileWriter)
+			}
+
+			router.SetWriter(writer)
+		} else {
+			logger.Debugf("initialize network connection %v:%v...", opts.addr, opts.port)
+			writer, _ := adapters.NewNetwork(opts.addr, opts.port)
+			defer writer.Close()
+			writer.SetSource(source, linkType, snapLen)
+			writer.SetControlHandler(func(item goul.Item) {
+				ctl.apply(logger, item)
+			})
+			if capturer != nil {
+				writer.SetConnectHandler(func(local, remote net.Addr) {
+					logger.Infof("excluding own connection %v-%v from capture", local, remote)
+					if err := capturer.SetExclude(exclusion(local, remote, ports)); err != nil {
+						logger.Warnf("couldn't exclude own connection: %v", err)
+					}
+				})
+			}
+
+			router.SetWriter(writer)
+		}
+		if dedup := newDeduplicator(opts); dedup != nil {
+			logger.Infof("deduplication is enabled")
+			router.AddPipe(dedup)
+		}
+		if opts.postFilter != "" {
+			filter, err := newFilter(opts)
+			if err != nil {
+				logger.Error(ErrCouldNotCreateFilter, ": ", err)
+				return errors.New(ErrCouldNotCreateFilter)
+			}
+			logger.Infof("post filter is enabled: %v", opts.postFilter)
+			router.AddPipe(filter)
+		}
+		if opts.sample != 0 {
+			sampler, err = newSampler(opts)
+			if err != nil {
+				logger.Error(ErrCouldNotCreateSampler, ": ", err)
+				return errors.New(ErrCouldNotCreateSampler)
+			}
+			logger.Infof("sampling 1 in %v (%v)", opts.sample, sampler.Mode)
+			router.AddPipe(sampler)
+		}
+		if opts.protocolStats {
+			router.AddPipe(newProtocolStats(opts))
+		}
+		if opts.process || opts.processLog != "" {
+			tagger := &pipes.ProcessTagger{Pipe: &goul.BasePipe{Mode: goul.ModeConverter}}
+			if opts.processLog != "" {
+				log, err := os.OpenFile(opts.processLog, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+				if err != nil {
+					logger.Error(ErrCouldNotCreateProcessLog, ": ", err)
+					return errors.New(ErrCouldNotCreateProcessLog)
+				}
+				defer log.Close()
+				tagger.FlowLog = log
+			}
+			logger.Infof("process attribution is enabled")
+			router.AddPipe(tagger)
+		}
+		if truncator := newTruncator(opts); truncator != nil {
+			logger.Infof("truncation is enabled")
+			router.AddPipe(truncator)
+		}
+		if opts.recordWindow > 0 || opts.recordSize > 0 {
+			recorder, err = newRecorder(opts, linkType, snapLen)
+			if err != nil {
+				logger.Error(ErrCouldNotCreateRecorder, ": ", err)
+				return errors.New(ErrCouldNotCreateRecorder)
+			}
+			if triggerSignal != nil {
+				logger.Infof("flight recorder is enabled. send %v to trigger", triggerSignal)
+			} else {
+				logger.Infof("flight recorder is enabled. use control file to trigger")
+			}
+			router.AddPipe(recorder)
+		}
+		if opts.anonymizeKey != "" {
+			anonymizer, err := newAnonymizer(opts.anonymizeKey, opts, goul.ModeConverter)
+			if err != nil {
+				logger.Error(ErrCouldNotReadAnonymizerKey, ": ", err)
+				return errors.New(ErrCouldNotReadAnonymizerKey)
+			}
+			logger.Infof("anonymization is enabled")
+			router.AddPipe(anonymizer)
+		}
 		//router.AddPipe(&pipes.DebugPipe{Pipe: &goul.BasePipe{Mode: goul.ModeConverter}})
 		//router.AddPipe(&pipes.CompressZLib{Pipe: &goul.BasePipe{Mode: goul.ModeConverter}})
 		//router.AddPipe(&pipes.DebugPipe{Pipe: &goul.BasePipe{Mode: goul.ModeReverter}})
+		ctl.capturer = capturer
+		ctl.recorder = recorder
+		ctl.sampler = sampler
 	}
 	control, done, err := router.Run()
 	if err != nil {
@@ -80,6 +457,12 @@ func run(opts *Options, sigs ...chan os.Signal) error {
 		sig = sigs[0]
 	}
 	signal.Notify(sig, os.Interrupt)
+	if recorder != nil && triggerSignal != nil {
+		signal.Notify(sig, triggerSignal)
+	}
+	if opts.filterFile != "" || opts.controlFile != "" {
+		signal.Notify(sig, syscall.SIGHUP)
+	}
 	go func() {
 		for {
 			s := <-sig
@@ -92,6 +475,25 @@ func run(opts *Options, sigs ...chan os.Signal) error {
 				default: // if channel is still alive
 					close(control)
 				}
+			case triggerSignal:
+				if recorder == nil {
+					logger.Warnf("got signal '%v' but no recorder enabled!", s.String())
+					break
+				}
+				logger.Info("triggering flight recorder...")
+				recorder.Trigger("signal")
+			case syscall.SIGHUP:
+				if opts.controlFile != "" {
+					reloadControl(logger, opts.controlFile, receiver, ctl)
+				}
+				if opts.filterFile == "" {
+					break
+				}
+				if capturer == nil {
+					logger.Warnf("got signal '%v' but no filter to reload!", s.String())
+					break
+				}
+				reloadFilter(logger, capturer, opts.filterFile)
 			default:
 				logger.Warnf("got signal '%v' but no handler defined!", s.String())
 			}
@@ -111,6 +513,597 @@ func run(opts *Options, sigs ...chan os.Signal) error {
 
 //** utilities...
 
+// default capture options.
+const (
+	defaultSnapLen = 1600
+	defaultTimeout = 1
+)
+
+// default ring of afpacket capture, 128 blocks of 512KB.
+const (
+	afpacketBlockSize = 512 * 1024
+	afpacketBlocks    = 128
+)
+
+// pcapFileName is a name pattern of pcap files written in write-dir mode.
+const pcapFileName = PROGRAM + "-%Y%m%d-%H%M%S.pcap"
+
+func newFileWriter(opts *Options) (*adapters.PcapFileAdapter, error) {
+	writer, err := adapters.NewPcapFile(filepath.Join(opts.writeDir, pcapFileName))
+	if err != nil {
+		return nil, err
+	}
+	size := int64(opts.rotateSize) * 1000 * 1000
+	err = writer.SetRotation(size, opts.rotateInterval, opts.rotateCount, opts.maxFiles)
+	return writer, err
+}
+
+// newStream returns pcap stream adapter for the path. `-` means stdin for
+// reader and stdout for writer. Other paths, such as named pipes, are
+// opened as plain streams.
+func newStream(path string, write bool) (*adapters.PcapStreamAdapter, error) {
+	if path == "-" {
+		return adapters.NewStdio()
+	}
+	if write {
+		file, err := os.Create(path)
+		if err != nil {
+			return nil, err
+		}
+		return adapters.NewPcapStream(nil, file)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return adapters.NewPcapStream(file, nil)
+}
+
+// newPcapOverIP returns pcap-over-ip adapter for the address. It listens
+// on the port if the host part of the address is empty, e.g. `:57012`,
+// otherwise it connects to the host.
+func newPcapOverIP(address string) (*adapters.PcapOverIPAdapter, error) {
+	host, p, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(p)
+	if err != nil || port < 1 || port > 65535 {
+		return nil, errors.New(ErrCouldNotCreatePcapOverIP)
+	}
+	return adapters.NewPcapOverIP(host, port)
+}
+
+// newMultiDeviceReader returns multi device adapter for the devices which
+// are separated by comma. The filter of each device can be set by the
+// option `dev=filter` of devFilters, otherwise the common filter is used.
+func newMultiDeviceReader(opts *Options) (*adapters.MultiDeviceAdapter, error) {
+	filters := map[string]string{}
+	for _, f := range opts.devFilters {
+		kv := strings.SplitN(f, "=", 2)
+		if len(kv) != 2 {
+			return nil, errors.New(ErrInvalidDeviceFilter)
+		}
+		filters[kv[0]] = kv[1]
+	}
+
+	multi, _ := adapters.NewMultiDevice()
+	for _, dev := range strings.Split(opts.device, ",") {
+		filter, ok := filters[dev]
+		if !ok {
+			filter = opts.filter
+		}
+		reader, err := multi.AddDeviceInNetns(dev, opts.netns, filter, opts.isTest)
+		if err != nil {
+			multi.Close()
+			return nil, err
+		}
+		if opts.direction != "" {
+			if err := reader.SetDirection(opts.direction); err != nil {
+				multi.Close()
+				return nil, err
+			}
+		}
+		if err := setDeviceOptions(reader, opts, true); err != nil {
+			multi.Close()
+			return nil, err
+		}
+	}
+	return multi, nil
+}
+
+// newDemuxWriter returns demux adapter for the devices which are separated
+// by comma. Each entry is `interface=device` or just `device` for the
+// same name of interface and device. The device of the first entry is
+// used for the packets of unknown interface.
+func newDemuxWriter(opts *Options) (*adapters.DemuxAdapter, error) {
+	var demux *adapters.DemuxAdapter
+	writers := map[string]*adapters.DeviceAdapter{}
+	for _, entry := range strings.Split(opts.device, ",") {
+		kv := strings.SplitN(entry, "=", 2)
+		name, dev := kv[0], kv[0]
+		if len(kv) == 2 {
+			dev = kv[1]
+		}
+		writer, ok := writers[dev]
+		if !ok {
+			var err error
+			writer, err = adapters.NewDeviceInNetns(dev, opts.netns, opts.isTest)
+			if err != nil {
+				if demux != nil {
+					demux.Close()
+				}
+				return nil, err
+			}
+			writer.ID = "pump:" + dev
+			writers[dev] = writer
+			if err := setDeviceOptions(writer, opts, false); err != nil {
+				if demux != nil {
+					demux.Close()
+				}
+				writer.Close()
+				return nil, err
+			}
+		}
+		if demux == nil {
+			demux, _ = adapters.NewDemux(writer)
+		}
+		if err := demux.Add(name, writer); err != nil {
+			demux.Close()
+			return nil, err
+		}
+	}
+	return demux, nil
+}
+
+// newNflogReader returns nflog reader for the group of the options.
+func newNflogReader(opts *Options) (*adapters.NflogAdapter, error) {
+	group, err := strconv.Atoi(opts.nflog)
+	if err != nil {
+		return nil, errors.New(adapters.ErrNflogInvalidGroup)
+	}
+	reader, err := adapters.NewNflog(group)
+	if err != nil {
+		return nil, err
+	}
+	if err := reader.SetSnapLen(snaplen(opts)); err != nil {
+		return nil, err
+	}
+	return reader, nil
+}
+
+// excluder is a reader adapter which can change the filter and exclude
+// traffic from capture while capturing.
+type excluder interface {
+	SetFilter(filter string) error
+	SetExclude(exclude string) error
+}
+
+// readFilter returns the filter expression in the file. Lines starting
+// with `#` are comments and the other lines are joined with spaces.
+func readFilter(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	lines := []string{}
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "#") {
+			lines = append(lines, line)
+		}
+	}
+	return strings.Join(lines, " "), nil
+}
+
+// reloadFilter reads the filter file again and applies it to the running
+// capturer. If the new filter is invalid, the current filter is kept.
+func reloadFilter(logger goul.Logger, capturer excluder, path string) {
+	filter, err := readFilter(path)
+	if err != nil {
+		logger.Error(ErrCouldNotReadFilterFile, ": ", err)
+		return
+	}
+	logger.Infof("changing filter to <%v>...", filter)
+	if err := capturer.SetFilter(filter); err != nil {
+		logger.Warnf("couldn't change filter, keep the current one: %v", err)
+	}
+}
+
+// controls are the parts of the running client which can be changed by
+// control items from the receiver or from the control file.
+type controls struct {
+	capturer excluder
+	recorder *pipes.FlightRecorder
+	sampler  *pipes.Sampler
+}
+
+// apply applies the control item to the running client.
+func (c *controls) apply(logger goul.Logger, item goul.Item) {
+	switch item.String() {
+	case goul.ItemTypeFilter:
+		if c.capturer == nil {
+			logger.Warnf("got filter <%s> but the reader cannot change the filter!", item.Data())
+			return
+		}
+		logger.Infof("changing filter to <%s>...", item.Data())
+		if err := c.capturer.SetFilter(string(item.Data())); err != nil {
+			logger.Warnf("couldn't change filter, keep the current one: %v", err)
+		}
+	case goul.ItemTypeTrigger:
+		if c.recorder == nil {
+			logger.Warnf("got trigger <%s> but no recorder enabled!", item.Data())
+			return
+		}
+		reason := string(item.Data())
+		if reason == "" {
+			reason = "control"
+		}
+		logger.Info("triggering flight recorder...")
+		if !c.recorder.Trigger(reason) {
+			logger.Warnf("couldn't trigger flight recorder, trigger is pending")
+		}
+	case goul.ItemTypeSample:
+		if c.sampler == nil {
+			logger.Warnf("got sample rate <%s> but sampling is not enabled!", item.Data())
+			return
+		}
+		rate, err := strconv.Atoi(string(item.Data()))
+		if err == nil {
+			err = c.sampler.SetRate(rate)
+		}
+		if err != nil {
+			logger.Warnf("couldn't change sample rate, keep 1 in %v: %v", c.sampler.GetRate(), err)
+			return
+		}
+		logger.Infof("sampling 1 in %v (%v)", rate, c.sampler.Mode)
+	default:
+		logger.Warnf("got control '%v' but no handler defined!", item.String())
+	}
+}
+
+// controlTypes are the commands of the control file, which are the types
+// of the control items.
+var controlTypes = map[string]bool{
+	goul.ItemTypeFilter:  true,
+	goul.ItemTypeTrigger: true,
+	goul.ItemTypeSample:  true,
+}
+
+// readControl returns the control items of the commands in the file. Each
+// line is a command with its value, e.g. `filter tcp port 443`, and lines
+// starting with `#` are comments.
+func readControl(path string) ([]goul.Item, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	items := []goul.Item{}
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		command := strings.SplitN(line, " ", 2)
+		if !controlTypes[command[0]] {
+			return nil, errors.New(ErrInvalidControlCommand)
+		}
+		value := ""
+		if len(command) > 1 {
+			value = strings.TrimSpace(command[1])
+		}
+		items = append(items, &goul.ItemGeneric{Meta: command[0], DATA: []byte(value)})
+	}
+	return items, nil
+}
+
+// reloadControl reads the control file again and applies its items to the
+// running client. On the server, the items are sent to all clients.
+func reloadControl(logger goul.Logger, path string, receiver *adapters.NetworkAdapter, ctl *controls) {
+	items, err := readControl(path)
+	if err != nil {
+		logger.Error(ErrCouldNotReadControlFile, ": ", err)
+		return
+	}
+	for _, item := range items {
+		if receiver != nil {
+			count := receiver.SendControl(item)
+			logger.Infof("%v <%s> sent to %v sessions", item.String(), item.Data(), count)
+			continue
+		}
+		ctl.apply(logger, item)
+	}
+}
+
+// excludedPorts returns the ports to exclude from capture, such as relay
+// or management ports. Each option can have comma separated ports.
+func excludedPorts(opts *Options) ([]int, error) {
+	ports := []int{}
+	for _, opt := range opts.excludePorts {
+		for _, p := range strings.Split(opt, ",") {
+			port, err := strconv.Atoi(strings.TrimSpace(p))
+			if err != nil || port < 1 || port > 65535 {
+				return nil, errors.New(ErrInvalidExcludePort)
+			}
+			ports = append(ports, port)
+		}
+	}
+	return ports, nil
+}
+
+// exclusion returns the filter expression matching the connection between
+// local and remote, and the ports. The connection is matched by its 5-tuple
+// in both directions, so the other connections between the same hosts,
+// even with the same ports on the other sides, are not affected.
+func exclusion(local, remote net.Addr, ports []int) string {
+	terms := []string{}
+	l, lok := local.(*net.TCPAddr)
+	r, rok := remote.(*net.TCPAddr)
+	if lok && rok {
+		terms = append(terms, fmt.Sprintf("(tcp and ("+
+			"(src host %v and src port %v and dst host %v and dst port %v) or "+
+			"(src host %v and src port %v and dst host %v and dst port %v)))",
+			l.IP, l.Port, r.IP, r.Port, r.IP, r.Port, l.IP, l.Port))
+	}
+	for _, port := range ports {
+		terms = append(terms, fmt.Sprintf("(port %v)", port))
+	}
+	return strings.Join(terms, " or ")
+}
+
+// setDeviceOptions sets the options of the device adapter. The tuning
+// options of libpcap such as buffer size and immediate mode are set only
+// for capturing. In test mode, only the statistics interval is set since
+// the device is not opened.
+func setDeviceOptions(device *adapters.DeviceAdapter, opts *Options, capture bool) error {
+	if opts.statsInterval != 0 {
+		if err := device.SetStatsInterval(opts.statsInterval); err != nil {
+			return err
+		}
+	}
+	if opts.retryInterval != 0 {
+		if err := device.SetRetryInterval(opts.retryInterval); err != nil {
+			return err
+		}
+	}
+	if opts.isTest {
+		return nil
+	}
+	if err := device.SetOptions(opts.promisc, snaplen(opts), timeout(opts)); err != nil {
+		return err
+	}
+	if !capture {
+		return nil
+	}
+	if opts.bufferSize != 0 {
+		if err := device.SetBufferSize(opts.bufferSize * 1024); err != nil {
+			return err
+		}
+	}
+	if opts.immediate {
+		if err := device.SetImmediateMode(true); err != nil {
+			return err
+		}
+	}
+	if opts.tstampType != "" {
+		if err := device.SetTimestampSource(opts.tstampType); err != nil {
+			return err
+		}
+	}
+	return device.SetNanosecond(opts.tstampNano)
+}
+
+// snaplen returns the snapshot length of the options or the default.
+func snaplen(opts *Options) int {
+	if opts.snaplen == 0 {
+		return defaultSnapLen
+	}
+	return opts.snaplen
+}
+
+// timeout returns the read timeout of the options in seconds or the
+// default.
+func timeout(opts *Options) time.Duration {
+	if opts.timeout == 0 {
+		return defaultTimeout
+	}
+	return time.Duration(opts.timeout)
+}
+
+// newAfpacketReader returns AF_PACKET adapter configured by the options.
+func newAfpacketReader(opts *Options) (*adapters.AfpacketAdapter, error) {
+	reader, err := adapters.NewAfpacket(opts.device)
+	if err != nil {
+		return nil, err
+	}
+	if opts.filter != "" {
+		reader.SetFilter(opts.filter)
+	}
+	if err := reader.SetOptions(opts.promisc, snaplen(opts), timeout(opts)); err != nil {
+		return nil, err
+	}
+	if opts.direction != "" {
+		if err := reader.SetDirection(opts.direction); err != nil {
+			return nil, err
+		}
+	}
+	if opts.blockSize > 0 || opts.blocks > 0 {
+		size, count := opts.blockSize*1024, opts.blocks
+		if size == 0 {
+			size = afpacketBlockSize
+		}
+		if count == 0 {
+			count = afpacketBlocks
+		}
+		if err := reader.SetRing(size, count); err != nil {
+			return nil, err
+		}
+	}
+	if opts.fanout > 1 {
+		if err := reader.SetFanout(opts.fanout, opts.fanoutType, 0); err != nil {
+			return nil, err
+		}
+	}
+	return reader, nil
+}
+
+// newRecorder returns flight recorder pipe configured by the options. If
+// trigger expression is given, it is compiled as a BPF filter for the link
+// type and snaplen of the source and packets matched with it trigger the
+// recorder.
+func newRecorder(opts *Options, linkType layers.LinkType, snapLen int) (*pipes.FlightRecorder, error) {
+	recorder := &pipes.FlightRecorder{
+		Pipe:   &goul.BasePipe{Mode: goul.ModeConverter},
+		Window: opts.recordWindow,
+		Size:   opts.recordSize * 1000 * 1000,
+		After:  opts.recordAfter,
+		Path:   opts.recordFile,
+	}
+	if opts.recordTrigger != "" {
+		bpf, err := pcap.NewBPF(linkType, snapLen, opts.recordTrigger)
+		if err != nil {
+			return nil, err
+		}
+		recorder.Match = func(packet gopacket.Packet) bool {
+			return bpf.Matches(packet.Metadata().CaptureInfo, packet.Data())
+		}
+	}
+	return recorder, nil
+}
+
+// newDeduplicator returns a dedup pipe configured by the options, or nil
+// if deduplication is not requested.
+func newDeduplicator(opts *Options) *pipes.Deduplicator {
+	if opts.dedupWindow == 0 && !opts.dedupIgnoreIPID {
+		return nil
+	}
+	return &pipes.Deduplicator{
+		Pipe:       &goul.BasePipe{Mode: goul.ModeConverter},
+		Window:     opts.dedupWindow,
+		IgnoreIPID: opts.dedupIgnoreIPID,
+	}
+}
+
+// newProtocolStats returns a protocol statistics pipe which logs the
+// summary for each stats-interval.
+func newProtocolStats(opts *Options) *pipes.ProtocolStats {
+	return &pipes.ProtocolStats{
+		Pipe:     &goul.BasePipe{Mode: goul.ModeConverter},
+		Interval: opts.statsInterval,
+	}
+}
+
+// newTruncator returns a truncator pipe configured by the options, or nil
+// if truncation is not requested.
+func newTruncator(opts *Options) *pipes.Truncator {
+	if opts.truncate == 0 && !opts.truncateHeaders && opts.truncatePayload == 0 {
+		return nil
+	}
+	return &pipes.Truncator{
+		Pipe:    &goul.BasePipe{Mode: goul.ModeConverter},
+		Length:  opts.truncate,
+		Headers: opts.truncateHeaders || opts.truncatePayload != 0,
+		Payload: opts.truncatePayload,
+	}
+}
+
+// newAnonymizer returns an anonymizer pipe with the key in the file. The
+// file contains 32 bytes of the key as is or in hex.
+func newAnonymizer(path string, opts *Options, mode bool) (*pipes.Anonymizer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key := data
+	if decoded, err := hex.DecodeString(strings.TrimSpace(string(data))); err == nil {
+		key = decoded
+	}
+	if len(key) != pipes.AnonymizerKeySize {
+		return nil, errors.New(pipes.ErrAnonymizerInvalidKey)
+	}
+	return &pipes.Anonymizer{
+		Pipe:         &goul.BasePipe{Mode: mode},
+		Key:          key,
+		ScrubMAC:     opts.scrubMAC,
+		FixChecksums: opts.fixChecksums,
+	}, nil
+}
+
+// newSampler returns a sampler pipe configured by the options.
+func newSampler(opts *Options) (*pipes.Sampler, error) {
+	sampler := &pipes.Sampler{
+		Pipe: &goul.BasePipe{Mode: goul.ModeConverter},
+		Mode: opts.sampleMode,
+	}
+	switch opts.sampleMode {
+	case "":
+		sampler.Mode = pipes.SampleCount
+	case pipes.SampleCount, pipes.SampleRandom, pipes.SampleFlow:
+	default:
+		return nil, errors.New(pipes.ErrSamplerInvalidMode)
+	}
+	if err := sampler.SetRate(opts.sample); err != nil {
+		return nil, err
+	}
+	return sampler, nil
+}
+
+// newFilter returns a filter pipe configured by the options. The expression
+// is compiled here to report the syntax error before the router starts.
+func newFilter(opts *Options) (*pipes.Filter, error) {
+	if _, err := pipes.CompileExpression(opts.postFilter); err != nil {
+		return nil, err
+	}
+	return &pipes.Filter{
+		Pipe:       &goul.BasePipe{Mode: goul.ModeConverter},
+		Expression: opts.postFilter,
+		Drop:       opts.postFilterDrop,
+	}, nil
+}
+
+// newRewriter returns a rewriter pipe configured by the options, or nil if
+// no rewriting is requested.
+func newRewriter(opts *Options) (*pipes.Rewriter, error) {
+	if opts.setDstMAC == "" && opts.setSrcMAC == "" && opts.pushVLAN == 0 &&
+		!opts.vlanPerSession && !opts.popVLAN && opts.setTTL == 0 && !opts.fixChecksums {
+		return nil, nil
+	}
+	if opts.pushVLAN < 0 || opts.pushVLAN > 4094 || opts.setTTL < 0 || opts.setTTL > 255 {
+		return nil, errors.New(pipes.ErrRewriterInvalidOptions)
+	}
+	if opts.vlanPerSession && opts.pushVLAN == 4094 { // no vlan left for the sessions
+		return nil, errors.New(pipes.ErrRewriterInvalidOptions)
+	}
+	rewriter := &pipes.Rewriter{
+		Pipe:         &goul.BasePipe{Mode: goul.ModeConverter},
+		PopVLAN:      opts.popVLAN,
+		PushVLAN:     uint16(opts.pushVLAN),
+		TTL:          uint8(opts.setTTL),
+		FixChecksums: opts.fixChecksums,
+	}
+	var err error
+	if opts.setDstMAC != "" {
+		if rewriter.DstMAC, err = net.ParseMAC(opts.setDstMAC); err != nil {
+			return nil, err
+		}
+	}
+	if opts.setSrcMAC != "" {
+		if rewriter.SrcMAC, err = net.ParseMAC(opts.setSrcMAC); err != nil {
+			return nil, err
+		}
+	}
+	if opts.vlanPerSession {
+		base := opts.pushVLAN
+		rewriter.VLANOf = func(item goul.Item) int {
+			if session := adapters.SessionOf(item); session != nil {
+				return base + session.ID
+			}
+			return base
+		}
+	}
+	return rewriter, nil
+}
+
 func logger(opts *Options) goul.Logger {
 	if opts.isDebug {
 		return goul.NewLogger("debug")
@@ -1,13 +1,29 @@
 package main
 
 import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"net"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
 	"syscall"
 	"testing"
 	"time"
 
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+	"github.com/google/gopacket/pcapgo"
 	"github.com/stretchr/testify/require"
+
+	"github.com/hyeoncheon/goul"
+	"github.com/hyeoncheon/goul/adapters"
+	"github.com/hyeoncheon/goul/pipes"
+	. "github.com/hyeoncheon/goul/testing"
 )
 
 func Test_RunServer(t *testing.T) {
@@ -50,10 +66,490 @@ func Test_RunTestServer(t *testing.T) {
 		wg.Done()
 	}()
 	time.Sleep(1 * time.Second)
-	sig <- syscall.SIGUSR1
+	sig <- triggerSignal
+	sig <- syscall.SIGINT
+	wg.Wait()
+	r.NoError(goerr)
+
+	svrOpts.statsInterval = -1 * time.Second
+	r.EqualError(run(svrOpts), ErrCouldNotCreateDeviceWriter)
+	svrOpts.statsInterval = 0
+	svrOpts.retryInterval = -1 * time.Second
+	r.EqualError(run(svrOpts), ErrCouldNotCreateDeviceWriter)
+	svrOpts.device = "eth0=bond9,eth1=bond9"
+	r.EqualError(run(svrOpts), ErrCouldNotCreateDeviceWriter)
+}
+
+func Test_RunFileServer(t *testing.T) {
+	r := require.New(t)
+
+	svrOpts := &Options{
+		isDebug:     true,
+		isServer:    true,
+		port:        6098,
+		writeDir:    t.TempDir(),
+		rotateCount: 100,
+		maxFiles:    2,
+	}
+
+	wg := sync.WaitGroup{}
+	sig := make(chan os.Signal, 1)
+	var goerr error
+	wg.Add(1)
+	go func() {
+		goerr = run(svrOpts, sig)
+		wg.Done()
+	}()
+	time.Sleep(1 * time.Second)
+	sig <- syscall.SIGINT
+	wg.Wait()
+	r.NoError(goerr)
+
+	files, _ := filepath.Glob(filepath.Join(svrOpts.writeDir, PROGRAM+"-*.pcap"))
+	r.Equal(1, len(files))
+
+	svrOpts.writeDir = "/dev/null"
+	err := run(svrOpts)
+	r.EqualError(err, ErrCouldNotStartTheRouter)
+}
+
+func Test_RunFileClient(t *testing.T) {
+	r := require.New(t)
+
+	path := filepath.Join(t.TempDir(), "client.pcap")
+	f, err := os.Create(path)
+	r.NoError(err)
+	w := pcapgo.NewWriter(f)
+	r.NoError(w.WriteFileHeader(65536, layers.LinkTypeEthernet))
+	packet, _ := GeneratePacket("TestData")
+	for i := 0; i < 3; i++ {
+		ci := gopacket.CaptureInfo{
+			Timestamp:     time.Now(),
+			CaptureLength: len(packet.Data()),
+			Length:        len(packet.Data()),
+		}
+		r.NoError(w.WritePacket(ci, packet.Data()))
+	}
+	f.Close()
+
+	svrOpts := &Options{isDebug: true, isTest: true, isServer: true, port: 6097}
+	wg := sync.WaitGroup{}
+	sig := make(chan os.Signal, 1)
+	wg.Add(1)
+	go func() {
+		run(svrOpts, sig)
+		wg.Done()
+	}()
+	time.Sleep(1 * time.Second)
+
+	cliOpts := &Options{
+		isDebug:  true,
+		addr:     "localhost",
+		port:     6097,
+		readFile: path,
+		filter:   "port 80",
+	}
+	r.NoError(run(cliOpts)) // returns when the file is done
+
+	cliOpts.replaySpeed = -1
+	r.EqualError(run(cliOpts), ErrCouldNotCreateFileReader)
+
+	sig <- syscall.SIGINT
+	wg.Wait()
+}
+
+func Test_RunStream(t *testing.T) {
+	r := require.New(t)
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "stream.pcap")
+	f, err := os.Create(path)
+	r.NoError(err)
+	w := pcapgo.NewWriter(f)
+	r.NoError(w.WriteFileHeader(65536, layers.LinkTypeEthernet))
+	packet, _ := GeneratePacket("TestData")
+	for i := 0; i < 3; i++ {
+		ci := gopacket.CaptureInfo{
+			Timestamp:     time.Now(),
+			CaptureLength: len(packet.Data()),
+			Length:        len(packet.Data()),
+		}
+		r.NoError(w.WritePacket(ci, packet.Data()))
+	}
+	f.Close()
+
+	output := filepath.Join(dir, "output.pcap")
+	svrOpts := &Options{isDebug: true, isServer: true, port: 6096, writeStream: output}
+	wg := sync.WaitGroup{}
+	sig := make(chan os.Signal, 1)
+	wg.Add(1)
+	go func() {
+		run(svrOpts, sig)
+		wg.Done()
+	}()
+	time.Sleep(1 * time.Second)
+
+	cliOpts := &Options{isDebug: true, addr: "localhost", port: 6096, readStream: path}
+	r.NoError(run(cliOpts)) // returns at the end of the stream
+	time.Sleep(500 * time.Millisecond)
+
+	sig <- syscall.SIGINT
+	wg.Wait()
+
+	f, err = os.Open(output)
+	r.NoError(err)
+	defer f.Close()
+	pr, err := pcapgo.NewReader(f)
+	r.NoError(err)
+	count := 0
+	for {
+		if _, _, err := pr.ReadPacketData(); err != nil {
+			break
+		}
+		count++
+	}
+	r.Equal(3, count)
+
+	cliOpts.readStream = filepath.Join(dir, "not-exist.pcap")
+	r.EqualError(run(cliOpts), ErrCouldNotCreateStream)
+	cliOpts.readStream = output + ".empty"
+	r.NoError(os.WriteFile(cliOpts.readStream, []byte{}, 0644))
+	r.EqualError(run(cliOpts), ErrCouldNotCreateStream)
+}
+
+func Test_RunPcapOverIP(t *testing.T) {
+	r := require.New(t)
+
+	// a sensor which serves a pcap-over-ip stream of 3 packets.
+	listener, err := net.Listen("tcp", "localhost:6098")
+	r.NoError(err)
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		w := pcapgo.NewWriter(conn)
+		w.WriteFileHeader(65536, layers.LinkTypeEthernet)
+		packet, _ := GeneratePacket("TestData")
+		for i := 0; i < 3; i++ {
+			ci := gopacket.CaptureInfo{
+				Timestamp:     time.Now(),
+				CaptureLength: len(packet.Data()),
+				Length:        len(packet.Data()),
+			}
+			w.WritePacket(ci, packet.Data())
+		}
+	}()
+
+	svrOpts := &Options{isDebug: true, isServer: true, port: 6097, pcapOverIP: ":6099"}
+	wg := sync.WaitGroup{}
+	sig := make(chan os.Signal, 1)
+	wg.Add(1)
+	go func() {
+		run(svrOpts, sig)
+		wg.Done()
+	}()
+	time.Sleep(1 * time.Second)
+
+	// a tool such as NetworkMiner connected to the server.
+	conn, err := net.Dial("tcp", "localhost:6099")
+	r.NoError(err)
+	defer conn.Close()
+	pr, err := pcapgo.NewReader(conn)
+	r.NoError(err)
+	r.Equal(layers.LinkTypeEthernet, pr.LinkType())
+
+	cliOpts := &Options{isDebug: true, addr: "localhost", port: 6097, readPcapOverIP: "localhost:6098"}
+	r.NoError(run(cliOpts)) // returns at the end of the stream
+
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	for i := 0; i < 3; i++ {
+		data, _, err := pr.ReadPacketData()
+		r.NoError(err)
+		r.Contains(string(data), "TestData")
+	}
+
+	sig <- syscall.SIGINT
+	wg.Wait()
+
+	cliOpts.readPcapOverIP = "localhost"
+	r.EqualError(run(cliOpts), ErrCouldNotCreatePcapOverIP)
+	cliOpts.readPcapOverIP = "localhost:0"
+	r.EqualError(run(cliOpts), ErrCouldNotCreatePcapOverIP)
+	svrOpts.pcapOverIP = "localhost:http-alt"
+	r.EqualError(run(svrOpts), ErrCouldNotCreatePcapOverIP)
+}
+
+func Test_RunRecorder(t *testing.T) {
+	r := require.New(t)
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "recorder.pcap")
+	f, err := os.Create(path)
+	r.NoError(err)
+	w := pcapgo.NewWriter(f)
+	r.NoError(w.WriteFileHeader(65536, layers.LinkTypeEthernet))
+	packet, _ := GeneratePacket("TestData")
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		ci := gopacket.CaptureInfo{
+			Timestamp:     now.Add(time.Duration(i) * 100 * time.Millisecond),
+			CaptureLength: len(packet.Data()),
+			Length:        len(packet.Data()),
+		}
+		r.NoError(w.WritePacket(ci, packet.Data()))
+	}
+	f.Close()
+
+	cliOpts := &Options{
+		isDebug:      true,
+		readFile:     path,
+		replaySpeed:  1,
+		loop:         true,
+		writeDir:     filepath.Join(dir, "out"),
+		recordWindow: 10 * time.Second,
+		recordSize:   1,
+		recordFile:   filepath.Join(dir, "ring"),
+	}
+	wg := sync.WaitGroup{}
+	sig := make(chan os.Signal, 1)
+	var goerr error
+	wg.Add(1)
+	go func() {
+		goerr = run(cliOpts, sig)
+		wg.Done()
+	}()
+	time.Sleep(700 * time.Millisecond)
+	sig <- triggerSignal
+	time.Sleep(300 * time.Millisecond)
 	sig <- syscall.SIGINT
 	wg.Wait()
 	r.NoError(goerr)
+
+	files, _ := filepath.Glob(filepath.Join(cliOpts.writeDir, PROGRAM+"-*.pcap"))
+	r.Equal(1, len(files))
+	f, err = os.Open(files[0])
+	r.NoError(err)
+	defer f.Close()
+	pr, err := pcapgo.NewReader(f)
+	r.NoError(err)
+	_, _, err = pr.ReadPacketData()
+	r.NoError(err) // dumped by the signal
+
+	cliOpts.recordTrigger = "invalid expression ("
+	r.EqualError(run(cliOpts), ErrCouldNotCreateRecorder)
+}
+
+func Test_NewRecorder(t *testing.T) {
+	r := require.New(t)
+
+	// the trigger is compiled for the link type of the source.
+	ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolTCP,
+		SrcIP: net.IP{10, 0, 0, 1}, DstIP: net.IP{10, 0, 0, 2}}
+	tcp := &layers.TCP{SrcPort: 40000, DstPort: 443, RST: true}
+	tcp.SetNetworkLayerForChecksum(ip)
+	buffer := gopacket.NewSerializeBuffer()
+	r.NoError(gopacket.SerializeLayers(buffer,
+		gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}, ip, tcp))
+	packet := gopacket.NewPacket(buffer.Bytes(), layers.LayerTypeIPv4, gopacket.Default)
+	md := packet.Metadata()
+	md.CaptureLength = len(packet.Data())
+	md.Length = len(packet.Data())
+
+	opts := &Options{recordWindow: time.Second, recordTrigger: "tcp port 443"}
+	recorder, err := newRecorder(opts, layers.LinkTypeRaw, 1500)
+	if err != nil {
+		t.Skipf("couldn't compile the trigger: %v", err)
+	}
+	r.True(recorder.Match(packet))
+	recorder, err = newRecorder(opts, layers.LinkTypeEthernet, 1500)
+	r.NoError(err)
+	r.False(recorder.Match(packet))
+}
+
+func Test_RunAfpacketClient(t *testing.T) {
+	r := require.New(t)
+
+	cliOpts := &Options{
+		isDebug:  true,
+		addr:     "localhost",
+		port:     6060,
+		device:   "bond9", // does not exist
+		afpacket: true,
+	}
+	r.EqualError(run(cliOpts), ErrCouldNotCreateDeviceReader)
+
+	cliOpts.device = "lo"
+	cliOpts.blocks = 4
+	cliOpts.blockSize = 3 // not a multiple of page size
+	r.EqualError(run(cliOpts), ErrCouldNotCreateDeviceReader)
+
+	cliOpts.blockSize = 0
+	cliOpts.direction = "both"
+	r.EqualError(run(cliOpts), ErrCouldNotCreateDeviceReader)
+
+	cliOpts.direction = "in"
+	cliOpts.fanout = 2
+	cliOpts.fanoutType = "unknown"
+	r.EqualError(run(cliOpts), ErrCouldNotCreateDeviceReader)
+}
+
+func Test_RunMultiDevice(t *testing.T) {
+	r := require.New(t)
+
+	svrOpts := &Options{
+		isDebug:  true,
+		isTest:   true,
+		isServer: true,
+		port:     6095,
+		device:   "wan=tap0,lan=tap1,dmz=tap1",
+	}
+	wg := sync.WaitGroup{}
+	sig := make(chan os.Signal, 1)
+	var goerr error
+	wg.Add(1)
+	go func() {
+		goerr = run(svrOpts, sig)
+		wg.Done()
+	}()
+	time.Sleep(500 * time.Millisecond)
+	sig <- syscall.SIGINT
+	wg.Wait()
+	r.NoError(goerr)
+
+	svrOpts.device = "wan=tap0,wan=tap1"
+	r.EqualError(run(svrOpts), ErrCouldNotCreateDeviceWriter)
+
+	cliOpts := &Options{
+		isDebug:    true,
+		isTest:     true,
+		addr:       "localhost",
+		port:       6095,
+		device:     "lo,lo",
+		devFilters: []string{"lo=port 80"},
+	}
+	r.EqualError(run(cliOpts), ErrCouldNotCreateDeviceReader) // duplicated
+
+	cliOpts.device = "lo,eth0"
+	cliOpts.devFilters = []string{"port 80"}
+	r.EqualError(run(cliOpts), ErrCouldNotCreateDeviceReader) // invalid filter
+
+	cliOpts.devFilters = nil
+	cliOpts.direction = "both"
+	r.EqualError(run(cliOpts), ErrCouldNotCreateDeviceReader)
+}
+
+func Test_RunCaptureOptions(t *testing.T) {
+	r := require.New(t)
+
+	cliOpts := &Options{
+		isDebug: true,
+		addr:    "localhost",
+		port:    6093,
+		device:  "lo",
+		snaplen: 300000,
+	}
+	r.EqualError(run(cliOpts), ErrCouldNotCreateDeviceReader)
+
+	cliOpts.snaplen = 0 // default
+	cliOpts.timeout = -1
+	r.EqualError(run(cliOpts), ErrCouldNotCreateDeviceReader)
+
+	cliOpts.timeout = 0
+	cliOpts.bufferSize = -1
+	r.EqualError(run(cliOpts), ErrCouldNotCreateDeviceReader)
+
+	cliOpts.bufferSize = 1024
+	cliOpts.immediate = true
+	cliOpts.tstampType = "sundial"
+	r.EqualError(run(cliOpts), ErrCouldNotCreateDeviceReader)
+
+	cliOpts.tstampType = ""
+	cliOpts.device = "lo,eth0"
+	cliOpts.snaplen = -1
+	r.EqualError(run(cliOpts), ErrCouldNotCreateDeviceReader)
+
+	cliOpts.device = "lo"
+	cliOpts.afpacket = true
+	r.EqualError(run(cliOpts), ErrCouldNotCreateDeviceReader)
+}
+
+func Test_RunTap(t *testing.T) {
+	r := require.New(t)
+
+	svrOpts := &Options{
+		isDebug:       true,
+		isServer:      true,
+		port:          6094,
+		tap:           "goulrun0",
+		tapPerSession: true,
+	}
+	wg := sync.WaitGroup{}
+	sig := make(chan os.Signal, 1)
+	var goerr error
+	wg.Add(1)
+	go func() {
+		goerr = run(svrOpts, sig)
+		wg.Done()
+	}()
+	time.Sleep(500 * time.Millisecond)
+	if _, err := net.InterfaceByName("goulrun0"); err != nil {
+		sig <- syscall.SIGINT
+		wg.Wait()
+		t.Skipf("couldn't create tap device: %v", err)
+	}
+	sig <- syscall.SIGINT
+	wg.Wait()
+	r.NoError(goerr)
+	_, err := net.InterfaceByName("goulrun0")
+	r.Error(err) // removed on exit
+
+	svrOpts.tap = "very-long-tap-name"
+	r.EqualError(run(svrOpts), ErrCouldNotCreateTapWriter)
+}
+
+func Test_NewRewriter(t *testing.T) {
+	r := require.New(t)
+
+	rewriter, err := newRewriter(&Options{})
+	r.NoError(err)
+	r.Nil(rewriter)
+
+	rewriter, err = newRewriter(&Options{
+		setDstMAC:      "02:00:00:00:00:01",
+		pushVLAN:       100,
+		vlanPerSession: true,
+		setTTL:         64,
+	})
+	r.NoError(err)
+	r.Equal("02:00:00:00:00:01", rewriter.DstMAC.String())
+	r.Nil(rewriter.SrcMAC)
+	r.Equal(uint8(64), rewriter.TTL)
+	packet, _ := GeneratePacket("session")
+	r.Equal(100, rewriter.VLANOf(packet))
+	packet.Metadata().AncillaryData = append(packet.Metadata().AncillaryData, &adapters.Session{ID: 3})
+	r.Equal(103, rewriter.VLANOf(packet))
+	packet.Metadata().AncillaryData[0] = &adapters.Session{ID: 65500}
+	r.Equal(65600, rewriter.VLANOf(packet)) // out of range, not wrapped
+
+	_, err = newRewriter(&Options{setSrcMAC: "invalid"})
+	r.Error(err)
+	_, err = newRewriter(&Options{pushVLAN: 4095})
+	r.EqualError(err, pipes.ErrRewriterInvalidOptions)
+	_, err = newRewriter(&Options{pushVLAN: 4094, vlanPerSession: true})
+	r.EqualError(err, pipes.ErrRewriterInvalidOptions)
+	_, err = newRewriter(&Options{setTTL: 256})
+	r.EqualError(err, pipes.ErrRewriterInvalidOptions)
+
+	r.EqualError(run(&Options{
+		isServer:  true,
+		isTest:    true,
+		port:      6091,
+		device:    "lo",
+		setDstMAC: "invalid",
+	}), ErrCouldNotCreateRewriter)
 }
 
 func Test_RunClient(t *testing.T) {
@@ -86,3 +582,292 @@ func Test_Logger(t *testing.T) {
 	loggerNormal := logger(&Options{})
 	r.NotNil(loggerNormal)
 }
+
+func Test_Exclusion(t *testing.T) {
+	r := require.New(t)
+
+	ports, err := excludedPorts(&Options{excludePorts: []string{"22", "8080, 9090"}})
+	r.NoError(err)
+	r.Equal([]int{22, 8080, 9090}, ports)
+	_, err = excludedPorts(&Options{excludePorts: []string{"ssh"}})
+	r.EqualError(err, ErrInvalidExcludePort)
+	_, err = excludedPorts(&Options{excludePorts: []string{"70000"}})
+	r.EqualError(err, ErrInvalidExcludePort)
+
+	local := &net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 40000}
+	remote := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 6001}
+	r.Equal("(tcp and ("+
+		"(src host 10.0.0.2 and src port 40000 and dst host 10.0.0.1 and dst port 6001) or "+
+		"(src host 10.0.0.1 and src port 6001 and dst host 10.0.0.2 and dst port 40000)))"+
+		" or (port 22)", exclusion(local, remote, []int{22}))
+	r.Equal("(port 22) or (port 8080)", exclusion(nil, nil, []int{22, 8080}))
+	r.Equal("", exclusion(nil, nil, nil))
+
+	cliOpts := &Options{isDebug: true, isTest: true, addr: "localhost", port: 6092,
+		device: "lo", excludePorts: []string{"x"}}
+	r.EqualError(run(cliOpts), ErrInvalidExcludePort)
+
+	// only the connection itself is excluded, in both directions.
+	bpf, err := pcap.NewBPF(layers.LinkTypeEthernet, 1600, exclusion(local, remote, nil))
+	if err != nil {
+		t.Skipf("couldn't compile the exclusion: %v", err)
+	}
+	for tuple, excluded := range map[[4]string]bool{
+		{"10.0.0.2", "40000", "10.0.0.1", "6001"}: true,
+		{"10.0.0.1", "6001", "10.0.0.2", "40000"}: true,
+		{"10.0.0.2", "6001", "10.0.0.1", "40000"}: false, // another connection
+		{"10.0.0.1", "40000", "10.0.0.2", "6001"}: false,
+		{"10.0.0.2", "40001", "10.0.0.1", "6001"}: false,
+	} {
+		data := tcpPacket(tuple[0], tuple[1], tuple[2], tuple[3])
+		ci := gopacket.CaptureInfo{CaptureLength: len(data), Length: len(data)}
+		r.Equal(excluded, bpf.Matches(ci, data), tuple)
+	}
+}
+
+// tcpPacket returns an ethernet frame of TCP segment between the
+// addresses and the ports.
+func tcpPacket(src, sport, dst, dport string) []byte {
+	ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolTCP,
+		SrcIP: net.ParseIP(src).To4(), DstIP: net.ParseIP(dst).To4()}
+	sp, _ := strconv.Atoi(sport)
+	dp, _ := strconv.Atoi(dport)
+	tcp := &layers.TCP{SrcPort: layers.TCPPort(sp), DstPort: layers.TCPPort(dp), ACK: true}
+	tcp.SetNetworkLayerForChecksum(ip)
+	ether := &layers.Ethernet{SrcMAC: net.HardwareAddr{2, 0, 0, 0, 0, 1},
+		DstMAC: net.HardwareAddr{2, 0, 0, 0, 0, 2}, EthernetType: layers.EthernetTypeIPv4}
+	buffer := gopacket.NewSerializeBuffer()
+	gopacket.SerializeLayers(buffer, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true},
+		ether, ip, tcp)
+	return buffer.Bytes()
+}
+
+// filterRecorder is an excluder which records the filters.
+type filterRecorder struct {
+	filters []string
+}
+
+func (f *filterRecorder) SetFilter(filter string) error {
+	if strings.Contains(filter, "(") {
+		return errors.New("invalid filter")
+	}
+	f.filters = append(f.filters, filter)
+	return nil
+}
+
+func (f *filterRecorder) SetExclude(exclude string) error {
+	return nil
+}
+
+func Test_FilterFile(t *testing.T) {
+	r := require.New(t)
+
+	path := filepath.Join(t.TempDir(), "filter")
+	r.NoError(os.WriteFile(path, []byte("# web traffic\ntcp port 80\n  or tcp port 443\n"), 0644))
+	filter, err := readFilter(path)
+	r.NoError(err)
+	r.Equal("tcp port 80 or tcp port 443", filter)
+
+	capturer := &filterRecorder{}
+	reloadFilter(logger(&Options{}), capturer, path)
+	r.Equal([]string{"tcp port 80 or tcp port 443"}, capturer.filters)
+
+	// invalid or missing filter keeps the current one.
+	r.NoError(os.WriteFile(path, []byte("tcp and ("), 0644))
+	reloadFilter(logger(&Options{}), capturer, path)
+	reloadFilter(logger(&Options{}), capturer, path+".missing")
+	r.Equal([]string{"tcp port 80 or tcp port 443"}, capturer.filters)
+
+	cliOpts := &Options{isDebug: true, isTest: true, addr: "localhost", port: 6090,
+		device: "lo", filterFile: path + ".missing"}
+	r.EqualError(run(cliOpts), ErrCouldNotReadFilterFile)
+}
+
+func Test_ControlFile(t *testing.T) {
+	r := require.New(t)
+
+	path := filepath.Join(t.TempDir(), "control")
+	r.NoError(os.WriteFile(path, []byte("# narrow down\nfilter tcp port 443\n\nfilter tcp and (\n"), 0644))
+	items, err := readControl(path)
+	r.NoError(err)
+	r.Equal(2, len(items))
+	r.Equal(goul.ItemTypeFilter, items[0].String())
+	r.Equal("tcp port 443", string(items[0].Data()))
+
+	// invalid filter from the control keeps the current one.
+	capturer := &filterRecorder{}
+	reloadControl(logger(&Options{}), path, nil, &controls{capturer: capturer})
+	r.Equal([]string{"tcp port 443"}, capturer.filters)
+	(&controls{}).apply(logger(&Options{}), items[0])
+	(&controls{}).apply(logger(&Options{}), &goul.ItemGeneric{Meta: "unknown"})
+
+	// trigger the recorder with the reason.
+	r.NoError(os.WriteFile(path, []byte("trigger incident\n"), 0644))
+	items, err = readControl(path)
+	r.NoError(err)
+	r.Equal(goul.ItemTypeTrigger, items[0].String())
+	r.Equal("incident", string(items[0].Data()))
+	(&controls{}).apply(logger(&Options{}), items[0])
+	recorder := &pipes.FlightRecorder{Pipe: &goul.BasePipe{Mode: goul.ModeConverter}}
+	in := make(chan goul.Item)
+	out, err := recorder.Convert(in, nil)
+	r.NoError(err)
+	packet, _ := GeneratePacket("Recorded")
+	in <- packet
+	reloadControl(logger(&Options{}), path, nil, &controls{recorder: recorder})
+	item := <-out
+	r.Equal("flight recorder triggered by incident", goul.AnnotationsOf(item)[goul.AnnotationComment])
+	close(in)
+
+	// change the sampling rate, and keep it if the rate is invalid.
+	r.NoError(os.WriteFile(path, []byte("sample 10\n"), 0644))
+	items, err = readControl(path)
+	r.NoError(err)
+	r.Equal(goul.ItemTypeSample, items[0].String())
+	(&controls{}).apply(logger(&Options{}), items[0])
+	sampler, err := newSampler(&Options{sample: 100})
+	r.NoError(err)
+	reloadControl(logger(&Options{}), path, nil, &controls{sampler: sampler})
+	r.Equal(10, sampler.GetRate())
+	(&controls{sampler: sampler}).apply(logger(&Options{}), &goul.ItemGeneric{Meta: goul.ItemTypeSample, DATA: []byte("ten")})
+	(&controls{sampler: sampler}).apply(logger(&Options{}), &goul.ItemGeneric{Meta: goul.ItemTypeSample, DATA: []byte("0")})
+	r.Equal(10, sampler.GetRate())
+
+	r.NoError(os.WriteFile(path, []byte("reboot now\n"), 0644))
+	_, err = readControl(path)
+	r.EqualError(err, ErrInvalidControlCommand)
+
+	cliOpts := &Options{isDebug: true, isTest: true, addr: "localhost", port: 6084,
+		device: "lo", controlFile: path}
+	r.EqualError(run(cliOpts), ErrCouldNotReadControlFile)
+}
+
+func Test_RunNetns(t *testing.T) {
+	r := require.New(t)
+
+	cliOpts := &Options{isDebug: true, isTest: true, addr: "localhost", port: 6089,
+		device: "lo", netns: "goulnone"}
+	r.EqualError(run(cliOpts), ErrCouldNotCreateDeviceReader)
+	cliOpts.device = "lo,eth0"
+	r.EqualError(run(cliOpts), ErrCouldNotCreateDeviceReader)
+
+	svrOpts := &Options{isDebug: true, isTest: true, isServer: true, port: 6089,
+		device: "lo", netns: "/etc/hostname"}
+	r.EqualError(run(svrOpts), ErrCouldNotCreateDeviceWriter)
+}
+
+func Test_RunNflog(t *testing.T) {
+	r := require.New(t)
+
+	cliOpts := &Options{isDebug: true, addr: "localhost", port: 6088, nflog: "group"}
+	r.EqualError(run(cliOpts), ErrCouldNotCreateNflogReader)
+	cliOpts.nflog = "65536"
+	r.EqualError(run(cliOpts), ErrCouldNotCreateNflogReader)
+	cliOpts.nflog = "1906"
+	cliOpts.snaplen = -1
+	r.EqualError(run(cliOpts), ErrCouldNotCreateNflogReader)
+}
+
+func Test_RunProcess(t *testing.T) {
+	r := require.New(t)
+
+	cliOpts := &Options{isDebug: true, isTest: true, addr: "localhost", port: 6087,
+		device: "lo", processLog: filepath.Join(t.TempDir(), "none", "flows.json")}
+	r.EqualError(run(cliOpts), ErrCouldNotCreateProcessLog)
+}
+
+func Test_NewDeduplicator(t *testing.T) {
+	r := require.New(t)
+
+	r.Nil(newDeduplicator(&Options{}))
+	dedup := newDeduplicator(&Options{dedupWindow: 100 * time.Millisecond})
+	r.Equal(100*time.Millisecond, dedup.Window)
+	r.False(dedup.IgnoreIPID)
+	dedup = newDeduplicator(&Options{dedupIgnoreIPID: true})
+	r.Equal(time.Duration(0), dedup.Window)
+	r.True(dedup.IgnoreIPID)
+}
+
+func Test_NewProtocolStats(t *testing.T) {
+	r := require.New(t)
+
+	stats := newProtocolStats(&Options{statsInterval: time.Second})
+	r.Equal(time.Second, stats.Interval)
+}
+
+func Test_NewTruncator(t *testing.T) {
+	r := require.New(t)
+
+	r.Nil(newTruncator(&Options{}))
+	truncator := newTruncator(&Options{truncate: 128})
+	r.Equal(128, truncator.Length)
+	r.False(truncator.Headers)
+	truncator = newTruncator(&Options{truncatePayload: 16})
+	r.True(truncator.Headers)
+	r.Equal(16, truncator.Payload)
+}
+
+func Test_NewAnonymizer(t *testing.T) {
+	r := require.New(t)
+
+	key := bytes.Repeat([]byte{0x5a}, 32)
+	raw := filepath.Join(t.TempDir(), "raw.key")
+	r.NoError(os.WriteFile(raw, key, 0600))
+	anonymizer, err := newAnonymizer(raw, &Options{scrubMAC: true}, false)
+	r.NoError(err)
+	r.Equal(key, anonymizer.Key)
+	r.True(anonymizer.ScrubMAC)
+
+	encoded := filepath.Join(t.TempDir(), "hex.key")
+	r.NoError(os.WriteFile(encoded, []byte(hex.EncodeToString(key)+"\n"), 0600))
+	anonymizer, err = newAnonymizer(encoded, &Options{}, true)
+	r.NoError(err)
+	r.Equal(key, anonymizer.Key)
+
+	short := filepath.Join(t.TempDir(), "short.key")
+	r.NoError(os.WriteFile(short, []byte("short"), 0600))
+	_, err = newAnonymizer(short, &Options{}, true)
+	r.EqualError(err, pipes.ErrAnonymizerInvalidKey)
+
+	cliOpts := &Options{isDebug: true, isTest: true, addr: "localhost", port: 6086,
+		device: "lo", anonymizeKey: filepath.Join(t.TempDir(), "none.key")}
+	r.EqualError(run(cliOpts), ErrCouldNotReadAnonymizerKey)
+}
+
+func Test_NewSampler(t *testing.T) {
+	r := require.New(t)
+
+	sampler, err := newSampler(&Options{sample: 10})
+	r.NoError(err)
+	r.Equal(pipes.SampleCount, sampler.Mode)
+	r.Equal(10, sampler.GetRate())
+	sampler, err = newSampler(&Options{sample: 2, sampleMode: "flow"})
+	r.NoError(err)
+	r.Equal(pipes.SampleFlow, sampler.Mode)
+
+	_, err = newSampler(&Options{sample: -1})
+	r.EqualError(err, pipes.ErrSamplerInvalidRate)
+	_, err = newSampler(&Options{sample: 10, sampleMode: "unknown"})
+	r.EqualError(err, pipes.ErrSamplerInvalidMode)
+
+	cliOpts := &Options{isDebug: true, isTest: true, addr: "localhost", port: 6085,
+		device: "lo", sample: 10, sampleMode: "unknown"}
+	r.EqualError(run(cliOpts), ErrCouldNotCreateSampler)
+}
+
+func Test_NewFilter(t *testing.T) {
+	r := require.New(t)
+
+	filter, err := newFilter(&Options{postFilter: `dns.name ~ "*.example.com"`, postFilterDrop: true})
+	r.NoError(err)
+	r.Equal(`dns.name ~ "*.example.com"`, filter.Expression)
+	r.True(filter.Drop)
+
+	_, err = newFilter(&Options{postFilter: "tls.sni >"})
+	r.Error(err)
+	r.Contains(err.Error(), pipes.ErrInvalidExpression)
+
+	cliOpts := &Options{isDebug: true, isTest: true, addr: "localhost", port: 6086,
+		device: "lo", postFilter: "unknown"}
+	r.EqualError(run(cliOpts), ErrCouldNotCreateFilter)
+}
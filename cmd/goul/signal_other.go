@@ -0,0 +1,10 @@
+//go:build !aix && !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !solaris
+// +build !aix,!darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!solaris
+
+package main
+
+import "os"
+
+// triggerSignal is nil since there is no user signal on this platform.
+// The flight recorder can be triggered by the control file instead.
+var triggerSignal os.Signal
@@ -1,9 +1,14 @@
 package goul
 
+import "github.com/google/gopacket"
+
 // constants...
 const (
 	ItemTypeUnknown   = "unknown"
 	ItemTypeRawPacket = "rawpacket"
+	ItemTypeFilter    = "filter"  // control item to change the capture filter
+	ItemTypeTrigger   = "trigger" // control item to trigger the flight recorder
+	ItemTypeSample    = "sample"  // control item to change the sampling rate
 )
 
 //** types for goul, items ------------------------------------------
@@ -29,3 +34,65 @@ func (c *ItemGeneric) String() string {
 func (c *ItemGeneric) Data() []byte {
 	return c.DATA
 }
+
+//** annotations for packet items -----------------------------------
+
+// annotation keys...
+const (
+	AnnotationComment    = "comment"
+	AnnotationDirection  = "direction"
+	AnnotationInterface  = "interface"
+	AnnotationPrefix     = "prefix"
+	AnnotationMark       = "mark"
+	AnnotationInDevice   = "in-device"
+	AnnotationOutDevice  = "out-device"
+	AnnotationPID        = "pid"
+	AnnotationExecutable = "exe"
+	AnnotationCgroup     = "cgroup"
+	AnnotationContainer  = "container"
+	AnnotationSampleRate = "sample-rate"
+)
+
+// capture directions, used as the value of AnnotationDirection.
+const (
+	DirectionIn    = "in"
+	DirectionOut   = "out"
+	DirectionInOut = "inout"
+)
+
+// Annotations is a set of key/value metadata attached to a packet item.
+// It is stored in the ancillary data of the capture information of the
+// packet so it can be passed through the pipeline along with the packet.
+type Annotations map[string]string
+
+// AnnotationsOf returns the annotations of the item. It returns nil if
+// the item is not a packet or the packet has no annotations.
+func AnnotationsOf(item Item) Annotations {
+	p, ok := item.(gopacket.Packet)
+	if !ok || p.Metadata() == nil {
+		return nil
+	}
+	for _, data := range p.Metadata().AncillaryData {
+		if annotations, ok := data.(Annotations); ok {
+			return annotations
+		}
+	}
+	return nil
+}
+
+// Annotate sets the value for the key on the annotations of the item.
+// It returns false if the item is not a packet and cannot be annotated.
+func Annotate(item Item, key, value string) bool {
+	p, ok := item.(gopacket.Packet)
+	if !ok || p.Metadata() == nil {
+		return false
+	}
+	annotations := AnnotationsOf(item)
+	if annotations == nil {
+		annotations = Annotations{}
+		md := p.Metadata()
+		md.AncillaryData = append(md.AncillaryData, annotations)
+	}
+	annotations[key] = value
+	return true
+}
@@ -0,0 +1,25 @@
+package goul_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/hyeoncheon/goul"
+	. "github.com/hyeoncheon/goul/testing"
+)
+
+func Test_Annotations(t *testing.T) {
+	r := require.New(t)
+
+	packet, _ := GeneratePacket("TestData")
+	r.Nil(goul.AnnotationsOf(packet))
+	r.True(goul.Annotate(packet, goul.AnnotationComment, "hello"))
+	r.True(goul.Annotate(packet, "key", "value"))
+	r.Equal(goul.Annotations{goul.AnnotationComment: "hello", "key": "value"}, goul.AnnotationsOf(packet))
+	r.Equal(1, len(packet.Metadata().AncillaryData))
+
+	item := &goul.ItemGeneric{Meta: goul.ItemTypeRawPacket, DATA: packet.Data()}
+	r.False(goul.Annotate(item, "key", "value"))
+	r.Nil(goul.AnnotationsOf(item))
+}
@@ -0,0 +1,399 @@
+package pipes
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync/atomic"
+
+	"github.com/google/gopacket/layers"
+
+	"github.com/hyeoncheon/goul"
+)
+
+// constants...
+const (
+	AnonymizerKeySize    = 32
+	maxAnonymizerEntries = 65536
+
+	ErrAnonymizerInvalidKey = "invalid anonymizer key, it should be 32 bytes"
+)
+
+// Anonymizer is a pipe that pseudonymizes the IPv4 and IPv6 addresses of
+// IP and ARP with prefix-preserving Crypto-PAn. The addresses in ICMP
+// messages are also rewritten: the IP headers quoted in the error messages
+// of ICMP and ICMPv6, the gateway of ICMP redirects and the target of
+// IPv6 neighbor discovery and redirects. The addresses sharing a
+// prefix are mapped to the addresses sharing the prefix of the same
+// length, and the mapping is always the same for the same Key, so it is
+// consistent across restarts.
+//
+// Convert anonymizes the addresses and Revert restores them with the same
+// Key, for the holders of the key. If ScrubMAC is set, the unicast MAC
+// addresses are also replaced by locally administered addresses derived
+// from the key, which could not be restored. If FixChecksums is set, the
+// checksums are computed again after the rewriting.
+type Anonymizer struct {
+	goul.Pipe
+	ID           string
+	Key          []byte
+	ScrubMAC     bool
+	FixChecksums bool
+
+	reverse    bool
+	cipher     cipher.Block
+	pad        [aes.BlockSize]byte
+	addresses  map[string][]byte
+	macs       map[string][]byte
+	anonymized uint64
+	failed     uint64
+}
+
+// Convert implements interface Pipe/Converter
+func (p *Anonymizer) Convert(in chan goul.Item, message goul.Message) (out chan goul.Item, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			fmt.Fprintf(os.Stderr, "Anonymizer#Convert recovered from panic!\n")
+			fmt.Fprintf(os.Stderr, "Probably an inheritance problem of pipeline instance.\n")
+			fmt.Fprintf(os.Stderr, "panic: %v\n", r)
+			err = errors.New("panic")
+		}
+	}()
+
+	if p.ID == "" {
+		p.ID = "anonymize"
+	}
+	p.reverse = false
+	if err := p.init(); err != nil {
+		p.SetError(err)
+		return nil, err
+	}
+	p.SetError(nil)
+	return goul.Launch(p.anonymizer, in, message)
+}
+
+// Revert implements interface Pipe/Reverter
+func (p *Anonymizer) Revert(in chan goul.Item, message goul.Message) (out chan goul.Item, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			fmt.Fprintf(os.Stderr, "Anonymizer#Revert recovered from panic!\n")
+			fmt.Fprintf(os.Stderr, "Probably an inheritance problem of pipeline instance.\n")
+			fmt.Fprintf(os.Stderr, "panic: %v\n", r)
+			err = errors.New("panic")
+		}
+	}()
+
+	if p.ID == "" {
+		p.ID = "deanonymize"
+	}
+	p.reverse = true
+	if err := p.init(); err != nil {
+		p.SetError(err)
+		return nil, err
+	}
+	p.SetError(nil)
+	return goul.Launch(p.anonymizer, in, message)
+}
+
+// Stats returns the number of rewritten packets and the number of packets
+// of which checksums could not be computed. It is safe to call from other
+// goroutines.
+func (p *Anonymizer) Stats() (anonymized, failed uint64) {
+	return atomic.LoadUint64(&p.anonymized), atomic.LoadUint64(&p.failed)
+}
+
+func (p *Anonymizer) init() error {
+	if len(p.Key) != AnonymizerKeySize {
+		return errors.New(ErrAnonymizerInvalidKey)
+	}
+	block, err := aes.NewCipher(p.Key[:aes.BlockSize])
+	if err != nil {
+		return err
+	}
+	p.cipher = block
+	p.cipher.Encrypt(p.pad[:], p.Key[aes.BlockSize:])
+	p.addresses = map[string][]byte{}
+	p.macs = map[string][]byte{}
+	return nil
+}
+
+// anonymizer rewrites the addresses of the packets from input channel.
+func (p *Anonymizer) anonymizer(in, out chan goul.Item, message goul.Message) {
+	defer close(out)
+	defer goul.Log(p.GetLogger(), p.ID, "exit")
+	goul.Log(p.GetLogger(), p.ID, "anonymizer in looping...")
+
+	for item := range in {
+		packet := toPacket(item)
+		if packet == nil {
+			out <- item
+			continue
+		}
+		frame := append([]byte{}, packet.Data()...)
+		if !p.rewrite(frame, p.reverse) {
+			out <- packet
+			continue
+		}
+		if p.FixChecksums {
+			if fixed, err := fixChecksums(frame); err == nil {
+				frame = fixed
+			} else {
+				if atomic.AddUint64(&p.failed, 1) == 1 {
+					goul.Error(p.GetLogger(), p.ID, "couldn't fix checksums: %v", err)
+				}
+			}
+		}
+		atomic.AddUint64(&p.anonymized, 1)
+		out <- repacket(packet, frame)
+	}
+	p.SetError(errors.New(goul.ErrPipeInputClosed))
+	goul.Log(p.GetLogger(), p.ID, "channel closed")
+	if logger := p.GetLogger(); logger != nil {
+		anonymized, failed := p.Stats()
+		logger.Infof("[%v] %v packets rewritten, %v checksums failed", p.ID, anonymized, failed)
+	}
+}
+
+// rewrite rewrites the addresses of the frame in place. It returns false
+// if there is nothing to rewrite.
+func (p *Anonymizer) rewrite(frame []byte, reverse bool) bool {
+	if len(frame) < 14 {
+		return false
+	}
+	rewritten := false
+	if p.ScrubMAC && !reverse {
+		p.scrubMAC(frame[0:6])
+		p.scrubMAC(frame[6:12])
+		rewritten = true
+	}
+
+	offset := 12
+	etherType := layers.EthernetType(binary.BigEndian.Uint16(frame[offset:]))
+	for (etherType == layers.EthernetTypeDot1Q || etherType == layers.EthernetTypeQinQ) && len(frame) >= offset+6 {
+		offset += 4
+		etherType = layers.EthernetType(binary.BigEndian.Uint16(frame[offset:]))
+	}
+	data := frame[offset+2:]
+	switch etherType {
+	case layers.EthernetTypeIPv4:
+		if len(data) < 20 {
+			return rewritten
+		}
+		p.address(data[12:16], reverse)
+		p.address(data[16:20], reverse)
+		p.icmp4(data, reverse)
+	case layers.EthernetTypeIPv6:
+		if len(data) < 40 {
+			return rewritten
+		}
+		p.address(data[8:24], reverse)
+		p.address(data[24:40], reverse)
+		p.icmp6(data, reverse)
+	case layers.EthernetTypeARP:
+		// only ethernet and IPv4 are supported
+		if len(data) < 28 || data[4] != 6 || data[5] != 4 {
+			return rewritten
+		}
+		if p.ScrubMAC && !reverse {
+			p.scrubMAC(data[8:14])
+			p.scrubMAC(data[18:24])
+		}
+		p.address(data[14:18], reverse)
+		p.address(data[24:28], reverse)
+	default:
+		return rewritten
+	}
+	return true
+}
+
+// icmp4 rewrites the addresses in the ICMP message of the IPv4 packet in
+// place, which are the gateway of the redirect and the addresses of the IP
+// header quoted in the error messages.
+func (p *Anonymizer) icmp4(data []byte, reverse bool) {
+	ihl := int(data[0]&0x0f) * 4
+	if layers.IPProtocol(data[9]) != layers.IPProtocolICMPv4 || ihl < 20 || len(data) < ihl+8 {
+		return
+	}
+	if binary.BigEndian.Uint16(data[6:])&0x1fff != 0 { // not the first fragment
+		return
+	}
+	icmp := data[ihl:]
+	switch icmp[0] {
+	case layers.ICMPv4TypeRedirect:
+		p.address(icmp[4:8], reverse)
+		p.quoted4(icmp[8:], reverse)
+	case layers.ICMPv4TypeDestinationUnreachable, layers.ICMPv4TypeSourceQuench,
+		layers.ICMPv4TypeTimeExceeded, layers.ICMPv4TypeParameterProblem:
+		p.quoted4(icmp[8:], reverse)
+	}
+}
+
+// quoted4 rewrites the addresses of the quoted IPv4 header in place.
+func (p *Anonymizer) quoted4(quoted []byte, reverse bool) {
+	if len(quoted) < 20 || quoted[0]>>4 != 4 {
+		return
+	}
+	p.address(quoted[12:16], reverse)
+	p.address(quoted[16:20], reverse)
+}
+
+// icmp6 rewrites the addresses in the ICMPv6 message of the IPv6 packet in
+// place, which are the addresses of the IPv6 header quoted in the error
+// messages, the target of neighbor discovery and the target and the
+// destination of redirects with the options of them.
+func (p *Anonymizer) icmp6(data []byte, reverse bool) {
+	next, offset := layers.IPProtocol(data[6]), 40
+	for next == layers.IPProtocolIPv6HopByHop || next == layers.IPProtocolIPv6Routing ||
+		next == layers.IPProtocolIPv6Destination {
+		if len(data) < offset+8 {
+			return
+		}
+		next, offset = layers.IPProtocol(data[offset]), offset+(int(data[offset+1])+1)*8
+	}
+	if next != layers.IPProtocolICMPv6 || len(data) < offset+8 {
+		return
+	}
+	icmp := data[offset:]
+	switch icmp[0] {
+	case layers.ICMPv6TypeDestinationUnreachable, layers.ICMPv6TypePacketTooBig,
+		layers.ICMPv6TypeTimeExceeded, layers.ICMPv6TypeParameterProblem:
+		p.quoted6(icmp[8:], reverse)
+	case layers.ICMPv6TypeNeighborSolicitation, layers.ICMPv6TypeNeighborAdvertisement:
+		if len(icmp) < 24 {
+			return
+		}
+		p.address(icmp[8:24], reverse)
+		p.ndOptions(icmp[24:], reverse)
+	case layers.ICMPv6TypeRedirect:
+		if len(icmp) < 40 {
+			return
+		}
+		p.address(icmp[8:24], reverse)
+		p.address(icmp[24:40], reverse)
+		p.ndOptions(icmp[40:], reverse)
+	}
+}
+
+// quoted6 rewrites the addresses of the quoted IPv6 header in place.
+func (p *Anonymizer) quoted6(quoted []byte, reverse bool) {
+	if len(quoted) < 40 || quoted[0]>>4 != 6 {
+		return
+	}
+	p.address(quoted[8:24], reverse)
+	p.address(quoted[24:40], reverse)
+}
+
+// ndOptions rewrites the options of neighbor discovery in place, which are
+// the link-layer addresses if ScrubMAC is set and the header quoted in the
+// redirected header option.
+func (p *Anonymizer) ndOptions(options []byte, reverse bool) {
+	for len(options) >= 8 && options[1] > 0 {
+		length := int(options[1]) * 8
+		if len(options) < length {
+			return
+		}
+		switch layers.ICMPv6Opt(options[0]) {
+		case layers.ICMPv6OptSourceAddress, layers.ICMPv6OptTargetAddress:
+			if p.ScrubMAC && !reverse && length == 8 {
+				p.scrubMAC(options[2:8])
+			}
+		case layers.ICMPv6OptRedirectedHeader:
+			p.quoted6(options[8:length], reverse)
+		}
+		options = options[length:]
+	}
+}
+
+// address anonymizes or restores the address in place.
+func (p *Anonymizer) address(addr []byte, reverse bool) {
+	key := string(addr)
+	if reverse {
+		key = "-" + key
+	}
+	if mapped, ok := p.addresses[key]; ok {
+		copy(addr, mapped)
+		return
+	}
+	mapped := p.cryptoPAn(addr, reverse)
+	if len(p.addresses) >= maxAnonymizerEntries {
+		p.addresses = map[string][]byte{}
+	}
+	p.addresses[key] = mapped
+	copy(addr, mapped)
+}
+
+// cryptoPAn returns the address anonymized by Crypto-PAn, or restored from
+// the anonymized address if reverse is set. Each bit of the result is the
+// original bit xor the first bit of the cipher of the original prefix
+// before the bit, padded with the pad.
+func (p *Anonymizer) cryptoPAn(addr []byte, reverse bool) []byte {
+	result := make([]byte, len(addr))
+	original := addr
+	if reverse {
+		original = result // restored bit by bit
+	}
+
+	var input, output [aes.BlockSize]byte
+	for i := 0; i < len(addr)*8; i++ {
+		input = p.pad
+		copy(input[:i/8], original[:i/8])
+		if bits := uint(i % 8); bits > 0 {
+			mask := byte(0xff << (8 - bits))
+			input[i/8] = original[i/8]&mask | p.pad[i/8]&^mask
+		}
+		p.cipher.Encrypt(output[:], input[:])
+		bit := (addr[i/8]>>(7-uint(i%8)) ^ output[0]>>7) & 1
+		result[i/8] |= bit << (7 - uint(i%8))
+	}
+	return result
+}
+
+// scrubMAC replaces the unicast MAC address in place by a locally
+// administered address derived from the key. Multicast and broadcast
+// addresses are kept.
+func (p *Anonymizer) scrubMAC(mac []byte) {
+	if mac[0]&0x01 != 0 {
+		return
+	}
+	if mapped, ok := p.macs[string(mac)]; ok {
+		copy(mac, mapped)
+		return
+	}
+	var input, output [aes.BlockSize]byte
+	input = p.pad
+	copy(input[:], mac)
+	p.cipher.Encrypt(output[:], input[:])
+	mapped := output[:6]
+	mapped[0] = mapped[0]&0xfc | 0x02
+	if len(p.macs) >= maxAnonymizerEntries {
+		p.macs = map[string][]byte{}
+	}
+	p.macs[string(mac)] = mapped
+	copy(mac, mapped)
+}
+
+// AnonymizeIP returns the address anonymized with the key, to find the
+// anonymized address of a known address.
+func AnonymizeIP(key []byte, ip net.IP) (net.IP, error) {
+	return cryptoPAnIP(key, ip, false)
+}
+
+// DeanonymizeIP returns the original address of the anonymized address.
+func DeanonymizeIP(key []byte, ip net.IP) (net.IP, error) {
+	return cryptoPAnIP(key, ip, true)
+}
+
+func cryptoPAnIP(key []byte, ip net.IP, reverse bool) (net.IP, error) {
+	p := &Anonymizer{Key: key}
+	if err := p.init(); err != nil {
+		return nil, err
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	return net.IP(p.cryptoPAn(ip, reverse)), nil
+}
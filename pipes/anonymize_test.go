@@ -0,0 +1,232 @@
+package pipes_test
+
+import (
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/stretchr/testify/require"
+
+	"github.com/hyeoncheon/goul"
+	"github.com/hyeoncheon/goul/pipes"
+)
+
+// anonymizerKey is the key of the sample trace of Crypto-PAn.
+var anonymizerKey = []byte{
+	21, 34, 23, 141, 51, 164, 207, 128, 19, 10, 91, 22, 73, 144, 125, 16,
+	216, 152, 143, 131, 121, 121, 101, 39, 98, 87, 76, 45, 42, 132, 34, 2,
+}
+
+func Test_Anonymizer_10_CryptoPAn(t *testing.T) {
+	r := require.New(t)
+
+	// from the sample trace of the reference implementation.
+	for original, anonymized := range map[string]string{
+		"128.11.68.132":   "135.242.180.132",
+		"129.118.74.4":    "134.136.186.123",
+		"130.132.252.244": "133.68.164.234",
+		"141.223.7.43":    "141.167.8.160",
+	} {
+		ip, err := pipes.AnonymizeIP(anonymizerKey, net.ParseIP(original))
+		r.NoError(err)
+		r.Equal(anonymized, ip.String())
+		ip, err = pipes.DeanonymizeIP(anonymizerKey, ip)
+		r.NoError(err)
+		r.Equal(original, ip.String())
+	}
+
+	// prefixes are preserved for IPv6.
+	a, err := pipes.AnonymizeIP(anonymizerKey, net.ParseIP("2001:db8:1::1"))
+	r.NoError(err)
+	b, err := pipes.AnonymizeIP(anonymizerKey, net.ParseIP("2001:db8:1::2"))
+	r.NoError(err)
+	r.Equal(a[:15], b[:15])
+	r.NotEqual(a[15], b[15])
+	ip, err := pipes.DeanonymizeIP(anonymizerKey, a)
+	r.NoError(err)
+	r.Equal("2001:db8:1::1", ip.String())
+
+	_, err = pipes.AnonymizeIP([]byte("short"), a)
+	r.EqualError(err, pipes.ErrAnonymizerInvalidKey)
+}
+
+func Test_Anonymizer_20_Pipe(t *testing.T) {
+	r := require.New(t)
+
+	anonymizer := &pipes.Anonymizer{
+		Pipe:         &goul.BasePipe{Mode: goul.ModeConverter},
+		Key:          anonymizerKey,
+		ScrubMAC:     true,
+		FixChecksums: true,
+	}
+	deanonymizer := &pipes.Anonymizer{
+		Pipe:         &goul.BasePipe{Mode: goul.ModeReverter},
+		Key:          anonymizerKey,
+		FixChecksums: true,
+	}
+	in := make(chan goul.Item)
+	anonymized, err := anonymizer.Convert(in, nil)
+	r.NoError(err)
+	relay := make(chan goul.Item)
+	out, err := deanonymizer.Revert(relay, nil)
+	r.NoError(err)
+
+	src := &net.TCPAddr{IP: net.IP{128, 11, 68, 132}, Port: 1}
+	dst := &net.TCPAddr{IP: net.IP{129, 118, 74, 4}, Port: 2}
+	original := tcpPacket(src, dst)
+	in <- original
+	packet := (<-anonymized).(gopacket.Packet)
+	ip := packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+	r.Equal("135.242.180.132", ip.SrcIP.String())
+	r.Equal("134.136.186.123", ip.DstIP.String())
+	r.True(validIPv4Checksum(ip))
+	r.True(validChecksums(packet))
+	ether := packet.Layer(layers.LayerTypeEthernet).(*layers.Ethernet)
+	r.NotEqual(original.LinkLayer().(*layers.Ethernet).SrcMAC, ether.SrcMAC)
+	r.Equal(byte(0x02), ether.SrcMAC[0]&0x03)
+	r.Equal("Process", string(packet.ApplicationLayer().Payload()))
+
+	// the mapping is the same for the same key.
+	again := &pipes.Anonymizer{Pipe: &goul.BasePipe{Mode: goul.ModeConverter}, Key: anonymizerKey, ScrubMAC: true}
+	in2 := make(chan goul.Item)
+	out2, err := again.Convert(in2, nil)
+	r.NoError(err)
+	in2 <- original
+	r.Equal(ether.SrcMAC, (<-out2).(gopacket.Packet).LinkLayer().(*layers.Ethernet).SrcMAC)
+	close(in2)
+	<-out2
+
+	// restored by the holder of the key, except MAC addresses.
+	relay <- packet
+	restored := (<-out).(gopacket.Packet)
+	ip = restored.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+	r.Equal(src.IP.String(), ip.SrcIP.String())
+	r.Equal(dst.IP.String(), ip.DstIP.String())
+	r.Equal(original.Data()[12:], restored.Data()[12:])
+
+	in <- &goul.ItemGeneric{Meta: "message", DATA: []byte("hello")}
+	r.Equal("hello", string((<-anonymized).Data()))
+
+	close(in)
+	_, ok := <-anonymized
+	r.False(ok)
+	r.EqualError(anonymizer.GetError(), goul.ErrPipeInputClosed)
+	close(relay)
+	<-out
+	rewritten, failed := anonymizer.Stats()
+	r.Equal(uint64(1), rewritten)
+	r.Equal(uint64(0), failed)
+}
+
+// icmpPacket returns an ICMP port unreachable of the UDP packet from src
+// to dst, sent by dst.
+func icmpPacket(src, dst net.IP) gopacket.Packet {
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	quotedIP := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolUDP, SrcIP: src, DstIP: dst}
+	udp := &layers.UDP{SrcPort: 40000, DstPort: 53}
+	udp.SetNetworkLayerForChecksum(quotedIP)
+	quoted := gopacket.NewSerializeBuffer()
+	gopacket.SerializeLayers(quoted, opts, quotedIP, udp, gopacket.Payload("Query"))
+
+	ether := &layers.Ethernet{
+		SrcMAC:       net.HardwareAddr{0x02, 0, 0, 0, 0, 2},
+		DstMAC:       net.HardwareAddr{0x02, 0, 0, 0, 0, 1},
+		EthernetType: layers.EthernetTypeIPv4,
+	}
+	ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolICMPv4, SrcIP: dst, DstIP: src}
+	icmp := &layers.ICMPv4{TypeCode: layers.CreateICMPv4TypeCode(layers.ICMPv4TypeDestinationUnreachable,
+		layers.ICMPv4CodePort)}
+	buffer := gopacket.NewSerializeBuffer()
+	gopacket.SerializeLayers(buffer, opts, ether, ip, icmp, gopacket.Payload(quoted.Bytes()))
+	return gopacket.NewPacket(buffer.Bytes(), layers.LayerTypeEthernet, gopacket.Default)
+}
+
+// solicitation returns an IPv6 neighbor solicitation for the target.
+func solicitation(src, target net.IP) gopacket.Packet {
+	ether := &layers.Ethernet{
+		SrcMAC:       net.HardwareAddr{0x02, 0, 0, 0, 0, 2},
+		DstMAC:       net.HardwareAddr{0x33, 0x33, 0xff, 0, 0, 1},
+		EthernetType: layers.EthernetTypeIPv6,
+	}
+	ip := &layers.IPv6{Version: 6, HopLimit: 255, NextHeader: layers.IPProtocolICMPv6,
+		SrcIP: src, DstIP: net.ParseIP("ff02::1:ff00:1")}
+	icmp := &layers.ICMPv6{TypeCode: layers.CreateICMPv6TypeCode(layers.ICMPv6TypeNeighborSolicitation, 0)}
+	icmp.SetNetworkLayerForChecksum(ip)
+	ns := &layers.ICMPv6NeighborSolicitation{TargetAddress: target, Options: layers.ICMPv6Options{
+		{Type: layers.ICMPv6OptSourceAddress, Data: []byte{0x02, 0, 0, 0, 0, 2}},
+	}}
+	buffer := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	gopacket.SerializeLayers(buffer, opts, ether, ip, icmp, ns)
+	return gopacket.NewPacket(buffer.Bytes(), layers.LayerTypeEthernet, gopacket.Default)
+}
+
+func Test_Anonymizer_25_ICMP(t *testing.T) {
+	r := require.New(t)
+
+	anonymizer := &pipes.Anonymizer{
+		Pipe:         &goul.BasePipe{Mode: goul.ModeConverter},
+		Key:          anonymizerKey,
+		ScrubMAC:     true,
+		FixChecksums: true,
+	}
+	in := make(chan goul.Item)
+	out, err := anonymizer.Convert(in, nil)
+	r.NoError(err)
+	defer close(in)
+
+	// the header quoted in the port unreachable is also anonymized.
+	original := icmpPacket(net.IP{128, 11, 68, 132}, net.IP{129, 118, 74, 4})
+	in <- original
+	packet := (<-out).(gopacket.Packet)
+	r.True(validChecksums(packet))
+	icmp := packet.Layer(layers.LayerTypeICMPv4).(*layers.ICMPv4)
+	quoted := gopacket.NewPacket(icmp.Payload, layers.LayerTypeIPv4, gopacket.Default)
+	ip := quoted.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+	r.Equal("135.242.180.132", ip.SrcIP.String())
+	r.Equal("134.136.186.123", ip.DstIP.String())
+	r.Equal(layers.UDPPort(53), quoted.Layer(layers.LayerTypeUDP).(*layers.UDP).DstPort)
+
+	deanonymizer := &pipes.Anonymizer{Pipe: &goul.BasePipe{Mode: goul.ModeReverter}, Key: anonymizerKey}
+	relay := make(chan goul.Item)
+	restored, err := deanonymizer.Revert(relay, nil)
+	r.NoError(err)
+	relay <- packet
+	data := (<-restored).Data()
+	r.Equal(original.Data()[26:34], data[26:34]) // outer addresses
+	r.Equal(original.Data()[54:62], data[54:62]) // quoted addresses
+	close(relay)
+	<-restored
+
+	// the target of neighbor discovery and the link-layer address option.
+	src, target := net.ParseIP("2001:db8:1::1"), net.ParseIP("2001:db8:1::2")
+	in <- solicitation(src, target)
+	packet = (<-out).(gopacket.Packet)
+	ns := packet.Layer(layers.LayerTypeICMPv6NeighborSolicitation).(*layers.ICMPv6NeighborSolicitation)
+	anonymized, err := pipes.AnonymizeIP(anonymizerKey, target)
+	r.NoError(err)
+	r.Equal(anonymized.String(), ns.TargetAddress.String())
+	r.NotEqual([]byte{0x02, 0, 0, 0, 0, 2}, ns.Options[0].Data)
+	r.Equal(packet.LinkLayer().(*layers.Ethernet).SrcMAC, net.HardwareAddr(ns.Options[0].Data))
+}
+
+func Test_Anonymizer_30_Exceptions(t *testing.T) {
+	r := require.New(t)
+
+	anonymizer := &pipes.Anonymizer{Pipe: &goul.BasePipe{Mode: goul.ModeConverter}}
+	_, err := anonymizer.Convert(make(chan goul.Item), nil)
+	r.EqualError(err, pipes.ErrAnonymizerInvalidKey)
+	_, err = anonymizer.Revert(make(chan goul.Item), nil)
+	r.EqualError(err, pipes.ErrAnonymizerInvalidKey)
+
+	// non-IP frames are passed as is.
+	anonymizer = &pipes.Anonymizer{Pipe: &goul.BasePipe{Mode: goul.ModeConverter}, Key: anonymizerKey}
+	in := make(chan goul.Item)
+	out, err := anonymizer.Convert(in, nil)
+	r.NoError(err)
+	in <- &goul.ItemGeneric{Meta: goul.ItemTypeRawPacket, DATA: []byte("short")}
+	r.Equal("short", string((<-out).Data()))
+	close(in)
+	<-out
+}
@@ -0,0 +1,203 @@
+package pipes
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/gopacket/layers"
+
+	"github.com/hyeoncheon/goul"
+)
+
+// constants...
+const (
+	defaultDedupWindow = 50 * time.Millisecond
+
+	ErrDedupInvalidWindow = "invalid dedup window"
+)
+
+// Deduplicator is a pipe that drops duplicated packets in the window, such
+// as the packets captured on both sides of a connection or on several
+// hosts of the same segment.
+//
+// The packets are compared by the hash from the network layer, so the
+// ethernet header which is changed by routing is ignored. The volatile
+// fields of the IP header, TTL and checksum of IPv4 or hop limit of IPv6,
+// are masked before hashing, and the ID of IPv4 is also masked if
+// IgnoreIPID is set. It can be used on both client and server.
+type Deduplicator struct {
+	goul.Pipe
+	ID         string
+	Window     time.Duration
+	IgnoreIPID bool
+
+	seen    map[uint64]time.Time
+	history []dedupEntry
+	passed  uint64
+	dropped uint64
+}
+
+// dedupEntry is a hash and its time in the order of arrival.
+type dedupEntry struct {
+	hash uint64
+	time time.Time
+}
+
+// Convert implements interface Pipe/Converter
+func (p *Deduplicator) Convert(in chan goul.Item, message goul.Message) (out chan goul.Item, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			fmt.Fprintf(os.Stderr, "Deduplicator#Convert recovered from panic!\n")
+			fmt.Fprintf(os.Stderr, "Probably an inheritance problem of pipeline instance.\n")
+			fmt.Fprintf(os.Stderr, "panic: %v\n", r)
+			err = errors.New("panic")
+		}
+	}()
+
+	if err := p.init(); err != nil {
+		p.SetError(err)
+		return nil, err
+	}
+	p.SetError(nil)
+	return goul.Launch(p.deduplicator, in, message)
+}
+
+// Revert implements interface Pipe/Reverter
+func (p *Deduplicator) Revert(in chan goul.Item, message goul.Message) (out chan goul.Item, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			fmt.Fprintf(os.Stderr, "Deduplicator#Revert recovered from panic!\n")
+			fmt.Fprintf(os.Stderr, "Probably an inheritance problem of pipeline instance.\n")
+			fmt.Fprintf(os.Stderr, "panic: %v\n", r)
+			err = errors.New("panic")
+		}
+	}()
+
+	if err := p.init(); err != nil {
+		p.SetError(err)
+		return nil, err
+	}
+	p.SetError(nil)
+	return goul.Launch(p.deduplicator, in, message)
+}
+
+// Stats returns the number of passed and dropped packets. It is safe to
+// call from other goroutines.
+func (p *Deduplicator) Stats() (passed, dropped uint64) {
+	return atomic.LoadUint64(&p.passed), atomic.LoadUint64(&p.dropped)
+}
+
+// Ratio returns the ratio of dropped packets in percent.
+func (p *Deduplicator) Ratio() float64 {
+	passed, dropped := p.Stats()
+	if passed+dropped == 0 {
+		return 0
+	}
+	return float64(dropped) * 100 / float64(passed+dropped)
+}
+
+func (p *Deduplicator) init() error {
+	if p.ID == "" {
+		p.ID = "dedup"
+	}
+	if p.Window < 0 {
+		return errors.New(ErrDedupInvalidWindow)
+	}
+	if p.Window == 0 {
+		p.Window = defaultDedupWindow
+	}
+	p.seen = map[uint64]time.Time{}
+	p.history = nil
+	return nil
+}
+
+// deduplicator drops the packets seen in the window.
+func (p *Deduplicator) deduplicator(in, out chan goul.Item, message goul.Message) {
+	defer close(out)
+	defer goul.Log(p.GetLogger(), p.ID, "exit")
+	goul.Log(p.GetLogger(), p.ID, "deduplicator in looping... (window %v)", p.Window)
+
+	for item := range in {
+		packet := toPacket(item)
+		if packet == nil {
+			out <- item
+			continue
+		}
+		if p.duplicated(p.hash(packet.Data()), time.Now()) {
+			atomic.AddUint64(&p.dropped, 1)
+			continue
+		}
+		atomic.AddUint64(&p.passed, 1)
+		out <- packet
+	}
+	p.SetError(errors.New(goul.ErrPipeInputClosed))
+	goul.Log(p.GetLogger(), p.ID, "channel closed")
+	if logger := p.GetLogger(); logger != nil {
+		passed, dropped := p.Stats()
+		logger.Infof("[%v] %v packets passed, %v duplicates dropped (%.1f%%)", p.ID, passed, dropped, p.Ratio())
+	}
+}
+
+// duplicated returns true if the hash was seen in the window. Otherwise,
+// it remembers the hash. The hashes out of the window are forgotten.
+func (p *Deduplicator) duplicated(hash uint64, now time.Time) bool {
+	expired := 0
+	for _, entry := range p.history {
+		if now.Sub(entry.time) <= p.Window {
+			break
+		}
+		if p.seen[entry.hash] == entry.time {
+			delete(p.seen, entry.hash)
+		}
+		expired++
+	}
+	p.history = p.history[expired:]
+
+	if _, ok := p.seen[hash]; ok {
+		return true
+	}
+	p.seen[hash] = now
+	p.history = append(p.history, dedupEntry{hash: hash, time: now})
+	return false
+}
+
+// hash returns the hash of the frame from the network layer, with the
+// volatile fields of the IP header masked.
+func (p *Deduplicator) hash(frame []byte) uint64 {
+	h := fnv.New64a()
+	offset := 12
+	for len(frame) >= offset+2 {
+		etherType := layers.EthernetType(binary.BigEndian.Uint16(frame[offset:]))
+		if etherType == layers.EthernetTypeDot1Q || etherType == layers.EthernetTypeQinQ {
+			offset += 4
+			continue
+		}
+		data := frame[offset+2:]
+		switch {
+		case etherType == layers.EthernetTypeIPv4 && len(data) >= 20:
+			header := make([]byte, 20)
+			copy(header, data)
+			header[8] = 0                 // TTL
+			header[10], header[11] = 0, 0 // checksum
+			if p.IgnoreIPID {
+				header[4], header[5] = 0, 0
+			}
+			h.Write(header)
+			h.Write(data[20:])
+			return h.Sum64()
+		case etherType == layers.EthernetTypeIPv6 && len(data) >= 40:
+			h.Write(data[:7])
+			h.Write(data[8:]) // without hop limit
+			return h.Sum64()
+		}
+		h.Write(frame[offset:])
+		return h.Sum64()
+	}
+	h.Write(frame)
+	return h.Sum64()
+}
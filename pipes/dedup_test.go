@@ -0,0 +1,123 @@
+package pipes_test
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/stretchr/testify/require"
+
+	"github.com/hyeoncheon/goul"
+	"github.com/hyeoncheon/goul/pipes"
+)
+
+// routedPacket returns a copy of the packet as if it was routed once, with
+// new MAC addresses, decreased TTL and the given IP ID.
+func routedPacket(packet gopacket.Packet, id uint16) gopacket.Packet {
+	ether := *packet.Layer(layers.LayerTypeEthernet).(*layers.Ethernet)
+	ether.SrcMAC = net.HardwareAddr{0x02, 0, 0, 0, 0, 3}
+	ip := *packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+	ip.TTL--
+	ip.Id = id
+	buffer := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{ComputeChecksums: true}
+	gopacket.SerializeLayers(buffer, opts, &ether, &ip, gopacket.Payload(ip.Payload))
+	return gopacket.NewPacket(buffer.Bytes(), layers.LayerTypeEthernet, gopacket.Default)
+}
+
+func Test_Deduplicator_10_Dedup(t *testing.T) {
+	r := require.New(t)
+
+	dedup := &pipes.Deduplicator{
+		Pipe:   &goul.BasePipe{Mode: goul.ModeConverter},
+		Window: 200 * time.Millisecond,
+	}
+	in := make(chan goul.Item)
+	out, err := dedup.Convert(in, nil)
+	r.NoError(err)
+
+	src := &net.TCPAddr{IP: net.IP{10, 0, 0, 1}, Port: 1}
+	dst := &net.TCPAddr{IP: net.IP{10, 0, 0, 2}, Port: 2}
+	packet := tcpPacket(src, dst)
+	in <- packet
+	r.Equal(packet.Data(), (<-out).Data())
+
+	// routed copy is dropped, the next packet is passed.
+	in <- routedPacket(packet, 0)
+	in <- tcpPacket(dst, src)
+	r.Equal(tcpPacket(dst, src).Data(), (<-out).Data())
+
+	// different IP ID is not a duplicate by default.
+	in <- routedPacket(packet, 1)
+	r.NotNil(<-out)
+
+	// the same packet is passed again after the window.
+	time.Sleep(250 * time.Millisecond)
+	in <- packet
+	r.Equal(packet.Data(), (<-out).Data())
+
+	in <- &goul.ItemGeneric{Meta: "message", DATA: []byte("hello")}
+	r.Equal("hello", string((<-out).Data()))
+
+	close(in)
+	_, ok := <-out
+	r.False(ok)
+	r.EqualError(dedup.GetError(), goul.ErrPipeInputClosed)
+	passed, dropped := dedup.Stats()
+	r.Equal(uint64(4), passed)
+	r.Equal(uint64(1), dropped)
+	r.InDelta(20.0, dedup.Ratio(), 0.01)
+}
+
+func Test_Deduplicator_20_IgnoreIPID(t *testing.T) {
+	r := require.New(t)
+
+	dedup := &pipes.Deduplicator{
+		Pipe:       &goul.BasePipe{Mode: goul.ModeReverter},
+		IgnoreIPID: true,
+	}
+	in := make(chan goul.Item)
+	out, err := dedup.Revert(in, nil)
+	r.NoError(err)
+
+	packet := tcpPacket(&net.TCPAddr{IP: net.IP{10, 0, 0, 1}, Port: 1}, &net.TCPAddr{IP: net.IP{10, 0, 0, 2}, Port: 2})
+	in <- packet
+	<-out
+	in <- routedPacket(packet, 1234)
+	close(in)
+	_, ok := <-out
+	r.False(ok)
+
+	passed, dropped := dedup.Stats()
+	r.Equal(uint64(1), passed)
+	r.Equal(uint64(1), dropped)
+}
+
+func Test_Deduplicator_30_Exceptions(t *testing.T) {
+	r := require.New(t)
+
+	dedup := &pipes.Deduplicator{
+		Pipe:   &goul.BasePipe{Mode: goul.ModeConverter},
+		Window: -time.Second,
+	}
+	_, err := dedup.Convert(make(chan goul.Item), nil)
+	r.EqualError(err, pipes.ErrDedupInvalidWindow)
+	r.Equal(float64(0), dedup.Ratio())
+
+	// short or non-IP frames are compared as a whole.
+	dedup = &pipes.Deduplicator{Pipe: &goul.BasePipe{Mode: goul.ModeConverter}}
+	in := make(chan goul.Item)
+	out, err := dedup.Convert(in, nil)
+	r.NoError(err)
+	in <- &goul.ItemGeneric{Meta: goul.ItemTypeRawPacket, DATA: []byte("short")}
+	r.Equal("short", string((<-out).Data()))
+	in <- &goul.ItemGeneric{Meta: goul.ItemTypeRawPacket, DATA: []byte("short")}
+	in <- &goul.ItemGeneric{Meta: goul.ItemTypeRawPacket, DATA: []byte("other")}
+	r.Equal("other", string((<-out).Data()))
+	close(in)
+	<-out
+	_, dropped := dedup.Stats()
+	r.Equal(uint64(1), dropped)
+}
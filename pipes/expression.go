@@ -0,0 +1,752 @@
+package pipes
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// constants...
+const (
+	ErrInvalidExpression = "invalid filter expression"
+)
+
+// Expression is a compiled filter expression over the decoded layers of
+// packets. It is parsed once by CompileExpression and evaluated for each
+// packet by Match.
+//
+// The expression is a combination of the terms with `and`, `or`, `not`
+// (or `&&`, `||`, `!`) and parentheses. A term is a protocol such as
+// `tcp` or `dns`, a field which matches if the packet has it such as
+// `tls.sni`, or a comparison of a field and a value such as
+// `port == 443`. The values could be quoted.
+//
+//	protocols: ip, ip6, arp, tcp, udp, sctp, icmp, icmp6, dns, dns.query,
+//	           dns.response, http, tls, tls.clienthello
+//	addresses: ip.src, ip.dst, ip.addr  (==, != with address or CIDR)
+//	numbers:   ip.version, ip.ttl, ip.proto, src.port, dst.port, port, len
+//	           (==, !=, <, <=, >, >=)
+//	strings:   dns.name, http.method, http.host, http.path, tls.sni
+//	           (==, != or ~, !~ with glob pattern of `*` and `?`)
+//
+// The fields with multiple values such as `ip.addr` or `port` match if any
+// of the values matches, and `!=` or `!~` matches if none of them does.
+// The names and methods are compared case-insensitively.
+//
+// For example, `tls.sni ~ "*.example.com"` matches TLS ClientHello for the
+// servers of example.com and `dns.query and dns.name ~ "*.corp"` matches
+// DNS queries for the names in corp.
+type Expression struct {
+	source string
+	root   expressionNode
+}
+
+// CompileExpression parses the expression.
+func CompileExpression(source string) (*Expression, error) {
+	tokens, err := tokenize(source)
+	if err != nil {
+		return nil, err
+	}
+	parser := &expressionParser{tokens: tokens}
+	root, err := parser.or()
+	if err != nil {
+		return nil, err
+	}
+	if parser.position < len(parser.tokens) {
+		return nil, expressionError("unexpected %q", parser.tokens[parser.position].text)
+	}
+	return &Expression{source: source, root: root}, nil
+}
+
+// Match returns true if the packet matches the expression.
+func (e *Expression) Match(packet gopacket.Packet) bool {
+	return e.root.match(&packetFields{packet: packet})
+}
+
+// String returns the source of the expression.
+func (e *Expression) String() string {
+	return e.source
+}
+
+func expressionError(format string, args ...interface{}) error {
+	return fmt.Errorf("%v: %v", ErrInvalidExpression, fmt.Sprintf(format, args...))
+}
+
+//** parser ---------------------------------------------------------
+
+// expressionToken is a token of the expression. quoted is true for the
+// quoted strings, which are never keywords or operators.
+type expressionToken struct {
+	text   string
+	quoted bool
+}
+
+// tokenize splits the expression into the tokens.
+func tokenize(source string) ([]expressionToken, error) {
+	tokens := []expressionToken{}
+	for i := 0; i < len(source); {
+		c := source[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '(' || c == ')':
+			tokens = append(tokens, expressionToken{text: string(c)})
+			i++
+		case c == '"':
+			value := []byte{}
+			for i++; i < len(source) && source[i] != '"'; i++ {
+				if source[i] == '\\' && i+1 < len(source) {
+					i++
+				}
+				value = append(value, source[i])
+			}
+			if i >= len(source) {
+				return nil, expressionError("unterminated string")
+			}
+			tokens = append(tokens, expressionToken{text: string(value), quoted: true})
+			i++
+		case strings.IndexByte("=!~<>&|", c) >= 0:
+			j := i + 1
+			for j < len(source) && strings.IndexByte("=~&|", source[j]) >= 0 {
+				j++
+			}
+			tokens = append(tokens, expressionToken{text: source[i:j]})
+			i = j
+		default:
+			j := i
+			for j < len(source) && strings.IndexByte(" \t\n\r()\"=!~<>&|", source[j]) < 0 {
+				j++
+			}
+			tokens = append(tokens, expressionToken{text: source[i:j]})
+			i = j
+		}
+	}
+	return tokens, nil
+}
+
+// expressionParser is a recursive descent parser of the expression.
+type expressionParser struct {
+	tokens   []expressionToken
+	position int
+}
+
+// peek returns the next token if it is not quoted, or empty string.
+func (p *expressionParser) peek() string {
+	if p.position >= len(p.tokens) || p.tokens[p.position].quoted {
+		return ""
+	}
+	return p.tokens[p.position].text
+}
+
+func (p *expressionParser) or() (expressionNode, error) {
+	left, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "or" || p.peek() == "||" {
+		p.position++
+		right, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		left = &orNode{left, right}
+	}
+	return left, nil
+}
+
+func (p *expressionParser) and() (expressionNode, error) {
+	left, err := p.not()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "and" || p.peek() == "&&" {
+		p.position++
+		right, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		left = &andNode{left, right}
+	}
+	return left, nil
+}
+
+func (p *expressionParser) not() (expressionNode, error) {
+	if p.peek() == "not" || p.peek() == "!" {
+		p.position++
+		node, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		return &notNode{node}, nil
+	}
+	return p.term()
+}
+
+func (p *expressionParser) term() (expressionNode, error) {
+	if p.position >= len(p.tokens) {
+		return nil, expressionError("unexpected end")
+	}
+	if p.peek() == "(" {
+		p.position++
+		node, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ")" {
+			return nil, expressionError("missing )")
+		}
+		p.position++
+		return node, nil
+	}
+
+	token := p.tokens[p.position]
+	name := strings.ToLower(token.text)
+	p.position++
+	if token.quoted {
+		return nil, expressionError("unexpected %q", token.text)
+	}
+	field, isField := expressionFields[name]
+	if !isField {
+		if protocol, ok := expressionProtocols[name]; ok {
+			return &protocolNode{protocol}, nil
+		}
+		return nil, expressionError("unknown field %q", token.text)
+	}
+
+	op := p.peek()
+	if !isOperator(op) {
+		return &existsNode{field}, nil
+	}
+	p.position++
+	if p.position >= len(p.tokens) {
+		return nil, expressionError("missing value of %v", name)
+	}
+	value := p.tokens[p.position]
+	p.position++
+	return newCompareNode(name, field, op, value.text)
+}
+
+func isOperator(op string) bool {
+	switch op {
+	case "==", "!=", "~", "!~", "<", "<=", ">", ">=":
+		return true
+	}
+	return false
+}
+
+//** nodes ----------------------------------------------------------
+
+// expressionNode is a node of the parsed expression.
+type expressionNode interface {
+	match(fields *packetFields) bool
+}
+
+type orNode struct{ left, right expressionNode }
+
+func (n *orNode) match(fields *packetFields) bool {
+	return n.left.match(fields) || n.right.match(fields)
+}
+
+type andNode struct{ left, right expressionNode }
+
+func (n *andNode) match(fields *packetFields) bool {
+	return n.left.match(fields) && n.right.match(fields)
+}
+
+type notNode struct{ node expressionNode }
+
+func (n *notNode) match(fields *packetFields) bool {
+	return !n.node.match(fields)
+}
+
+type protocolNode struct{ has func(*packetFields) bool }
+
+func (n *protocolNode) match(fields *packetFields) bool {
+	return n.has(fields)
+}
+
+type existsNode struct{ field expressionField }
+
+func (n *existsNode) match(fields *packetFields) bool {
+	switch n.field.kind {
+	case fieldAddress:
+		return len(n.field.addresses(fields)) > 0
+	case fieldNumber:
+		return len(n.field.numbers(fields)) > 0
+	default:
+		return len(n.field.strings(fields)) > 0
+	}
+}
+
+// compareNode compares the values of the field with the value. negate is
+// set for `!=` and `!~`, which match if the positive operator does not.
+type compareNode struct {
+	field   expressionField
+	op      string
+	negate  bool
+	network *net.IPNet
+	number  uint64
+	text    string
+}
+
+func newCompareNode(name string, field expressionField, op, value string) (expressionNode, error) {
+	n := &compareNode{field: field, op: op}
+	if op == "!=" || op == "!~" {
+		n.negate = true
+		n.op = op[1:]
+		if n.op == "=" {
+			n.op = "=="
+		}
+	}
+	switch field.kind {
+	case fieldAddress:
+		if n.op != "==" {
+			return nil, expressionError("invalid operator %v for %v", op, name)
+		}
+		if _, network, err := net.ParseCIDR(value); err == nil {
+			n.network = network
+		} else if ip := net.ParseIP(value); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			n.network = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+		} else {
+			return nil, expressionError("invalid address %q", value)
+		}
+	case fieldNumber:
+		if n.op == "~" {
+			return nil, expressionError("invalid operator %v for %v", op, name)
+		}
+		number, err := strconv.ParseUint(value, 0, 64)
+		if err != nil {
+			return nil, expressionError("invalid number %q", value)
+		}
+		n.number = number
+	default:
+		if n.op != "==" && n.op != "~" {
+			return nil, expressionError("invalid operator %v for %v", op, name)
+		}
+		n.text = value
+		if field.fold {
+			n.text = strings.ToLower(value)
+		}
+	}
+	return n, nil
+}
+
+func (n *compareNode) match(fields *packetFields) bool {
+	return n.any(fields) != n.negate
+}
+
+// any returns true if any value of the field matches.
+func (n *compareNode) any(fields *packetFields) bool {
+	switch n.field.kind {
+	case fieldAddress:
+		for _, ip := range n.field.addresses(fields) {
+			if n.network.Contains(ip) {
+				return true
+			}
+		}
+	case fieldNumber:
+		for _, number := range n.field.numbers(fields) {
+			if compareNumbers(number, n.op, n.number) {
+				return true
+			}
+		}
+	default:
+		for _, text := range n.field.strings(fields) {
+			if n.field.fold {
+				text = strings.ToLower(text)
+			}
+			if (n.op == "==" && text == n.text) || (n.op == "~" && globMatch(n.text, text)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func compareNumbers(a uint64, op string, b uint64) bool {
+	switch op {
+	case "==":
+		return a == b
+	case "<":
+		return a < b
+	case "<=":
+		return a <= b
+	case ">":
+		return a > b
+	case ">=":
+		return a >= b
+	}
+	return false
+}
+
+// globMatch returns true if the text matches the pattern, in which `*`
+// matches any sequence and `?` matches any character.
+func globMatch(pattern, text string) bool {
+	p, t := 0, 0
+	star, mark := -1, 0
+	for t < len(text) {
+		switch {
+		case p < len(pattern) && (pattern[p] == '?' || pattern[p] == text[t]):
+			p++
+			t++
+		case p < len(pattern) && pattern[p] == '*':
+			star, mark = p, t
+			p++
+		case star >= 0:
+			p = star + 1
+			mark++
+			t = mark
+		default:
+			return false
+		}
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+//** fields ---------------------------------------------------------
+
+// kinds of the fields.
+const (
+	fieldAddress = iota
+	fieldNumber
+	fieldString
+)
+
+// expressionField is a field of the packets. One of the functions is set
+// for the kind of the field. fold is set for the case-insensitive strings.
+type expressionField struct {
+	kind      int
+	fold      bool
+	addresses func(*packetFields) []net.IP
+	numbers   func(*packetFields) []uint64
+	strings   func(*packetFields) []string
+}
+
+var expressionFields = map[string]expressionField{
+	"ip.src": {kind: fieldAddress, addresses: func(f *packetFields) []net.IP {
+		return f.ips(true, false)
+	}},
+	"ip.dst": {kind: fieldAddress, addresses: func(f *packetFields) []net.IP {
+		return f.ips(false, true)
+	}},
+	"ip.addr": {kind: fieldAddress, addresses: func(f *packetFields) []net.IP {
+		return f.ips(true, true)
+	}},
+	"ip.version": {kind: fieldNumber, numbers: func(f *packetFields) []uint64 {
+		switch f.packet.NetworkLayer().(type) {
+		case *layers.IPv4:
+			return []uint64{4}
+		case *layers.IPv6:
+			return []uint64{6}
+		}
+		return nil
+	}},
+	"ip.ttl": {kind: fieldNumber, numbers: func(f *packetFields) []uint64 {
+		switch network := f.packet.NetworkLayer().(type) {
+		case *layers.IPv4:
+			return []uint64{uint64(network.TTL)}
+		case *layers.IPv6:
+			return []uint64{uint64(network.HopLimit)}
+		}
+		return nil
+	}},
+	"ip.proto": {kind: fieldNumber, numbers: func(f *packetFields) []uint64 {
+		switch network := f.packet.NetworkLayer().(type) {
+		case *layers.IPv4:
+			return []uint64{uint64(network.Protocol)}
+		case *layers.IPv6:
+			return []uint64{uint64(network.NextHeader)}
+		}
+		return nil
+	}},
+	"src.port": {kind: fieldNumber, numbers: func(f *packetFields) []uint64 {
+		return f.ports(true, false)
+	}},
+	"dst.port": {kind: fieldNumber, numbers: func(f *packetFields) []uint64 {
+		return f.ports(false, true)
+	}},
+	"port": {kind: fieldNumber, numbers: func(f *packetFields) []uint64 {
+		return f.ports(true, true)
+	}},
+	"len": {kind: fieldNumber, numbers: func(f *packetFields) []uint64 {
+		if length := f.packet.Metadata().Length; length > 0 {
+			return []uint64{uint64(length)}
+		}
+		return []uint64{uint64(len(f.packet.Data()))}
+	}},
+	"dns.name": {kind: fieldString, fold: true, strings: func(f *packetFields) []string {
+		dns, ok := f.packet.Layer(layers.LayerTypeDNS).(*layers.DNS)
+		if !ok {
+			return nil
+		}
+		names := []string{}
+		for _, question := range dns.Questions {
+			names = append(names, strings.TrimSuffix(string(question.Name), "."))
+		}
+		return names
+	}},
+	"http.method": {kind: fieldString, fold: true, strings: func(f *packetFields) []string {
+		return f.http().values(0)
+	}},
+	"http.path": {kind: fieldString, strings: func(f *packetFields) []string {
+		return f.http().values(1)
+	}},
+	"http.host": {kind: fieldString, fold: true, strings: func(f *packetFields) []string {
+		return f.http().values(2)
+	}},
+	"tls.sni": {kind: fieldString, fold: true, strings: func(f *packetFields) []string {
+		if sni := f.tls().sni; sni != "" {
+			return []string{sni}
+		}
+		return nil
+	}},
+}
+
+var expressionProtocols = map[string]func(*packetFields) bool{
+	"ip":    layerOf(layers.LayerTypeIPv4),
+	"ip6":   layerOf(layers.LayerTypeIPv6),
+	"arp":   layerOf(layers.LayerTypeARP),
+	"tcp":   layerOf(layers.LayerTypeTCP),
+	"udp":   layerOf(layers.LayerTypeUDP),
+	"sctp":  layerOf(layers.LayerTypeSCTP),
+	"icmp":  layerOf(layers.LayerTypeICMPv4),
+	"icmp6": layerOf(layers.LayerTypeICMPv6),
+	"dns":   layerOf(layers.LayerTypeDNS),
+	"dns.query": func(f *packetFields) bool {
+		dns, ok := f.packet.Layer(layers.LayerTypeDNS).(*layers.DNS)
+		return ok && !dns.QR
+	},
+	"dns.response": func(f *packetFields) bool {
+		dns, ok := f.packet.Layer(layers.LayerTypeDNS).(*layers.DNS)
+		return ok && dns.QR
+	},
+	"http": func(f *packetFields) bool {
+		return f.http() != nil
+	},
+	"tls": func(f *packetFields) bool {
+		return f.tls().record
+	},
+	"tls.clienthello": func(f *packetFields) bool {
+		return f.tls().clientHello
+	},
+}
+
+func layerOf(layerType gopacket.LayerType) func(*packetFields) bool {
+	return func(f *packetFields) bool {
+		return f.packet.Layer(layerType) != nil
+	}
+}
+
+// packetFields is a packet with the fields decoded lazily from the payload
+// of TCP, which gopacket does not decode.
+type packetFields struct {
+	packet        gopacket.Packet
+	request       *httpRequest
+	requestParsed bool
+	hello         *tlsHello
+}
+
+func (f *packetFields) ips(src, dst bool) []net.IP {
+	ips := []net.IP{}
+	switch network := f.packet.NetworkLayer().(type) {
+	case *layers.IPv4:
+		if src {
+			ips = append(ips, network.SrcIP)
+		}
+		if dst {
+			ips = append(ips, network.DstIP)
+		}
+	case *layers.IPv6:
+		if src {
+			ips = append(ips, network.SrcIP)
+		}
+		if dst {
+			ips = append(ips, network.DstIP)
+		}
+	}
+	return ips
+}
+
+func (f *packetFields) ports(src, dst bool) []uint64 {
+	var sport, dport uint64
+	switch transport := f.packet.TransportLayer().(type) {
+	case *layers.TCP:
+		sport, dport = uint64(transport.SrcPort), uint64(transport.DstPort)
+	case *layers.UDP:
+		sport, dport = uint64(transport.SrcPort), uint64(transport.DstPort)
+	case *layers.SCTP:
+		sport, dport = uint64(transport.SrcPort), uint64(transport.DstPort)
+	default:
+		return nil
+	}
+	ports := []uint64{}
+	if src {
+		ports = append(ports, sport)
+	}
+	if dst {
+		ports = append(ports, dport)
+	}
+	return ports
+}
+
+// tcpPayload returns the payload of TCP.
+func (f *packetFields) tcpPayload() []byte {
+	if tcp, ok := f.packet.Layer(layers.LayerTypeTCP).(*layers.TCP); ok {
+		return tcp.Payload
+	}
+	return nil
+}
+
+//** HTTP and TLS ---------------------------------------------------
+
+// httpMethods are the methods of HTTP requests to be recognized.
+var httpMethods = map[string]bool{
+	"GET": true, "HEAD": true, "POST": true, "PUT": true, "DELETE": true,
+	"CONNECT": true, "OPTIONS": true, "TRACE": true, "PATCH": true,
+}
+
+// httpRequest is the method, path and host of HTTP request.
+type httpRequest [3]string
+
+func (r *httpRequest) values(i int) []string {
+	if r == nil || r[i] == "" {
+		return nil
+	}
+	return []string{r[i]}
+}
+
+// http returns the HTTP request in the payload of TCP, or nil if it is not
+// the start of HTTP request.
+func (f *packetFields) http() *httpRequest {
+	if f.requestParsed {
+		return f.request
+	}
+	f.requestParsed = true
+
+	payload := f.tcpPayload()
+	end := bytes.Index(payload, []byte("\r\n"))
+	if end < 0 {
+		return nil
+	}
+	line := strings.Split(string(payload[:end]), " ")
+	if len(line) != 3 || !httpMethods[line[0]] || !strings.HasPrefix(line[2], "HTTP/") {
+		return nil
+	}
+	request := &httpRequest{line[0], line[1]}
+	for _, header := range strings.Split(string(payload[end+2:]), "\r\n") {
+		if header == "" {
+			break
+		}
+		if colon := strings.IndexByte(header, ':'); colon > 0 && strings.EqualFold(header[:colon], "host") {
+			host := strings.TrimSpace(header[colon+1:])
+			if h, _, err := net.SplitHostPort(host); err == nil {
+				host = h
+			}
+			request[2] = host
+			break
+		}
+	}
+	f.request = request
+	return request
+}
+
+// tlsHello is the result of parsing TLS in the payload of TCP.
+type tlsHello struct {
+	record      bool
+	clientHello bool
+	sni         string
+}
+
+// tls parses the TLS record in the payload of TCP, and the server name
+// of the ClientHello in it.
+func (f *packetFields) tls() *tlsHello {
+	if f.hello != nil {
+		return f.hello
+	}
+	f.hello = &tlsHello{}
+
+	payload := f.tcpPayload()
+	// content type: change_cipher_spec(20) ~ application_data(23), major version 3
+	if len(payload) < 5 || payload[0] < 20 || payload[0] > 23 || payload[1] != 3 {
+		return f.hello
+	}
+	f.hello.record = true
+	// handshake(22) with client_hello(1)
+	if payload[0] != 22 || len(payload) < 9 || payload[5] != 1 {
+		return f.hello
+	}
+	f.hello.clientHello = true
+	f.hello.sni = serverName(payload[9:])
+	return f.hello
+}
+
+// serverName returns the server name in the body of ClientHello.
+func serverName(hello []byte) string {
+	next := func(n int) []byte { // returns the next n bytes or nil
+		if n > len(hello) {
+			hello = nil
+			return nil
+		}
+		data := hello[:n]
+		hello = hello[n:]
+		return data
+	}
+	vector := func(size int) []byte { // returns the next vector of the size
+		length := next(size)
+		if length == nil {
+			return nil
+		}
+		n := 0
+		for _, b := range length {
+			n = n<<8 | int(b)
+		}
+		return next(n)
+	}
+
+	next(2 + 32) // version and random
+	vector(1)    // session id
+	vector(2)    // cipher suites
+	vector(1)    // compression methods
+	extensions := vector(2)
+	for len(extensions) >= 4 {
+		kind := binary.BigEndian.Uint16(extensions)
+		length := int(binary.BigEndian.Uint16(extensions[2:]))
+		if len(extensions) < 4+length {
+			return ""
+		}
+		data := extensions[4 : 4+length]
+		extensions = extensions[4+length:]
+		if kind != 0 { // server_name
+			continue
+		}
+		if len(data) < 2 {
+			return ""
+		}
+		list := data[2:]
+		for len(list) >= 3 {
+			nameType := list[0]
+			nameLength := int(binary.BigEndian.Uint16(list[1:]))
+			if len(list) < 3+nameLength {
+				return ""
+			}
+			if nameType == 0 { // host_name
+				return string(list[3 : 3+nameLength])
+			}
+			list = list[3+nameLength:]
+		}
+	}
+	return ""
+}
@@ -0,0 +1,109 @@
+package pipes
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync/atomic"
+
+	"github.com/hyeoncheon/goul"
+)
+
+// Filter is a pipe that keeps the packets matching the Expression and
+// drops the others, or drops the matching packets if Drop is set. Unlike
+// BPF of the capture, the expression is evaluated over the decoded layers
+// such as DNS names, HTTP host or TLS SNI. See Expression for the syntax.
+// It can be used on both client and server.
+type Filter struct {
+	goul.Pipe
+	ID         string
+	Expression string
+	Drop       bool
+
+	expression *Expression
+	passed     uint64
+	dropped    uint64
+}
+
+// Convert implements interface Pipe/Converter
+func (p *Filter) Convert(in chan goul.Item, message goul.Message) (out chan goul.Item, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			fmt.Fprintf(os.Stderr, "Filter#Convert recovered from panic!\n")
+			fmt.Fprintf(os.Stderr, "Probably an inheritance problem of pipeline instance.\n")
+			fmt.Fprintf(os.Stderr, "panic: %v\n", r)
+			err = errors.New("panic")
+		}
+	}()
+
+	if err := p.init(); err != nil {
+		p.SetError(err)
+		return nil, err
+	}
+	p.SetError(nil)
+	return goul.Launch(p.filter, in, message)
+}
+
+// Revert implements interface Pipe/Reverter
+func (p *Filter) Revert(in chan goul.Item, message goul.Message) (out chan goul.Item, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			fmt.Fprintf(os.Stderr, "Filter#Revert recovered from panic!\n")
+			fmt.Fprintf(os.Stderr, "Probably an inheritance problem of pipeline instance.\n")
+			fmt.Fprintf(os.Stderr, "panic: %v\n", r)
+			err = errors.New("panic")
+		}
+	}()
+
+	if err := p.init(); err != nil {
+		p.SetError(err)
+		return nil, err
+	}
+	p.SetError(nil)
+	return goul.Launch(p.filter, in, message)
+}
+
+// Stats returns the number of passed and dropped packets. It is safe to
+// call from other goroutines.
+func (p *Filter) Stats() (passed, dropped uint64) {
+	return atomic.LoadUint64(&p.passed), atomic.LoadUint64(&p.dropped)
+}
+
+func (p *Filter) init() error {
+	if p.ID == "" {
+		p.ID = "filter"
+	}
+	expression, err := CompileExpression(p.Expression)
+	if err != nil {
+		return err
+	}
+	p.expression = expression
+	return nil
+}
+
+// filter passes the packets from input channel by the expression.
+func (p *Filter) filter(in, out chan goul.Item, message goul.Message) {
+	defer close(out)
+	defer goul.Log(p.GetLogger(), p.ID, "exit")
+	goul.Log(p.GetLogger(), p.ID, "filter in looping... <%v>", p.expression)
+
+	for item := range in {
+		packet := toPacket(item)
+		if packet == nil {
+			out <- item
+			continue
+		}
+		if p.expression.Match(packet) == p.Drop {
+			atomic.AddUint64(&p.dropped, 1)
+			continue
+		}
+		atomic.AddUint64(&p.passed, 1)
+		out <- packet
+	}
+	p.SetError(errors.New(goul.ErrPipeInputClosed))
+	goul.Log(p.GetLogger(), p.ID, "channel closed")
+	if logger := p.GetLogger(); logger != nil {
+		passed, dropped := p.Stats()
+		logger.Infof("[%v] %v packets passed, %v packets dropped", p.ID, passed, dropped)
+	}
+}
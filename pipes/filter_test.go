@@ -0,0 +1,182 @@
+package pipes_test
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/stretchr/testify/require"
+
+	"github.com/hyeoncheon/goul"
+	"github.com/hyeoncheon/goul/pipes"
+)
+
+// payloadPacket returns a TCP or UDP packet with the payload.
+func payloadPacket(protocol string, src, dst string, sport, dport int, payload gopacket.SerializableLayer) gopacket.Packet {
+	ether := &layers.Ethernet{
+		SrcMAC:       net.HardwareAddr{0x02, 0, 0, 0, 0, 1},
+		DstMAC:       net.HardwareAddr{0x02, 0, 0, 0, 0, 2},
+		EthernetType: layers.EthernetTypeIPv4,
+	}
+	ip := &layers.IPv4{Version: 4, TTL: 64, SrcIP: net.ParseIP(src).To4(), DstIP: net.ParseIP(dst).To4()}
+	var transport gopacket.SerializableLayer
+	if protocol == "udp" {
+		ip.Protocol = layers.IPProtocolUDP
+		udp := &layers.UDP{SrcPort: layers.UDPPort(sport), DstPort: layers.UDPPort(dport)}
+		udp.SetNetworkLayerForChecksum(ip)
+		transport = udp
+	} else {
+		ip.Protocol = layers.IPProtocolTCP
+		tcp := &layers.TCP{SrcPort: layers.TCPPort(sport), DstPort: layers.TCPPort(dport), ACK: true, PSH: true}
+		tcp.SetNetworkLayerForChecksum(ip)
+		transport = tcp
+	}
+	buffer := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	gopacket.SerializeLayers(buffer, opts, ether, ip, transport, payload)
+	return gopacket.NewPacket(buffer.Bytes(), layers.LayerTypeEthernet, gopacket.Default)
+}
+
+// clientHello returns a TLS record of ClientHello with the server name.
+func clientHello(name string) []byte {
+	sni := []byte{0, 0} // list length
+	sni = append(sni, 0, byte(len(name)>>8), byte(len(name)))
+	sni = append(sni, name...)
+	binary.BigEndian.PutUint16(sni, uint16(len(sni)-2))
+	extensions := []byte{0, 0, byte(len(sni) >> 8), byte(len(sni))}
+	extensions = append(extensions, sni...)
+
+	body := []byte{3, 3}
+	body = append(body, make([]byte, 32)...) // random
+	body = append(body, 0)                   // session id
+	body = append(body, 0, 2, 0x13, 0x01)    // cipher suites
+	body = append(body, 1, 0)                // compression methods
+	body = append(body, byte(len(extensions)>>8), byte(len(extensions)))
+	body = append(body, extensions...)
+
+	handshake := []byte{1, 0, byte(len(body) >> 8), byte(len(body))}
+	handshake = append(handshake, body...)
+	record := []byte{22, 3, 1, byte(len(handshake) >> 8), byte(len(handshake))}
+	return append(record, handshake...)
+}
+
+func Test_Expression_10_Match(t *testing.T) {
+	r := require.New(t)
+
+	dns := &layers.DNS{ID: 1, RD: true, Questions: []layers.DNSQuestion{
+		{Name: []byte("www.Example.com"), Type: layers.DNSTypeA, Class: layers.DNSClassIN},
+	}}
+	packets := map[string]gopacket.Packet{
+		"dns":   payloadPacket("udp", "10.0.0.1", "10.0.0.53", 40000, 53, dns),
+		"http":  payloadPacket("tcp", "10.0.0.1", "192.0.2.80", 40001, 80, gopacket.Payload("GET /index.html HTTP/1.1\r\nUser-Agent: test\r\nHost: www.example.com:8080\r\n\r\n")),
+		"tls":   payloadPacket("tcp", "10.0.0.1", "192.0.2.43", 40002, 443, gopacket.Payload(clientHello("api.example.com"))),
+		"plain": payloadPacket("tcp", "10.0.0.2", "198.51.100.1", 40003, 22, gopacket.Payload("SSH-2.0-OpenSSH")),
+	}
+
+	for expression, matches := range map[string][]string{
+		`tcp`:         {"http", "tls", "plain"},
+		`udp and dns`: {"dns"},
+		`dns.query and dns.name ~ "*.example.com"`: {"dns"},
+		`dns.response`:                                      {},
+		`dns.name == WWW.EXAMPLE.COM`:                       {"dns"},
+		`http.host == www.example.com`:                      {"http"},
+		`http.method == get && http.path ~ "/*.html"`:       {"http"},
+		`tls.sni ~ "*.example.com"`:                         {"tls"},
+		`tls.sni`:                                           {"tls"},
+		`tls.clienthello and not tls.sni ~ "*.example.org"`: {"tls"},
+		`tls`:                                 {"tls"},
+		`http or tls`:                         {"http", "tls"},
+		`ip.addr == 192.0.2.0/24`:             {"http", "tls"},
+		`ip.src == 10.0.0.2`:                  {"plain"},
+		`ip.dst != 192.0.2.0/24 and ip`:       {"dns", "plain"},
+		`port == 443 || port <= 53`:           {"dns", "tls", "plain"},
+		`src.port > 40001 and dst.port != 22`: {"tls"},
+		`!(port == 22) and ip.version == 4 and ip.ttl == 64 and ip.proto == 6`: {"http", "tls"},
+		`len > 100`:          {"http", "tls"},
+		`ip6 or arp or icmp`: {},
+	} {
+		matched := []string{}
+		compiled, err := pipes.CompileExpression(expression)
+		r.NoError(err, expression)
+		r.Equal(expression, compiled.String())
+		for name, packet := range packets {
+			if compiled.Match(packet) {
+				matched = append(matched, name)
+			}
+		}
+		r.ElementsMatch(matches, matched, expression)
+	}
+}
+
+func Test_Expression_20_Errors(t *testing.T) {
+	r := require.New(t)
+
+	for _, expression := range []string{
+		``,
+		`unknown`,
+		`tcp and`,
+		`(tcp`,
+		`tcp)`,
+		`port ~ 80`,
+		`port == http`,
+		`ip.addr == 10.0.0.0/33`,
+		`ip.addr < 10.0.0.1`,
+		`tls.sni > a`,
+		`tls.sni == "unterminated`,
+		`"tcp"`,
+		`port ==`,
+	} {
+		_, err := pipes.CompileExpression(expression)
+		r.Error(err, expression)
+		r.Contains(err.Error(), pipes.ErrInvalidExpression)
+	}
+}
+
+func Test_Filter_10_Filter(t *testing.T) {
+	r := require.New(t)
+
+	filter := &pipes.Filter{
+		Pipe:       &goul.BasePipe{Mode: goul.ModeConverter},
+		Expression: `tls.sni ~ "*.example.com"`,
+	}
+	in := make(chan goul.Item)
+	out, err := filter.Convert(in, nil)
+	r.NoError(err)
+
+	matched := payloadPacket("tcp", "10.0.0.1", "192.0.2.43", 40002, 443, gopacket.Payload(clientHello("api.example.com")))
+	other := payloadPacket("tcp", "10.0.0.1", "192.0.2.43", 40003, 443, gopacket.Payload(clientHello("www.example.org")))
+	in <- other
+	in <- matched
+	r.Equal(matched.Data(), (<-out).Data())
+	in <- &goul.ItemGeneric{Meta: "message", DATA: []byte("hello")}
+	r.Equal("hello", string((<-out).Data()))
+
+	close(in)
+	_, ok := <-out
+	r.False(ok)
+	r.EqualError(filter.GetError(), goul.ErrPipeInputClosed)
+	passed, dropped := filter.Stats()
+	r.Equal(uint64(1), passed)
+	r.Equal(uint64(1), dropped)
+
+	// matching packets are dropped.
+	filter = &pipes.Filter{
+		Pipe:       &goul.BasePipe{Mode: goul.ModeReverter},
+		Expression: `tls.sni ~ "*.example.com"`,
+		Drop:       true,
+	}
+	in = make(chan goul.Item)
+	out, err = filter.Revert(in, nil)
+	r.NoError(err)
+	in <- matched
+	in <- other
+	r.Equal(other.Data(), (<-out).Data())
+	close(in)
+	<-out
+
+	filter = &pipes.Filter{Pipe: &goul.BasePipe{Mode: goul.ModeConverter}, Expression: "unknown"}
+	_, err = filter.Convert(make(chan goul.Item), nil)
+	r.Error(err)
+}
@@ -0,0 +1,407 @@
+package pipes
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unsafe"
+
+	"github.com/google/gopacket/layers"
+
+	"github.com/hyeoncheon/goul"
+)
+
+// constants...
+const (
+	defaultProcRoot       = "/proc"
+	defaultProcessRefresh = 1 * time.Second
+	defaultProcessExpire  = 1 * time.Minute
+	maxProcessFlows       = 65536
+)
+
+// containerID matches the container ID of docker, containerd or cri-o in
+// the cgroup path.
+var containerID = regexp.MustCompile(`[0-9a-f]{64}`)
+
+// ProcessTagger is a pipe that attributes the TCP and UDP packets to the
+// local processes of the capturing host. The sockets are found by the
+// 5-tuple of the packet in `/proc/net/{tcp,udp,tcp6,udp6}` and the process
+// owning the socket is found by `/proc/<pid>/fd`. The PID, executable,
+// cgroup and container ID of the process are annotated on the packet, so
+// they travel to the receiver and are written as comments of pcapng.
+//
+// The results are cached for each flow of both directions for Expire. If
+// a flow is not found in the cache, /proc is scanned again but not more
+// often than Refresh. Flows without a process are cached only until the
+// next scan is allowed, so the sockets opened later are found soon. If
+// FlowLog is set, each new flow with its process is written to it as a
+// line of JSON.
+type ProcessTagger struct {
+	goul.Pipe
+	ID      string
+	Root    string
+	Refresh time.Duration
+	Expire  time.Duration
+	FlowLog io.Writer
+
+	flows     map[string]*flowProcess
+	sockets   map[string]uint64
+	locals    map[string]bool
+	owners    map[uint64]*Process
+	refreshed time.Time
+}
+
+// Process is a local process which owns the socket of a flow.
+type Process struct {
+	PID        int    `json:"pid"`
+	Executable string `json:"exe,omitempty"`
+	Cgroup     string `json:"cgroup,omitempty"`
+	Container  string `json:"container,omitempty"`
+}
+
+// flowProcess is a cached process of a flow. Process is nil if unknown.
+type flowProcess struct {
+	process *Process
+	expire  time.Time
+}
+
+// flowRecord is a record of the flow log.
+type flowRecord struct {
+	Time        time.Time `json:"time"`
+	Protocol    string    `json:"protocol"`
+	Source      string    `json:"src"`
+	Destination string    `json:"dst"`
+	*Process
+}
+
+// Convert implements interface Pipe/Converter
+func (p *ProcessTagger) Convert(in chan goul.Item, message goul.Message) (out chan goul.Item, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			fmt.Fprintf(os.Stderr, "ProcessTagger#Convert recovered from panic!\n")
+			fmt.Fprintf(os.Stderr, "Probably an inheritance problem of pipeline instance.\n")
+			fmt.Fprintf(os.Stderr, "panic: %v\n", r)
+			err = errors.New("panic")
+		}
+	}()
+
+	p.init()
+	p.SetError(nil)
+	return goul.Launch(p.tagger, in, message)
+}
+
+// Revert implements interface Pipe/Reverter
+func (p *ProcessTagger) Revert(in chan goul.Item, message goul.Message) (out chan goul.Item, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			fmt.Fprintf(os.Stderr, "ProcessTagger#Revert recovered from panic!\n")
+			fmt.Fprintf(os.Stderr, "Probably an inheritance problem of pipeline instance.\n")
+			fmt.Fprintf(os.Stderr, "panic: %v\n", r)
+			err = errors.New("panic")
+		}
+	}()
+
+	p.init()
+	p.SetError(nil)
+	return goul.Launch(p.tagger, in, message)
+}
+
+func (p *ProcessTagger) init() {
+	if p.ID == "" {
+		p.ID = "process"
+	}
+	if p.Root == "" {
+		p.Root = defaultProcRoot
+	}
+	if p.Refresh == 0 {
+		p.Refresh = defaultProcessRefresh
+	}
+	if p.Expire == 0 {
+		p.Expire = defaultProcessExpire
+	}
+	p.flows = map[string]*flowProcess{}
+}
+
+// tagger annotates the packets from input channel with their processes.
+func (p *ProcessTagger) tagger(in, out chan goul.Item, message goul.Message) {
+	defer close(out)
+	defer goul.Log(p.GetLogger(), p.ID, "exit")
+	goul.Log(p.GetLogger(), p.ID, "tagger in looping...")
+
+	for item := range in {
+		packet := toPacket(item)
+		if packet == nil {
+			out <- item
+			continue
+		}
+		var src, dst net.IP
+		switch network := packet.NetworkLayer().(type) {
+		case *layers.IPv4:
+			src, dst = network.SrcIP, network.DstIP
+		case *layers.IPv6:
+			src, dst = network.SrcIP, network.DstIP
+		}
+		var protocol, sport, dport string
+		switch transport := packet.TransportLayer().(type) {
+		case *layers.TCP:
+			protocol = "tcp"
+			sport, dport = strconv.Itoa(int(transport.SrcPort)), strconv.Itoa(int(transport.DstPort))
+		case *layers.UDP:
+			protocol = "udp"
+			sport, dport = strconv.Itoa(int(transport.SrcPort)), strconv.Itoa(int(transport.DstPort))
+		}
+		if src != nil && protocol != "" {
+			source, destination := net.JoinHostPort(src.String(), sport), net.JoinHostPort(dst.String(), dport)
+			if process := p.lookup(protocol, source, destination); process != nil {
+				goul.Annotate(packet, goul.AnnotationPID, strconv.Itoa(process.PID))
+				if process.Executable != "" {
+					goul.Annotate(packet, goul.AnnotationExecutable, process.Executable)
+				}
+				if process.Cgroup != "" {
+					goul.Annotate(packet, goul.AnnotationCgroup, process.Cgroup)
+				}
+				if process.Container != "" {
+					goul.Annotate(packet, goul.AnnotationContainer, process.Container)
+				}
+			}
+		}
+		out <- packet
+	}
+	p.SetError(errors.New(goul.ErrPipeInputClosed))
+	goul.Log(p.GetLogger(), p.ID, "channel closed")
+}
+
+// lookup returns the process of the flow from the cache or /proc.
+func (p *ProcessTagger) lookup(protocol, src, dst string) *Process {
+	now := time.Now()
+	key := flowKey(protocol, src, dst)
+	if flow, ok := p.flows[key]; ok && now.Before(flow.expire) {
+		return flow.process
+	}
+
+	if now.Sub(p.refreshed) >= p.Refresh {
+		p.refresh()
+		p.refreshed = now
+	}
+	var process *Process
+	if inode, ok := p.socket(protocol, src, dst); ok {
+		process = p.owners[inode]
+	}
+
+	if len(p.flows) >= maxProcessFlows {
+		p.flows = map[string]*flowProcess{}
+	}
+	expire := now.Add(p.Expire)
+	if process == nil {
+		expire = p.refreshed.Add(p.Refresh)
+	}
+	p.flows[key] = &flowProcess{process: process, expire: expire}
+	if process != nil && p.FlowLog != nil {
+		record := &flowRecord{Time: now, Protocol: protocol, Source: src, Destination: dst, Process: process}
+		if data, err := json.Marshal(record); err == nil {
+			p.FlowLog.Write(append(data, '\n'))
+		}
+	}
+	return process
+}
+
+// flowKey returns the cache key of the flow, which is the same for both
+// directions of the flow.
+func flowKey(protocol, src, dst string) string {
+	if dst < src {
+		src, dst = dst, src
+	}
+	return protocol + " " + src + " " + dst
+}
+
+// socket returns the inode of the socket of the flow. The flow can be
+// either direction, and the sockets not connected or bound to any
+// address are matched by the local address or the port. Only the
+// endpoints of the local addresses are matched so, for example, a reply
+// from a remote DNS server is not attributed to the local DNS server.
+func (p *ProcessTagger) socket(protocol, src, dst string) (uint64, bool) {
+	for _, pair := range [][2]string{{src, dst}, {dst, src}} {
+		if inode, ok := p.sockets[protocol+" "+pair[0]+" "+pair[1]]; ok {
+			return inode, true
+		}
+	}
+	for _, local := range []string{src, dst} {
+		host, port, _ := net.SplitHostPort(local)
+		if !p.locals[host] {
+			continue
+		}
+		if inode, ok := p.sockets[protocol+" "+local]; ok {
+			return inode, true
+		}
+		if inode, ok := p.sockets[protocol+" *:"+port]; ok {
+			return inode, true
+		}
+	}
+	return 0, false
+}
+
+// refresh reads the sockets and their owner processes from /proc. The
+// local addresses are the addresses of the interfaces and the addresses
+// the sockets are bound to.
+func (p *ProcessTagger) refresh() {
+	p.sockets = map[string]uint64{}
+	p.locals = map[string]bool{}
+	if addrs, err := net.InterfaceAddrs(); err == nil {
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok {
+				p.locals[ipnet.IP.String()] = true
+			}
+		}
+	}
+	for _, table := range []string{"tcp", "udp", "tcp6", "udp6"} {
+		protocol := strings.TrimSuffix(table, "6")
+		readSockets(filepath.Join(p.Root, "net", table), protocol, p.sockets, p.locals)
+	}
+
+	p.owners = map[uint64]*Process{}
+	entries, err := ioutil.ReadDir(p.Root)
+	if err != nil {
+		goul.Error(p.GetLogger(), p.ID, "couldn't read processes: %v", err)
+		return
+	}
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		dir := filepath.Join(p.Root, entry.Name())
+		fds, err := ioutil.ReadDir(filepath.Join(dir, "fd"))
+		if err != nil {
+			continue
+		}
+		var process *Process
+		for _, fd := range fds {
+			link, err := os.Readlink(filepath.Join(dir, "fd", fd.Name()))
+			if err != nil || !strings.HasPrefix(link, "socket:[") {
+				continue
+			}
+			inode, err := strconv.ParseUint(strings.TrimSuffix(link[len("socket:["):], "]"), 10, 64)
+			if err != nil {
+				continue
+			}
+			if process == nil {
+				process = readProcess(dir, pid)
+			}
+			p.owners[inode] = process
+		}
+	}
+	goul.Log(p.GetLogger(), p.ID, "%v sockets of %v processes", len(p.sockets), len(entries))
+}
+
+// readProcess returns the process information in the directory of /proc.
+func readProcess(dir string, pid int) *Process {
+	process := &Process{PID: pid}
+	process.Executable, _ = os.Readlink(filepath.Join(dir, "exe"))
+	data, err := ioutil.ReadFile(filepath.Join(dir, "cgroup"))
+	if err != nil {
+		return process
+	}
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		fields := strings.SplitN(line, ":", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		if process.Cgroup == "" || fields[0] == "0" { // prefer cgroup v2
+			process.Cgroup = fields[2]
+		}
+	}
+	if ids := containerID.FindAllString(process.Cgroup, -1); len(ids) > 0 {
+		process.Container = ids[len(ids)-1]
+	}
+	return process
+}
+
+// readSockets reads the socket table of /proc/net into the map of the
+// sockets by the addresses. The sockets connected are keyed with local and
+// remote addresses, the others are keyed with local address or `*:port`
+// if they are bound to any address. The local addresses of the sockets
+// are added to locals.
+func readSockets(path, protocol string, sockets map[string]uint64, locals map[string]bool) {
+	file, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Scan() // header
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 10 {
+			continue
+		}
+		inode, err := strconv.ParseUint(fields[9], 10, 64)
+		if err != nil || inode == 0 {
+			continue
+		}
+		localIP, localPort, err := procAddress(fields[1])
+		if err != nil {
+			continue
+		}
+		remoteIP, remotePort, err := procAddress(fields[2])
+		if err != nil {
+			continue
+		}
+		local := net.JoinHostPort(localIP.String(), localPort)
+		if !localIP.IsUnspecified() {
+			locals[localIP.String()] = true
+		}
+		switch {
+		case !remoteIP.IsUnspecified():
+			sockets[protocol+" "+local+" "+net.JoinHostPort(remoteIP.String(), remotePort)] = inode
+		case localIP.IsUnspecified():
+			sockets[protocol+" *:"+localPort] = inode
+		default:
+			sockets[protocol+" "+local] = inode
+		}
+	}
+}
+
+// procAddress parses the address of /proc/net tables such as
+// `0100007F:0050`. The address is in words of host byte order.
+func procAddress(s string) (net.IP, string, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 2 {
+		return nil, "", errors.New("invalid address")
+	}
+	words, err := hex.DecodeString(parts[0])
+	if err != nil || (len(words) != net.IPv4len && len(words) != net.IPv6len) {
+		return nil, "", errors.New("invalid address")
+	}
+	ip := make(net.IP, len(words))
+	for i := 0; i < len(words); i += 4 {
+		hostEndian.PutUint32(ip[i:], binary.BigEndian.Uint32(words[i:]))
+	}
+	port, err := strconv.ParseUint(parts[1], 16, 16)
+	if err != nil {
+		return nil, "", err
+	}
+	return ip, strconv.FormatUint(port, 10), nil
+}
+
+// hostEndian is the byte order of the host.
+var hostEndian binary.ByteOrder = binary.LittleEndian
+
+func init() {
+	one := uint16(1)
+	if *(*byte)(unsafe.Pointer(&one)) == 0 {
+		hostEndian = binary.BigEndian
+	}
+}
@@ -0,0 +1,173 @@
+package pipes_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/stretchr/testify/require"
+
+	"github.com/hyeoncheon/goul"
+	"github.com/hyeoncheon/goul/pipes"
+)
+
+// tcpPacket returns a TCP packet between the addresses.
+func tcpPacket(src, dst *net.TCPAddr) gopacket.Packet {
+	ether := &layers.Ethernet{
+		SrcMAC:       net.HardwareAddr{0x02, 0, 0, 0, 0, 1},
+		DstMAC:       net.HardwareAddr{0x02, 0, 0, 0, 0, 2},
+		EthernetType: layers.EthernetTypeIPv4,
+	}
+	ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolTCP, SrcIP: src.IP, DstIP: dst.IP}
+	tcp := &layers.TCP{SrcPort: layers.TCPPort(src.Port), DstPort: layers.TCPPort(dst.Port), ACK: true}
+	tcp.SetNetworkLayerForChecksum(ip)
+	buffer := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	gopacket.SerializeLayers(buffer, opts, ether, ip, tcp, gopacket.Payload("Process"))
+	return gopacket.NewPacket(buffer.Bytes(), layers.LayerTypeEthernet, gopacket.Default)
+}
+
+func Test_ProcessTagger_10_Tag(t *testing.T) {
+	r := require.New(t)
+
+	if _, err := os.Stat("/proc/net/tcp"); err != nil {
+		t.Skipf("no procfs: %v", err)
+	}
+	listener, err := net.Listen("tcp4", "127.0.0.1:0")
+	r.NoError(err)
+	defer listener.Close()
+	conn, err := net.Dial("tcp4", listener.Addr().String())
+	r.NoError(err)
+	defer conn.Close()
+	local, remote := conn.LocalAddr().(*net.TCPAddr), conn.RemoteAddr().(*net.TCPAddr)
+
+	log := &bytes.Buffer{}
+	tagger := &pipes.ProcessTagger{
+		Pipe:    &goul.BasePipe{Mode: goul.ModeConverter},
+		FlowLog: log,
+	}
+	in := make(chan goul.Item)
+	out, err := tagger.Convert(in, nil)
+	r.NoError(err)
+
+	exe, _ := os.Executable()
+	for _, packet := range []gopacket.Packet{tcpPacket(local, remote), tcpPacket(remote, local)} {
+		in <- packet
+		annotations := goul.AnnotationsOf(<-out)
+		r.Equal(strconv.Itoa(os.Getpid()), annotations[goul.AnnotationPID])
+		r.Equal(exe, annotations[goul.AnnotationExecutable])
+	}
+
+	// other flows are not tagged.
+	in <- tcpPacket(&net.TCPAddr{IP: net.IP{10, 0, 0, 1}, Port: 1}, &net.TCPAddr{IP: net.IP{10, 0, 0, 2}, Port: 2})
+	r.Nil(goul.AnnotationsOf(<-out))
+	in <- &goul.ItemGeneric{Meta: "message", DATA: []byte("hello")}
+	r.Equal("hello", string((<-out).Data()))
+
+	close(in)
+	_, ok := <-out
+	r.False(ok)
+	r.EqualError(tagger.GetError(), goul.ErrPipeInputClosed)
+
+	// each flow is logged once for both directions.
+	lines := bytes.Split(bytes.TrimSpace(log.Bytes()), []byte("\n"))
+	r.Equal(1, len(lines))
+	record := map[string]interface{}{}
+	r.NoError(json.Unmarshal(lines[0], &record))
+	r.Equal("tcp", record["protocol"])
+	r.Equal(local.String(), record["src"])
+	r.Equal(float64(os.Getpid()), record["pid"])
+}
+
+func Test_ProcessTagger_11_Miss(t *testing.T) {
+	r := require.New(t)
+
+	if _, err := os.Stat("/proc/net/tcp"); err != nil {
+		t.Skipf("no procfs: %v", err)
+	}
+	free, err := net.Listen("tcp4", "127.0.0.1:0")
+	r.NoError(err)
+	local := free.Addr().(*net.TCPAddr)
+	free.Close()
+	remote := &net.TCPAddr{IP: net.IP{10, 0, 0, 1}, Port: 40000}
+
+	tagger := &pipes.ProcessTagger{
+		Pipe:    &goul.BasePipe{Mode: goul.ModeConverter},
+		Refresh: 100 * time.Millisecond,
+	}
+	in := make(chan goul.Item)
+	out, err := tagger.Convert(in, nil)
+	r.NoError(err)
+	defer close(in)
+
+	// the flow is not found before the socket is opened.
+	in <- tcpPacket(remote, local)
+	r.Nil(goul.AnnotationsOf(<-out))
+
+	// and it is found after the next scan, not after the expiration.
+	listener, err := net.Listen("tcp4", local.String())
+	r.NoError(err)
+	defer listener.Close()
+	time.Sleep(200 * time.Millisecond)
+	in <- tcpPacket(local, remote)
+	r.Equal(strconv.Itoa(os.Getpid()), goul.AnnotationsOf(<-out)[goul.AnnotationPID])
+}
+
+func Test_ProcessTagger_12_RemotePort(t *testing.T) {
+	r := require.New(t)
+
+	if _, err := os.Stat("/proc/net/tcp"); err != nil {
+		t.Skipf("no procfs: %v", err)
+	}
+	// a local server on any address, such as dnsmasq on *:53.
+	listener, err := net.Listen("tcp4", ":0")
+	r.NoError(err)
+	defer listener.Close()
+	port := listener.Addr().(*net.TCPAddr).Port
+	free, err := net.Listen("tcp4", "127.0.0.1:0")
+	r.NoError(err)
+	local := free.Addr().(*net.TCPAddr)
+	free.Close()
+
+	tagger := &pipes.ProcessTagger{Pipe: &goul.BasePipe{Mode: goul.ModeConverter}}
+	in := make(chan goul.Item)
+	out, err := tagger.Convert(in, nil)
+	r.NoError(err)
+	defer close(in)
+
+	// a reply from the remote server of the same port is not attributed
+	// to the local server, in both directions.
+	remote := &net.TCPAddr{IP: net.IP{192, 0, 2, 1}, Port: port}
+	in <- tcpPacket(remote, local)
+	r.Nil(goul.AnnotationsOf(<-out))
+	in <- tcpPacket(local, remote)
+	r.Nil(goul.AnnotationsOf(<-out))
+
+	// but a request to the local server is.
+	client := &net.TCPAddr{IP: net.IP{192, 0, 2, 1}, Port: local.Port}
+	in <- tcpPacket(client, &net.TCPAddr{IP: net.IP{127, 0, 0, 1}, Port: port})
+	r.Equal(strconv.Itoa(os.Getpid()), goul.AnnotationsOf(<-out)[goul.AnnotationPID])
+}
+
+func Test_ProcessTagger_20_NoProc(t *testing.T) {
+	r := require.New(t)
+
+	tagger := &pipes.ProcessTagger{
+		Pipe: &goul.BasePipe{Mode: goul.ModeReverter},
+		Root: t.TempDir(),
+	}
+	in := make(chan goul.Item)
+	out, err := tagger.Revert(in, nil)
+	r.NoError(err)
+
+	in <- tcpPacket(&net.TCPAddr{IP: net.IP{127, 0, 0, 1}, Port: 1}, &net.TCPAddr{IP: net.IP{127, 0, 0, 1}, Port: 2})
+	r.Nil(goul.AnnotationsOf(<-out))
+	close(in)
+	<-out
+}
@@ -0,0 +1,338 @@
+package pipes
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+
+	"github.com/hyeoncheon/goul"
+)
+
+// constants...
+const (
+	defaultRecorderSize = 64 * 1024 * 1024
+
+	ErrRecorderInvalidOptions = "invalid flight recorder options"
+)
+
+// FlightRecorder is a pipe that keeps recent packets in a ring buffer
+// instead of passing them. When it is triggered, it dumps the packets in
+// the ring buffer to the next pipe or writer, then passes the packets for
+// `After` duration and goes back to recording. Triggers while passing
+// extend the duration.
+//
+// The ring buffer keeps the packets for the last `Window` duration and
+// up to `Size` bytes. If `Window` is zero, the packets are kept until the
+// buffer is full. If `Size` is zero, 64MB is used. By default, the buffer
+// is allocated on the memory but if `Path` is given, the file of the path
+// is mapped and used as the buffer. On the platforms without memory mapped
+// files, the buffer is allocated on the memory even if `Path` is given.
+// The window is measured on the capture timestamps of the packets, so
+// replayed packets with old timestamps are kept as they were captured.
+//
+// It can be triggered by calling `Trigger()`, for example on a signal,
+// by a control item of type `trigger` with the reason as its data, or by
+// the packet matched with `Match` function. The first dumped packet is
+// annotated with the reason of the trigger.
+type FlightRecorder struct {
+	goul.Pipe
+	ID     string
+	Window time.Duration
+	Size   int
+	After  time.Duration
+	Path   string
+	Match  func(packet gopacket.Packet) bool
+
+	trigger  chan string
+	ring     *recorderRing
+	triggers int
+	dumped   int
+}
+
+// Convert implements interface Pipe/Converter
+func (p *FlightRecorder) Convert(in chan goul.Item, message goul.Message) (out chan goul.Item, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			fmt.Fprintf(os.Stderr, "FlightRecorder#Convert recovered from panic!\n")
+			fmt.Fprintf(os.Stderr, "Probably an inheritance problem of pipeline instance.\n")
+			fmt.Fprintf(os.Stderr, "panic: %v\n", r)
+			err = errors.New("panic")
+		}
+	}()
+
+	if p.ID == "" {
+		p.ID = "recorder"
+	}
+	if err := p.prepare(); err != nil {
+		p.SetError(err)
+		return nil, err
+	}
+	p.SetError(nil)
+	return goul.Launch(p.recorder, in, message)
+}
+
+// Revert implements interface Pipe/Reverter
+func (p *FlightRecorder) Revert(in chan goul.Item, message goul.Message) (out chan goul.Item, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			fmt.Fprintf(os.Stderr, "FlightRecorder#Revert recovered from panic!\n")
+			fmt.Fprintf(os.Stderr, "Probably an inheritance problem of pipeline instance.\n")
+			fmt.Fprintf(os.Stderr, "panic: %v\n", r)
+			err = errors.New("panic")
+		}
+	}()
+
+	if p.ID == "" {
+		p.ID = "recorder"
+	}
+	if err := p.prepare(); err != nil {
+		p.SetError(err)
+		return nil, err
+	}
+	p.SetError(nil)
+	return goul.Launch(p.recorder, in, message)
+}
+
+// Trigger triggers the recorder with the reason. It is safe to call from
+// other goroutines. It returns false if the recorder is not running or
+// another trigger is pending.
+func (p *FlightRecorder) Trigger(reason string) bool {
+	if p.trigger == nil {
+		return false
+	}
+	select {
+	case p.trigger <- reason:
+		return true
+	default:
+		return false
+	}
+}
+
+func (p *FlightRecorder) prepare() error {
+	if p.Window < 0 || p.Size < 0 || p.After < 0 {
+		return errors.New(ErrRecorderInvalidOptions)
+	}
+	size := p.Size
+	if size == 0 {
+		size = defaultRecorderSize
+	}
+	ring, err := newRecorderRing(size, p.Path)
+	if err != nil {
+		return err
+	}
+	p.ring = ring
+	p.trigger = make(chan string, 1)
+	return nil
+}
+
+// recorder records the packets and dumps them when triggered.
+func (p *FlightRecorder) recorder(in, out chan goul.Item, message goul.Message) {
+	defer close(out)
+	defer goul.Log(p.GetLogger(), p.ID, "exit")
+	defer p.ring.close()
+	goul.Log(p.GetLogger(), p.ID, "recorder in looping... (window %v, size %v, after %v)",
+		p.Window, p.ring.size(), p.After)
+	if p.Path != "" && p.ring.file == nil {
+		goul.Log(p.GetLogger(), p.ID, "file mapping is not supported. recording on the memory")
+	}
+
+	var passing <-chan time.Time
+	var timer *time.Timer
+	fire := func(reason string) {
+		p.triggers++
+		if passing == nil {
+			count := p.dump(out, reason)
+			p.dumped += count
+			goul.Log(p.GetLogger(), p.ID, "triggered by %v. %v packets dumped", reason, count)
+			timer = time.NewTimer(p.After)
+			passing = timer.C
+			return
+		}
+		goul.Log(p.GetLogger(), p.ID, "triggered by %v while passing. extended", reason)
+		if !timer.Stop() {
+			<-timer.C
+		}
+		timer.Reset(p.After)
+	}
+
+	for {
+		select {
+		case item, ok := <-in:
+			if !ok {
+				p.SetError(errors.New(goul.ErrPipeInputClosed))
+				goul.Log(p.GetLogger(), p.ID, "channel closed")
+				goul.Log(p.GetLogger(), p.ID, "%v triggers, %v packets dumped", p.triggers, p.dumped)
+				return
+			}
+			if item.String() == goul.ItemTypeTrigger {
+				reason := string(item.Data())
+				if reason == "" {
+					reason = "control"
+				}
+				fire(reason)
+				continue
+			}
+			packet := toPacket(item)
+			if packet == nil {
+				continue
+			}
+			if passing != nil {
+				out <- packet
+			} else {
+				ci := packet.Metadata().CaptureInfo
+				if ci.Timestamp.IsZero() {
+					ci.Timestamp = time.Now()
+				}
+				p.ring.push(ci, packet.Data(), p.Window)
+			}
+			if p.Match != nil && p.Match(packet) {
+				fire("packet")
+			}
+		case reason := <-p.trigger:
+			fire(reason)
+		case <-passing:
+			goul.Log(p.GetLogger(), p.ID, "back to recording")
+			passing = nil
+		}
+	}
+}
+
+// dump sends the packets in the ring buffer to output channel and clears
+// the buffer. It returns the number of dumped packets. The window is
+// measured from the newest packet, not from the wall clock, since the
+// timestamps are of the capture.
+func (p *FlightRecorder) dump(out chan goul.Item, reason string) int {
+	count := 0
+	newest := p.ring.newest()
+	p.ring.drain(func(ci gopacket.CaptureInfo, data []byte) {
+		if p.Window > 0 && newest.Sub(ci.Timestamp) > p.Window {
+			return
+		}
+		packet := gopacket.NewPacket(data, layers.LayerTypeEthernet, gopacket.Default)
+		md := packet.Metadata()
+		md.CaptureInfo = ci
+		if count == 0 {
+			goul.Annotate(packet, goul.AnnotationComment, "flight recorder triggered by "+reason)
+		}
+		out <- packet
+		count++
+	})
+	return count
+}
+
+// toPacket returns the item as a packet. Raw packets are decoded as
+// ethernet frames. It returns nil for other items.
+func toPacket(item goul.Item) gopacket.Packet {
+	if packet, ok := item.(gopacket.Packet); ok {
+		return packet
+	}
+	if item.String() != goul.ItemTypeRawPacket {
+		return nil
+	}
+	packet := gopacket.NewPacket(item.Data(), layers.LayerTypeEthernet, gopacket.Default)
+	md := packet.Metadata()
+	md.Timestamp = time.Now()
+	md.CaptureLength = len(item.Data())
+	md.Length = len(item.Data())
+	return packet
+}
+
+//** ring buffer for flight recorder --------------------------------
+
+// recorderRing is a ring buffer of packet data on a byte slice, which is
+// allocated on the memory or mapped from a file. The capture information
+// and the position of each packet is kept in the index.
+type recorderRing struct {
+	buffer []byte
+	file   *os.File
+	index  []recorderEntry
+	tail   int
+}
+
+type recorderEntry struct {
+	ci     gopacket.CaptureInfo
+	offset int
+}
+
+func newRecorderRing(size int, path string) (*recorderRing, error) {
+	if path == "" {
+		return &recorderRing{buffer: make([]byte, size)}, nil
+	}
+	return mapRecorderRing(size, path)
+}
+
+func (r *recorderRing) size() int {
+	return len(r.buffer)
+}
+
+// newest returns the timestamp of the newest packet in the buffer.
+func (r *recorderRing) newest() time.Time {
+	if len(r.index) == 0 {
+		return time.Time{}
+	}
+	return r.index[len(r.index)-1].ci.Timestamp
+}
+
+// push adds the packet data into the buffer. The oldest packets are
+// evicted if there is no space for the data or they are older than the
+// window. Data larger than the buffer is dropped.
+func (r *recorderRing) push(ci gopacket.CaptureInfo, data []byte, window time.Duration) {
+	if window > 0 {
+		for len(r.index) > 0 && ci.Timestamp.Sub(r.index[0].ci.Timestamp) > window {
+			r.index = r.index[1:]
+		}
+	}
+	if len(data) > len(r.buffer) {
+		return
+	}
+
+	offset := r.tail
+	if offset+len(data) > len(r.buffer) {
+		// wrap around. the packets after the tail are the oldest ones.
+		for len(r.index) > 0 && r.index[0].offset >= r.tail {
+			r.index = r.index[1:]
+		}
+		offset = 0
+	}
+	for len(r.index) > 0 {
+		e := r.index[0]
+		if e.offset >= offset+len(data) || e.offset+e.ci.CaptureLength <= offset {
+			break
+		}
+		r.index = r.index[1:]
+	}
+
+	copy(r.buffer[offset:], data)
+	ci.CaptureLength = len(data)
+	r.index = append(r.index, recorderEntry{ci: ci, offset: offset})
+	r.tail = offset + len(data)
+}
+
+// drain calls fn for each packet from the oldest one with a copy of the
+// data, and clears the buffer.
+func (r *recorderRing) drain(fn func(ci gopacket.CaptureInfo, data []byte)) {
+	for _, e := range r.index {
+		data := make([]byte, e.ci.CaptureLength)
+		copy(data, r.buffer[e.offset:])
+		fn(e.ci, data)
+	}
+	r.index = nil
+	r.tail = 0
+}
+
+func (r *recorderRing) close() error {
+	if r.file == nil {
+		return nil
+	}
+	err := r.unmap()
+	if cerr := r.file.Close(); err == nil {
+		err = cerr
+	}
+	r.buffer = nil
+	r.file = nil
+	return err
+}
@@ -0,0 +1,14 @@
+//go:build !aix && !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !solaris
+// +build !aix,!darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!solaris
+
+package pipes
+
+// mapRecorderRing returns a ring buffer on the memory since memory mapped
+// files are not supported on this platform. The path is not used.
+func mapRecorderRing(size int, path string) (*recorderRing, error) {
+	return &recorderRing{buffer: make([]byte, size)}, nil
+}
+
+func (r *recorderRing) unmap() error {
+	return nil
+}
@@ -0,0 +1,180 @@
+package pipes_test
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/stretchr/testify/require"
+
+	"github.com/hyeoncheon/goul"
+	"github.com/hyeoncheon/goul/pipes"
+	. "github.com/hyeoncheon/goul/testing"
+)
+
+func runRecorder(t *testing.T, recorder *pipes.FlightRecorder) (chan goul.Item, chan goul.Item) {
+	var router goul.Router = &goul.Pipeline{Router: &goul.BaseRouter{}}
+	router.SetLogger(goul.NewLogger("debug"))
+	router.SetReader(&GeneratorAdapter{Adapter: &goul.BaseAdapter{}})
+	router.SetWriter(&GeneratorAdapter{Adapter: &goul.BaseAdapter{}})
+	router.AddPipe(recorder)
+
+	control, done, err := router.Run()
+	require.NoError(t, err)
+	return control, done
+}
+
+func nothingFrom(ch chan goul.Item) bool {
+	select {
+	case <-ch:
+		return false
+	case <-time.After(200 * time.Millisecond):
+		return true
+	}
+}
+
+func Test_FlightRecorder_10_Trigger(t *testing.T) {
+	r := require.New(t)
+
+	recorder := &pipes.FlightRecorder{
+		Pipe:   &goul.BasePipe{Mode: goul.ModeConverter},
+		Window: 10 * time.Second,
+		After:  500 * time.Millisecond,
+	}
+	r.False(recorder.Trigger("not running"))
+	control, done := runRecorder(t, recorder)
+
+	for i := 0; i < 5; i++ {
+		control <- &goul.ItemGeneric{Meta: "packet", DATA: []byte("Recorded")}
+	}
+	control <- &goul.ItemGeneric{Meta: "rawpacket", DATA: []byte("Recorded")}
+	r.True(nothingFrom(done))
+
+	r.True(recorder.Trigger("test"))
+	for i := 0; i < 6; i++ {
+		item := <-done
+		r.NoError(CheckPacket(item, "Recorded"))
+		if i == 0 {
+			r.Equal("flight recorder triggered by test", goul.AnnotationsOf(item)[goul.AnnotationComment])
+		} else {
+			r.Nil(goul.AnnotationsOf(item))
+		}
+	}
+
+	// packets in the next duration are passed.
+	control <- &goul.ItemGeneric{Meta: "packet", DATA: []byte("Passed")}
+	r.NoError(CheckPacket(<-done, "Passed"))
+
+	// and goes back to recording.
+	time.Sleep(700 * time.Millisecond)
+	control <- &goul.ItemGeneric{Meta: "packet", DATA: []byte("Recorded")}
+	r.True(nothingFrom(done))
+
+	close(control)
+	_, ok := <-done
+	r.False(ok)
+	r.EqualError(recorder.GetError(), goul.ErrPipeInputClosed)
+}
+
+func Test_FlightRecorder_20_MatchAndMmap(t *testing.T) {
+	r := require.New(t)
+
+	packet, _ := GeneratePacket("Record-0")
+	recorder := &pipes.FlightRecorder{
+		Pipe:  &goul.BasePipe{Mode: goul.ModeReverter},
+		Size:  len(packet.Data()) * 3,
+		After: 100 * time.Millisecond,
+		Path:  filepath.Join(t.TempDir(), "recorder.ring"),
+		Match: func(packet gopacket.Packet) bool {
+			app := packet.ApplicationLayer()
+			return app != nil && strings.HasPrefix(string(app.Payload()), "Trigger")
+		},
+	}
+	control, done := runRecorder(t, recorder)
+
+	// the buffer can keep three packets so old ones are evicted.
+	for _, data := range []string{"Record-1", "Record-2", "Record-3", "Record-4"} {
+		control <- &goul.ItemGeneric{Meta: "packet", DATA: []byte(data)}
+	}
+	r.True(nothingFrom(done))
+
+	control <- &goul.ItemGeneric{Meta: "packet", DATA: []byte("Trigger!")}
+	for _, data := range []string{"Record-3", "Record-4", "Trigger!"} {
+		r.NoError(CheckPacket(<-done, data))
+	}
+	r.True(nothingFrom(done))
+
+	close(control)
+	_, ok := <-done
+	r.False(ok)
+}
+
+func Test_FlightRecorder_30_Window(t *testing.T) {
+	r := require.New(t)
+
+	recorder := &pipes.FlightRecorder{
+		Pipe:   &goul.BasePipe{Mode: goul.ModeConverter},
+		Window: 300 * time.Millisecond,
+		After:  100 * time.Millisecond,
+	}
+	control, done := runRecorder(t, recorder)
+
+	control <- &goul.ItemGeneric{Meta: "packet", DATA: []byte("Outdated")}
+	time.Sleep(500 * time.Millisecond)
+	control <- &goul.ItemGeneric{Meta: "packet", DATA: []byte("Recorded")}
+	time.Sleep(100 * time.Millisecond)
+	r.True(recorder.Trigger("test"))
+	r.NoError(CheckPacket(<-done, "Recorded"))
+	r.True(nothingFrom(done))
+	close(control)
+}
+
+func Test_FlightRecorder_35_CaptureTime(t *testing.T) {
+	r := require.New(t)
+
+	recorder := &pipes.FlightRecorder{
+		Pipe:   &goul.BasePipe{Mode: goul.ModeConverter},
+		Window: time.Second,
+		After:  100 * time.Millisecond,
+	}
+	in := make(chan goul.Item)
+	out, err := recorder.Convert(in, nil)
+	r.NoError(err)
+
+	// replayed packets captured long ago are in the window of the newest.
+	captured := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i, data := range []string{"Outdated", "Recorded", "Newest"} {
+		packet, _ := GeneratePacket(data)
+		packet.Metadata().Timestamp = captured.Add(time.Duration(i) * 700 * time.Millisecond)
+		in <- packet
+	}
+	in <- &goul.ItemGeneric{Meta: goul.ItemTypeTrigger, DATA: []byte("remote")}
+	item := <-out
+	r.NoError(CheckPacket(item, "Recorded"))
+	r.Equal("flight recorder triggered by remote", goul.AnnotationsOf(item)[goul.AnnotationComment])
+	r.NoError(CheckPacket(<-out, "Newest"))
+	r.True(nothingFrom(out))
+	close(in)
+}
+
+func Test_FlightRecorder_40_Exceptions(t *testing.T) {
+	r := require.New(t)
+
+	recorder := &pipes.FlightRecorder{
+		Pipe:   &goul.BasePipe{Mode: goul.ModeConverter},
+		Window: -1,
+	}
+	_, err := recorder.Convert(make(chan goul.Item), nil)
+	r.EqualError(err, pipes.ErrRecorderInvalidOptions)
+	_, err = recorder.Revert(make(chan goul.Item), nil)
+	r.EqualError(err, pipes.ErrRecorderInvalidOptions)
+
+	recorder = &pipes.FlightRecorder{
+		Pipe: &goul.BasePipe{Mode: goul.ModeConverter},
+		Path: "/not/exist/recorder.ring",
+	}
+	_, err = recorder.Convert(make(chan goul.Item), nil)
+	r.Error(err)
+}
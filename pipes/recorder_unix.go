@@ -0,0 +1,33 @@
+//go:build aix || darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+// +build aix darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package pipes
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// mapRecorderRing returns a ring buffer on the file of the path, which is
+// mapped on the memory.
+func mapRecorderRing(size int, path string) (*recorderRing, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := file.Truncate(int64(size)); err != nil {
+		file.Close()
+		return nil, err
+	}
+	buffer, err := unix.Mmap(int(file.Fd()), 0, size, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &recorderRing{buffer: buffer, file: file}, nil
+}
+
+func (r *recorderRing) unmap() error {
+	return unix.Munmap(r.buffer)
+}
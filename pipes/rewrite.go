@@ -0,0 +1,277 @@
+package pipes
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync/atomic"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+
+	"github.com/hyeoncheon/goul"
+)
+
+// constants...
+const (
+	maxVLAN = 4094
+
+	ErrRewriterInvalidOptions = "invalid rewriter options"
+	ErrRewriteNotEthernet     = "not an ethernet frame"
+	ErrRewriteNoVLAN          = "no vlan tag to pop"
+	ErrRewriteNotSerializable = "frame could not be serialized"
+)
+
+// Rewriter is a pipe that rewrites the frames before injection, so the
+// analyzers behind a switch can accept them or separate them by VLAN.
+//
+// It sets the destination and source MAC addresses if DstMAC or SrcMAC is
+// given, pops the outer 802.1Q tag if PopVLAN is set, and pushes a tag of
+// PushVLAN or of the VLAN returned by VLANOf, for example one VLAN for
+// each session. If TTL is not zero, the TTL of IPv4 or the hop limit of
+// IPv6 is set. With FixChecksums, the checksums of IP, TCP, UDP and ICMP
+// are recomputed, which is useful for the frames captured with checksum
+// offloading.
+//
+// The frames which cannot be rewritten, such as non-ethernet frames or
+// untagged frames for PopVLAN, are passed without modification and
+// counted as failed. But the frames for which VLANOf returns a VLAN out
+// of range are dropped, since they must not be mixed into the untagged
+// traffic.
+type Rewriter struct {
+	goul.Pipe
+	ID           string
+	DstMAC       net.HardwareAddr
+	SrcMAC       net.HardwareAddr
+	PopVLAN      bool
+	PushVLAN     uint16
+	VLANOf       func(item goul.Item) int
+	TTL          uint8
+	FixChecksums bool
+
+	rewritten uint64
+	failed    uint64
+	dropped   uint64
+}
+
+// Convert implements interface Pipe/Converter
+func (p *Rewriter) Convert(in chan goul.Item, message goul.Message) (out chan goul.Item, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			fmt.Fprintf(os.Stderr, "Rewriter#Convert recovered from panic!\n")
+			fmt.Fprintf(os.Stderr, "Probably an inheritance problem of pipeline instance.\n")
+			fmt.Fprintf(os.Stderr, "panic: %v\n", r)
+			err = errors.New("panic")
+		}
+	}()
+
+	if p.ID == "" {
+		p.ID = "rewriter"
+	}
+	if err := p.validate(); err != nil {
+		p.SetError(err)
+		return nil, err
+	}
+	p.SetError(nil)
+	return goul.Launch(p.rewriter, in, message)
+}
+
+// Revert implements interface Pipe/Reverter
+func (p *Rewriter) Revert(in chan goul.Item, message goul.Message) (out chan goul.Item, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			fmt.Fprintf(os.Stderr, "Rewriter#Revert recovered from panic!\n")
+			fmt.Fprintf(os.Stderr, "Probably an inheritance problem of pipeline instance.\n")
+			fmt.Fprintf(os.Stderr, "panic: %v\n", r)
+			err = errors.New("panic")
+		}
+	}()
+
+	if p.ID == "" {
+		p.ID = "rewriter"
+	}
+	if err := p.validate(); err != nil {
+		p.SetError(err)
+		return nil, err
+	}
+	p.SetError(nil)
+	return goul.Launch(p.rewriter, in, message)
+}
+
+// Stats returns the number of rewritten and failed frames. It is safe to
+// call from other goroutines.
+func (p *Rewriter) Stats() (rewritten, failed uint64) {
+	return atomic.LoadUint64(&p.rewritten), atomic.LoadUint64(&p.failed)
+}
+
+func (p *Rewriter) validate() error {
+	if (p.DstMAC != nil && len(p.DstMAC) != 6) || (p.SrcMAC != nil && len(p.SrcMAC) != 6) {
+		return errors.New(ErrRewriterInvalidOptions)
+	}
+	if p.PushVLAN > maxVLAN {
+		return errors.New(ErrRewriterInvalidOptions)
+	}
+	return nil
+}
+
+// rewriter rewrites the packets from input channel.
+func (p *Rewriter) rewriter(in, out chan goul.Item, message goul.Message) {
+	defer close(out)
+	defer goul.Log(p.GetLogger(), p.ID, "exit")
+	goul.Log(p.GetLogger(), p.ID, "rewriter in looping...")
+
+	for item := range in {
+		packet := toPacket(item)
+		if packet == nil {
+			out <- item
+			continue
+		}
+		vlan := p.PushVLAN
+		if p.VLANOf != nil {
+			v := p.VLANOf(item)
+			if v < 0 || v > maxVLAN {
+				atomic.AddUint64(&p.failed, 1)
+				if atomic.AddUint64(&p.dropped, 1) == 1 { // log the first one only
+					goul.Error(p.GetLogger(), p.ID, "vlan %v is out of range, frames are dropped", v)
+				}
+				continue
+			}
+			vlan = uint16(v)
+		}
+		frame, err := p.rewrite(packet.Data(), vlan)
+		if err != nil {
+			if atomic.AddUint64(&p.failed, 1) == 1 { // log the first one only
+				goul.Error(p.GetLogger(), p.ID, "couldn't rewrite the frame: %v", err)
+			}
+			out <- packet
+			continue
+		}
+		atomic.AddUint64(&p.rewritten, 1)
+		out <- repacket(packet, frame)
+	}
+	p.SetError(errors.New(goul.ErrPipeInputClosed))
+	goul.Log(p.GetLogger(), p.ID, "channel closed")
+	if logger := p.GetLogger(); logger != nil {
+		rewritten, failed := p.Stats()
+		logger.Infof("[%v] %v frames rewritten, %v failed (%v dropped)", p.ID, rewritten, failed,
+			atomic.LoadUint64(&p.dropped))
+	}
+}
+
+// rewrite returns a rewritten copy of the frame.
+func (p *Rewriter) rewrite(data []byte, vlan uint16) ([]byte, error) {
+	if len(data) < 14 {
+		return nil, errors.New(ErrRewriteNotEthernet)
+	}
+	frame := make([]byte, len(data))
+	copy(frame, data)
+
+	if p.DstMAC != nil {
+		copy(frame[0:6], p.DstMAC)
+	}
+	if p.SrcMAC != nil {
+		copy(frame[6:12], p.SrcMAC)
+	}
+	if p.PopVLAN {
+		if len(frame) < 18 || binary.BigEndian.Uint16(frame[12:14]) != uint16(layers.EthernetTypeDot1Q) {
+			return nil, errors.New(ErrRewriteNoVLAN)
+		}
+		frame = append(frame[:12], frame[16:]...)
+	}
+	if vlan != 0 {
+		tagged := make([]byte, 0, len(frame)+4)
+		tagged = append(tagged, frame[:12]...)
+		tagged = append(tagged, 0x81, 0x00, byte(vlan>>8), byte(vlan))
+		frame = append(tagged, frame[12:]...)
+	}
+	if p.TTL != 0 {
+		setTTL(frame, p.TTL)
+	}
+	if p.FixChecksums {
+		return fixChecksums(frame)
+	}
+	return frame, nil
+}
+
+// setTTL sets the TTL of IPv4 or the hop limit of IPv6 of the frame after
+// the VLAN tags. The header checksum of IPv4 is updated. Other frames are
+// not changed.
+func setTTL(frame []byte, ttl uint8) {
+	offset := 12
+	etherType := binary.BigEndian.Uint16(frame[offset:])
+	for (etherType == uint16(layers.EthernetTypeDot1Q) || etherType == uint16(layers.EthernetTypeQinQ)) &&
+		len(frame) >= offset+6 {
+		offset += 4
+		etherType = binary.BigEndian.Uint16(frame[offset:])
+	}
+	ip := frame[offset+2:]
+	switch layers.EthernetType(etherType) {
+	case layers.EthernetTypeIPv4:
+		if len(ip) < 20 || len(ip) < int(ip[0]&0x0f)*4 {
+			return
+		}
+		ip[8] = ttl
+		header := ip[:int(ip[0]&0x0f)*4]
+		header[10], header[11] = 0, 0
+		binary.BigEndian.PutUint16(header[10:], ipChecksum(header))
+	case layers.EthernetTypeIPv6:
+		if len(ip) >= 40 {
+			ip[7] = ttl
+		}
+	}
+}
+
+// ipChecksum returns the internet checksum of the header.
+func ipChecksum(header []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(header); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(header[i:]))
+	}
+	if len(header)%2 == 1 {
+		sum += uint32(header[len(header)-1]) << 8
+	}
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+	return ^uint16(sum)
+}
+
+// fixChecksums decodes the frame and serializes it again with computed
+// checksums of all layers.
+func fixChecksums(frame []byte) ([]byte, error) {
+	packet := gopacket.NewPacket(frame, layers.LayerTypeEthernet, gopacket.Default)
+	if packet.ErrorLayer() != nil {
+		return nil, errors.New(ErrRewriteNotSerializable)
+	}
+	if network := packet.NetworkLayer(); network != nil {
+		switch transport := packet.TransportLayer().(type) {
+		case *layers.TCP:
+			transport.SetNetworkLayerForChecksum(network)
+		case *layers.UDP:
+			transport.SetNetworkLayerForChecksum(network)
+		}
+		if icmp, ok := packet.Layer(layers.LayerTypeICMPv6).(*layers.ICMPv6); ok {
+			icmp.SetNetworkLayerForChecksum(network)
+		}
+	}
+	buffer := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{ComputeChecksums: true}
+	if err := gopacket.SerializePacket(buffer, opts, packet); err != nil {
+		return nil, errors.New(ErrRewriteNotSerializable)
+	}
+	return buffer.Bytes(), nil
+}
+
+// repacket returns new packet of the frame with the metadata of the
+// original packet, including the annotations and the session.
+func repacket(packet gopacket.Packet, frame []byte) gopacket.Packet {
+	np := gopacket.NewPacket(frame, layers.LayerTypeEthernet, gopacket.Default)
+	md := np.Metadata()
+	md.CaptureInfo = packet.Metadata().CaptureInfo
+	md.Length += len(frame) - len(packet.Data())
+	md.CaptureLength = len(frame)
+	md.AncillaryData = packet.Metadata().AncillaryData
+	return np
+}
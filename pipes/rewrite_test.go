@@ -0,0 +1,202 @@
+package pipes_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/stretchr/testify/require"
+
+	"github.com/hyeoncheon/goul"
+	"github.com/hyeoncheon/goul/pipes"
+	. "github.com/hyeoncheon/goul/testing"
+)
+
+func runRewriter(t *testing.T, rewriter *pipes.Rewriter) (chan goul.Item, chan goul.Item) {
+	var router goul.Router = &goul.Pipeline{Router: &goul.BaseRouter{}}
+	router.SetLogger(goul.NewLogger("debug"))
+	router.SetReader(&GeneratorAdapter{Adapter: &goul.BaseAdapter{}})
+	router.SetWriter(&GeneratorAdapter{Adapter: &goul.BaseAdapter{}})
+	router.AddPipe(rewriter)
+
+	control, done, err := router.Run()
+	require.NoError(t, err)
+	return control, done
+}
+
+// validIPv4Checksum returns true if the checksum of the IPv4 header is valid.
+func validIPv4Checksum(ip *layers.IPv4) bool {
+	header := ip.Contents
+	var sum uint32
+	for i := 0; i+1 < len(header); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(header[i:]))
+	}
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+	return sum == 0xffff
+}
+
+func Test_Rewriter_10_Rewrite(t *testing.T) {
+	r := require.New(t)
+
+	dst := net.HardwareAddr{0x02, 0, 0, 0, 0, 0x01}
+	src := net.HardwareAddr{0x02, 0, 0, 0, 0, 0x02}
+	rewriter := &pipes.Rewriter{
+		Pipe:     &goul.BasePipe{Mode: goul.ModeReverter},
+		DstMAC:   dst,
+		SrcMAC:   src,
+		PushVLAN: 100,
+		TTL:      3,
+	}
+	control, done := runRewriter(t, rewriter)
+
+	control <- &goul.ItemGeneric{Meta: "packet", DATA: []byte("Rewritten")}
+	item := <-done
+	packet, ok := item.(gopacket.Packet)
+	r.True(ok)
+	r.Equal(len("Rewritten"), len(packet.ApplicationLayer().Payload()))
+
+	ether := packet.Layer(layers.LayerTypeEthernet).(*layers.Ethernet)
+	r.Equal(dst, ether.DstMAC)
+	r.Equal(src, ether.SrcMAC)
+	dot1q, ok := packet.Layer(layers.LayerTypeDot1Q).(*layers.Dot1Q)
+	r.True(ok)
+	r.Equal(uint16(100), dot1q.VLANIdentifier)
+	ip := packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+	r.Equal(uint8(3), ip.TTL)
+	r.True(validIPv4Checksum(ip))
+	r.Equal(len(packet.Data()), packet.Metadata().CaptureLength)
+
+	close(control)
+	_, ok = <-done
+	r.False(ok)
+	r.EqualError(rewriter.GetError(), goul.ErrPipeInputClosed)
+	rewritten, failed := rewriter.Stats()
+	r.Equal(uint64(1), rewritten)
+	r.Equal(uint64(0), failed)
+}
+
+func Test_Rewriter_20_VLANOf(t *testing.T) {
+	r := require.New(t)
+
+	rewriter := &pipes.Rewriter{
+		Pipe:     &goul.BasePipe{Mode: goul.ModeReverter},
+		PushVLAN: 100,
+		VLANOf: func(item goul.Item) int {
+			if bytes.HasSuffix(item.Data(), []byte("Overflow")) {
+				return 4095
+			}
+			return 200
+		},
+		FixChecksums: true,
+	}
+	control, done := runRewriter(t, rewriter)
+
+	control <- &goul.ItemGeneric{Meta: "packet", DATA: []byte("Tagged")}
+	packet := (<-done).(gopacket.Packet)
+	r.Equal(uint16(200), packet.Layer(layers.LayerTypeDot1Q).(*layers.Dot1Q).VLANIdentifier)
+	r.Equal("Tagged", string(packet.ApplicationLayer().Payload()))
+	r.True(validIPv4Checksum(packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4)))
+
+	// frames of a vlan out of range are dropped instead of untagged.
+	control <- &goul.ItemGeneric{Meta: "packet", DATA: []byte("Overflow")}
+	control <- &goul.ItemGeneric{Meta: "packet", DATA: []byte("Tagged")}
+	packet = (<-done).(gopacket.Packet)
+	r.Equal("Tagged", string(packet.ApplicationLayer().Payload()))
+
+	close(control)
+	<-done
+	rewritten, failed := rewriter.Stats()
+	r.Equal(uint64(2), rewritten)
+	r.Equal(uint64(1), failed)
+}
+
+func Test_Rewriter_30_PopVLAN(t *testing.T) {
+	r := require.New(t)
+
+	// untagged frames could not be popped, passed as is.
+	rewriter := &pipes.Rewriter{
+		Pipe:    &goul.BasePipe{Mode: goul.ModeConverter},
+		PopVLAN: true,
+	}
+	control, done := runRewriter(t, rewriter)
+
+	control <- &goul.ItemGeneric{Meta: "packet", DATA: []byte("Untagged")}
+	r.NoError(CheckPacket(<-done, "Untagged"))
+	close(control)
+	<-done
+	rewritten, failed := rewriter.Stats()
+	r.Equal(uint64(0), rewritten)
+	r.Equal(uint64(1), failed)
+
+	// pop and push replaces the tag.
+	tagger := &pipes.Rewriter{
+		Pipe:     &goul.BasePipe{Mode: goul.ModeConverter},
+		PushVLAN: 10,
+	}
+	replacer := &pipes.Rewriter{
+		Pipe:     &goul.BasePipe{Mode: goul.ModeConverter},
+		PopVLAN:  true,
+		PushVLAN: 20,
+	}
+	popper := &pipes.Rewriter{
+		Pipe:    &goul.BasePipe{Mode: goul.ModeConverter},
+		PopVLAN: true,
+	}
+	var router goul.Router = &goul.Pipeline{Router: &goul.BaseRouter{}}
+	router.SetReader(&GeneratorAdapter{Adapter: &goul.BaseAdapter{}})
+	router.SetWriter(&GeneratorAdapter{Adapter: &goul.BaseAdapter{}})
+	router.AddPipe(tagger)
+	router.AddPipe(replacer)
+	router.AddPipe(popper)
+	control, done, err := router.Run()
+	r.NoError(err)
+
+	control <- &goul.ItemGeneric{Meta: "packet", DATA: []byte("Popped")}
+	item := <-done
+	r.NoError(CheckPacket(item, "Popped"))
+	r.Nil(item.(gopacket.Packet).Layer(layers.LayerTypeDot1Q))
+	rewritten, _ = replacer.Stats()
+	r.Equal(uint64(1), rewritten)
+	close(control)
+	<-done
+}
+
+func Test_Rewriter_40_Exceptions(t *testing.T) {
+	r := require.New(t)
+
+	rewriter := &pipes.Rewriter{
+		Pipe:   &goul.BasePipe{Mode: goul.ModeConverter},
+		DstMAC: net.HardwareAddr{0x02, 0x00},
+	}
+	_, err := rewriter.Convert(make(chan goul.Item), nil)
+	r.EqualError(err, pipes.ErrRewriterInvalidOptions)
+
+	rewriter = &pipes.Rewriter{
+		Pipe:     &goul.BasePipe{Mode: goul.ModeReverter},
+		PushVLAN: 4095,
+	}
+	_, err = rewriter.Revert(make(chan goul.Item), nil)
+	r.EqualError(err, pipes.ErrRewriterInvalidOptions)
+
+	// non-packet items are passed.
+	rewriter = &pipes.Rewriter{
+		Pipe:     &goul.BasePipe{Mode: goul.ModeConverter},
+		PushVLAN: 1,
+	}
+	in := make(chan goul.Item)
+	out, err := rewriter.Convert(in, nil)
+	r.NoError(err)
+	in <- &goul.ItemGeneric{Meta: "message", DATA: []byte("hello")}
+	r.Equal("hello", string((<-out).Data()))
+	in <- &goul.ItemGeneric{Meta: goul.ItemTypeRawPacket, DATA: []byte("short")}
+	r.Equal("short", string((<-out).Data()))
+	close(in)
+	<-out
+	_, failed := rewriter.Stats()
+	r.Equal(uint64(1), failed)
+}
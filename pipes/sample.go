@@ -0,0 +1,193 @@
+package pipes
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/gopacket"
+
+	"github.com/hyeoncheon/goul"
+)
+
+// sampling modes...
+const (
+	SampleCount  = "count"
+	SampleRandom = "random"
+	SampleFlow   = "flow"
+
+	ErrSamplerInvalidMode = "invalid sampling mode, it should be count, random or flow"
+	ErrSamplerInvalidRate = "invalid sampling rate, it should be positive"
+)
+
+// Sampler is a pipe that passes 1 in Rate packets and drops the others.
+// In `count` mode, every Rate-th packet is passed. In `random` mode, each
+// packet is passed with the probability of 1/Rate. In `flow` mode, the
+// flows are sampled by the hash of their addresses and ports, so all the
+// packets of a flow in both directions are passed or dropped together.
+//
+// The rate can be changed with SetRate while running, e.g. by the sample
+// command of the control file. The rate is annotated on the passed
+// packets, so the statistics of the receiver can be scaled back up with
+// SampleRateOf.
+type Sampler struct {
+	goul.Pipe
+	ID   string
+	Mode string
+	Rate int
+
+	rate    uint32
+	count   uint32
+	random  *rand.Rand
+	passed  uint64
+	dropped uint64
+}
+
+// Convert implements interface Pipe/Converter
+func (p *Sampler) Convert(in chan goul.Item, message goul.Message) (out chan goul.Item, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			fmt.Fprintf(os.Stderr, "Sampler#Convert recovered from panic!\n")
+			fmt.Fprintf(os.Stderr, "Probably an inheritance problem of pipeline instance.\n")
+			fmt.Fprintf(os.Stderr, "panic: %v\n", r)
+			err = errors.New("panic")
+		}
+	}()
+
+	if err := p.init(); err != nil {
+		p.SetError(err)
+		return nil, err
+	}
+	p.SetError(nil)
+	return goul.Launch(p.sampler, in, message)
+}
+
+// Revert implements interface Pipe/Reverter
+func (p *Sampler) Revert(in chan goul.Item, message goul.Message) (out chan goul.Item, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			fmt.Fprintf(os.Stderr, "Sampler#Revert recovered from panic!\n")
+			fmt.Fprintf(os.Stderr, "Probably an inheritance problem of pipeline instance.\n")
+			fmt.Fprintf(os.Stderr, "panic: %v\n", r)
+			err = errors.New("panic")
+		}
+	}()
+
+	if err := p.init(); err != nil {
+		p.SetError(err)
+		return nil, err
+	}
+	p.SetError(nil)
+	return goul.Launch(p.sampler, in, message)
+}
+
+// SetRate changes the sampling rate to 1 in rate packets or flows. It is
+// safe to call while the pipe is running.
+func (p *Sampler) SetRate(rate int) error {
+	if rate < 1 || rate > int(^uint32(0)) {
+		return errors.New(ErrSamplerInvalidRate)
+	}
+	atomic.StoreUint32(&p.rate, uint32(rate))
+	return nil
+}
+
+// GetRate returns the current sampling rate.
+func (p *Sampler) GetRate() int {
+	return int(atomic.LoadUint32(&p.rate))
+}
+
+// Stats returns the number of passed and dropped packets. It is safe to
+// call from other goroutines.
+func (p *Sampler) Stats() (passed, dropped uint64) {
+	return atomic.LoadUint64(&p.passed), atomic.LoadUint64(&p.dropped)
+}
+
+func (p *Sampler) init() error {
+	if p.ID == "" {
+		p.ID = "sample"
+	}
+	if p.Mode == "" {
+		p.Mode = SampleCount
+	}
+	if p.Mode != SampleCount && p.Mode != SampleRandom && p.Mode != SampleFlow {
+		return errors.New(ErrSamplerInvalidMode)
+	}
+	if atomic.LoadUint32(&p.rate) == 0 {
+		if err := p.SetRate(p.Rate); err != nil {
+			return err
+		}
+	}
+	p.random = rand.New(rand.NewSource(time.Now().UnixNano()))
+	return nil
+}
+
+// sampler passes the sampled packets from input channel.
+func (p *Sampler) sampler(in, out chan goul.Item, message goul.Message) {
+	defer close(out)
+	defer goul.Log(p.GetLogger(), p.ID, "exit")
+	goul.Log(p.GetLogger(), p.ID, "sampler in looping... (%v, 1 in %v)", p.Mode, p.GetRate())
+
+	for item := range in {
+		packet := toPacket(item)
+		if packet == nil {
+			out <- item
+			continue
+		}
+		rate := atomic.LoadUint32(&p.rate)
+		var sampled bool
+		switch p.Mode {
+		case SampleCount:
+			p.count++
+			if sampled = p.count >= rate; sampled {
+				p.count = 0
+			}
+		case SampleRandom:
+			sampled = p.random.Int63n(int64(rate)) == 0
+		case SampleFlow:
+			sampled = flowHash(packet)%uint64(rate) == 0
+		}
+		if !sampled {
+			atomic.AddUint64(&p.dropped, 1)
+			continue
+		}
+		atomic.AddUint64(&p.passed, 1)
+		// the rate of the packets sampled again is the product of the rates.
+		goul.Annotate(packet, goul.AnnotationSampleRate, strconv.Itoa(SampleRateOf(packet)*int(rate)))
+		out <- packet
+	}
+	p.SetError(errors.New(goul.ErrPipeInputClosed))
+	goul.Log(p.GetLogger(), p.ID, "channel closed")
+	if logger := p.GetLogger(); logger != nil {
+		passed, dropped := p.Stats()
+		logger.Infof("[%v] %v packets sampled, %v packets dropped", p.ID, passed, dropped)
+	}
+}
+
+// flowHash returns the symmetric hash of the addresses and ports of the
+// packet, which is the same for both directions of a flow.
+func flowHash(packet gopacket.Packet) uint64 {
+	var hash uint64
+	if link := packet.LinkLayer(); link != nil {
+		hash = link.LinkFlow().FastHash()
+	}
+	if network := packet.NetworkLayer(); network != nil {
+		hash = network.NetworkFlow().FastHash()
+		if transport := packet.TransportLayer(); transport != nil {
+			hash = hash*31 + transport.TransportFlow().FastHash()
+		}
+	}
+	return hash
+}
+
+// SampleRateOf returns the sampling rate annotated on the item, or 1 if the
+// item is not sampled.
+func SampleRateOf(item goul.Item) int {
+	if rate, err := strconv.Atoi(goul.AnnotationsOf(item)[goul.AnnotationSampleRate]); err == nil && rate > 0 {
+		return rate
+	}
+	return 1
+}
@@ -0,0 +1,141 @@
+package pipes_test
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/hyeoncheon/goul"
+	"github.com/hyeoncheon/goul/pipes"
+)
+
+// sample sends the items to the sampler and returns the passed items. A
+// message item is sent after them to know the end.
+func sample(in, out chan goul.Item, items []goul.Item) []goul.Item {
+	go func() {
+		for _, item := range items {
+			in <- item
+		}
+		in <- &goul.ItemGeneric{Meta: "message", DATA: []byte("end")}
+	}()
+	passed := []goul.Item{}
+	for item := range out {
+		if item.String() == "message" {
+			break
+		}
+		passed = append(passed, item)
+	}
+	return passed
+}
+
+func Test_Sampler_10_Count(t *testing.T) {
+	r := require.New(t)
+
+	sampler := &pipes.Sampler{
+		Pipe: &goul.BasePipe{Mode: goul.ModeConverter},
+		Rate: 3,
+	}
+	in := make(chan goul.Item)
+	out, err := sampler.Convert(in, nil)
+	r.NoError(err)
+
+	src := &net.TCPAddr{IP: net.IP{10, 0, 0, 1}, Port: 1}
+	dst := &net.TCPAddr{IP: net.IP{10, 0, 0, 2}, Port: 2}
+	items := []goul.Item{}
+	for i := 0; i < 9; i++ {
+		items = append(items, tcpPacket(src, dst))
+	}
+	passed := sample(in, out, items)
+	r.Equal(3, len(passed))
+	r.Equal(3, pipes.SampleRateOf(passed[0]))
+
+	// the rate can be changed while running.
+	r.NoError(sampler.SetRate(1))
+	r.Equal(1, sampler.GetRate())
+	passed = sample(in, out, items[:2])
+	r.Equal(2, len(passed))
+	r.Equal(1, pipes.SampleRateOf(passed[0]))
+
+	in <- &goul.ItemGeneric{Meta: "message", DATA: []byte("hello")}
+	r.Equal("hello", string((<-out).Data()))
+	r.Equal(1, pipes.SampleRateOf(&goul.ItemGeneric{Meta: "message"}))
+
+	close(in)
+	_, ok := <-out
+	r.False(ok)
+	r.EqualError(sampler.GetError(), goul.ErrPipeInputClosed)
+	sampled, dropped := sampler.Stats()
+	r.Equal(uint64(5), sampled)
+	r.Equal(uint64(6), dropped)
+}
+
+func Test_Sampler_20_Flow(t *testing.T) {
+	r := require.New(t)
+
+	sampler := &pipes.Sampler{
+		Pipe: &goul.BasePipe{Mode: goul.ModeConverter},
+		Mode: pipes.SampleFlow,
+		Rate: 4,
+	}
+	in := make(chan goul.Item)
+	out, err := sampler.Convert(in, nil)
+	r.NoError(err)
+
+	// flows are passed or dropped in both directions together.
+	server := &net.TCPAddr{IP: net.IP{10, 0, 0, 1}, Port: 443}
+	flows := 0
+	for port := 40000; port < 40100; port++ {
+		client := &net.TCPAddr{IP: net.IP{10, 0, 0, 2}, Port: port}
+		items := []goul.Item{tcpPacket(client, server), tcpPacket(server, client), tcpPacket(client, server)}
+		passed := sample(in, out, items)
+		r.True(len(passed) == 0 || len(passed) == 3)
+		if len(passed) == 3 {
+			flows++
+		}
+	}
+	r.True(flows > 0 && flows < 100)
+
+	close(in)
+	<-out
+}
+
+func Test_Sampler_30_Random(t *testing.T) {
+	r := require.New(t)
+
+	sampler := &pipes.Sampler{
+		Pipe: &goul.BasePipe{Mode: goul.ModeReverter},
+		Mode: pipes.SampleRandom,
+		Rate: 2,
+	}
+	in := make(chan goul.Item)
+	out, err := sampler.Revert(in, nil)
+	r.NoError(err)
+
+	src := &net.TCPAddr{IP: net.IP{10, 0, 0, 1}, Port: 1}
+	dst := &net.TCPAddr{IP: net.IP{10, 0, 0, 2}, Port: 2}
+	items := []goul.Item{}
+	for i := 0; i < 1000; i++ {
+		items = append(items, tcpPacket(src, dst))
+	}
+	passed := sample(in, out, items)
+	r.InDelta(500, len(passed), 150)
+
+	close(in)
+	<-out
+}
+
+func Test_Sampler_40_Exceptions(t *testing.T) {
+	r := require.New(t)
+
+	sampler := &pipes.Sampler{Pipe: &goul.BasePipe{Mode: goul.ModeConverter}}
+	_, err := sampler.Convert(make(chan goul.Item), nil)
+	r.EqualError(err, pipes.ErrSamplerInvalidRate)
+
+	sampler = &pipes.Sampler{Pipe: &goul.BasePipe{Mode: goul.ModeConverter}, Mode: "unknown", Rate: 1}
+	_, err = sampler.Convert(make(chan goul.Item), nil)
+	r.EqualError(err, pipes.ErrSamplerInvalidMode)
+
+	sampler = &pipes.Sampler{Pipe: &goul.BasePipe{Mode: goul.ModeConverter}, Rate: 1}
+	r.EqualError(sampler.SetRate(0), pipes.ErrSamplerInvalidRate)
+}
@@ -0,0 +1,433 @@
+package pipes
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+
+	"github.com/hyeoncheon/goul"
+)
+
+// constants...
+const (
+	defaultTopPorts = 10
+
+	ErrStatsInvalidOptions = "invalid statistics options"
+)
+
+// defaultStatsWindows are the sliding windows of the totals by default.
+var defaultStatsWindows = []time.Duration{1 * time.Minute, 5 * time.Minute, 15 * time.Minute}
+
+// ProtocolStats is a pass-through pipe that counts the packets and bytes
+// by the types of link, network, transport and application layers, by the
+// version of IP and by the ports of TCP, UDP and SCTP. The totals are also
+// counted over the sliding Windows.
+//
+// Snapshot returns the current counters, and the summary is logged on exit
+// and for each Interval if it is set. It can be used on both client and
+// server.
+type ProtocolStats struct {
+	goul.Pipe
+	ID       string
+	Windows  []time.Duration
+	TopPorts int
+	Interval time.Duration
+
+	mutex     sync.Mutex // guards the counters
+	total     Counter
+	estimated Counter
+	errors    uint64
+	layers    map[string]map[string]*Counter
+	ports     map[string]*Counter
+	buckets   []statsBucket
+}
+
+// Counter is the number of packets and bytes.
+type Counter struct {
+	Packets uint64
+	Bytes   uint64
+}
+
+// String returns the counter as `packets/bytes`.
+func (c Counter) String() string {
+	return fmt.Sprintf("%v/%vB", c.Packets, c.Bytes)
+}
+
+// PortCounter is a counter of a port such as `tcp/443`.
+type PortCounter struct {
+	Port string
+	Counter
+}
+
+// ProtocolSnapshot is a snapshot of the protocol statistics. The maps of
+// the layers are keyed by the names of the layer types, and Versions is
+// keyed by `IPv4` or `IPv6`. Ports are the top ports in the order of the
+// packets. Errors is the number of packets failed to decode. Estimated is
+// the total scaled up by the sampling rates of the packets.
+type ProtocolSnapshot struct {
+	Time         time.Time
+	Total        Counter
+	Estimated    Counter
+	Errors       uint64
+	Links        map[string]Counter
+	Networks     map[string]Counter
+	Transports   map[string]Counter
+	Applications map[string]Counter
+	Versions     map[string]Counter
+	Ports        []PortCounter
+	Windows      map[time.Duration]Counter
+}
+
+// String returns a multi-line summary of the snapshot.
+func (s ProtocolSnapshot) String() string {
+	lines := []string{fmt.Sprintf("total %v, errors %v", s.Total, s.Errors)}
+	if s.Estimated != s.Total {
+		lines[0] += fmt.Sprintf(", estimated %v", s.Estimated)
+	}
+	for _, group := range []struct {
+		name     string
+		counters map[string]Counter
+	}{
+		{"link", s.Links},
+		{"network", s.Networks},
+		{"transport", s.Transports},
+		{"application", s.Applications},
+		{"version", s.Versions},
+	} {
+		if len(group.counters) == 0 {
+			continue
+		}
+		names := []string{}
+		for name := range group.counters {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		counts := []string{}
+		for _, name := range names {
+			counts = append(counts, fmt.Sprintf("%v %v", name, group.counters[name]))
+		}
+		lines = append(lines, group.name+": "+strings.Join(counts, ", "))
+	}
+	if len(s.Ports) > 0 {
+		counts := []string{}
+		for _, port := range s.Ports {
+			counts = append(counts, fmt.Sprintf("%v %v", port.Port, port.Counter))
+		}
+		lines = append(lines, "ports: "+strings.Join(counts, ", "))
+	}
+	if len(s.Windows) > 0 {
+		windows := []time.Duration{}
+		for window := range s.Windows {
+			windows = append(windows, window)
+		}
+		sort.Slice(windows, func(i, j int) bool { return windows[i] < windows[j] })
+		counts := []string{}
+		for _, window := range windows {
+			counts = append(counts, fmt.Sprintf("%v %v", window, s.Windows[window]))
+		}
+		lines = append(lines, "windows: "+strings.Join(counts, ", "))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// statsBucket is the counter of a second for the sliding windows.
+type statsBucket struct {
+	second int64
+	Counter
+}
+
+// layer groups of the counters.
+const (
+	statsLink        = "link"
+	statsNetwork     = "network"
+	statsTransport   = "transport"
+	statsApplication = "application"
+	statsVersion     = "version"
+)
+
+// Convert implements interface Pipe/Converter
+func (p *ProtocolStats) Convert(in chan goul.Item, message goul.Message) (out chan goul.Item, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			fmt.Fprintf(os.Stderr, "ProtocolStats#Convert recovered from panic!\n")
+			fmt.Fprintf(os.Stderr, "Probably an inheritance problem of pipeline instance.\n")
+			fmt.Fprintf(os.Stderr, "panic: %v\n", r)
+			err = errors.New("panic")
+		}
+	}()
+
+	if err := p.init(); err != nil {
+		p.SetError(err)
+		return nil, err
+	}
+	p.SetError(nil)
+	return goul.Launch(p.counter, in, message)
+}
+
+// Revert implements interface Pipe/Reverter
+func (p *ProtocolStats) Revert(in chan goul.Item, message goul.Message) (out chan goul.Item, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			fmt.Fprintf(os.Stderr, "ProtocolStats#Revert recovered from panic!\n")
+			fmt.Fprintf(os.Stderr, "Probably an inheritance problem of pipeline instance.\n")
+			fmt.Fprintf(os.Stderr, "panic: %v\n", r)
+			err = errors.New("panic")
+		}
+	}()
+
+	if err := p.init(); err != nil {
+		p.SetError(err)
+		return nil, err
+	}
+	p.SetError(nil)
+	return goul.Launch(p.counter, in, message)
+}
+
+func (p *ProtocolStats) init() error {
+	if p.ID == "" {
+		p.ID = "stats"
+	}
+	if p.Windows == nil {
+		p.Windows = defaultStatsWindows
+	}
+	if p.TopPorts == 0 {
+		p.TopPorts = defaultTopPorts
+	}
+	if p.TopPorts < 0 || p.Interval < 0 {
+		return errors.New(ErrStatsInvalidOptions)
+	}
+	for _, window := range p.Windows {
+		if window < time.Second {
+			return errors.New(ErrStatsInvalidOptions)
+		}
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.total = Counter{}
+	p.estimated = Counter{}
+	p.errors = 0
+	p.layers = map[string]map[string]*Counter{}
+	p.ports = map[string]*Counter{}
+	p.buckets = nil
+	return nil
+}
+
+// counter counts the packets from input channel and passes them as is.
+func (p *ProtocolStats) counter(in, out chan goul.Item, message goul.Message) {
+	defer close(out)
+	defer goul.Log(p.GetLogger(), p.ID, "exit")
+	goul.Log(p.GetLogger(), p.ID, "counter in looping...")
+
+	var tick <-chan time.Time
+	if p.Interval > 0 {
+		ticker := time.NewTicker(p.Interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case item, ok := <-in:
+			if !ok {
+				p.SetError(errors.New(goul.ErrPipeInputClosed))
+				goul.Log(p.GetLogger(), p.ID, "channel closed")
+				p.logSnapshot()
+				return
+			}
+			packet := toPacket(item)
+			if packet == nil {
+				out <- item
+				continue
+			}
+			p.count(packet, time.Now())
+			out <- packet
+		case <-tick:
+			p.logSnapshot()
+		}
+	}
+}
+
+// count counts the packet.
+func (p *ProtocolStats) count(packet gopacket.Packet, now time.Time) {
+	size := uint64(len(packet.Data()))
+	if length := packet.Metadata().Length; length > 0 {
+		size = uint64(length)
+	}
+
+	rate := uint64(SampleRateOf(packet))
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.total.add(size)
+	p.estimated.Packets += rate
+	p.estimated.Bytes += size * rate
+	if packet.ErrorLayer() != nil {
+		p.errors++
+	}
+	if link := packet.LinkLayer(); link != nil {
+		p.add(statsLink, link.LayerType().String(), size)
+	}
+	if network := packet.NetworkLayer(); network != nil {
+		p.add(statsNetwork, network.LayerType().String(), size)
+		switch network.(type) {
+		case *layers.IPv4:
+			p.add(statsVersion, "IPv4", size)
+		case *layers.IPv6:
+			p.add(statsVersion, "IPv6", size)
+		}
+	}
+	if transport := packet.TransportLayer(); transport != nil {
+		p.add(statsTransport, transport.LayerType().String(), size)
+		var protocol string
+		var src, dst uint16
+		switch transport := transport.(type) {
+		case *layers.TCP:
+			protocol, src, dst = "tcp", uint16(transport.SrcPort), uint16(transport.DstPort)
+		case *layers.UDP:
+			protocol, src, dst = "udp", uint16(transport.SrcPort), uint16(transport.DstPort)
+		case *layers.SCTP:
+			protocol, src, dst = "sctp", uint16(transport.SrcPort), uint16(transport.DstPort)
+		}
+		if protocol != "" {
+			p.addPort(fmt.Sprintf("%v/%v", protocol, src), size)
+			if dst != src {
+				p.addPort(fmt.Sprintf("%v/%v", protocol, dst), size)
+			}
+		}
+	}
+	if application := packet.ApplicationLayer(); application != nil {
+		p.add(statsApplication, application.LayerType().String(), size)
+	}
+
+	second := now.Unix()
+	if n := len(p.buckets); n > 0 && p.buckets[n-1].second == second {
+		p.buckets[n-1].add(size)
+	} else {
+		p.buckets = append(p.buckets, statsBucket{second: second, Counter: Counter{1, size}})
+	}
+	p.expire(second)
+}
+
+// add adds the packet to the counter of the name in the group. It should
+// be called with mutex.
+func (p *ProtocolStats) add(group, name string, size uint64) {
+	counters := p.layers[group]
+	if counters == nil {
+		counters = map[string]*Counter{}
+		p.layers[group] = counters
+	}
+	counter := counters[name]
+	if counter == nil {
+		counter = &Counter{}
+		counters[name] = counter
+	}
+	counter.add(size)
+}
+
+// addPort adds the packet to the counter of the port. It should be called
+// with mutex.
+func (p *ProtocolStats) addPort(port string, size uint64) {
+	counter := p.ports[port]
+	if counter == nil {
+		counter = &Counter{}
+		p.ports[port] = counter
+	}
+	counter.add(size)
+}
+
+// expire removes the buckets out of the longest window. It should be
+// called with mutex.
+func (p *ProtocolStats) expire(second int64) {
+	var longest time.Duration
+	for _, window := range p.Windows {
+		if window > longest {
+			longest = window
+		}
+	}
+	expired := 0
+	for _, bucket := range p.buckets {
+		if time.Duration(second-bucket.second)*time.Second < longest {
+			break
+		}
+		expired++
+	}
+	p.buckets = p.buckets[expired:]
+}
+
+func (c *Counter) add(size uint64) {
+	c.Packets++
+	c.Bytes += size
+}
+
+// Snapshot returns a snapshot of the statistics. It is safe to call from
+// other goroutines.
+func (p *ProtocolStats) Snapshot() ProtocolSnapshot {
+	now := time.Now()
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	snapshot := ProtocolSnapshot{
+		Time:         now,
+		Total:        p.total,
+		Estimated:    p.estimated,
+		Errors:       p.errors,
+		Links:        copyCounters(p.layers[statsLink]),
+		Networks:     copyCounters(p.layers[statsNetwork]),
+		Transports:   copyCounters(p.layers[statsTransport]),
+		Applications: copyCounters(p.layers[statsApplication]),
+		Versions:     copyCounters(p.layers[statsVersion]),
+		Windows:      map[time.Duration]Counter{},
+	}
+
+	for port, counter := range p.ports {
+		snapshot.Ports = append(snapshot.Ports, PortCounter{Port: port, Counter: *counter})
+	}
+	sort.Slice(snapshot.Ports, func(i, j int) bool {
+		if snapshot.Ports[i].Packets != snapshot.Ports[j].Packets {
+			return snapshot.Ports[i].Packets > snapshot.Ports[j].Packets
+		}
+		return snapshot.Ports[i].Port < snapshot.Ports[j].Port
+	})
+	if len(snapshot.Ports) > p.TopPorts {
+		snapshot.Ports = snapshot.Ports[:p.TopPorts]
+	}
+
+	second := now.Unix()
+	for _, window := range p.Windows {
+		counter := Counter{}
+		for _, bucket := range p.buckets {
+			if time.Duration(second-bucket.second)*time.Second < window {
+				counter.Packets += bucket.Packets
+				counter.Bytes += bucket.Bytes
+			}
+		}
+		snapshot.Windows[window] = counter
+	}
+	return snapshot
+}
+
+// logSnapshot logs the summary of the statistics.
+func (p *ProtocolStats) logSnapshot() {
+	if logger := p.GetLogger(); logger != nil {
+		for _, line := range strings.Split(p.Snapshot().String(), "\n") {
+			logger.Infof("[%v] %v", p.ID, line)
+		}
+	}
+}
+
+// copyCounters returns a copy of the counters.
+func copyCounters(counters map[string]*Counter) map[string]Counter {
+	copied := map[string]Counter{}
+	for name, counter := range counters {
+		copied[name] = *counter
+	}
+	return copied
+}
@@ -0,0 +1,112 @@
+package pipes_test
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/hyeoncheon/goul"
+	"github.com/hyeoncheon/goul/pipes"
+)
+
+func Test_ProtocolStats_10_Count(t *testing.T) {
+	r := require.New(t)
+
+	stats := &pipes.ProtocolStats{
+		Pipe:     &goul.BasePipe{Mode: goul.ModeConverter},
+		TopPorts: 2,
+		Windows:  []time.Duration{time.Minute},
+	}
+	in := make(chan goul.Item)
+	out, err := stats.Convert(in, nil)
+	r.NoError(err)
+
+	client := &net.TCPAddr{IP: net.IP{10, 0, 0, 1}, Port: 40000}
+	server := &net.TCPAddr{IP: net.IP{10, 0, 0, 2}, Port: 443}
+	other := &net.TCPAddr{IP: net.IP{10, 0, 0, 3}, Port: 40001}
+	for _, packet := range []goul.Item{
+		tcpPacket(client, server),
+		tcpPacket(server, client),
+		tcpPacket(other, server),
+	} {
+		in <- packet
+		r.Equal(packet.Data(), (<-out).Data())
+	}
+	in <- &goul.ItemGeneric{Meta: "message", DATA: []byte("hello")}
+	r.Equal("hello", string((<-out).Data()))
+
+	snapshot := stats.Snapshot()
+	size := uint64(len(tcpPacket(client, server).Data()))
+	r.Equal(pipes.Counter{Packets: 3, Bytes: 3 * size}, snapshot.Total)
+	r.Equal(uint64(0), snapshot.Errors)
+	r.Equal(uint64(3), snapshot.Links["Ethernet"].Packets)
+	r.Equal(uint64(3), snapshot.Networks["IPv4"].Packets)
+	r.Equal(uint64(3), snapshot.Versions["IPv4"].Packets)
+	r.Equal(uint64(3), snapshot.Transports["TCP"].Packets)
+	r.Equal(uint64(3), snapshot.Applications["Payload"].Packets)
+	r.Equal(2, len(snapshot.Ports))
+	r.Equal("tcp/443", snapshot.Ports[0].Port)
+	r.Equal(uint64(3), snapshot.Ports[0].Packets)
+	r.Equal("tcp/40000", snapshot.Ports[1].Port)
+	r.Equal(snapshot.Total, snapshot.Windows[time.Minute])
+	r.Contains(snapshot.String(), "ports: tcp/443 3/")
+	r.Equal(snapshot.Total, snapshot.Estimated)
+
+	// sampled packets are scaled up by their rates.
+	sampled := tcpPacket(client, server)
+	goul.Annotate(sampled, goul.AnnotationSampleRate, "10")
+	in <- sampled
+	<-out
+	snapshot = stats.Snapshot()
+	r.Equal(uint64(4), snapshot.Total.Packets)
+	r.Equal(pipes.Counter{Packets: 13, Bytes: 13 * size}, snapshot.Estimated)
+	r.Contains(snapshot.String(), "estimated 13/")
+
+	close(in)
+	_, ok := <-out
+	r.False(ok)
+	r.EqualError(stats.GetError(), goul.ErrPipeInputClosed)
+}
+
+func Test_ProtocolStats_20_Pipeline(t *testing.T) {
+	r := require.New(t)
+
+	stats := &pipes.ProtocolStats{
+		Pipe:     &goul.BasePipe{Mode: goul.ModeReverter},
+		Interval: 10 * time.Millisecond,
+	}
+	in := make(chan goul.Item)
+	out, err := stats.Revert(in, nil)
+	r.NoError(err)
+
+	in <- &goul.ItemGeneric{Meta: goul.ItemTypeRawPacket, DATA: []byte("short")}
+	r.Equal("short", string((<-out).Data()))
+	time.Sleep(30 * time.Millisecond)
+
+	snapshot := stats.Snapshot()
+	r.Equal(uint64(1), snapshot.Total.Packets)
+	r.Equal(uint64(1), snapshot.Errors)
+	r.Equal(3, len(snapshot.Windows))
+	close(in)
+	<-out
+}
+
+func Test_ProtocolStats_30_Exceptions(t *testing.T) {
+	r := require.New(t)
+
+	stats := &pipes.ProtocolStats{
+		Pipe:    &goul.BasePipe{Mode: goul.ModeConverter},
+		Windows: []time.Duration{time.Millisecond},
+	}
+	_, err := stats.Convert(make(chan goul.Item), nil)
+	r.EqualError(err, pipes.ErrStatsInvalidOptions)
+
+	stats = &pipes.ProtocolStats{
+		Pipe:     &goul.BasePipe{Mode: goul.ModeReverter},
+		TopPorts: -1,
+	}
+	_, err = stats.Revert(make(chan goul.Item), nil)
+	r.EqualError(err, pipes.ErrStatsInvalidOptions)
+}
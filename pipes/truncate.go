@@ -0,0 +1,253 @@
+package pipes
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"sync/atomic"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+
+	"github.com/hyeoncheon/goul"
+)
+
+// constants...
+const (
+	minTruncateLength = 14 // ethernet header
+
+	ErrTruncatorInvalidOptions = "invalid truncator options"
+)
+
+// Truncator is a pipe that truncates the packets to cut the cost of
+// sending them. The packets are truncated after the header of transport
+// layer, or network layer if there is no transport layer, if Headers is
+// set, keeping the first Payload bytes of the payload, or at the fixed
+// Length if it is set. If both are set, the shorter one is
+// used. The original length is kept in the metadata of the packet, so it
+// travels to the receiver and is written in the pcap output.
+//
+// On the receiver, FixUp fixes the lengths and checksums of IP, TCP and
+// UDP of the truncated frames, which are shorter than their original
+// length, so they can be injected as valid packets.
+type Truncator struct {
+	goul.Pipe
+	ID      string
+	Length  int
+	Headers bool
+	Payload int
+	FixUp   bool
+
+	truncated uint64
+	saved     uint64
+	fixed     uint64
+}
+
+// Convert implements interface Pipe/Converter
+func (p *Truncator) Convert(in chan goul.Item, message goul.Message) (out chan goul.Item, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			fmt.Fprintf(os.Stderr, "Truncator#Convert recovered from panic!\n")
+			fmt.Fprintf(os.Stderr, "Probably an inheritance problem of pipeline instance.\n")
+			fmt.Fprintf(os.Stderr, "panic: %v\n", r)
+			err = errors.New("panic")
+		}
+	}()
+
+	if err := p.init(); err != nil {
+		p.SetError(err)
+		return nil, err
+	}
+	p.SetError(nil)
+	return goul.Launch(p.truncator, in, message)
+}
+
+// Revert implements interface Pipe/Reverter
+func (p *Truncator) Revert(in chan goul.Item, message goul.Message) (out chan goul.Item, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			fmt.Fprintf(os.Stderr, "Truncator#Revert recovered from panic!\n")
+			fmt.Fprintf(os.Stderr, "Probably an inheritance problem of pipeline instance.\n")
+			fmt.Fprintf(os.Stderr, "panic: %v\n", r)
+			err = errors.New("panic")
+		}
+	}()
+
+	if err := p.init(); err != nil {
+		p.SetError(err)
+		return nil, err
+	}
+	p.SetError(nil)
+	return goul.Launch(p.truncator, in, message)
+}
+
+// Stats returns the number of truncated packets, the bytes saved by the
+// truncation and the number of fixed packets. It is safe to call from
+// other goroutines.
+func (p *Truncator) Stats() (truncated, saved, fixed uint64) {
+	return atomic.LoadUint64(&p.truncated), atomic.LoadUint64(&p.saved), atomic.LoadUint64(&p.fixed)
+}
+
+func (p *Truncator) init() error {
+	if p.ID == "" {
+		p.ID = "truncate"
+	}
+	if p.Length < 0 || (p.Length > 0 && p.Length < minTruncateLength) ||
+		p.Payload < 0 || (p.Payload > 0 && !p.Headers) ||
+		(p.Length == 0 && !p.Headers && !p.FixUp) {
+		return errors.New(ErrTruncatorInvalidOptions)
+	}
+	return nil
+}
+
+// truncator truncates or fixes the packets from input channel.
+func (p *Truncator) truncator(in, out chan goul.Item, message goul.Message) {
+	defer close(out)
+	defer goul.Log(p.GetLogger(), p.ID, "exit")
+	goul.Log(p.GetLogger(), p.ID, "truncator in looping...")
+
+	for item := range in {
+		packet := toPacket(item)
+		if packet == nil {
+			out <- item
+			continue
+		}
+		if size := p.size(packet); size < len(packet.Data()) {
+			atomic.AddUint64(&p.truncated, 1)
+			atomic.AddUint64(&p.saved, uint64(len(packet.Data())-size))
+			packet = truncate(packet, size)
+		}
+		if p.FixUp && packet.Metadata().Length > len(packet.Data()) {
+			frame := append([]byte{}, packet.Data()...)
+			if fixTruncated(frame) {
+				atomic.AddUint64(&p.fixed, 1)
+				packet = repacket(packet, frame)
+				packet.Metadata().Length = len(frame)
+			}
+		}
+		out <- packet
+	}
+	p.SetError(errors.New(goul.ErrPipeInputClosed))
+	goul.Log(p.GetLogger(), p.ID, "channel closed")
+	if logger := p.GetLogger(); logger != nil {
+		truncated, saved, fixed := p.Stats()
+		logger.Infof("[%v] %v packets truncated (%v bytes saved), %v packets fixed", p.ID, truncated, saved, fixed)
+	}
+}
+
+// size returns the length to truncate the packet to.
+func (p *Truncator) size(packet gopacket.Packet) int {
+	size := len(packet.Data())
+	if p.Headers {
+		var last gopacket.Layer
+		if transport := packet.TransportLayer(); transport != nil {
+			last = transport
+		} else if network := packet.NetworkLayer(); network != nil {
+			last = network
+		}
+		if last != nil {
+			end := p.Payload
+			for _, layer := range packet.Layers() {
+				end += len(layer.LayerContents())
+				if layer == last {
+					break
+				}
+			}
+			if end < size {
+				size = end
+			}
+		}
+	}
+	if p.Length > 0 && p.Length < size {
+		size = p.Length
+	}
+	return size
+}
+
+// truncate returns new packet of the first size bytes of the packet. The
+// capture information is kept except the capture length, and the original
+// length is kept as is.
+func truncate(packet gopacket.Packet, size int) gopacket.Packet {
+	frame := append([]byte{}, packet.Data()[:size]...)
+	np := gopacket.NewPacket(frame, layers.LayerTypeEthernet, gopacket.Default)
+	md := np.Metadata()
+	md.CaptureInfo = packet.Metadata().CaptureInfo
+	if md.Length < len(packet.Data()) {
+		md.Length = len(packet.Data())
+	}
+	md.CaptureLength = size
+	md.Truncated = true
+	md.AncillaryData = packet.Metadata().AncillaryData
+	return np
+}
+
+// fixTruncated fixes the lengths of IP and UDP header to the length of the
+// truncated frame, and computes the checksums again. It returns false if
+// the frame is not an IP packet.
+func fixTruncated(frame []byte) bool {
+	offset := 12
+	for len(frame) >= offset+2 {
+		etherType := layers.EthernetType(binary.BigEndian.Uint16(frame[offset:]))
+		if etherType == layers.EthernetTypeDot1Q || etherType == layers.EthernetTypeQinQ {
+			offset += 4
+			continue
+		}
+		ip := frame[offset+2:]
+		switch etherType {
+		case layers.EthernetTypeIPv4:
+			if len(ip) < 20 || int(ip[0]&0x0f)*4 < 20 || len(ip) < int(ip[0]&0x0f)*4 {
+				return false
+			}
+			ihl := int(ip[0]&0x0f) * 4
+			binary.BigEndian.PutUint16(ip[2:], uint16(len(ip)))
+			ip[10], ip[11] = 0, 0
+			binary.BigEndian.PutUint16(ip[10:], ipChecksum(ip[:ihl]))
+			if binary.BigEndian.Uint16(ip[6:])&0x3fff != 0 { // fragment
+				return true
+			}
+			fixTransport(ip[ihl:], ip[9], ip[12:20])
+			return true
+		case layers.EthernetTypeIPv6:
+			if len(ip) < 40 {
+				return false
+			}
+			binary.BigEndian.PutUint16(ip[4:], uint16(len(ip)-40))
+			fixTransport(ip[40:], ip[6], ip[8:40])
+			return true
+		}
+		return false
+	}
+	return false
+}
+
+// fixTransport fixes the length of UDP and the checksums of TCP and UDP.
+// The addresses are the source and destination addresses of IP header for
+// the pseudo header. The extension headers of IPv6 are not supported.
+func fixTransport(segment []byte, protocol byte, addresses []byte) {
+	var checksumAt int
+	switch layers.IPProtocol(protocol) {
+	case layers.IPProtocolTCP:
+		if len(segment) < 20 || len(segment) < int(segment[12]>>4)*4 {
+			return
+		}
+		checksumAt = 16
+	case layers.IPProtocolUDP:
+		if len(segment) < 8 {
+			return
+		}
+		binary.BigEndian.PutUint16(segment[4:], uint16(len(segment)))
+		checksumAt = 6
+	default:
+		return
+	}
+	// the sum of the pseudo header is the same for IPv4 and IPv6.
+	pseudo := append([]byte{}, addresses...)
+	pseudo = append(pseudo, 0, protocol, byte(len(segment)>>8), byte(len(segment)))
+	segment[checksumAt], segment[checksumAt+1] = 0, 0
+	checksum := ipChecksum(append(pseudo, segment...))
+	if checksum == 0 && layers.IPProtocol(protocol) == layers.IPProtocolUDP {
+		checksum = 0xffff
+	}
+	binary.BigEndian.PutUint16(segment[checksumAt:], checksum)
+}
@@ -0,0 +1,165 @@
+package pipes_test
+
+import (
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/stretchr/testify/require"
+
+	"github.com/hyeoncheon/goul"
+	"github.com/hyeoncheon/goul/pipes"
+)
+
+// udpPacket returns an IPv6 UDP packet with the payload.
+func udpPacket(payload string) gopacket.Packet {
+	ether := &layers.Ethernet{
+		SrcMAC:       net.HardwareAddr{0x02, 0, 0, 0, 0, 1},
+		DstMAC:       net.HardwareAddr{0x02, 0, 0, 0, 0, 2},
+		EthernetType: layers.EthernetTypeIPv6,
+	}
+	ip := &layers.IPv6{Version: 6, HopLimit: 64, NextHeader: layers.IPProtocolUDP,
+		SrcIP: net.ParseIP("fd00::1"), DstIP: net.ParseIP("fd00::2")}
+	udp := &layers.UDP{SrcPort: 40000, DstPort: 5000}
+	udp.SetNetworkLayerForChecksum(ip)
+	buffer := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	gopacket.SerializeLayers(buffer, opts, ether, ip, udp, gopacket.Payload(payload))
+	return gopacket.NewPacket(buffer.Bytes(), layers.LayerTypeEthernet, gopacket.Default)
+}
+
+// validChecksums returns true if the checksums of the frame are not changed
+// by computing them again. The padding of short frames is ignored.
+func validChecksums(packet gopacket.Packet) bool {
+	network := packet.NetworkLayer()
+	switch transport := packet.TransportLayer().(type) {
+	case *layers.TCP:
+		transport.SetNetworkLayerForChecksum(network)
+	case *layers.UDP:
+		transport.SetNetworkLayerForChecksum(network)
+	}
+	buffer := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{ComputeChecksums: true}
+	if err := gopacket.SerializePacket(buffer, opts, packet); err != nil {
+		return false
+	}
+	data := buffer.Bytes()
+	return len(data) >= len(packet.Data()) && string(data[:len(packet.Data())]) == string(packet.Data())
+}
+
+func Test_Truncator_10_Truncate(t *testing.T) {
+	r := require.New(t)
+
+	truncator := &pipes.Truncator{
+		Pipe:    &goul.BasePipe{Mode: goul.ModeConverter},
+		Headers: true,
+		Payload: 3,
+	}
+	in := make(chan goul.Item)
+	out, err := truncator.Convert(in, nil)
+	r.NoError(err)
+
+	src := &net.TCPAddr{IP: net.IP{10, 0, 0, 1}, Port: 1}
+	dst := &net.TCPAddr{IP: net.IP{10, 0, 0, 2}, Port: 2}
+	original := tcpPacket(src, dst)
+	in <- original
+	packet := (<-out).(gopacket.Packet)
+	r.Equal(14+20+20+3, len(packet.Data()))
+	r.Equal(original.Data()[:len(packet.Data())], packet.Data())
+	r.Equal(len(packet.Data()), packet.Metadata().CaptureLength)
+	r.Equal(len(original.Data()), packet.Metadata().Length)
+
+	// short packets are passed as is.
+	short := udpPacket("ab")
+	in <- short
+	r.Equal(short.Data(), (<-out).Data())
+
+	in <- &goul.ItemGeneric{Meta: "message", DATA: []byte("hello")}
+	r.Equal("hello", string((<-out).Data()))
+
+	close(in)
+	_, ok := <-out
+	r.False(ok)
+	r.EqualError(truncator.GetError(), goul.ErrPipeInputClosed)
+	truncated, saved, fixed := truncator.Stats()
+	r.Equal(uint64(1), truncated)
+	r.Equal(uint64(len("Process")-3), saved)
+	r.Equal(uint64(0), fixed)
+}
+
+func Test_Truncator_20_FixUp(t *testing.T) {
+	r := require.New(t)
+
+	truncator := &pipes.Truncator{
+		Pipe:    &goul.BasePipe{Mode: goul.ModeConverter},
+		Headers: true,
+		Payload: 2,
+	}
+	fixer := &pipes.Truncator{
+		Pipe:  &goul.BasePipe{Mode: goul.ModeReverter},
+		FixUp: true,
+	}
+	in := make(chan goul.Item)
+	truncated, err := truncator.Convert(in, nil)
+	r.NoError(err)
+	out, err := fixer.Revert(truncated, nil)
+	r.NoError(err)
+
+	src := &net.TCPAddr{IP: net.IP{10, 0, 0, 1}, Port: 1}
+	dst := &net.TCPAddr{IP: net.IP{10, 0, 0, 2}, Port: 2}
+	for _, original := range []gopacket.Packet{tcpPacket(src, dst), udpPacket("Truncated payload")} {
+		in <- original
+		packet := (<-out).(gopacket.Packet)
+		r.Equal(2, len(packet.ApplicationLayer().Payload()))
+		r.Nil(packet.ErrorLayer())
+		r.True(validChecksums(packet))
+		size := len(packet.Data())
+		switch network := packet.NetworkLayer().(type) {
+		case *layers.IPv4:
+			r.Equal(uint16(size-14), network.Length)
+			r.True(validIPv4Checksum(network))
+		case *layers.IPv6:
+			r.Equal(uint16(size-14-40), network.Length)
+			r.Equal(uint16(size-14-40), packet.TransportLayer().(*layers.UDP).Length)
+		}
+	}
+
+	// complete frames are not fixed.
+	complete := udpPacket("ab")
+	in <- complete
+	r.Equal(complete.Data(), (<-out).Data())
+
+	close(in)
+	<-out
+	_, _, fixed := fixer.Stats()
+	r.Equal(uint64(2), fixed)
+}
+
+func Test_Truncator_30_Exceptions(t *testing.T) {
+	r := require.New(t)
+
+	for _, truncator := range []*pipes.Truncator{
+		{Pipe: &goul.BasePipe{Mode: goul.ModeConverter}},
+		{Pipe: &goul.BasePipe{Mode: goul.ModeConverter}, Length: 10},
+		{Pipe: &goul.BasePipe{Mode: goul.ModeConverter}, Payload: 10},
+		{Pipe: &goul.BasePipe{Mode: goul.ModeConverter}, Headers: true, Payload: -1},
+	} {
+		_, err := truncator.Convert(make(chan goul.Item), nil)
+		r.EqualError(err, pipes.ErrTruncatorInvalidOptions)
+	}
+
+	// non-IP frames could not be fixed.
+	fixer := &pipes.Truncator{Pipe: &goul.BasePipe{Mode: goul.ModeReverter}, FixUp: true}
+	in := make(chan goul.Item)
+	out, err := fixer.Revert(in, nil)
+	r.NoError(err)
+	packet := gopacket.NewPacket([]byte("0123456789ab\x08\x06short"), layers.LayerTypeEthernet, gopacket.Default)
+	packet.Metadata().Length = 100
+	in <- packet
+	r.Equal(packet.Data(), (<-out).Data())
+	close(in)
+	<-out
+	_, _, fixed := fixer.Stats()
+	r.Equal(uint64(0), fixed)
+}